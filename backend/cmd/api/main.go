@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -12,7 +14,12 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/jay/dadmail/internal/api"
 	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/mailbody"
+	"github.com/jay/dadmail/internal/mailimport"
+	"github.com/jay/dadmail/internal/provider/providers"
 	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/storage"
+	"github.com/jay/dadmail/internal/vault"
 )
 
 func main() {
@@ -30,10 +37,28 @@ func main() {
 	defer db.Close()
 	log.Println("Successfully connected to database")
 
+	// Credential vault for linked email accounts
+	credVault, err := vault.New(cfg.Email.EncryptionKeys, cfg.Email.EncryptionKeyID)
+	if err != nil {
+		log.Fatalf("Failed to initialize credential vault: %v", err)
+	}
+
+	// Object storage for attachments and the encrypted message body cache
+	store, err := storage.New(&cfg.Storage)
+	if err != nil {
+		log.Fatalf("Failed to initialize object storage: %v", err)
+	}
+	if err := store.Init(context.Background()); err != nil {
+		log.Printf("Object storage unavailable, attachments and cached bodies will fail: %v", err)
+	}
+	bodyCache := mailbody.NewCache(db, store, credVault,
+		time.Duration(cfg.Email.BodyCacheTTL)*time.Hour, int64(cfg.Email.BodyCacheMaxMB)<<20)
+
 	// Initialize Fiber app
 	app := fiber.New(fiber.Config{
 		AppName:      "DadMail API",
 		ErrorHandler: customErrorHandler,
+		BodyLimit:    40 * 1024 * 1024, // room for base64 encoded attachments
 	})
 
 	// Middleware
@@ -49,7 +74,9 @@ func main() {
 	}))
 
 	// Setup routes
-	api.SetupRoutes(app, cfg, db)
+	api.SetupRoutes(app, cfg, db, credVault,
+		mailbody.NewFetcher(providers.NewRegistry(&cfg.Email, credVault), bodyCache,
+			mailimport.NewStore(db, store, credVault)), store)
 
 	// Health check endpoint
 	app.Get("/health", func(c *fiber.Ctx) error {
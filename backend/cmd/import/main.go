@@ -0,0 +1,99 @@
+// Command import adds the mail in mbox files and zipped .eml collections to
+// a user's imported mail, for archives too large to upload comfortably:
+//
+//	import -user dad@example.com takeout.mbox old-isp.zip
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/mailimport"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/storage"
+	"github.com/jay/dadmail/internal/vault"
+)
+
+func main() {
+	userEmail := flag.String("user", "", "email address the user signs in with")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -user <email> <file>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *userEmail == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Connect to database
+	db, err := repository.NewDB(&cfg.Database)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	credVault, err := vault.New(cfg.Email.EncryptionKeys, cfg.Email.EncryptionKeyID)
+	if err != nil {
+		log.Fatalf("Failed to initialize credential vault: %v", err)
+	}
+
+	store, err := storage.New(&cfg.Storage)
+	if err != nil {
+		log.Fatalf("Failed to initialize object storage: %v", err)
+	}
+	if err := store.Init(context.Background()); err != nil {
+		log.Fatalf("Object storage unavailable: %v", err)
+	}
+
+	user, err := repository.NewUserRepository(db).GetByEmail(*userEmail)
+	if err != nil {
+		log.Fatalf("Failed to find user %s: %v", *userEmail, err)
+	}
+
+	// Interrupting stops after the current message; running the command
+	// again skips what was already imported
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	importer := mailimport.NewImporter(db, mailimport.NewStore(db, store, credVault))
+	failed := false
+	for _, name := range flag.Args() {
+		progress, err := importer.ImportFile(ctx, user.ID, name, func(p mailimport.Progress) {
+			printProgress(name, p)
+		})
+		printProgress(name, progress)
+		if err != nil {
+			log.Printf("Failed to import %s: %v", name, err)
+			failed = true
+			if ctx.Err() != nil {
+				break
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func printProgress(name string, p mailimport.Progress) {
+	percent := 100
+	if p.BytesTotal > 0 {
+		percent = int(p.BytesProcessed * 100 / p.BytesTotal)
+	}
+	fmt.Printf("%s: %d%% (%d imported, %d duplicates, %d failed)\n",
+		name, percent, p.Imported, p.Duplicates, p.Failed)
+}
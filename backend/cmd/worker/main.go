@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jay/dadmail/internal/attachments"
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/drafts"
+	"github.com/jay/dadmail/internal/mailbody"
+	"github.com/jay/dadmail/internal/mailer"
+	"github.com/jay/dadmail/internal/mailexport"
+	"github.com/jay/dadmail/internal/mailimport"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/provider/gmail"
+	"github.com/jay/dadmail/internal/provider/imap"
+	"github.com/jay/dadmail/internal/provider/jmap"
+	"github.com/jay/dadmail/internal/provider/outlook"
+	"github.com/jay/dadmail/internal/provider/providers"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/storage"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jay/dadmail/internal/writeback"
+)
+
+func main() {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Connect to database
+	db, err := repository.NewDB(&cfg.Database)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+	log.Println("Successfully connected to database")
+
+	// Credential vault for linked email accounts
+	credVault, err := vault.New(cfg.Email.EncryptionKeys, cfg.Email.EncryptionKeyID)
+	if err != nil {
+		log.Fatalf("Failed to initialize credential vault: %v", err)
+	}
+
+	// Object storage for attachments and the encrypted message body cache
+	store, err := storage.New(&cfg.Storage)
+	if err != nil {
+		log.Fatalf("Failed to initialize object storage: %v", err)
+	}
+	if err := store.Init(context.Background()); err != nil {
+		log.Printf("Object storage unavailable, attachments and cached bodies will fail: %v", err)
+	}
+	bodyCache := mailbody.NewCache(db, store, credVault,
+		time.Duration(cfg.Email.BodyCacheTTL)*time.Hour, int64(cfg.Email.BodyCacheMaxMB)<<20)
+	importStore := mailimport.NewStore(db, store, credVault)
+	registry := providers.NewRegistry(&cfg.Email, credVault)
+
+	// Graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	imapSyncer := imap.NewSyncer(db, credVault)
+	gmailSyncer := gmail.NewSyncer(db, &cfg.Email, credVault)
+	outlookSyncer := outlook.NewSyncer(db, &cfg.Email, credVault)
+	// Providers that list their own changes, such as JMAP
+	changeSyncer := provider.NewSyncer(db, registry)
+
+	// Push new mail as it arrives; the periodic run below catches the rest
+	idleManager := imap.NewIdleManager(imapSyncer, cfg.Email.IdleMaxConns)
+	go idleManager.Run(ctx)
+	pushManager := jmap.NewPushManager(db, credVault, changeSyncer, cfg.Email.PushMaxConns)
+	go pushManager.Run(ctx)
+
+	// Re-encrypt stored credentials and mail after the active key changed
+	go func() {
+		if err := vault.NewRotator(db, credVault, importStore, bodyCache).Run(ctx); err != nil {
+			log.Printf("Credential rotation failed: %v", err)
+		}
+	}()
+
+	// Expire cached message bodies
+	go bodyCache.RunEvictor(ctx)
+
+	// Delete attachment content no email or draft refers to any more
+	attachmentStore := attachments.NewStore(db, store)
+	go attachmentStore.RunCollector(ctx)
+
+	// Deliver queued outgoing mail
+	outboxWorker := mailer.NewOutboxWorker(db, mailer.NewSender(registry))
+	go outboxWorker.Run(ctx)
+
+	// Apply read, star, archive and delete changes to the providers
+	writebackWorker := writeback.NewWorker(db, registry)
+	go writebackWorker.Run(ctx)
+	go writebackWorker.RunPruner(ctx)
+
+	// Keep copies of drafts in the providers' Drafts folders
+	go drafts.NewWorker(db, &cfg.Email, credVault, attachmentStore).Run(ctx)
+
+	// Import uploaded mail archives, and delete the sources of imported
+	// mail that was deleted
+	go importStore.RunCollector(ctx)
+	go mailimport.NewWorker(db, importStore).Run(ctx)
+
+	// Write requested mailbox exports, and delete them once expired
+	exportWorker := mailexport.NewWorker(db,
+		mailbody.NewFetcher(registry, bodyCache, importStore), attachmentStore, store)
+	go exportWorker.Run(ctx)
+	go exportWorker.RunExpirer(ctx)
+
+	interval := time.Duration(cfg.Email.SyncInterval) * time.Second
+	log.Printf("DadMail worker starting, syncing every %s...", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := imapSyncer.SyncAll(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("IMAP sync run failed: %v", err)
+		}
+		if err := gmailSyncer.SyncAll(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Gmail sync run failed: %v", err)
+		}
+		if err := outlookSyncer.SyncAll(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Outlook sync run failed: %v", err)
+		}
+		if err := changeSyncer.SyncAll(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Change sync run failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("Shutting down gracefully...")
+			return
+		case <-ticker.C:
+		}
+	}
+}
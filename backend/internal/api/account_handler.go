@@ -0,0 +1,541 @@
+package api
+
+import (
+	"context"
+	"net/mail"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/auth"
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/mailer"
+	"github.com/jay/dadmail/internal/mailimport"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/netguard"
+	"github.com/jay/dadmail/internal/provider/gmail"
+	"github.com/jay/dadmail/internal/provider/imap"
+	"github.com/jay/dadmail/internal/provider/jmap"
+	"github.com/jay/dadmail/internal/provider/outlook"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// connectionTestTimeout bounds a single IMAP/SMTP settings check
+	connectionTestTimeout = 30 * time.Second
+	// verifyDialTimeout bounds connecting to a server under test, so an
+	// unreachable host fails fast
+	verifyDialTimeout = 10 * time.Second
+)
+
+// AccountHandler handles email account management endpoints
+type AccountHandler struct {
+	accountRepo *repository.EmailAccountRepository
+	vault       *vault.Vault
+	gmail       *gmail.Connector
+	outlook     *outlook.Connector
+}
+
+// NewAccountHandler creates a new account handler
+func NewAccountHandler(db *sqlx.DB, cfg *config.Config, v *vault.Vault) *AccountHandler {
+	return &AccountHandler{
+		accountRepo: repository.NewEmailAccountRepository(db),
+		vault:       v,
+		gmail:       gmail.NewConnector(&cfg.Email, v),
+		outlook:     outlook.NewConnector(&cfg.Email, v),
+	}
+}
+
+// ServerSettingsRequest represents IMAP and SMTP server settings, or the
+// settings of a JMAP server instead
+type ServerSettingsRequest struct {
+	IMAP *vault.IMAPCredentials `json:"imap"`
+	SMTP *vault.SMTPCredentials `json:"smtp"` // optional; enables sending
+	JMAP *vault.JMAPCredentials `json:"jmap"`
+}
+
+// CreateAccountRequest represents a request to link an IMAP or JMAP
+// account
+type CreateAccountRequest struct {
+	EmailAddress string                 `json:"email_address"`
+	DisplayName  *string                `json:"display_name"`
+	SyncEnabled  *bool                  `json:"sync_enabled"` // defaults to true
+	IMAP         *vault.IMAPCredentials `json:"imap"`
+	SMTP         *vault.SMTPCredentials `json:"smtp"`
+	JMAP         *vault.JMAPCredentials `json:"jmap"`
+}
+
+// UpdateAccountRequest represents a partial account update. A settings
+// section replaces the stored one; an empty password keeps the stored
+// password.
+type UpdateAccountRequest struct {
+	DisplayName *string                `json:"display_name"`
+	SyncEnabled *bool                  `json:"sync_enabled"`
+	IsPrimary   *bool                  `json:"is_primary"`
+	IMAP        *vault.IMAPCredentials `json:"imap"`
+	SMTP        *vault.SMTPCredentials `json:"smtp"`
+	JMAP        *vault.JMAPCredentials `json:"jmap"`
+}
+
+// ConnectionTestResult reports whether server settings were accepted
+type ConnectionTestResult struct {
+	OK        bool   `json:"ok"`
+	IMAPError string `json:"imap_error,omitempty"`
+	SMTPError string `json:"smtp_error,omitempty"`
+	Error     string `json:"error,omitempty"` // API providers such as Gmail, Outlook and JMAP
+}
+
+// List returns the user's email accounts
+func (h *AccountHandler) List(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	accounts, err := h.accountRepo.ListForUser(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list accounts",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"accounts": accounts,
+	})
+}
+
+// Get returns one email account
+func (h *AccountHandler) Get(c *fiber.Ctx) error {
+	account, err := h.userAccount(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(account)
+}
+
+// Create tests IMAP/SMTP or JMAP settings and links the account if they
+// work
+func (h *AccountHandler) Create(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req CreateAccountRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	addr, err := mail.ParseAddress(req.EmailAddress)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A valid email address is required",
+		})
+	}
+	creds, err := newServerSettings(&ServerSettingsRequest{IMAP: req.IMAP, SMTP: req.SMTP, JMAP: req.JMAP})
+	if err != nil {
+		return err
+	}
+
+	if existing, _ := h.accountRepo.GetByAddress(userID, addr.Address); existing != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Account already linked",
+		})
+	}
+
+	if result := testConnection(c.UserContext(), creds); !result.OK {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Connection test failed",
+			"test":  result,
+		})
+	}
+
+	provider := imap.ProviderName
+	if creds.JMAP != nil {
+		provider = jmap.ProviderName
+	}
+
+	account := &models.EmailAccount{
+		ID:           uuid.New(),
+		UserID:       userID,
+		Provider:     provider,
+		EmailAddress: addr.Address,
+		DisplayName:  req.DisplayName,
+		SyncEnabled:  req.SyncEnabled == nil || *req.SyncEnabled,
+	}
+	if account.DisplayName == nil && addr.Name != "" {
+		account.DisplayName = &addr.Name
+	}
+
+	account.CredentialsEncrypted, err = h.vault.Seal(account.ID, creds)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store credentials",
+		})
+	}
+
+	if err := h.accountRepo.Create(account); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create account",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(account)
+}
+
+// Update changes an account's name, sync flag, primary flag or server
+// settings. New server settings are tested before they are saved.
+func (h *AccountHandler) Update(c *fiber.Ctx) error {
+	account, err := h.userAccount(c)
+	if err != nil {
+		return err
+	}
+
+	var req UpdateAccountRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.IsPrimary != nil && !*req.IsPrimary {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Make another account primary instead",
+		})
+	}
+	if req.IsPrimary != nil && account.Provider == mailimport.ProviderName {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Imported mail cannot be sent from",
+		})
+	}
+
+	if req.IMAP != nil || req.SMTP != nil || req.JMAP != nil {
+		jmapAccount := account.Provider == jmap.ProviderName
+		if account.Provider != imap.ProviderName && !jmapAccount {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Server settings can only be changed for IMAP and JMAP accounts",
+			})
+		}
+		if jmapAccount != (req.JMAP != nil) || (jmapAccount && (req.IMAP != nil || req.SMTP != nil)) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Settings do not match the account's server type",
+			})
+		}
+
+		creds, err := h.vault.Open(account.ID, account.CredentialsEncrypted)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to read stored credentials",
+			})
+		}
+		mergeServerSettings(creds, req.IMAP, req.SMTP, req.JMAP)
+		if jmapAccount {
+			err = validateJMAPSettings(creds.JMAP)
+		} else {
+			err = validateServerSettings(creds.IMAP, creds.SMTP)
+		}
+		if err != nil {
+			return err
+		}
+
+		if result := testConnection(c.UserContext(), creds); !result.OK {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": "Connection test failed",
+				"test":  result,
+			})
+		}
+
+		account.CredentialsEncrypted, err = h.vault.Seal(account.ID, creds)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to store credentials",
+			})
+		}
+	}
+
+	if req.DisplayName != nil {
+		account.DisplayName = req.DisplayName
+		if *req.DisplayName == "" {
+			account.DisplayName = nil
+		}
+	}
+	if req.SyncEnabled != nil {
+		account.SyncEnabled = *req.SyncEnabled
+	}
+
+	if err := h.accountRepo.Update(account); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update account",
+		})
+	}
+
+	if req.IsPrimary != nil && !account.IsPrimary {
+		if err := h.accountRepo.SetPrimary(account.UserID, account.ID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to set primary account",
+			})
+		}
+		account.IsPrimary = true
+	}
+
+	return c.JSON(account)
+}
+
+// SetPrimary makes the account the user's primary (default sending) account
+func (h *AccountHandler) SetPrimary(c *fiber.Ctx) error {
+	account, err := h.userAccount(c)
+	if err != nil {
+		return err
+	}
+	if account.Provider == mailimport.ProviderName {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Imported mail cannot be sent from",
+		})
+	}
+
+	if err := h.accountRepo.SetPrimary(account.UserID, account.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to set primary account",
+		})
+	}
+	account.IsPrimary = true
+
+	return c.JSON(account)
+}
+
+// Delete unlinks an account and removes its synced mail
+func (h *AccountHandler) Delete(c *fiber.Ctx) error {
+	account, err := h.userAccount(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.accountRepo.Delete(account.UserID, account.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete account",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Account deleted successfully",
+	})
+}
+
+// TestSettings checks IMAP/SMTP or JMAP settings without saving anything
+func (h *AccountHandler) TestSettings(c *fiber.Ctx) error {
+	var req ServerSettingsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	creds, err := newServerSettings(&req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(testConnection(c.UserContext(), creds))
+}
+
+// TestAccount checks that a linked account's stored credentials still work
+func (h *AccountHandler) TestAccount(c *fiber.Ctx) error {
+	account, err := h.userAccount(c)
+	if err != nil {
+		return err
+	}
+
+	if account.Provider == mailimport.ProviderName {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Imported mail has no server to test",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), connectionTestTimeout)
+	defer cancel()
+
+	if account.Provider == gmail.ProviderName {
+		result := ConnectionTestResult{OK: true}
+		client, err := h.gmail.Client(ctx, account)
+		if err == nil {
+			_, err = client.GetProfile(ctx)
+		}
+		if err != nil {
+			result = ConnectionTestResult{Error: err.Error()}
+		}
+		return c.JSON(result)
+	}
+	if account.Provider == outlook.ProviderName {
+		result := ConnectionTestResult{OK: true}
+		client, err := h.outlook.Client(ctx, account)
+		if err == nil {
+			_, err = client.GetProfile(ctx)
+		}
+		if err != nil {
+			result = ConnectionTestResult{Error: err.Error()}
+		}
+		return c.JSON(result)
+	}
+
+	creds, err := h.vault.Open(account.ID, account.CredentialsEncrypted)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read stored credentials",
+		})
+	}
+
+	return c.JSON(testConnection(ctx, creds))
+}
+
+// userAccount loads the account named by the :id parameter if it belongs
+// to the current user
+func (h *AccountHandler) userAccount(c *fiber.Ctx) (*models.EmailAccount, error) {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid account ID")
+	}
+
+	account, err := h.accountRepo.GetForUser(userID, id)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Email account not found")
+	}
+
+	return account, nil
+}
+
+// newServerSettings validates the settings of a new account, which has
+// either IMAP/SMTP or JMAP settings, and returns them as credentials.
+// Failures are returned as 400 fiber errors.
+func newServerSettings(req *ServerSettingsRequest) (*vault.Credentials, error) {
+	if req.JMAP == nil {
+		if err := validateServerSettings(req.IMAP, req.SMTP); err != nil {
+			return nil, err
+		}
+		return &vault.Credentials{IMAP: req.IMAP, SMTP: req.SMTP}, nil
+	}
+
+	if req.IMAP != nil || req.SMTP != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Give either IMAP/SMTP or JMAP settings")
+	}
+	if err := validateJMAPSettings(req.JMAP); err != nil {
+		return nil, err
+	}
+	return &vault.Credentials{JMAP: req.JMAP}, nil
+}
+
+// validateJMAPSettings checks that JMAP settings name a server and a
+// password or API token. Failures are returned as 400 fiber errors.
+func validateJMAPSettings(creds *vault.JMAPCredentials) error {
+	if creds == nil || creds.SessionURL == "" || creds.Password == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "JMAP session URL and password or API token are required")
+	}
+	if _, err := jmap.SessionURL(creds.SessionURL); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid JMAP session URL")
+	}
+	return nil
+}
+
+// validateServerSettings checks that IMAP settings are complete and both
+// sections use a known security mode. Failures are returned as 400 fiber
+// errors.
+func validateServerSettings(imapCreds *vault.IMAPCredentials, smtpCreds *vault.SMTPCredentials) error {
+	if imapCreds == nil || imapCreds.Host == "" || imapCreds.Username == "" || imapCreds.Password == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "IMAP host, username and password are required")
+	}
+	if !validSecurity(imapCreds.Security) || imapCreds.Port < 0 || imapCreds.Port > 65535 {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid IMAP port or security mode")
+	}
+
+	if smtpCreds != nil {
+		if smtpCreds.Host == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "SMTP host is required")
+		}
+		if !validSecurity(smtpCreds.Security) || smtpCreds.Port < 0 || smtpCreds.Port > 65535 {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid SMTP port or security mode")
+		}
+	}
+
+	return nil
+}
+
+// validSecurity reports whether a user may choose mode. Unencrypted
+// connections would send the password in the clear, so only TLS and
+// STARTTLS are accepted.
+func validSecurity(mode string) bool {
+	switch mode {
+	case "", imap.SecurityTLS, imap.SecurityStartTLS:
+		return true
+	}
+	return false
+}
+
+// mergeServerSettings applies updated settings sections to stored
+// credentials, keeping stored passwords the client left empty
+func mergeServerSettings(creds *vault.Credentials, imapCreds *vault.IMAPCredentials, smtpCreds *vault.SMTPCredentials, jmapCreds *vault.JMAPCredentials) {
+	if imapCreds != nil {
+		if imapCreds.Password == "" && creds.IMAP != nil {
+			imapCreds.Password = creds.IMAP.Password
+		}
+		creds.IMAP = imapCreds
+	}
+	if smtpCreds != nil {
+		if smtpCreds.Password == "" && creds.SMTP != nil {
+			smtpCreds.Password = creds.SMTP.Password
+		}
+		creds.SMTP = smtpCreds
+	}
+	if jmapCreds != nil {
+		if jmapCreds.Password == "" && creds.JMAP != nil {
+			jmapCreds.Password = creds.JMAP.Password
+		}
+		creds.JMAP = jmapCreds
+	}
+}
+
+// testConnection logs in to the IMAP server and, if configured, the SMTP
+// server, or to the JMAP server
+func testConnection(ctx context.Context, creds *vault.Credentials) ConnectionTestResult {
+	ctx, cancel := context.WithTimeout(ctx, connectionTestTimeout)
+	defer cancel()
+
+	result := ConnectionTestResult{OK: true}
+
+	// The servers are the user's choice, so keep the checks off private
+	// networks
+	dialer := netguard.Dialer(verifyDialTimeout)
+
+	if creds.JMAP != nil {
+		if err := jmap.Verify(ctx, dialer, creds.JMAP); err != nil {
+			result = ConnectionTestResult{Error: err.Error()}
+		}
+		return result
+	}
+
+	imapCreds := imap.Credentials(*creds.IMAP)
+	if err := imap.Verify(ctx, dialer, &imapCreds); err != nil {
+		result.OK = false
+		result.IMAPError = err.Error()
+	}
+
+	if creds.SMTP != nil {
+		settings := mailer.SMTPSettings(*creds.SMTP)
+		if settings.Username == "" {
+			settings.Username = creds.IMAP.Username
+			settings.Password = creds.IMAP.Password
+		}
+		if err := mailer.VerifySMTP(ctx, dialer, &settings); err != nil {
+			result.OK = false
+			result.SMTPError = err.Error()
+		}
+	}
+
+	return result
+}
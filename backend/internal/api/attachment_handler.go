@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/attachments"
+	"github.com/jay/dadmail/internal/auth"
+	"github.com/jay/dadmail/internal/mailbody"
+	"github.com/jay/dadmail/internal/mimeparse"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/storage"
+	"github.com/jmoiron/sqlx"
+)
+
+// attachmentURLTTL is how long a temporary attachment URL stays valid
+const attachmentURLTTL = 15 * time.Minute
+
+// inlineContentTypes may be shown in the browser instead of downloaded.
+// Anything that can run script, such as HTML or SVG, is always downloaded.
+var inlineContentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// AttachmentHandler handles attachment endpoints
+type AttachmentHandler struct {
+	accountRepo    *repository.EmailAccountRepository
+	emailRepo      *repository.EmailRepository
+	attachmentRepo *repository.AttachmentRepository
+	store          *attachments.Store
+	fetcher        *mailbody.Fetcher
+}
+
+// NewAttachmentHandler creates a new attachment handler
+func NewAttachmentHandler(db *sqlx.DB, store *attachments.Store, fetcher *mailbody.Fetcher) *AttachmentHandler {
+	return &AttachmentHandler{
+		accountRepo:    repository.NewEmailAccountRepository(db),
+		emailRepo:      repository.NewEmailRepository(db),
+		attachmentRepo: repository.NewAttachmentRepository(db),
+		store:          store,
+		fetcher:        fetcher,
+	}
+}
+
+// List returns the attachments of an email. Attachments are stored when the
+// email is first opened; if that has not happened yet they are fetched now.
+func (h *AttachmentHandler) List(c *fiber.Ctx) error {
+	email, err := h.viewableEmail(c)
+	if err != nil {
+		return err
+	}
+
+	list, err := h.attachmentRepo.ListForEmail(email.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list attachments",
+		})
+	}
+
+	if len(list) == 0 && email.HasAttachments {
+		list, err = h.ingest(c.UserContext(), email)
+		if err != nil {
+			return h.ingestError(c, err)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"attachments": list,
+	})
+}
+
+// Download streams an attachment. The caller must own the email or be an
+// authorized caregiver of its owner. Pass disposition=inline to view images
+// and PDFs in the browser.
+func (h *AttachmentHandler) Download(c *fiber.Ctx) error {
+	email, attachment, err := h.viewableAttachment(c)
+	if err != nil {
+		return err
+	}
+
+	body, size, err := h.store.Open(c.UserContext(), attachment)
+	if err == storage.ErrNotFound {
+		// The object can go missing if garbage collection raced with a new
+		// reference to the same content; store it again from the message
+		if _, err := h.ingest(c.UserContext(), email); err != nil {
+			return h.ingestError(c, err)
+		}
+		body, size, err = h.store.Open(c.UserContext(), attachment)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read attachment",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, attachment.ContentType)
+	c.Set(fiber.HeaderContentDisposition, contentDisposition(attachment, c.Query("disposition") == "inline"))
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderContentSecurityPolicy, "default-src 'none'; sandbox")
+	c.Set(fiber.HeaderCacheControl, "private, max-age=3600")
+
+	return c.SendStream(body, int(size))
+}
+
+// URL returns a temporary URL for an attachment that works without the
+// Authorization header, e.g. as the src of an image. The same access rules
+// as Download apply when the URL is issued.
+func (h *AttachmentHandler) URL(c *fiber.Ctx) error {
+	_, attachment, err := h.viewableAttachment(c)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(attachmentURLTTL)
+	url, err := h.store.URL(c.UserContext(), attachment, attachmentURLTTL, storage.URLOptions{
+		ContentType:        attachment.ContentType,
+		ContentDisposition: contentDisposition(attachment, c.Query("disposition") == "inline"),
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create attachment URL",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"url":        url,
+		"expires_at": expiresAt,
+	})
+}
+
+// contentDisposition builds the Content-Disposition of an attachment
+// download. Inline display is only honoured for types that cannot run
+// script.
+func contentDisposition(attachment *models.Attachment, inline bool) string {
+	disposition := "attachment"
+	if inline && inlineContentTypes[strings.ToLower(attachment.ContentType)] {
+		disposition = "inline"
+	}
+
+	filename := "attachment"
+	if attachment.Filename != nil && *attachment.Filename != "" {
+		filename = *attachment.Filename
+	}
+
+	return mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+}
+
+// viewableEmail loads the email named by the :id route parameter if the
+// current user may read it
+func (h *AttachmentHandler) viewableEmail(c *fiber.Ctx) (*models.Email, error) {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid email ID")
+	}
+
+	email, err := h.emailRepo.GetForViewer(userID, id)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Email not found")
+	}
+
+	return email, nil
+}
+
+// viewableAttachment loads the attachment named by the :attachmentId route
+// parameter along with its email, if the current user may read the email
+func (h *AttachmentHandler) viewableAttachment(c *fiber.Ctx) (*models.Email, *models.Attachment, error) {
+	email, err := h.viewableEmail(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attachmentID, err := uuid.Parse(c.Params("attachmentId"))
+	if err != nil {
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Invalid attachment ID")
+	}
+
+	attachment, err := h.attachmentRepo.Get(email.ID, attachmentID)
+	if err != nil {
+		return nil, nil, fiber.NewError(fiber.StatusNotFound, "Attachment not found")
+	}
+
+	return email, attachment, nil
+}
+
+// ingest fetches an email from its provider and stores its attachments
+func (h *AttachmentHandler) ingest(ctx context.Context, email *models.Email) ([]models.Attachment, error) {
+	account, err := h.accountRepo.GetByID(email.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bodyFetchTimeout)
+	defer cancel()
+
+	raw, err := h.fetcher.Raw(ctx, account, email)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := mimeparse.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.store.Save(ctx, email.ID, msg.Attachments)
+}
+
+func (h *AttachmentHandler) ingestError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, provider.ErrMessageGone) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Email no longer exists on the mail server",
+		})
+	}
+
+	log.Printf("Failed to store attachments: %v", err)
+	return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+		"error": "Failed to fetch attachments from the mail server",
+	})
+}
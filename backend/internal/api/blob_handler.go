@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jay/dadmail/internal/storage"
+)
+
+// BlobHandler serves the temporary URLs of the local blob store, playing
+// the part of presigned URLs on S3. The signature in the URL is the only
+// authorization.
+type BlobHandler struct {
+	store *storage.LocalStore
+}
+
+// NewBlobHandler creates a new blob handler
+func NewBlobHandler(store *storage.LocalStore) *BlobHandler {
+	return &BlobHandler{store: store}
+}
+
+// Get streams the object named by the URL path if the signature is valid
+func (h *BlobHandler) Get(c *fiber.Ctx) error {
+	key, err := url.PathUnescape(strings.TrimPrefix(c.Path(), storage.LocalURLPrefix))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid blob URL")
+	}
+
+	query, err := url.ParseQuery(string(c.Request().URI().QueryString()))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid blob URL")
+	}
+
+	opts, err := h.store.VerifyURL(key, query)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Invalid or expired URL",
+		})
+	}
+
+	body, size, err := h.store.Open(c.UserContext(), key)
+	if err == storage.ErrNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read blob",
+		})
+	}
+
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	if opts.ContentDisposition != "" {
+		c.Set(fiber.HeaderContentDisposition, opts.ContentDisposition)
+	}
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderContentSecurityPolicy, "default-src 'none'; sandbox")
+	c.Set(fiber.HeaderCacheControl, "private, max-age=300")
+
+	return c.SendStream(body, int(size))
+}
@@ -0,0 +1,557 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/attachments"
+	"github.com/jay/dadmail/internal/auth"
+	"github.com/jay/dadmail/internal/drafts"
+	"github.com/jay/dadmail/internal/mailer"
+	"github.com/jay/dadmail/internal/mailimport"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// maxDraftBodyBytes caps the text and the HTML of a draft
+	maxDraftBodyBytes = 1 << 20
+	// maxDraftRecipients caps the addresses in each recipient field
+	maxDraftRecipients = 100
+)
+
+// DraftHandler handles draft endpoints
+type DraftHandler struct {
+	draftRepo      *repository.DraftRepository
+	accountRepo    *repository.EmailAccountRepository
+	emailRepo      *repository.EmailRepository
+	attachmentRepo *repository.AttachmentRepository
+	outboxRepo     *repository.OutboxRepository
+	store          *attachments.Store
+}
+
+// NewDraftHandler creates a new draft handler
+func NewDraftHandler(db *sqlx.DB, store *attachments.Store) *DraftHandler {
+	return &DraftHandler{
+		draftRepo:      repository.NewDraftRepository(db),
+		accountRepo:    repository.NewEmailAccountRepository(db),
+		emailRepo:      repository.NewEmailRepository(db),
+		attachmentRepo: repository.NewAttachmentRepository(db),
+		outboxRepo:     repository.NewOutboxRepository(db),
+		store:          store,
+	}
+}
+
+// DraftRequest creates or changes a draft. Omitted fields are left
+// unchanged. Version is required to change a draft and must be the version
+// the client last saw; an account_id of all zeros sends from the primary
+// account.
+type DraftRequest struct {
+	Version        int        `json:"version"`
+	AccountID      *uuid.UUID `json:"account_id"`
+	To             *[]string  `json:"to"`
+	Cc             *[]string  `json:"cc"`
+	Bcc            *[]string  `json:"bcc"`
+	Subject        *string    `json:"subject"`
+	Text           *string    `json:"text"`
+	HTML           *string    `json:"html"`
+	SyncToProvider *bool      `json:"sync_to_provider"`
+}
+
+// DraftAttachmentRequest attaches a file to a draft: either an attachment
+// of a received email, by email_id and attachment_id, or uploaded content
+type DraftAttachmentRequest struct {
+	EmailID      *uuid.UUID `json:"email_id"`
+	AttachmentID *uuid.UUID `json:"attachment_id"`
+	AttachmentRequest
+}
+
+// SendDraftRequest sends a draft. With a version, the draft is only sent if
+// it was not changed on another device since.
+type SendDraftRequest struct {
+	Version *int `json:"version"`
+}
+
+// List returns the user's drafts, most recently changed first
+func (h *DraftHandler) List(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	list, err := h.draftRepo.ListForUser(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list drafts",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"drafts": list,
+	})
+}
+
+// Create saves a new draft
+func (h *DraftHandler) Create(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req DraftRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if err := h.validate(userID, &req); err != nil {
+		return err
+	}
+
+	draft := &models.Draft{UserID: userID}
+	if req.AccountID != nil && *req.AccountID != uuid.Nil {
+		draft.AccountID = req.AccountID
+	}
+	if req.To != nil {
+		draft.To = *req.To
+	}
+	if req.Cc != nil {
+		draft.Cc = *req.Cc
+	}
+	if req.Bcc != nil {
+		draft.Bcc = *req.Bcc
+	}
+	if req.Subject != nil {
+		draft.Subject = *req.Subject
+	}
+	if req.Text != nil {
+		draft.Text = *req.Text
+	}
+	if req.HTML != nil {
+		draft.HTML = *req.HTML
+	}
+	if req.SyncToProvider != nil {
+		draft.SyncToProvider = *req.SyncToProvider
+	}
+
+	if err := h.draftRepo.Create(draft); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save draft",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(draft)
+}
+
+// Get returns a draft with its attachments
+func (h *DraftHandler) Get(c *fiber.Ctx) error {
+	draft, err := h.ownDraft(c)
+	if err != nil {
+		return err
+	}
+
+	return h.respond(c, fiber.StatusOK, draft)
+}
+
+// Update saves changes to a draft. If the draft was changed on another
+// device since the given version, nothing is saved and the current draft
+// is returned with 409 so the client can merge.
+func (h *DraftHandler) Update(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid draft ID",
+		})
+	}
+
+	var req DraftRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Version < 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Draft version is required",
+		})
+	}
+	if err := h.validate(userID, &req); err != nil {
+		return err
+	}
+
+	draft, updated, err := h.draftRepo.Update(userID, id, req.Version, &repository.DraftChanges{
+		AccountID:      req.AccountID,
+		To:             req.To,
+		Cc:             req.Cc,
+		Bcc:            req.Bcc,
+		Subject:        req.Subject,
+		Text:           req.Text,
+		HTML:           req.HTML,
+		SyncToProvider: req.SyncToProvider,
+	})
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Draft not found",
+		})
+	}
+	if !updated {
+		return h.conflict(c, draft)
+	}
+
+	return h.respond(c, fiber.StatusOK, draft)
+}
+
+// Delete discards a draft, including its copy at the provider
+func (h *DraftHandler) Delete(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid draft ID",
+		})
+	}
+
+	if err := h.draftRepo.Delete(userID, id); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Draft not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Draft deleted successfully",
+	})
+}
+
+// AddAttachment attaches a file to a draft and returns the draft
+func (h *DraftHandler) AddAttachment(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	draft, err := h.ownDraft(c)
+	if err != nil {
+		return err
+	}
+
+	var req DraftAttachmentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	attachment, err := h.attachment(c, userID, &req)
+	if err != nil {
+		return err
+	}
+	attachment.DraftID = draft.ID
+
+	existing, err := h.draftRepo.ListAttachments(draft.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get draft attachments",
+		})
+	}
+	total := attachment.SizeBytes
+	for _, a := range existing {
+		total += a.SizeBytes
+	}
+	if total > maxAttachmentBytes {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Attachments are larger than 25 MB",
+		})
+	}
+
+	if err := h.draftRepo.AddAttachment(attachment); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to attach file",
+		})
+	}
+
+	draft, err = h.draftRepo.GetForUser(userID, draft.ID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Draft not found",
+		})
+	}
+	return h.respond(c, fiber.StatusCreated, draft)
+}
+
+// RemoveAttachment removes a file from a draft and returns the draft
+func (h *DraftHandler) RemoveAttachment(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	draft, err := h.ownDraft(c)
+	if err != nil {
+		return err
+	}
+
+	attachmentID, err := uuid.Parse(c.Params("attachmentId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid attachment ID",
+		})
+	}
+
+	if err := h.draftRepo.RemoveAttachment(draft.ID, attachmentID); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Attachment not found",
+		})
+	}
+
+	draft, err = h.draftRepo.GetForUser(userID, draft.ID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Draft not found",
+		})
+	}
+	return h.respond(c, fiber.StatusOK, draft)
+}
+
+// Send queues a draft in the outbox and discards it
+func (h *DraftHandler) Send(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	draft, err := h.ownDraft(c)
+	if err != nil {
+		return err
+	}
+
+	var req SendDraftRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+	if req.Version != nil && *req.Version != draft.Version {
+		return h.conflict(c, draft)
+	}
+
+	if len(draft.To)+len(draft.Cc)+len(draft.Bcc) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one recipient is required",
+		})
+	}
+
+	account, err := h.sendingAccount(userID, draft.AccountID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Email account not found",
+		})
+	}
+
+	msg, err := buildMessage(account, &SendEmailRequest{
+		To:      draft.To,
+		Cc:      draft.Cc,
+		Bcc:     draft.Bcc,
+		Subject: draft.Subject,
+		Text:    draft.Text,
+		HTML:    draft.HTML,
+	})
+	if err != nil {
+		return err
+	}
+
+	list, err := h.draftRepo.ListAttachments(draft.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get draft attachments",
+		})
+	}
+	if msg.Attachments, err = drafts.LoadAttachments(c.UserContext(), h.store, list); err != nil {
+		log.Printf("Failed to load attachments of draft %s: %v", draft.ID, err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Failed to load draft attachments",
+		})
+	}
+
+	// Sending a version twice returns the first outbox entry
+	key := fmt.Sprintf("draft:%s:%d", draft.ID, draft.Version)
+	stored, created, err := queueMessage(h.outboxRepo, userID, account, msg, key)
+	if err != nil {
+		return err
+	}
+
+	if err := h.draftRepo.Delete(userID, draft.ID); err != nil {
+		log.Printf("Failed to discard sent draft %s: %v", draft.ID, err)
+	}
+
+	status := fiber.StatusAccepted
+	if !created {
+		status = fiber.StatusOK
+	}
+	return c.Status(status).JSON(stored)
+}
+
+// validate checks the fields of a draft request. Addresses are not
+// checked, since the user may still be typing them. Failures are returned
+// as fiber errors.
+func (h *DraftHandler) validate(userID uuid.UUID, req *DraftRequest) error {
+	if req.AccountID != nil && *req.AccountID != uuid.Nil {
+		account, err := h.accountRepo.GetForUser(userID, *req.AccountID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusNotFound, "Email account not found")
+		}
+		if account.Provider == mailimport.ProviderName {
+			return fiber.NewError(fiber.StatusBadRequest, "Imported mail cannot be sent from")
+		}
+	}
+
+	for _, list := range []*[]string{req.To, req.Cc, req.Bcc} {
+		if list != nil && len(*list) > maxDraftRecipients {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("A draft can have at most %d recipients per field", maxDraftRecipients))
+		}
+	}
+	for _, body := range []*string{req.Subject, req.Text, req.HTML} {
+		if body != nil && len(*body) > maxDraftBodyBytes {
+			return fiber.NewError(fiber.StatusBadRequest, "Draft is too large")
+		}
+	}
+	if req.Subject != nil && !mailer.ValidHeaderText(*req.Subject) {
+		return fiber.NewError(fiber.StatusBadRequest, "Subject must not contain line breaks or control characters")
+	}
+
+	return nil
+}
+
+// attachment turns an attachment request into a draft attachment, storing
+// uploaded content. Failures are returned as fiber errors.
+func (h *DraftHandler) attachment(c *fiber.Ctx, userID uuid.UUID, req *DraftAttachmentRequest) (*models.DraftAttachment, error) {
+	if req.AttachmentID != nil {
+		if req.EmailID == nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Email ID is required")
+		}
+		if _, err := h.emailRepo.GetForViewer(userID, *req.EmailID); err != nil {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Email not found")
+		}
+		source, err := h.attachmentRepo.Get(*req.EmailID, *req.AttachmentID)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Attachment not found")
+		}
+
+		attachment := &models.DraftAttachment{
+			Filename:           "attachment",
+			ContentType:        source.ContentType,
+			SizeBytes:          source.SizeBytes,
+			SHA256:             source.SHA256,
+			SourceAttachmentID: &source.ID,
+		}
+		if source.Filename != nil {
+			attachment.Filename = *source.Filename
+		}
+		return attachment, nil
+	}
+
+	if req.Filename == "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Attachment filename is required")
+	}
+	data, err := base64.StdEncoding.DecodeString(req.Content)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Attachment %s is not valid base64", req.Filename))
+	}
+	if len(data) > maxAttachmentBytes {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Attachments are larger than 25 MB")
+	}
+
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	hash, err := h.store.Upload(c.UserContext(), data, contentType)
+	if err != nil {
+		log.Printf("Failed to store draft attachment: %v", err)
+		return nil, fiber.NewError(fiber.StatusBadGateway, "Failed to store attachment")
+	}
+
+	return &models.DraftAttachment{
+		Filename:    req.Filename,
+		ContentType: contentType,
+		SizeBytes:   int64(len(data)),
+		SHA256:      hash,
+	}, nil
+}
+
+// ownDraft loads the draft in the path if it belongs to the user
+func (h *DraftHandler) ownDraft(c *fiber.Ctx) (*models.Draft, error) {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid draft ID")
+	}
+
+	draft, err := h.draftRepo.GetForUser(userID, id)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Draft not found")
+	}
+
+	return draft, nil
+}
+
+func (h *DraftHandler) sendingAccount(userID uuid.UUID, accountID *uuid.UUID) (*models.EmailAccount, error) {
+	if accountID == nil {
+		return h.accountRepo.GetPrimary(userID)
+	}
+	account, err := h.accountRepo.GetForUser(userID, *accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account.Provider == mailimport.ProviderName {
+		return nil, fmt.Errorf("imported mail cannot be sent from")
+	}
+	return account, nil
+}
+
+// respond writes a draft with its attachments
+func (h *DraftHandler) respond(c *fiber.Ctx, status int, draft *models.Draft) error {
+	if err := h.loadAttachments(draft); err != nil {
+		return err
+	}
+	return c.Status(status).JSON(draft)
+}
+
+// conflict reports that a draft was changed on another device, with the
+// current draft for the client to merge
+func (h *DraftHandler) conflict(c *fiber.Ctx, draft *models.Draft) error {
+	if err := h.loadAttachments(draft); err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+		"error": "Draft was changed on another device",
+		"draft": draft,
+	})
+}
+
+func (h *DraftHandler) loadAttachments(draft *models.Draft) error {
+	list, err := h.draftRepo.ListAttachments(draft.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to get draft attachments")
+	}
+	draft.Attachments = list
+	return nil
+}
@@ -0,0 +1,1101 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/attachments"
+	"github.com/jay/dadmail/internal/auth"
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/imageproxy"
+	"github.com/jay/dadmail/internal/mailbody"
+	"github.com/jay/dadmail/internal/mailer"
+	"github.com/jay/dadmail/internal/mailimport"
+	"github.com/jay/dadmail/internal/mimeparse"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/sanitize"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// maxAttachmentBytes caps the combined size of attachments in one message
+	maxAttachmentBytes = 25 << 20
+
+	defaultPageSize = 50
+	maxPageSize     = 100
+
+	// bodyFetchTimeout bounds fetching a message from the provider
+	bodyFetchTimeout = time.Minute
+
+	// maxBulkEmails caps the emails changed by one bulk request
+	maxBulkEmails = 500
+)
+
+// EmailHandler handles email endpoints
+type EmailHandler struct {
+	accountRepo    *repository.EmailAccountRepository
+	emailRepo      *repository.EmailRepository
+	outboxRepo     *repository.OutboxRepository
+	stateRepo      *repository.WritebackRepository
+	prefsRepo      *repository.PreferencesRepository
+	attachmentRepo *repository.AttachmentRepository
+	fetcher        *mailbody.Fetcher
+	attachments    *attachments.Store
+	imageProxy     *imageproxy.Proxy
+}
+
+// NewEmailHandler creates a new email handler
+func NewEmailHandler(db *sqlx.DB, cfg *config.Config, fetcher *mailbody.Fetcher, attachmentStore *attachments.Store, imageProxy *imageproxy.Proxy) *EmailHandler {
+	return &EmailHandler{
+		accountRepo:    repository.NewEmailAccountRepository(db),
+		emailRepo:      repository.NewEmailRepository(db),
+		outboxRepo:     repository.NewOutboxRepository(db),
+		stateRepo:      repository.NewWritebackRepository(db),
+		prefsRepo:      repository.NewPreferencesRepository(db),
+		attachmentRepo: repository.NewAttachmentRepository(db),
+		fetcher:        fetcher,
+		attachments:    attachmentStore,
+		imageProxy:     imageProxy,
+	}
+}
+
+// AttachmentRequest represents a file attached to an outgoing email
+type AttachmentRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     string `json:"content"` // base64 encoded
+}
+
+// SendEmailRequest represents a request to send an email
+type SendEmailRequest struct {
+	// IdempotencyKey identifies this send request; resubmitting the same key
+	// returns the original outbox entry instead of sending twice. The
+	// Idempotency-Key header takes precedence.
+	IdempotencyKey string              `json:"idempotency_key"`
+	AccountID      *uuid.UUID          `json:"account_id"` // defaults to the primary account
+	To             []string            `json:"to"`
+	Cc             []string            `json:"cc"`
+	Bcc            []string            `json:"bcc"`
+	Subject        string              `json:"subject"`
+	Text           string              `json:"text"`
+	HTML           string              `json:"html"`
+	Attachments    []AttachmentRequest `json:"attachments"`
+}
+
+// ReplyEmailRequest represents a reply to or forward of an email. The
+// subject, threading headers and quoted original are added by the server,
+// and the message is sent from the account that received the original.
+type ReplyEmailRequest struct {
+	IdempotencyKey string              `json:"idempotency_key"`
+	To             []string            `json:"to"` // required to forward; added to the recipients of a reply
+	Cc             []string            `json:"cc"`
+	Bcc            []string            `json:"bcc"`
+	Text           string              `json:"text"`
+	HTML           string              `json:"html"`
+	Attachments    []AttachmentRequest `json:"attachments"`
+}
+
+// UpdateEmailRequest changes the state of one or more emails. Omitted
+// fields are left unchanged. IDs are only used by the bulk endpoint.
+type UpdateEmailRequest struct {
+	IDs        []uuid.UUID `json:"ids"`
+	IsRead     *bool       `json:"is_read"`
+	IsStarred  *bool       `json:"is_starred"`
+	IsArchived *bool       `json:"is_archived"`
+}
+
+// DeleteEmailsRequest deletes several emails at once
+type DeleteEmailsRequest struct {
+	IDs []uuid.UUID `json:"ids"`
+}
+
+// List returns a page of the user's emails across all accounts, newest
+// first. Archived emails are only listed with archived=true. Pass
+// next_cursor from the response as cursor to get the next page.
+func (h *EmailHandler) List(c *fiber.Ctx) error {
+	return h.list(c, c.Query("category"))
+}
+
+// ListByCategory lists the user's emails in one category
+func (h *EmailHandler) ListByCategory(c *fiber.Ctx) error {
+	return h.list(c, c.Params("category"))
+}
+
+func (h *EmailHandler) list(c *fiber.Ctx, category string) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	filter, err := parseEmailFilter(c, category)
+	if err != nil {
+		return err
+	}
+	filter.UserID = userID
+
+	emails, next, err := h.emailRepo.List(filter)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list emails",
+		})
+	}
+
+	var nextCursor *string
+	if next != nil {
+		encoded := encodeEmailCursor(next)
+		nextCursor = &encoded
+	}
+
+	return c.JSON(fiber.Map{
+		"emails":      emails,
+		"next_cursor": nextCursor,
+	})
+}
+
+// Search finds the user's emails matching q, best matches first. Besides
+// words, "phrases" and -excluded words, q understands from:, category:,
+// before: and after: (dates as YYYY-MM-DD). Pass next_offset from the
+// response as offset to get the next page.
+func (h *EmailHandler) Search(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	search, err := parseSearchQuery(c.Query("q"))
+	if err != nil {
+		return err
+	}
+	if search.Text == "" && search.From == "" && search.Category == "" && search.Before == nil && search.After == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Search query is required",
+		})
+	}
+
+	limit := c.QueryInt("limit", defaultPageSize)
+	if limit < 1 || limit > maxPageSize {
+		limit = defaultPageSize
+	}
+	offset := c.QueryInt("offset", 0)
+	if offset < 0 {
+		offset = 0
+	}
+
+	// Fetch one extra row to learn whether another page exists
+	search.UserID = userID
+	search.Limit = limit + 1
+	search.Offset = offset
+
+	results, err := h.emailRepo.Search(search)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to search emails",
+		})
+	}
+
+	var nextOffset *int
+	if len(results) > limit {
+		results = results[:limit]
+		next := offset + limit
+		nextOffset = &next
+	}
+
+	return c.JSON(fiber.Map{
+		"results":     results,
+		"next_offset": nextOffset,
+	})
+}
+
+// Get returns an email with its body. The body is not stored in the
+// database; it is fetched from the provider on first open and cached.
+// Remote images are replaced by placeholders unless the user shows images,
+// always shows them from this sender, or passes show_images=true; shown
+// images are loaded through the image proxy.
+func (h *EmailHandler) Get(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid email ID",
+		})
+	}
+
+	email, err := h.emailRepo.GetForUser(userID, id)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Email not found",
+		})
+	}
+
+	account, err := h.accountRepo.GetByID(email.AccountID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get email account",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), bodyFetchTimeout)
+	defer cancel()
+
+	raw, err := h.fetcher.Raw(ctx, account, &email.Email)
+	if errors.Is(err, provider.ErrMessageGone) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Email no longer exists on the mail server",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Failed to fetch email from the mail server",
+		})
+	}
+
+	msg, err := mimeparse.Parse(raw)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read email",
+		})
+	}
+
+	// Make the body searchable the first time it is fetched
+	indexed, err := h.emailRepo.HasBodyText(email.ID)
+	if err == nil && !indexed {
+		err = h.emailRepo.SaveBodyText(email.ID, msg.PlainText())
+	}
+	if err != nil {
+		log.Printf("Failed to index body of email %s: %v", email.ID, err)
+	}
+
+	// Store attachments the first time the email is opened so they can be
+	// downloaded; without them the manifest still lists what the message
+	// contains
+	var manifest interface{} = msg.Attachments
+	stored, err := h.attachmentRepo.ListForEmail(email.ID)
+	if err == nil && len(stored) == 0 && len(msg.Attachments) > 0 {
+		stored, err = h.attachments.Save(ctx, email.ID, msg.Attachments)
+	}
+	if err != nil {
+		log.Printf("Failed to store attachments of email %s: %v", email.ID, err)
+	} else {
+		manifest = stored
+	}
+
+	html, images := sanitize.Images(msg.HTML, sanitize.ImageOptions{
+		AllowRemote: h.showImages(c, userID, &email.Email),
+		Proxy:       h.imageProxy.URL,
+	})
+
+	return c.JSON(fiber.Map{
+		"email": email,
+		"body": fiber.Map{
+			"text":        msg.Text,
+			"html":        html,
+			"images":      images,
+			"attachments": manifest,
+		},
+	})
+}
+
+// Update marks an email read, starred or archived. The change is saved
+// immediately and written back to the mail provider in the background.
+func (h *EmailHandler) Update(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid email ID",
+		})
+	}
+
+	var req UpdateEmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	updated, err := h.stateRepo.Update(userID, []uuid.UUID{id}, req.changes())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update email",
+		})
+	}
+	if len(updated) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Email not found",
+		})
+	}
+
+	email, err := h.emailRepo.GetForUser(userID, id)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Email not found",
+		})
+	}
+
+	return c.JSON(email)
+}
+
+// UpdateMany applies the same change to up to maxBulkEmails emails. IDs
+// that are not the user's are skipped; the response counts the emails
+// that were found.
+func (h *EmailHandler) UpdateMany(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req UpdateEmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if err := checkBulkIDs(req.IDs); err != nil {
+		return err
+	}
+
+	updated, err := h.stateRepo.Update(userID, req.IDs, req.changes())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update emails",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"updated": len(updated),
+	})
+}
+
+// Delete hides an email and moves it to the provider's trash in the
+// background
+func (h *EmailHandler) Delete(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid email ID",
+		})
+	}
+
+	deleted, err := h.stateRepo.Delete(userID, []uuid.UUID{id})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete email",
+		})
+	}
+	if len(deleted) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Email not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Email deleted successfully",
+	})
+}
+
+// DeleteMany deletes up to maxBulkEmails emails. IDs that are not the
+// user's are skipped.
+func (h *EmailHandler) DeleteMany(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req DeleteEmailsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if err := checkBulkIDs(req.IDs); err != nil {
+		return err
+	}
+
+	deleted, err := h.stateRepo.Delete(userID, req.IDs)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete emails",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"deleted": len(deleted),
+	})
+}
+
+func (req *UpdateEmailRequest) changes() *repository.EmailChanges {
+	return &repository.EmailChanges{
+		IsRead:     req.IsRead,
+		IsStarred:  req.IsStarred,
+		IsArchived: req.IsArchived,
+	}
+}
+
+func checkBulkIDs(ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "ids is required")
+	}
+	if len(ids) > maxBulkEmails {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("At most %d ids per request", maxBulkEmails))
+	}
+	return nil
+}
+
+// showImages decides whether remote images of an email are shown. Errors
+// reading the preferences block images.
+func (h *EmailHandler) showImages(c *fiber.Ctx, userID uuid.UUID, email *models.Email) bool {
+	if c.QueryBool("show_images") {
+		return true
+	}
+
+	prefs, err := h.prefsRepo.Get(userID)
+	if err != nil {
+		log.Printf("Failed to get preferences of user %s: %v", userID, err)
+		return false
+	}
+	if prefs.ShowImages {
+		return true
+	}
+
+	allowed, err := h.prefsRepo.ImagesAllowedFrom(userID, email.FromAddress)
+	if err != nil {
+		log.Printf("Failed to check image senders of user %s: %v", userID, err)
+		return false
+	}
+	return allowed
+}
+
+// Send composes a new email and queues it in the outbox for delivery
+func (h *EmailHandler) Send(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req SendEmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if len(req.To)+len(req.Cc)+len(req.Bcc) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one recipient is required",
+		})
+	}
+
+	account, err := h.sendingAccount(userID, req.AccountID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Email account not found",
+		})
+	}
+
+	msg, err := buildMessage(account, &req)
+	if err != nil {
+		return err
+	}
+
+	return h.enqueue(c, userID, account, msg, req.IdempotencyKey)
+}
+
+// Reply queues a reply to the sender of an email
+func (h *EmailHandler) Reply(c *fiber.Ctx) error {
+	return h.respond(c, replySender)
+}
+
+// ReplyAll queues a reply to the sender and the other recipients of an
+// email
+func (h *EmailHandler) ReplyAll(c *fiber.Ctx) error {
+	return h.respond(c, replyAll)
+}
+
+// Forward queues a forward of an email, including its attachments
+func (h *EmailHandler) Forward(c *fiber.Ctx) error {
+	return h.respond(c, forward)
+}
+
+// responseKind selects how respond builds on the original email
+type responseKind int
+
+const (
+	replySender responseKind = iota
+	replyAll
+	forward
+)
+
+// respond builds a reply or forward of the email in the path and queues it
+// in the outbox like Send
+func (h *EmailHandler) respond(c *fiber.Ctx, kind responseKind) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid email ID",
+		})
+	}
+
+	var req ReplyEmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if kind == forward && len(req.To)+len(req.Cc)+len(req.Bcc) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one recipient is required",
+		})
+	}
+
+	email, err := h.emailRepo.GetForUser(userID, id)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Email not found",
+		})
+	}
+
+	account, err := h.accountRepo.GetByID(email.AccountID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get email account",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), bodyFetchTimeout)
+	defer cancel()
+
+	orig, err := h.original(ctx, account, &email.Email)
+	if err != nil {
+		return err
+	}
+
+	// Imported mail has no server to send from, so responses to it go out
+	// from the primary account
+	if account.Provider == mailimport.ProviderName {
+		if account, err = h.accountRepo.GetPrimary(userID); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Link an account to send from first",
+			})
+		}
+	}
+
+	from := mail.Address{Address: account.EmailAddress}
+	if account.DisplayName != nil {
+		from.Name = *account.DisplayName
+	}
+
+	var msg *mailer.Message
+	if kind == forward {
+		msg = mailer.NewForward(from, orig)
+		msg.QuoteForward(req.Text, req.HTML, orig)
+		if msg.Attachments, err = h.forwardedAttachments(ctx, email.ID, orig.Attachments); err != nil {
+			return err
+		}
+	} else {
+		msg = mailer.NewReply(from, orig, kind == replyAll)
+		msg.QuoteReply(req.Text, req.HTML, orig)
+	}
+
+	to, err := parseAddresses(req.To)
+	if err != nil {
+		return err
+	}
+	cc, err := parseAddresses(req.Cc)
+	if err != nil {
+		return err
+	}
+	if msg.Bcc, err = parseAddresses(req.Bcc); err != nil {
+		return err
+	}
+	msg.To = append(msg.To, to...)
+	msg.Cc = append(msg.Cc, cc...)
+	if len(msg.Recipients()) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The original email has no sender to reply to",
+		})
+	}
+
+	if msg.Attachments, err = decodeAttachments(msg.Attachments, req.Attachments); err != nil {
+		return err
+	}
+
+	return h.enqueue(c, userID, account, msg, req.IdempotencyKey)
+}
+
+// original fetches and parses the message an email refers to. Failures are
+// returned as fiber errors.
+func (h *EmailHandler) original(ctx context.Context, account *models.EmailAccount, email *models.Email) (*mimeparse.Message, error) {
+	raw, err := h.fetcher.Raw(ctx, account, email)
+	if errors.Is(err, provider.ErrMessageGone) {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Email no longer exists on the mail server")
+	}
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadGateway, "Failed to fetch email from the mail server")
+	}
+
+	msg, err := mimeparse.Parse(raw)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to read email")
+	}
+
+	return msg, nil
+}
+
+// forwardedAttachments stores the attachments of the original email and
+// reads them back from storage for the forward. Inline parts keep their
+// Content-ID so the quoted HTML still shows them.
+func (h *EmailHandler) forwardedAttachments(ctx context.Context, emailID uuid.UUID, parts []mimeparse.Attachment) ([]mailer.Attachment, error) {
+	stored, err := h.attachments.Save(ctx, emailID, parts)
+	if err != nil {
+		log.Printf("Failed to store attachments of email %s: %v", emailID, err)
+		return nil, fiber.NewError(fiber.StatusBadGateway, "Failed to load the original attachments")
+	}
+
+	attached := make([]mailer.Attachment, 0, len(stored))
+	total := int64(0)
+	for i := range stored {
+		total += stored[i].SizeBytes
+		if total > maxAttachmentBytes {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Attachments are larger than 25 MB")
+		}
+
+		data, err := h.attachments.Read(ctx, stored[i].SHA256)
+		if err != nil {
+			log.Printf("Failed to read attachment %s of email %s: %v", stored[i].ID, emailID, err)
+			return nil, fiber.NewError(fiber.StatusBadGateway, "Failed to load the original attachments")
+		}
+
+		att := mailer.Attachment{
+			Filename:    "attachment",
+			ContentType: stored[i].ContentType,
+			Data:        data,
+		}
+		if stored[i].Filename != nil {
+			att.Filename = *stored[i].Filename
+		}
+		if stored[i].IsInline && stored[i].ContentID != nil {
+			att.ContentID = *stored[i].ContentID
+		}
+		attached = append(attached, att)
+	}
+
+	return attached, nil
+}
+
+// enqueue renders msg and stores it in the outbox. Replays of an already
+// accepted idempotency key return the original entry.
+func (h *EmailHandler) enqueue(c *fiber.Ctx, userID uuid.UUID, account *models.EmailAccount, msg *mailer.Message, idempotencyKey string) error {
+	if key := c.Get("Idempotency-Key"); key != "" {
+		idempotencyKey = key
+	}
+
+	stored, created, err := queueMessage(h.outboxRepo, userID, account, msg, idempotencyKey)
+	if err != nil {
+		return err
+	}
+
+	status := fiber.StatusAccepted
+	if !created {
+		status = fiber.StatusOK
+	}
+	return c.Status(status).JSON(stored)
+}
+
+// queueMessage renders msg and stores it in the outbox under the given
+// idempotency key, or a new one when it is empty. Failures are returned as
+// fiber errors.
+func queueMessage(outboxRepo *repository.OutboxRepository, userID uuid.UUID, account *models.EmailAccount, msg *mailer.Message, idempotencyKey string) (stored *models.OutboxMessage, created bool, err error) {
+	if idempotencyKey == "" {
+		idempotencyKey = uuid.NewString()
+	}
+	if len(idempotencyKey) > 255 {
+		return nil, false, fiber.NewError(fiber.StatusBadRequest, "Idempotency key is too long")
+	}
+
+	raw, err := msg.Build()
+	if errors.Is(err, mailer.ErrInvalidHeader) {
+		return nil, false, fiber.NewError(fiber.StatusBadRequest, "Email headers must not contain line breaks or control characters")
+	}
+	if err != nil {
+		return nil, false, fiber.NewError(fiber.StatusInternalServerError, "Failed to build email")
+	}
+
+	entry := &models.OutboxMessage{
+		UserID:         userID,
+		AccountID:      account.ID,
+		IdempotencyKey: idempotencyKey,
+		MessageID:      msg.MessageID,
+		FromAddress:    msg.From.Address,
+		Recipients:     msg.Recipients(),
+		RawMessage:     raw,
+	}
+	if msg.Subject != "" {
+		entry.Subject = &msg.Subject
+	}
+
+	stored, created, err = outboxRepo.Enqueue(entry)
+	if err != nil {
+		return nil, false, fiber.NewError(fiber.StatusInternalServerError, "Failed to queue email")
+	}
+
+	return stored, created, nil
+}
+
+// ListOutbox lists the user's queued, sent and failed messages
+func (h *EmailHandler) ListOutbox(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	limit := c.QueryInt("limit", 50)
+	if limit < 1 || limit > 200 {
+		limit = 50
+	}
+
+	messages, err := h.outboxRepo.ListForUser(userID, c.Query("status"), limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list outbox",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"messages": messages,
+	})
+}
+
+// GetOutbox returns one outbox entry with its delivery attempts
+func (h *EmailHandler) GetOutbox(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid outbox ID",
+		})
+	}
+
+	msg, err := h.outboxRepo.GetForUser(userID, id)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Outbox message not found",
+		})
+	}
+
+	attempts, err := h.outboxRepo.ListAttempts(msg.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get delivery attempts",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":  msg,
+		"attempts": attempts,
+	})
+}
+
+func (h *EmailHandler) sendingAccount(userID uuid.UUID, accountID *uuid.UUID) (*models.EmailAccount, error) {
+	if accountID == nil {
+		return h.accountRepo.GetPrimary(userID)
+	}
+	account, err := h.accountRepo.GetForUser(userID, *accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account.Provider == mailimport.ProviderName {
+		return nil, fmt.Errorf("imported mail cannot be sent from")
+	}
+	return account, nil
+}
+
+// buildMessage validates a send request and turns it into a message.
+// Validation failures are returned as 400 fiber errors.
+func buildMessage(account *models.EmailAccount, req *SendEmailRequest) (*mailer.Message, error) {
+	if req.Text == "" && req.HTML == "" && req.Subject == "" {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Subject or message text is required")
+	}
+	if !mailer.ValidHeaderText(req.Subject) {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Subject must not contain line breaks or control characters")
+	}
+
+	msg := &mailer.Message{
+		From:    mail.Address{Address: account.EmailAddress},
+		Subject: req.Subject,
+		Text:    req.Text,
+		HTML:    req.HTML,
+	}
+	if account.DisplayName != nil {
+		msg.From.Name = *account.DisplayName
+	}
+
+	var err error
+	if msg.To, err = parseAddresses(req.To); err != nil {
+		return nil, err
+	}
+	if msg.Cc, err = parseAddresses(req.Cc); err != nil {
+		return nil, err
+	}
+	if msg.Bcc, err = parseAddresses(req.Bcc); err != nil {
+		return nil, err
+	}
+
+	if msg.Attachments, err = decodeAttachments(nil, req.Attachments); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// decodeAttachments appends the attachments of a request to attached,
+// keeping the combined size within maxAttachmentBytes
+func decodeAttachments(attached []mailer.Attachment, reqs []AttachmentRequest) ([]mailer.Attachment, error) {
+	total := 0
+	for _, att := range attached {
+		total += len(att.Data)
+	}
+
+	for _, att := range reqs {
+		if att.Filename == "" {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Attachment filename is required")
+		}
+		data, err := base64.StdEncoding.DecodeString(att.Content)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Attachment %s is not valid base64", att.Filename))
+		}
+		total += len(data)
+		if total > maxAttachmentBytes {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Attachments are larger than 25 MB")
+		}
+		attached = append(attached, mailer.Attachment{
+			Filename:    att.Filename,
+			ContentType: att.ContentType,
+			Data:        data,
+		})
+	}
+
+	return attached, nil
+}
+
+func parseAddresses(list []string) ([]mail.Address, error) {
+	addrs := make([]mail.Address, 0, len(list))
+	for _, s := range list {
+		addr, err := mail.ParseAddress(s)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Invalid email address: %s", s))
+		}
+		addrs = append(addrs, *addr)
+	}
+	return addrs, nil
+}
+
+// parseEmailFilter reads list filters from the query string. category may
+// be a category ID or name. Invalid values are returned as 400 fiber errors.
+func parseEmailFilter(c *fiber.Ctx, category string) (*repository.EmailFilter, error) {
+	filter := &repository.EmailFilter{Limit: c.QueryInt("limit", defaultPageSize)}
+	if filter.Limit < 1 || filter.Limit > maxPageSize {
+		filter.Limit = defaultPageSize
+	}
+
+	if v := c.Query("account_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid account_id")
+		}
+		filter.AccountID = &id
+	}
+
+	if category != "" {
+		if id, err := uuid.Parse(category); err == nil {
+			filter.CategoryID = &id
+		} else {
+			filter.CategoryName = &category
+		}
+	}
+
+	for name, dst := range map[string]**bool{
+		"unread":          &filter.Unread,
+		"starred":         &filter.Starred,
+		"has_attachments": &filter.HasAttachments,
+	} {
+		if v := c.Query(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Invalid %s: must be true or false", name))
+			}
+			*dst = &b
+		}
+	}
+
+	if v := c.Query("archived"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid archived: must be true or false")
+		}
+		filter.Archived = b
+	}
+
+	var err error
+	if filter.Since, err = parseDateParam(c.Query("since"), false); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid since: use RFC 3339 or YYYY-MM-DD")
+	}
+	if filter.Until, err = parseDateParam(c.Query("until"), true); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid until: use RFC 3339 or YYYY-MM-DD")
+	}
+
+	if v := c.Query("cursor"); v != "" {
+		if filter.After, err = decodeEmailCursor(v); err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid cursor")
+		}
+	}
+
+	return filter, nil
+}
+
+// parseDateParam parses an RFC 3339 time or a date. A date used as an upper
+// bound includes the whole day.
+func parseDateParam(v string, endOfDay bool) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return &t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+// parseSearchQuery splits a search query into full-text terms and the
+// from:, category:, before: and after: operators. Operator values may be
+// quoted; unknown operators are searched as text.
+func parseSearchQuery(q string) (*repository.EmailSearch, error) {
+	search := &repository.EmailSearch{}
+	var text []string
+
+	for _, token := range splitSearchQuery(q) {
+		name, value, ok := strings.Cut(token, ":")
+		value = strings.Trim(value, `"`)
+		if !ok || value == "" {
+			text = append(text, token)
+			continue
+		}
+
+		var err error
+		switch strings.ToLower(name) {
+		case "from":
+			search.From = value
+		case "category":
+			search.Category = value
+		case "before":
+			if search.Before, err = parseDateParam(value, false); err != nil {
+				return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid before: use YYYY-MM-DD")
+			}
+		case "after":
+			if search.After, err = parseDateParam(value, false); err != nil {
+				return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid after: use YYYY-MM-DD")
+			}
+		default:
+			text = append(text, token)
+		}
+	}
+
+	search.Text = strings.Join(text, " ")
+	return search, nil
+}
+
+// splitSearchQuery splits q on whitespace outside double quotes
+func splitSearchQuery(q string) []string {
+	var tokens []string
+	var current strings.Builder
+	quoted := false
+
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+
+	return tokens
+}
+
+// encodeEmailCursor turns a page position into an opaque token
+func encodeEmailCursor(cursor *repository.EmailCursor) string {
+	raw := cursor.ReceivedAt.Format(time.RFC3339Nano) + "|" + cursor.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeEmailCursor(token string) (*repository.EmailCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	receivedAt, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return nil, err
+	}
+	parsedID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &repository.EmailCursor{ReceivedAt: receivedAt, ID: parsedID}, nil
+}
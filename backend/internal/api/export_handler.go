@@ -0,0 +1,191 @@
+package api
+
+import (
+	"mime"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/auth"
+	"github.com/jay/dadmail/internal/mailexport"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/storage"
+	"github.com/jmoiron/sqlx"
+)
+
+// exportURLTTL is how long a temporary export download URL stays valid
+const exportURLTTL = 15 * time.Minute
+
+// ExportHandler handles mailbox export endpoints. A user can export their
+// own mailbox; a caregiver with full access can export the senior's.
+type ExportHandler struct {
+	exportRepo    *repository.ExportRepository
+	caregiverRepo *repository.CaregiverRepository
+	objects       storage.BlobStore
+}
+
+// NewExportHandler creates a new export handler
+func NewExportHandler(db *sqlx.DB, objects storage.BlobStore) *ExportHandler {
+	return &ExportHandler{
+		exportRepo:    repository.NewExportRepository(db),
+		caregiverRepo: repository.NewCaregiverRepository(db),
+		objects:       objects,
+	}
+}
+
+// CreateExportRequest requests an export of a mailbox. UserID defaults to
+// the current user and Format to mbox.
+type CreateExportRequest struct {
+	UserID *uuid.UUID `json:"user_id"`
+	Format string     `json:"format"`
+}
+
+// List returns the exports the user may download, newest first
+func (h *ExportHandler) List(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	list, err := h.exportRepo.ListVisible(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list exports",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"exports": list,
+	})
+}
+
+// Create queues an export of the user's mailbox, or of a senior's mailbox
+// for a caregiver with full access. If an export of the mailbox is already
+// running, it is returned instead.
+func (h *ExportHandler) Create(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req CreateExportRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	switch req.Format {
+	case "":
+		req.Format = models.ExportMbox
+	case models.ExportMbox, models.ExportEML:
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Format must be mbox or eml",
+		})
+	}
+
+	ownerID := userID
+	if req.UserID != nil && *req.UserID != userID {
+		ok, err := h.caregiverRepo.CanExport(*req.UserID, userID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to check access",
+			})
+		}
+		if !ok {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Exporting someone else's mail requires full caregiver access that includes reading emails",
+			})
+		}
+		ownerID = *req.UserID
+	}
+
+	exp := &models.Export{UserID: ownerID, RequestedBy: userID, Format: req.Format}
+	created, err := h.exportRepo.Create(exp)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create export",
+		})
+	}
+	if !created {
+		return c.JSON(exp)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(exp)
+}
+
+// Get returns an export and its progress
+func (h *ExportHandler) Get(c *fiber.Ctx) error {
+	exp, err := h.visibleExport(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(exp)
+}
+
+// Download returns a temporary URL that downloads a finished export
+func (h *ExportHandler) Download(c *fiber.Ctx) error {
+	exp, err := h.visibleExport(c)
+	if err != nil {
+		return err
+	}
+
+	if exp.Status != models.ExportDone || exp.ObjectKey == nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":  "The export is not ready to download",
+			"export": exp,
+		})
+	}
+	if exp.ExpiresAt != nil && time.Now().After(*exp.ExpiresAt) {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "The export has expired",
+		})
+	}
+
+	// The link never outlives the archive
+	ttl := exportURLTTL
+	if exp.ExpiresAt != nil && time.Until(*exp.ExpiresAt) < ttl {
+		ttl = time.Until(*exp.ExpiresAt)
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	url, err := h.objects.URL(c.UserContext(), *exp.ObjectKey, ttl, storage.URLOptions{
+		ContentType:        "application/zip",
+		ContentDisposition: mime.FormatMediaType("attachment", map[string]string{"filename": mailexport.Filename(exp)}),
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create download URL",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"url":        url,
+		"expires_at": expiresAt,
+	})
+}
+
+// visibleExport loads the export named by the :id parameter if it is of
+// the current user's mailbox, or was requested by them as a caregiver who
+// still has full access
+func (h *ExportHandler) visibleExport(c *fiber.Ctx) (*models.Export, error) {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid export ID")
+	}
+
+	exp, err := h.exportRepo.GetVisible(userID, id)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Export not found")
+	}
+
+	return exp, nil
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jay/dadmail/internal/imageproxy"
+)
+
+// ImageProxyHandler serves remote email images fetched by the server. The
+// signature in the URL is the only authorization, because browsers load
+// images without the Authorization header.
+type ImageProxyHandler struct {
+	proxy *imageproxy.Proxy
+}
+
+// NewImageProxyHandler creates a new image proxy handler
+func NewImageProxyHandler(proxy *imageproxy.Proxy) *ImageProxyHandler {
+	return &ImageProxyHandler{proxy: proxy}
+}
+
+// Get fetches and streams the remote image named by a signed proxy URL
+func (h *ImageProxyHandler) Get(c *fiber.Ctx) error {
+	query, err := url.ParseQuery(string(c.Request().URI().QueryString()))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid image URL")
+	}
+
+	remote, err := h.proxy.Verify(query)
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Invalid or expired URL",
+		})
+	}
+
+	image, err := h.proxy.Fetch(c.UserContext(), remote)
+	switch {
+	case errors.Is(err, imageproxy.ErrNotImage), errors.Is(err, imageproxy.ErrForbiddenAddress):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Image not allowed",
+		})
+	case errors.Is(err, imageproxy.ErrTooLarge):
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": "Image too large",
+		})
+	case err != nil:
+		log.Printf("Image proxy fetch failed: %v", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Failed to fetch image",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, image.ContentType)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderContentSecurityPolicy, "default-src 'none'; sandbox")
+	c.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+	c.Set(fiber.HeaderReferrerPolicy, "no-referrer")
+
+	return c.SendStream(image.Body, int(image.Size))
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/auth"
+	"github.com/jay/dadmail/internal/mailimport"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// maxImportChunkBytes caps one uploaded part of an archive, below the
+	// request body limit
+	maxImportChunkBytes = 32 << 20
+	// maxImportBytes caps a whole archive
+	maxImportBytes = 10 << 30
+)
+
+// ImportHandler handles mail import endpoints. Archives are uploaded in
+// parts, since they are usually larger than a request may be, and imported
+// by the worker once the upload is finished.
+type ImportHandler struct {
+	importRepo *repository.ImportRepository
+	store      *mailimport.Store
+}
+
+// NewImportHandler creates a new import handler
+func NewImportHandler(db *sqlx.DB, store *mailimport.Store) *ImportHandler {
+	return &ImportHandler{
+		importRepo: repository.NewImportRepository(db),
+		store:      store,
+	}
+}
+
+// CreateImportRequest starts the upload of an mbox file or a zip archive of
+// .eml files
+type CreateImportRequest struct {
+	Filename string `json:"filename"`
+}
+
+// List returns the user's imports, newest first
+func (h *ImportHandler) List(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	list, err := h.importRepo.ListForUser(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list imports",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"imports": list,
+	})
+}
+
+// Create starts a new import. The archive is then uploaded part by part
+// with UploadChunk.
+func (h *ImportHandler) Create(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req CreateImportRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	filename := strings.TrimSpace(filepath.Base(req.Filename))
+	if filename == "" || filename == "." || len(filename) > 255 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A filename of at most 255 characters is required",
+		})
+	}
+
+	imp := &models.Import{UserID: userID, Filename: filename}
+	if err := h.importRepo.Create(imp); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create import",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(imp)
+}
+
+// Get returns an import and its progress
+func (h *ImportHandler) Get(c *fiber.Ctx) error {
+	imp, err := h.userImport(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(imp)
+}
+
+// UploadChunk stores the part of the archive at :index, which is the raw
+// request body. Parts are numbered from 0 and must be uploaded in order;
+// repeating the upload of a received part has no effect, so a client can
+// safely retry.
+func (h *ImportHandler) UploadChunk(c *fiber.Ctx) error {
+	imp, err := h.userImport(c)
+	if err != nil {
+		return err
+	}
+
+	index, err := strconv.Atoi(c.Params("index"))
+	if err != nil || index < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid part index",
+		})
+	}
+
+	if imp.Status != models.ImportUploading {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":  "The upload is already finished",
+			"import": imp,
+		})
+	}
+	if index < imp.ChunkCount {
+		return c.JSON(imp)
+	}
+	if index > imp.ChunkCount {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":  fmt.Sprintf("Part %d must be uploaded next", imp.ChunkCount),
+			"import": imp,
+		})
+	}
+
+	data := c.Body()
+	if len(data) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The part is empty",
+		})
+	}
+	if len(data) > maxImportChunkBytes {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("Parts can be at most %d MB", maxImportChunkBytes>>20),
+		})
+	}
+	if imp.BytesTotal+int64(len(data)) > maxImportBytes {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("Archives can be at most %d GB", maxImportBytes>>30),
+		})
+	}
+
+	if err := h.store.PutChunk(c.UserContext(), imp, index, data); err != nil {
+		log.Printf("Failed to store part %d of import %s: %v", index, imp.ID, err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Failed to store the part",
+		})
+	}
+
+	updated, added, err := h.importRepo.AddChunk(imp.UserID, imp.ID, index, int64(len(data)))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save the part",
+		})
+	}
+	if !added && (updated.Status != models.ImportUploading || updated.ChunkCount <= index) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":  "The upload changed on another device",
+			"import": updated,
+		})
+	}
+
+	return c.JSON(updated)
+}
+
+// Start finishes the upload and queues the archive for import. Starting an
+// import that already started has no effect.
+func (h *ImportHandler) Start(c *fiber.Ctx) error {
+	imp, err := h.userImport(c)
+	if err != nil {
+		return err
+	}
+
+	started, ok, err := h.importRepo.Start(imp.UserID, imp.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start import",
+		})
+	}
+	if !ok {
+		if started.Status == models.ImportUploading {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Nothing has been uploaded yet",
+			})
+		}
+		return c.JSON(started)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(started)
+}
+
+// userImport loads the import named by the :id parameter if it belongs to
+// the current user
+func (h *ImportHandler) userImport(c *fiber.Ctx) (*models.Import, error) {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid import ID")
+	}
+
+	imp, err := h.importRepo.GetForUser(userID, id)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Import not found")
+	}
+
+	return imp, nil
+}
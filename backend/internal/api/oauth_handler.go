@@ -0,0 +1,237 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/auth"
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/provider/gmail"
+	"github.com/jay/dadmail/internal/provider/outlook"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/oauth2"
+)
+
+// oauthStateTTL is how long a user has to complete the consent screen
+const oauthStateTTL = 10 * time.Minute
+
+// OAuthHandler handles linking external accounts through OAuth2
+type OAuthHandler struct {
+	accountRepo   *repository.EmailAccountRepository
+	stateRepo     *repository.OAuthStateRepository
+	gmailOAuth    *oauth2.Config
+	gmailAPIURL   string
+	outlookOAuth  *oauth2.Config
+	outlookAPIURL string
+	vault         *vault.Vault
+}
+
+// NewOAuthHandler creates a new OAuth handler
+func NewOAuthHandler(db *sqlx.DB, cfg *config.Config, v *vault.Vault) *OAuthHandler {
+	return &OAuthHandler{
+		accountRepo:   repository.NewEmailAccountRepository(db),
+		stateRepo:     repository.NewOAuthStateRepository(db),
+		gmailOAuth:    gmail.NewOAuthConfig(&cfg.Email),
+		gmailAPIURL:   cfg.Email.GmailAPIURL,
+		outlookOAuth:  outlook.NewOAuthConfig(&cfg.Email),
+		outlookAPIURL: cfg.Email.OutlookAPIURL,
+		vault:         v,
+	}
+}
+
+// OAuthCallbackRequest represents the parameters returned by the provider
+type OAuthCallbackRequest struct {
+	Code  string `json:"code" query:"code"`
+	State string `json:"state" query:"state"`
+	Error string `json:"error" query:"error"`
+}
+
+// GmailStart begins the authorization code + PKCE flow and returns the URL
+// the frontend should send the user to
+func (h *OAuthHandler) GmailStart(c *fiber.Ctx) error {
+	// Offline access with forced consent makes Google return a refresh token
+	// even if the user linked this app before
+	return h.start(c, gmail.ProviderName, h.gmailOAuth,
+		oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("prompt", "consent"),
+	)
+}
+
+// OutlookStart begins the authorization code + PKCE flow for a Microsoft
+// account and returns the URL the frontend should send the user to
+func (h *OAuthHandler) OutlookStart(c *fiber.Ctx) error {
+	// The offline_access scope makes Microsoft return a refresh token;
+	// letting the user pick the account avoids silently linking whichever
+	// one is signed in to the browser
+	return h.start(c, outlook.ProviderName, h.outlookOAuth,
+		oauth2.SetAuthURLParam("prompt", "select_account"),
+	)
+}
+
+// start issues a state for the provider's consent screen and returns its
+// authorization URL
+func (h *OAuthHandler) start(c *fiber.Ctx, provider string, oauthConfig *oauth2.Config, opts ...oauth2.AuthCodeOption) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start authorization",
+		})
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	expiresAt := time.Now().Add(oauthStateTTL)
+	if err := h.stateRepo.Create(state, userID, provider, verifier, expiresAt); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start authorization",
+		})
+	}
+
+	authURL := oauthConfig.AuthCodeURL(state, append(opts, oauth2.S256ChallengeOption(verifier))...)
+
+	return c.JSON(fiber.Map{
+		"authorization_url": authURL,
+		"expires_at":        expiresAt,
+	})
+}
+
+// GmailCallback completes the flow: it checks that the state was issued to
+// the logged-in user, exchanges the code and stores the refresh token
+func (h *OAuthHandler) GmailCallback(c *fiber.Ctx) error {
+	userID, token, err := h.exchange(c, gmail.ProviderName, h.gmailOAuth)
+	if err != nil {
+		return err
+	}
+
+	// Ask Gmail which address was authorized rather than trusting the client
+	ctx := c.UserContext()
+	client := gmail.NewClient(ctx, h.gmailAPIURL, h.gmailOAuth.TokenSource(ctx, token))
+	profile, err := client.GetProfile(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Failed to read Gmail profile",
+		})
+	}
+
+	return h.link(c, userID, gmail.ProviderName, profile.EmailAddress, nil, token.RefreshToken)
+}
+
+// OutlookCallback completes the flow for a Microsoft account like
+// GmailCallback does for Google
+func (h *OAuthHandler) OutlookCallback(c *fiber.Ctx) error {
+	userID, token, err := h.exchange(c, outlook.ProviderName, h.outlookOAuth)
+	if err != nil {
+		return err
+	}
+
+	// Ask Graph which mailbox was authorized rather than trusting the client
+	ctx := c.UserContext()
+	client := outlook.NewClient(ctx, h.outlookAPIURL, h.outlookOAuth.TokenSource(ctx, token))
+	profile, err := client.GetProfile(ctx)
+	if err != nil || profile.Address() == "" {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Failed to read Microsoft profile",
+		})
+	}
+
+	var displayName *string
+	if profile.DisplayName != "" {
+		displayName = &profile.DisplayName
+	}
+
+	// Refreshing the access token above may already have rotated the
+	// refresh token, so store the latest one
+	if latest, err := client.Token(); err == nil && latest.RefreshToken != "" {
+		token = latest
+	}
+
+	return h.link(c, userID, outlook.ProviderName, profile.Address(), displayName, token.RefreshToken)
+}
+
+// exchange checks that the callback's state was issued to the logged-in
+// user for the provider and exchanges the code for a token with a refresh
+// token
+func (h *OAuthHandler) exchange(c *fiber.Ctx, provider string, oauthConfig *oauth2.Config) (uuid.UUID, *oauth2.Token, error) {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+
+	var req OAuthCallbackRequest
+	if c.Method() == fiber.MethodGet {
+		err = c.QueryParser(&req)
+	} else {
+		err = c.BodyParser(&req)
+	}
+	if err != nil {
+		return uuid.Nil, nil, fiber.NewError(fiber.StatusBadRequest, "Invalid request")
+	}
+
+	if req.Error != "" {
+		return uuid.Nil, nil, fiber.NewError(fiber.StatusBadRequest, "Authorization was denied")
+	}
+	if req.Code == "" || req.State == "" {
+		return uuid.Nil, nil, fiber.NewError(fiber.StatusBadRequest, "Code and state are required")
+	}
+
+	oauthState, err := h.stateRepo.Consume(req.State, provider, userID)
+	if err != nil {
+		return uuid.Nil, nil, fiber.NewError(fiber.StatusBadRequest, "Invalid or expired authorization state")
+	}
+
+	token, err := oauthConfig.Exchange(c.UserContext(), req.Code, oauth2.VerifierOption(oauthState.CodeVerifier))
+	if err != nil {
+		return uuid.Nil, nil, fiber.NewError(fiber.StatusBadGateway, "Failed to exchange authorization code")
+	}
+	if token.RefreshToken == "" {
+		return uuid.Nil, nil, fiber.NewError(fiber.StatusBadGateway, "The provider did not return a refresh token")
+	}
+
+	return userID, token, nil
+}
+
+// link stores the refresh token for the authorized address, linking the
+// account or replacing the credentials of an already linked one
+func (h *OAuthHandler) link(c *fiber.Ctx, userID uuid.UUID, provider, address string, displayName *string, refreshToken string) error {
+	accountID, err := h.accountRepo.IDForAddress(userID, address)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to link account",
+		})
+	}
+	encrypted, err := h.vault.Seal(accountID, &vault.Credentials{
+		OAuth: &vault.OAuthCredentials{RefreshToken: refreshToken},
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store credentials",
+		})
+	}
+
+	account, err := h.accountRepo.UpsertCredentials(accountID, userID, provider, address, displayName, encrypted)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to link account",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(account)
+}
+
+// randomToken returns a URL-safe random string with 256 bits of entropy
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jay/dadmail/internal/auth"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	validThemes    = map[string]bool{"light": true, "dark": true, "high-contrast": true}
+	validFontSizes = map[string]bool{"small": true, "medium": true, "large": true, "extra-large": true}
+)
+
+// PreferencesHandler handles user preference endpoints
+type PreferencesHandler struct {
+	prefsRepo *repository.PreferencesRepository
+}
+
+// NewPreferencesHandler creates a new preferences handler
+func NewPreferencesHandler(db *sqlx.DB) *PreferencesHandler {
+	return &PreferencesHandler{
+		prefsRepo: repository.NewPreferencesRepository(db),
+	}
+}
+
+// UpdatePreferencesRequest changes preferences. Omitted fields are left
+// unchanged.
+type UpdatePreferencesRequest struct {
+	Theme                *string `json:"theme"`
+	FontSize             *string `json:"font_size"`
+	AutoCategorize       *bool   `json:"auto_categorize"`
+	ShowImages           *bool   `json:"show_images"`
+	NotificationsEnabled *bool   `json:"notifications_enabled"`
+}
+
+// ImageSenderRequest names a sender, an address or @domain
+type ImageSenderRequest struct {
+	Sender string `json:"sender"`
+}
+
+// Get returns the current user's preferences
+func (h *PreferencesHandler) Get(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	prefs, err := h.prefsRepo.Get(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get preferences",
+		})
+	}
+
+	return c.JSON(prefs)
+}
+
+// Update changes the current user's preferences
+func (h *PreferencesHandler) Update(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req UpdatePreferencesRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Theme != nil && !validThemes[*req.Theme] {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Theme must be light, dark or high-contrast",
+		})
+	}
+	if req.FontSize != nil && !validFontSizes[*req.FontSize] {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Font size must be small, medium, large or extra-large",
+		})
+	}
+
+	prefs, err := h.prefsRepo.Get(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get preferences",
+		})
+	}
+
+	if req.Theme != nil {
+		prefs.Theme = *req.Theme
+	}
+	if req.FontSize != nil {
+		prefs.FontSize = *req.FontSize
+	}
+	if req.AutoCategorize != nil {
+		prefs.AutoCategorize = *req.AutoCategorize
+	}
+	if req.ShowImages != nil {
+		prefs.ShowImages = *req.ShowImages
+	}
+	if req.NotificationsEnabled != nil {
+		prefs.NotificationsEnabled = *req.NotificationsEnabled
+	}
+
+	if err := h.prefsRepo.Save(prefs); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save preferences",
+		})
+	}
+
+	return c.JSON(prefs)
+}
+
+// ListImageSenders returns the senders whose images are always shown
+func (h *PreferencesHandler) ListImageSenders(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	senders, err := h.prefsRepo.ListImageSenders(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list image senders",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"senders": senders,
+	})
+}
+
+// AddImageSender always shows images from a sender, even with show_images
+// off. "@example.com" covers every address of the domain.
+func (h *PreferencesHandler) AddImageSender(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req ImageSenderRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	sender, ok := normalizeImageSender(req.Sender)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Sender must be an email address or @domain",
+		})
+	}
+
+	row, err := h.prefsRepo.AddImageSender(userID, sender)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add image sender",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(row)
+}
+
+// RemoveImageSender stops always showing images from a sender
+func (h *PreferencesHandler) RemoveImageSender(c *fiber.Ctx) error {
+	userID, err := auth.GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	sender, err := url.PathUnescape(c.Params("sender"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid sender",
+		})
+	}
+
+	if err := h.prefsRepo.RemoveImageSender(userID, sender); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Image sender not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Image sender removed successfully",
+	})
+}
+
+// normalizeImageSender validates an address or @domain and lower-cases it
+func normalizeImageSender(sender string) (string, bool) {
+	sender = strings.ToLower(strings.TrimSpace(sender))
+	if domain, ok := strings.CutPrefix(sender, "@"); ok {
+		return sender, domain != "" && strings.Contains(domain, ".") && !strings.ContainsAny(domain, "@ ")
+	}
+
+	addr, err := mail.ParseAddress(sender)
+	if err != nil || addr.Address != sender {
+		return "", false
+	}
+	return sender, true
+}
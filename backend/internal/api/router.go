@@ -2,17 +2,33 @@ package api
 
 import (
 	"github.com/gofiber/fiber/v2"
+	"github.com/jay/dadmail/internal/attachments"
 	"github.com/jay/dadmail/internal/auth"
 	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/imageproxy"
+	"github.com/jay/dadmail/internal/mailbody"
+	"github.com/jay/dadmail/internal/mailimport"
 	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/storage"
+	"github.com/jay/dadmail/internal/vault"
 	"github.com/jmoiron/sqlx"
 )
 
 // SetupRoutes configures all API routes
-func SetupRoutes(app *fiber.App, cfg *config.Config, db *sqlx.DB) {
+func SetupRoutes(app *fiber.App, cfg *config.Config, db *sqlx.DB, credVault *vault.Vault, bodyFetcher *mailbody.Fetcher, blobStore storage.BlobStore) {
 	// Initialize services
 	jwtService := auth.NewJWTService(cfg.JWT.Secret, cfg.JWT.AccessTokenTTL, cfg.JWT.RefreshTokenTTL)
 	authHandler := NewAuthHandler(db, cfg)
+	oauthHandler := NewOAuthHandler(db, cfg, credVault)
+	accountHandler := NewAccountHandler(db, cfg, credVault)
+	attachmentStore := attachments.NewStore(db, blobStore)
+	imageProxy := imageproxy.New(&cfg.Email)
+	emailHandler := NewEmailHandler(db, cfg, bodyFetcher, attachmentStore, imageProxy)
+	attachmentHandler := NewAttachmentHandler(db, attachmentStore, bodyFetcher)
+	draftHandler := NewDraftHandler(db, attachmentStore)
+	importHandler := NewImportHandler(db, mailimport.NewStore(db, blobStore, credVault))
+	exportHandler := NewExportHandler(db, blobStore)
+	preferencesHandler := NewPreferencesHandler(db)
 	userRepo := repository.NewUserRepository(db)
 
 	// API v1 group
@@ -25,6 +41,14 @@ func SetupRoutes(app *fiber.App, cfg *config.Config, db *sqlx.DB) {
 	authGroup.Post("/refresh", authHandler.Refresh)
 	authGroup.Post("/logout", authHandler.Logout)
 
+	// Temporary blob URLs of the local storage backend (signed, public)
+	if local, ok := blobStore.(*storage.LocalStore); ok {
+		v1.Get("/blobs/*", NewBlobHandler(local).Get)
+	}
+
+	// Remote email images loaded by the server (signed, public)
+	v1.Get("/images/proxy", NewImageProxyHandler(imageProxy).Get)
+
 	// Protected routes
 	protected := v1.Group("", auth.AuthMiddleware(jwtService))
 
@@ -85,31 +109,78 @@ func SetupRoutes(app *fiber.App, cfg *config.Config, db *sqlx.DB) {
 		})
 	})
 
+	users.Get("/me/preferences", preferencesHandler.Get)
+	users.Patch("/me/preferences", preferencesHandler.Update)
+	users.Get("/me/image-senders", preferencesHandler.ListImageSenders)
+	users.Post("/me/image-senders", preferencesHandler.AddImageSender)
+	users.Delete("/me/image-senders/:sender", preferencesHandler.RemoveImageSender)
+
+	// Account routes (protected)
+	accounts := protected.Group("/accounts")
+	accounts.Get("/oauth/gmail/start", oauthHandler.GmailStart)
+	accounts.Get("/oauth/gmail/callback", oauthHandler.GmailCallback)
+	accounts.Post("/oauth/gmail/callback", oauthHandler.GmailCallback)
+	accounts.Get("/oauth/outlook/start", oauthHandler.OutlookStart)
+	accounts.Get("/oauth/outlook/callback", oauthHandler.OutlookCallback)
+	accounts.Post("/oauth/outlook/callback", oauthHandler.OutlookCallback)
+	accounts.Get("/", accountHandler.List)
+	accounts.Post("/", accountHandler.Create)
+	accounts.Post("/test", accountHandler.TestSettings)
+	accounts.Get("/:id", accountHandler.Get)
+	accounts.Patch("/:id", accountHandler.Update)
+	accounts.Delete("/:id", accountHandler.Delete)
+	accounts.Post("/:id/primary", accountHandler.SetPrimary)
+	accounts.Post("/:id/test", accountHandler.TestAccount)
+
 	// Email routes (protected)
 	emails := protected.Group("/emails")
-	emails.Get("/", func(c *fiber.Ctx) error {
-		return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{
-			"message": "List emails - coming soon",
-		})
-	})
-
-	emails.Get("/:id", func(c *fiber.Ctx) error {
-		return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{
-			"message": "Get email - coming soon",
-		})
-	})
-
-	emails.Post("/", func(c *fiber.Ctx) error {
-		return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{
-			"message": "Send email - coming soon",
-		})
-	})
-
-	emails.Get("/categories/:category", func(c *fiber.Ctx) error {
-		return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{
-			"message": "Get emails by category - coming soon",
-		})
-	})
+	emails.Get("/outbox", emailHandler.ListOutbox)
+	emails.Get("/outbox/:id", emailHandler.GetOutbox)
+	emails.Get("/", emailHandler.List)
+	emails.Get("/search", emailHandler.Search)
+
+	emails.Patch("/", emailHandler.UpdateMany)
+	emails.Delete("/", emailHandler.DeleteMany)
+
+	emails.Get("/:id", emailHandler.Get)
+	emails.Patch("/:id", emailHandler.Update)
+	emails.Delete("/:id", emailHandler.Delete)
+	emails.Get("/:id/attachments", attachmentHandler.List)
+	emails.Get("/:id/attachments/:attachmentId", attachmentHandler.Download)
+	emails.Get("/:id/attachments/:attachmentId/url", attachmentHandler.URL)
+	emails.Post("/:id/reply", emailHandler.Reply)
+	emails.Post("/:id/reply-all", emailHandler.ReplyAll)
+	emails.Post("/:id/forward", emailHandler.Forward)
+
+	emails.Post("/", emailHandler.Send)
+
+	emails.Get("/categories/:category", emailHandler.ListByCategory)
+
+	// Draft routes (protected)
+	drafts := protected.Group("/drafts")
+	drafts.Get("/", draftHandler.List)
+	drafts.Post("/", draftHandler.Create)
+	drafts.Get("/:id", draftHandler.Get)
+	drafts.Patch("/:id", draftHandler.Update)
+	drafts.Delete("/:id", draftHandler.Delete)
+	drafts.Post("/:id/send", draftHandler.Send)
+	drafts.Post("/:id/attachments", draftHandler.AddAttachment)
+	drafts.Delete("/:id/attachments/:attachmentId", draftHandler.RemoveAttachment)
+
+	// Mail import routes (protected)
+	imports := protected.Group("/imports")
+	imports.Get("/", importHandler.List)
+	imports.Post("/", importHandler.Create)
+	imports.Get("/:id", importHandler.Get)
+	imports.Put("/:id/chunks/:index", importHandler.UploadChunk)
+	imports.Post("/:id/start", importHandler.Start)
+
+	// Mailbox export routes (protected)
+	exports := protected.Group("/exports")
+	exports.Get("/", exportHandler.List)
+	exports.Post("/", exportHandler.Create)
+	exports.Get("/:id", exportHandler.Get)
+	exports.Get("/:id/download", exportHandler.Download)
 
 	// Caregiver routes (protected, caregiver role required)
 	caregivers := protected.Group("/caregivers")
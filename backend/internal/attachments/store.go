@@ -0,0 +1,182 @@
+// Package attachments stores the attachments of received emails in object
+// storage. Content is addressed by its SHA-256, so an attachment forwarded
+// around the family is stored once.
+package attachments
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/mimeparse"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/storage"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	collectInterval  = time.Hour
+	collectBatchSize = 200
+	// collectMinAge keeps blobs that were just uploaded but whose attachment
+	// rows are not committed yet
+	collectMinAge = time.Hour
+)
+
+// Store saves and opens attachment content
+type Store struct {
+	objects storage.BlobStore
+	repo    *repository.AttachmentRepository
+}
+
+// NewStore creates a new attachment store
+func NewStore(db *sqlx.DB, objects storage.BlobStore) *Store {
+	return &Store{
+		objects: objects,
+		repo:    repository.NewAttachmentRepository(db),
+	}
+}
+
+// ObjectKey returns the object storage key of content with the given hash
+func ObjectKey(hash string) string {
+	return "attachments/sha256/" + hash
+}
+
+// Save uploads the attachments of a parsed message and records them for
+// the email. Content already in the bucket is not uploaded again.
+func (s *Store) Save(ctx context.Context, emailID uuid.UUID, parts []mimeparse.Attachment) ([]models.Attachment, error) {
+	rows := make([]models.Attachment, 0, len(parts))
+	for _, part := range parts {
+		hash, err := s.Upload(ctx, part.Data, part.ContentType)
+		if err != nil {
+			return nil, err
+		}
+
+		row := models.Attachment{
+			EmailID:     emailID,
+			Part:        part.Part,
+			ContentType: part.ContentType,
+			SizeBytes:   int64(len(part.Data)),
+			IsInline:    part.Inline,
+			SHA256:      hash,
+		}
+		if part.Filename != "" {
+			filename := part.Filename
+			row.Filename = &filename
+		}
+		if part.ContentID != "" {
+			contentID := part.ContentID
+			row.ContentID = &contentID
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return rows, nil
+	}
+	return s.repo.SaveAll(emailID, rows)
+}
+
+// Upload stores content unless the bucket already has it and returns its
+// hash. The caller records the blob in attachment_blobs.
+func (s *Store) Upload(ctx context.Context, data []byte, contentType string) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	exists, err := s.objects.Exists(ctx, ObjectKey(hash))
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		if err := s.objects.Put(ctx, ObjectKey(hash), data, contentType); err != nil {
+			return "", err
+		}
+	}
+
+	return hash, nil
+}
+
+// Open streams the content of an attachment and returns its size. It
+// returns storage.ErrNotFound if the content is missing from the bucket.
+func (s *Store) Open(ctx context.Context, attachment *models.Attachment) (io.ReadCloser, int64, error) {
+	return s.objects.Open(ctx, ObjectKey(attachment.SHA256))
+}
+
+// Read returns the content with the given hash
+func (s *Store) Read(ctx context.Context, hash string) ([]byte, error) {
+	body, _, err := s.objects.Open(ctx, ObjectKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
+
+// URL returns a temporary URL that downloads an attachment without further
+// authentication, for clients such as <img> tags that cannot send tokens
+func (s *Store) URL(ctx context.Context, attachment *models.Attachment, ttl time.Duration, opts storage.URLOptions) (string, error) {
+	return s.objects.URL(ctx, ObjectKey(attachment.SHA256), ttl, opts)
+}
+
+// Collect deletes blobs no attachment refers to any more and returns how
+// many were removed
+func (s *Store) Collect(ctx context.Context) (int, error) {
+	collected := 0
+	for {
+		hashes, err := s.repo.ListUnreferencedBlobs(collectMinAge, collectBatchSize)
+		if err != nil {
+			return collected, err
+		}
+		if len(hashes) == 0 {
+			return collected, nil
+		}
+
+		for _, hash := range hashes {
+			if err := ctx.Err(); err != nil {
+				return collected, err
+			}
+			// The row goes first: if it was referenced again meanwhile it
+			// stays, and a failed object delete only leaves a stray object
+			deleted, err := s.repo.DeleteBlob(hash)
+			if err != nil {
+				return collected, err
+			}
+			if !deleted {
+				continue
+			}
+			if err := s.objects.Delete(ctx, ObjectKey(hash)); err != nil {
+				log.Printf("Failed to delete attachment object %s: %v", hash, err)
+				continue
+			}
+			collected++
+		}
+	}
+}
+
+// RunCollector collects unreferenced blobs periodically until ctx is
+// cancelled
+func (s *Store) RunCollector(ctx context.Context) {
+	ticker := time.NewTicker(collectInterval)
+	defer ticker.Stop()
+
+	for {
+		collected, err := s.Collect(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Attachment garbage collection failed: %v", err)
+		}
+		if collected > 0 {
+			log.Printf("Deleted %d unreferenced attachment objects", collected)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package config
 
 import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 // Config holds all application configuration
@@ -13,6 +17,7 @@ type Config struct {
 	Redis    RedisConfig
 	JWT      JWTConfig
 	Email    EmailConfig
+	Storage  StorageConfig
 }
 
 // ServerConfig holds server-specific configuration
@@ -49,9 +54,44 @@ type JWTConfig struct {
 
 // EmailConfig holds email service configuration
 type EmailConfig struct {
-	GmailClientID     string
-	GmailClientSecret string
-	EncryptionKey     string // AES-256 key for encrypting email credentials
+	GmailClientID       string
+	GmailClientSecret   string
+	GmailAPIURL         string // Gmail REST API base URL
+	GmailAuthURL        string // Google OAuth2 authorization endpoint
+	GmailTokenURL       string // Google OAuth2 token endpoint
+	GmailRedirectURL    string // where Google sends the user after consent
+	OutlookClientID     string
+	OutlookClientSecret string
+	OutlookAPIURL       string // Microsoft Graph API base URL
+	OutlookAuthURL      string // Microsoft identity platform authorization endpoint
+	OutlookTokenURL     string // Microsoft identity platform token endpoint
+	OutlookRedirectURL  string // where Microsoft sends the user after consent
+	// EncryptionKeys is the keyring of AES-256 keys for email credentials, by key ID
+	EncryptionKeys  map[string]string
+	EncryptionKeyID string // ID of the active key new credentials are sealed with
+	SyncInterval    int    // seconds between background sync runs
+	IdleMaxConns    int    // maximum concurrent IMAP IDLE connections per process
+	PushMaxConns    int    // maximum concurrent JMAP push connections per process
+	BodyCacheTTL    int    // hours a fetched message body stays cached
+	BodyCacheMaxMB  int    // total size of the message body cache
+	// Remote images in emails are loaded through the API so senders do not
+	// learn the reader's IP address
+	ImageProxyURL    string // API base URL in proxied image URLs; empty yields relative URLs
+	ImageProxySecret string // signs proxied image URLs
+	ImageProxyMaxMB  int    // largest image the proxy passes through
+}
+
+// StorageConfig holds blob storage configuration
+type StorageConfig struct {
+	Backend   string // s3 or local
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	UseSSL    bool
+	LocalPath string // directory of the local backend
+	PublicURL string // API base URL in temporary URLs of the local backend
+	URLSecret string // signs temporary URLs of the local backend
 }
 
 // Load loads configuration from environment variables
@@ -82,9 +122,38 @@ func Load() (*Config, error) {
 			RefreshTokenTTL: getEnvAsInt("JWT_REFRESH_TTL", 168), // 7 days
 		},
 		Email: EmailConfig{
-			GmailClientID:     getEnv("GMAIL_CLIENT_ID", ""),
-			GmailClientSecret: getEnv("GMAIL_CLIENT_SECRET", ""),
-			EncryptionKey:     getEnv("EMAIL_ENCRYPTION_KEY", ""),
+			GmailClientID:       getEnv("GMAIL_CLIENT_ID", ""),
+			GmailClientSecret:   getEnv("GMAIL_CLIENT_SECRET", ""),
+			GmailAPIURL:         getEnv("GMAIL_API_URL", "https://gmail.googleapis.com"),
+			GmailAuthURL:        getEnv("GMAIL_AUTH_URL", "https://accounts.google.com/o/oauth2/v2/auth"),
+			GmailTokenURL:       getEnv("GMAIL_TOKEN_URL", "https://oauth2.googleapis.com/token"),
+			GmailRedirectURL:    getEnv("GMAIL_REDIRECT_URL", "http://localhost:5173/accounts/oauth/gmail/callback"),
+			OutlookClientID:     getEnv("OUTLOOK_CLIENT_ID", ""),
+			OutlookClientSecret: getEnv("OUTLOOK_CLIENT_SECRET", ""),
+			OutlookAPIURL:       getEnv("OUTLOOK_API_URL", "https://graph.microsoft.com"),
+			OutlookAuthURL:      getEnv("OUTLOOK_AUTH_URL", "https://login.microsoftonline.com/common/oauth2/v2.0/authorize"),
+			OutlookTokenURL:     getEnv("OUTLOOK_TOKEN_URL", "https://login.microsoftonline.com/common/oauth2/v2.0/token"),
+			OutlookRedirectURL:  getEnv("OUTLOOK_REDIRECT_URL", "http://localhost:5173/accounts/oauth/outlook/callback"),
+			EncryptionKeyID:     getEnv("EMAIL_ENCRYPTION_KEY_ID", DefaultEncryptionKeyID),
+			SyncInterval:        getEnvAsInt("EMAIL_SYNC_INTERVAL", 300),
+			IdleMaxConns:        getEnvAsInt("EMAIL_IDLE_MAX_CONNECTIONS", 100),
+			PushMaxConns:        getEnvAsInt("EMAIL_PUSH_MAX_CONNECTIONS", 100),
+			BodyCacheTTL:        getEnvAsInt("EMAIL_BODY_CACHE_TTL_HOURS", 168), // 7 days
+			BodyCacheMaxMB:      getEnvAsInt("EMAIL_BODY_CACHE_MAX_MB", 1024),
+			ImageProxyURL:       getEnv("IMAGE_PROXY_PUBLIC_URL", ""),
+			ImageProxySecret:    getEnv("IMAGE_PROXY_SECRET", ""),
+			ImageProxyMaxMB:     getEnvAsInt("IMAGE_PROXY_MAX_MB", 10),
+		},
+		Storage: StorageConfig{
+			Backend:   getEnv("STORAGE_BACKEND", "s3"),
+			Endpoint:  getEnv("S3_ENDPOINT", "localhost:9000"),
+			AccessKey: getEnv("S3_ACCESS_KEY", ""),
+			SecretKey: getEnv("S3_SECRET_KEY", ""),
+			Bucket:    getEnv("S3_BUCKET", "dadmail-attachments"),
+			UseSSL:    getEnv("S3_USE_SSL", "false") == "true",
+			LocalPath: getEnv("STORAGE_LOCAL_PATH", "./data/blobs"),
+			PublicURL: getEnv("STORAGE_PUBLIC_URL", ""),
+			URLSecret: getEnv("STORAGE_URL_SECRET", ""),
 		},
 	}
 
@@ -95,13 +164,89 @@ func Load() (*Config, error) {
 	if cfg.JWT.Secret == "" {
 		return nil, fmt.Errorf("JWT_SECRET is required")
 	}
-	if cfg.Email.EncryptionKey == "" || len(cfg.Email.EncryptionKey) != 32 {
-		return nil, fmt.Errorf("EMAIL_ENCRYPTION_KEY must be exactly 32 characters (AES-256)")
+	if cfg.Storage.Backend != "s3" && cfg.Storage.Backend != "local" {
+		return nil, fmt.Errorf("STORAGE_BACKEND must be s3 or local")
+	}
+	if cfg.Storage.URLSecret == "" {
+		secret, err := deriveSecret(cfg.JWT.Secret, "dadmail storage URL signing")
+		if err != nil {
+			return nil, err
+		}
+		cfg.Storage.URLSecret = secret
+	}
+	if cfg.Email.ImageProxySecret == "" {
+		secret, err := deriveSecret(cfg.JWT.Secret, "dadmail image proxy URL signing")
+		if err != nil {
+			return nil, err
+		}
+		cfg.Email.ImageProxySecret = secret
+	}
+	keys, err := loadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Email.EncryptionKeys = keys
+	if _, ok := cfg.Email.EncryptionKeys[cfg.Email.EncryptionKeyID]; !ok {
+		return nil, fmt.Errorf("EMAIL_ENCRYPTION_KEY_ID %q is not in the keyring", cfg.Email.EncryptionKeyID)
 	}
 
 	return cfg, nil
 }
 
+// deriveSecret derives a signing secret for one purpose from the JWT
+// secret, so URLs signed with it cannot be turned into session tokens
+func deriveSecret(secret, purpose string) (string, error) {
+	key, err := hkdf.Key(sha256.New, []byte(secret), nil, purpose, 32)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive %s secret: %w", purpose, err)
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// DefaultEncryptionKeyID is the key ID of EMAIL_ENCRYPTION_KEY in the keyring
+const DefaultEncryptionKeyID = "default"
+
+// loadKeyring reads the credential encryption keys. EMAIL_ENCRYPTION_KEYS
+// holds comma separated id:key pairs; EMAIL_ENCRYPTION_KEY, if set, is added
+// under DefaultEncryptionKeyID. Retired keys must stay in the keyring until
+// the re-encryption job has finished with them, which covers imported mail
+// and cached message bodies as well as credentials.
+func loadKeyring() (map[string]string, error) {
+	keys := map[string]string{}
+	for _, entry := range strings.Split(os.Getenv("EMAIL_ENCRYPTION_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, key, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("EMAIL_ENCRYPTION_KEYS entries must be id:key")
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("EMAIL_ENCRYPTION_KEYS has duplicate key ID %q", id)
+		}
+		keys[id] = key
+	}
+
+	if key := os.Getenv("EMAIL_ENCRYPTION_KEY"); key != "" {
+		if _, dup := keys[DefaultEncryptionKeyID]; dup {
+			return nil, fmt.Errorf("EMAIL_ENCRYPTION_KEYS must not redefine key ID %q", DefaultEncryptionKeyID)
+		}
+		keys[DefaultEncryptionKeyID] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("EMAIL_ENCRYPTION_KEY or EMAIL_ENCRYPTION_KEYS is required")
+	}
+	for id, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %q must be exactly 32 characters (AES-256)", id)
+		}
+	}
+
+	return keys, nil
+}
+
 // GetDSN returns the database connection string
 func (c *DatabaseConfig) GetDSN() string {
 	return fmt.Sprintf(
@@ -0,0 +1,60 @@
+// Package drafts keeps a copy of the drafts saved in DadMail in the Drafts
+// folder at the provider, so they also show up in other mail apps.
+package drafts
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+
+	"github.com/jay/dadmail/internal/attachments"
+	"github.com/jay/dadmail/internal/mailer"
+	"github.com/jay/dadmail/internal/models"
+)
+
+// Message renders a draft as it would be sent from account, with the given
+// attachment content. Addresses that do not parse yet are left out, since
+// the user may still be typing them.
+func Message(draft *models.Draft, account *models.EmailAccount, files []mailer.Attachment) *mailer.Message {
+	msg := &mailer.Message{
+		From:        mail.Address{Address: account.EmailAddress},
+		To:          parseLenient(draft.To),
+		Cc:          parseLenient(draft.Cc),
+		Bcc:         parseLenient(draft.Bcc),
+		Subject:     draft.Subject,
+		Text:        draft.Text,
+		HTML:        draft.HTML,
+		Attachments: files,
+	}
+	if account.DisplayName != nil {
+		msg.From.Name = *account.DisplayName
+	}
+	return msg
+}
+
+// LoadAttachments reads the content of draft attachments from storage
+func LoadAttachments(ctx context.Context, store *attachments.Store, list []models.DraftAttachment) ([]mailer.Attachment, error) {
+	files := make([]mailer.Attachment, 0, len(list))
+	for _, att := range list {
+		data, err := store.Read(ctx, att.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read draft attachment %s: %w", att.ID, err)
+		}
+		files = append(files, mailer.Attachment{
+			Filename:    att.Filename,
+			ContentType: att.ContentType,
+			Data:        data,
+		})
+	}
+	return files, nil
+}
+
+func parseLenient(list []string) []mail.Address {
+	var addrs []mail.Address
+	for _, s := range list {
+		if addr, err := mail.ParseAddress(s); err == nil {
+			addrs = append(addrs, *addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,337 @@
+package drafts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/attachments"
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider/gmail"
+	"github.com/jay/dadmail/internal/provider/imap"
+	"github.com/jay/dadmail/internal/provider/jmap"
+	"github.com/jay/dadmail/internal/provider/outlook"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// MaxAttempts is how many times a draft version is tried before syncing
+	// it is given up; the next change tries again
+	MaxAttempts = 8
+
+	pollInterval = 5 * time.Second
+	batchSize    = 20
+	// lease must outlast a single provider call so a draft is never
+	// claimed by two workers at once
+	lease = 5 * time.Minute
+
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = time.Hour
+)
+
+// Worker brings the provider copies of drafts up to date, retrying
+// transient failures with exponential backoff
+type Worker struct {
+	draftRepo   *repository.DraftRepository
+	accountRepo *repository.EmailAccountRepository
+	store       *attachments.Store
+	vault       *vault.Vault
+	gmail       *gmail.Connector
+	outlook     *outlook.Connector
+	jmap        *jmap.Connector
+}
+
+// NewWorker creates a new draft sync worker
+func NewWorker(db *sqlx.DB, cfg *config.EmailConfig, v *vault.Vault, store *attachments.Store) *Worker {
+	return &Worker{
+		draftRepo:   repository.NewDraftRepository(db),
+		accountRepo: repository.NewEmailAccountRepository(db),
+		store:       store,
+		vault:       v,
+		gmail:       gmail.NewConnector(cfg, v),
+		outlook:     outlook.NewConnector(cfg, v),
+		jmap:        jmap.NewConnector(v),
+	}
+}
+
+// Run syncs due drafts until ctx is cancelled
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			processed, err := w.ProcessDue(ctx)
+			if err != nil {
+				log.Printf("Draft sync processing failed: %v", err)
+			}
+			// Keep draining while full batches come back
+			if err != nil || processed < batchSize || ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue claims and syncs one batch of due drafts and returns how many
+// were claimed
+func (w *Worker) ProcessDue(ctx context.Context) (int, error) {
+	drafts, err := w.draftRepo.ClaimDue(batchSize, lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range drafts {
+		w.process(ctx, &drafts[i])
+	}
+
+	return len(drafts), nil
+}
+
+func (w *Worker) process(ctx context.Context, draft *models.Draft) {
+	accountID, draftID, err := w.sync(ctx, draft)
+	if err == nil {
+		if err := w.draftRepo.CompleteSync(draft, accountID, draftID); err != nil {
+			log.Printf("Draft %s was synced but could not be completed: %v", draft.ID, err)
+		}
+		return
+	}
+
+	if isPermanent(err) || draft.SyncAttempts >= MaxAttempts {
+		log.Printf("Draft %s sync failed permanently after %d attempts: %v", draft.ID, draft.SyncAttempts, err)
+		if err := w.draftRepo.MarkSyncFailed(draft, err.Error()); err != nil {
+			log.Printf("Failed to mark draft %s sync failed: %v", draft.ID, err)
+		}
+		return
+	}
+
+	next := time.Now().Add(retryDelay(draft.SyncAttempts))
+	if err := w.draftRepo.MarkSyncRetry(draft, err.Error(), next); err != nil {
+		log.Printf("Failed to schedule sync retry for draft %s: %v", draft.ID, err)
+	}
+}
+
+// sync removes the provider copy of a draft where it no longer belongs and
+// saves the claimed version where it does. It returns the account and ID
+// of the copy, both nil when there is none.
+func (w *Worker) sync(ctx context.Context, draft *models.Draft) (*uuid.UUID, *string, error) {
+	var target *models.EmailAccount
+	if draft.DeletedAt == nil && draft.SyncToProvider {
+		var err error
+		if draft.AccountID != nil {
+			target, err = w.accountRepo.GetByID(*draft.AccountID)
+		} else {
+			target, err = w.accountRepo.GetPrimary(draft.UserID)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("no account to save the draft to (%v): %w", err, errUnsupported)
+		}
+	}
+
+	// A copy in another account than the target, or of a draft that is no
+	// longer synced, is removed. Without an account the copy went with it.
+	previous := ""
+	if draft.ProviderDraftID != nil && draft.ProviderAccountID != nil {
+		if target != nil && target.ID == *draft.ProviderAccountID {
+			previous = *draft.ProviderDraftID
+		} else if err := w.remove(ctx, *draft.ProviderAccountID, *draft.ProviderDraftID); err != nil {
+			return nil, nil, err
+		}
+	}
+	if target == nil {
+		return nil, nil, nil
+	}
+
+	list, err := w.draftRepo.ListAttachments(draft.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := LoadAttachments(ctx, w.store, list)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Every version gets a new Message-ID, which identifies the IMAP copy
+	msg := Message(draft, target, files)
+	raw, err := msg.Build()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build draft (%v): %w", err, errUnsupported)
+	}
+
+	id, err := w.save(ctx, target, raw, msg.MessageID, previous)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &target.ID, &id, nil
+}
+
+// save stores a rendered draft at the provider in place of the copy with
+// the given ID and returns the ID of the new copy
+func (w *Worker) save(ctx context.Context, account *models.EmailAccount, raw []byte, messageID, previous string) (string, error) {
+	switch account.Provider {
+	case gmail.ProviderName:
+		client, err := w.gmail.Client(ctx, account)
+		if err != nil {
+			return "", err
+		}
+		if previous != "" {
+			draft, err := client.UpdateDraft(ctx, previous, raw)
+			if err == nil {
+				return draft.ID, nil
+			}
+			// Deleted in Gmail meanwhile, so save it anew
+			if !gmail.IsNotFound(err) {
+				return "", err
+			}
+		}
+		draft, err := client.CreateDraft(ctx, raw)
+		if err != nil {
+			return "", err
+		}
+		return draft.ID, nil
+	case outlook.ProviderName:
+		// Graph cannot replace the content of a draft with a MIME message,
+		// so a new draft replaces the previous one
+		client, err := w.outlook.Client(ctx, account)
+		if err != nil {
+			return "", err
+		}
+		draft, err := client.CreateDraft(ctx, raw)
+		if err != nil {
+			return "", err
+		}
+		if previous != "" {
+			if err := client.DeleteMessage(ctx, previous); err != nil && !outlook.IsNotFound(err) {
+				log.Printf("Failed to delete replaced Outlook draft of account %s: %v", account.ID, err)
+			}
+		}
+		return draft.ID, nil
+	case jmap.ProviderName:
+		// JMAP emails are immutable, so a new draft replaces the previous one
+		client, err := w.jmap.Client(ctx, account)
+		if err != nil {
+			return "", err
+		}
+		id, err := client.CreateDraft(ctx, raw)
+		if err != nil {
+			return "", err
+		}
+		if previous != "" {
+			if err := client.DeleteEmail(ctx, previous); err != nil && !jmap.IsNotFound(err) {
+				log.Printf("Failed to delete replaced JMAP draft of account %s: %v", account.ID, err)
+			}
+		}
+		return id, nil
+	case imap.ProviderName:
+		creds, err := imap.DecryptCredentials(w.vault, account)
+		if err != nil {
+			return "", err
+		}
+		if err := imap.SaveDraft(creds, raw, previous); err != nil {
+			return "", err
+		}
+		return messageID, nil
+	default:
+		return "", fmt.Errorf("drafts are not supported for provider %s: %w", account.Provider, errUnsupported)
+	}
+}
+
+// remove deletes the copy of a draft from an account. A copy that is
+// already gone needs no change.
+func (w *Worker) remove(ctx context.Context, accountID uuid.UUID, id string) error {
+	account, err := w.accountRepo.GetByID(accountID)
+	if err != nil {
+		return err
+	}
+
+	switch account.Provider {
+	case gmail.ProviderName:
+		client, err := w.gmail.Client(ctx, account)
+		if err != nil {
+			return err
+		}
+		if err := client.DeleteDraft(ctx, id); err != nil && !gmail.IsNotFound(err) {
+			return err
+		}
+		return nil
+	case outlook.ProviderName:
+		client, err := w.outlook.Client(ctx, account)
+		if err != nil {
+			return err
+		}
+		if err := client.DeleteMessage(ctx, id); err != nil && !outlook.IsNotFound(err) {
+			return err
+		}
+		return nil
+	case jmap.ProviderName:
+		client, err := w.jmap.Client(ctx, account)
+		if err != nil {
+			return err
+		}
+		if err := client.DeleteEmail(ctx, id); err != nil && !jmap.IsNotFound(err) {
+			return err
+		}
+		return nil
+	case imap.ProviderName:
+		creds, err := imap.DecryptCredentials(w.vault, account)
+		if err != nil {
+			return err
+		}
+		return imap.DeleteDraft(creds, id)
+	default:
+		return fmt.Errorf("drafts are not supported for provider %s: %w", account.Provider, errUnsupported)
+	}
+}
+
+// errUnsupported marks drafts that can never be synced
+var errUnsupported = errors.New("unsupported draft")
+
+// isPermanent reports whether retrying err cannot succeed: the draft
+// cannot be synced at all, or the Gmail, Graph or JMAP server rejected the
+// request itself
+func isPermanent(err error) bool {
+	if errors.Is(err, errUnsupported) {
+		return true
+	}
+
+	var apiErr *gmail.APIError
+	if errors.As(err, &apiErr) {
+		return isPermanentStatus(apiErr.StatusCode)
+	}
+	var graphErr *outlook.APIError
+	if errors.As(err, &graphErr) {
+		return isPermanentStatus(graphErr.StatusCode)
+	}
+	return jmap.IsPermanent(err)
+}
+
+func isPermanentStatus(status int) bool {
+	return status >= 400 && status < 500 &&
+		status != http.StatusUnauthorized && status != http.StatusTooManyRequests
+}
+
+// retryDelay returns the backoff before the attempt after the given one:
+// 30s, 1m, 2m, 4m ... capped at an hour
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
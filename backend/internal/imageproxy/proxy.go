@@ -0,0 +1,230 @@
+// Package imageproxy loads remote images in emails on behalf of the reader,
+// so senders see the server's address instead of the reader's and cannot
+// tell when or where a message was opened.
+package imageproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/netguard"
+)
+
+// URLPrefix is the API path of proxied images
+const URLPrefix = "/api/v1/images/proxy"
+
+const (
+	// urlTTL is how long a proxied image URL stays valid
+	urlTTL = 24 * time.Hour
+
+	fetchTimeout = 20 * time.Second
+	maxRedirects = 5
+)
+
+var (
+	// ErrInvalidSignature is returned for proxy URLs that were not issued by
+	// this server or have expired
+	ErrInvalidSignature = errors.New("invalid or expired image URL")
+	// ErrNotImage is returned when the remote resource is not a raster image
+	ErrNotImage = errors.New("remote resource is not an image")
+	// ErrTooLarge is returned when the remote image exceeds the size limit
+	ErrTooLarge = errors.New("remote image is too large")
+	// ErrForbiddenAddress is returned when the remote host resolves to a
+	// private, loopback or otherwise internal address
+	ErrForbiddenAddress = netguard.ErrForbiddenAddress
+)
+
+// allowedTypes are the image types passed through. SVG is excluded because
+// it can carry script.
+var allowedTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+	"image/avif": true,
+}
+
+// Proxy signs proxied image URLs and fetches the images they name
+type Proxy struct {
+	publicURL string
+	secret    []byte
+	maxBytes  int64
+	client    *http.Client
+}
+
+// New creates a proxy
+func New(cfg *config.EmailConfig) *Proxy {
+	// The dialer checks every connection, including redirects and every
+	// address a name resolves to
+	dialer := netguard.Dialer(10 * time.Second)
+
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: fetchTimeout,
+		MaxIdleConns:          20,
+		IdleConnTimeout:       time.Minute,
+	}
+
+	return &Proxy{
+		publicURL: strings.TrimRight(cfg.ImageProxyURL, "/"),
+		secret:    []byte(cfg.ImageProxySecret),
+		maxBytes:  int64(cfg.ImageProxyMaxMB) << 20,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   fetchTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxRedirects)
+				}
+				if !allowedScheme(req.URL) {
+					return ErrForbiddenAddress
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// URL returns the signed proxy URL of a remote image. It returns "" for
+// anything but http and https URLs.
+func (p *Proxy) URL(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || !allowedScheme(u) {
+		return ""
+	}
+
+	query := url.Values{}
+	query.Set("url", remote)
+	query.Set("expires", strconv.FormatInt(time.Now().Add(urlTTL).Unix(), 10))
+	query.Set("signature", p.sign(remote, query.Get("expires")))
+
+	return p.publicURL + URLPrefix + "?" + query.Encode()
+}
+
+// Verify checks the signature and expiry of a proxy URL's query and returns
+// the remote URL
+func (p *Proxy) Verify(query url.Values) (string, error) {
+	remote, expires := query.Get("url"), query.Get("expires")
+
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get("signature"))
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(p.sign(remote, expires))
+	if !hmac.Equal(signature, expected) {
+		return "", ErrInvalidSignature
+	}
+
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return "", ErrInvalidSignature
+	}
+
+	return remote, nil
+}
+
+// Image is a fetched remote image. The caller must close Body.
+type Image struct {
+	Body        io.ReadCloser
+	ContentType string
+	Size        int64 // -1 when the server did not say
+}
+
+// Fetch downloads a remote image without cookies or referrer. The body is
+// cut off with an error once it exceeds the size limit.
+func (p *Proxy) Fetch(ctx context.Context, remote string) (*Image, error) {
+	u, err := url.Parse(remote)
+	if err != nil || !allowedScheme(u) {
+		return nil, ErrForbiddenAddress
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build image request: %w", err)
+	}
+	req.Header.Set("User-Agent", "DadMail-ImageProxy/1.0")
+	req.Header.Set("Accept", "image/avif,image/webp,image/png,image/jpeg,image/gif;q=0.9")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrForbiddenAddress) {
+			return nil, ErrForbiddenAddress
+		}
+		return nil, fmt.Errorf("failed to fetch image: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("image server returned %d", resp.StatusCode)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !allowedTypes[strings.ToLower(contentType)] {
+		resp.Body.Close()
+		return nil, ErrNotImage
+	}
+	if resp.ContentLength > p.maxBytes {
+		resp.Body.Close()
+		return nil, ErrTooLarge
+	}
+
+	return &Image{
+		Body:        &limitedBody{body: resp.Body, remaining: p.maxBytes},
+		ContentType: strings.ToLower(contentType),
+		Size:        resp.ContentLength,
+	}, nil
+}
+
+// sign computes the signature of a proxy URL
+func (p *Proxy) sign(remote, expires string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	for _, part := range []string{remote, expires} {
+		mac.Write([]byte(strconv.Itoa(len(part))))
+		mac.Write([]byte{':'})
+		mac.Write([]byte(part))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func allowedScheme(u *url.URL) bool {
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// limitedBody fails once more than remaining bytes have been read
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
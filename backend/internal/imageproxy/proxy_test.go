@@ -0,0 +1,58 @@
+package imageproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jay/dadmail/internal/config"
+)
+
+func newTestProxy() *Proxy {
+	return New(&config.EmailConfig{
+		ImageProxyURL:    "https://mail.example.com",
+		ImageProxySecret: "test secret",
+		ImageProxyMaxMB:  1,
+	})
+}
+
+func TestURLRoundTrip(t *testing.T) {
+	p := newTestProxy()
+	remote := "https://cdn.example.com/kids.jpg?size=large"
+
+	u, err := url.Parse(p.URL(remote))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got, err := p.Verify(u.Query()); err != nil || got != remote {
+		t.Errorf("Verify = %q, %v, want %q", got, err, remote)
+	}
+
+	tampered := u.Query()
+	tampered.Set("url", "https://cdn.example.com/other.jpg")
+	if _, err := p.Verify(tampered); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify of a tampered URL = %v, want ErrInvalidSignature", err)
+	}
+
+	if got := p.URL("javascript:alert(1)"); got != "" {
+		t.Errorf("URL of a javascript: source = %q, want empty", got)
+	}
+}
+
+func TestFetchRefusesInternalAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG"))
+	}))
+	defer srv.Close()
+
+	p := newTestProxy()
+	for _, remote := range []string{srv.URL + "/a.png", "http://[::ffff:127.0.0.1]:1/a.png", "http://100.64.0.1:1/a.png"} {
+		if _, err := p.Fetch(context.Background(), remote); !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("Fetch(%s) error = %v, want ErrForbiddenAddress", remote, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package mailbody
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/storage"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// maxCachedBytes is the largest message that is cached; bigger ones are
+	// always fetched from the provider
+	maxCachedBytes = 10 << 20
+
+	evictInterval  = 15 * time.Minute
+	evictBatchSize = 200
+)
+
+var _ vault.BlobResealer = (*Cache)(nil)
+
+// Cache keeps raw messages encrypted in object storage. Entries expire
+// after the TTL, and the least recently opened entries are evicted when
+// the cache grows beyond its size limit.
+type Cache struct {
+	store    storage.BlobStore
+	repo     *repository.BodyCacheRepository
+	vault    *vault.Vault
+	ttl      time.Duration
+	maxBytes int64
+}
+
+// NewCache creates a new body cache
+func NewCache(db *sqlx.DB, store storage.BlobStore, v *vault.Vault, ttl time.Duration, maxBytes int64) *Cache {
+	return &Cache{
+		store:    store,
+		repo:     repository.NewBodyCacheRepository(db),
+		vault:    v,
+		ttl:      ttl,
+		maxBytes: maxBytes,
+	}
+}
+
+// Get returns the cached raw message of an email, or nil if it is not
+// cached
+func (c *Cache) Get(ctx context.Context, emailID uuid.UUID) ([]byte, error) {
+	entry, err := c.repo.Touch(emailID)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	sealed, err := c.store.Get(ctx, entry.ObjectKey)
+	if err == storage.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c.vault.OpenBlob(blobLabel(emailID), sealed)
+}
+
+// Put caches the raw message of an email. Messages over maxCachedBytes are
+// skipped.
+func (c *Cache) Put(ctx context.Context, emailID uuid.UUID, raw []byte) error {
+	if len(raw) > maxCachedBytes {
+		return nil
+	}
+
+	sealed, err := c.vault.SealBlob(blobLabel(emailID), raw)
+	if err != nil {
+		return err
+	}
+
+	// A fresh key per write keeps a concurrent eviction of the previous
+	// entry from deleting this object
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	key := "bodies/" + emailID.String() + "/" + hex.EncodeToString(suffix)
+
+	if err := c.store.Put(ctx, key, sealed, "application/octet-stream"); err != nil {
+		return err
+	}
+
+	replaced, err := c.repo.Save(emailID, key, int64(len(sealed)), time.Now().Add(c.ttl))
+	if err != nil {
+		_ = c.store.Delete(ctx, key)
+		return err
+	}
+	if replaced != nil && *replaced != key {
+		if err := c.store.Delete(ctx, *replaced); err != nil {
+			log.Printf("Failed to delete replaced body cache object %s: %v", *replaced, err)
+		}
+	}
+
+	return nil
+}
+
+// Reseal drops the account's cached bodies that are not sealed with the
+// active key, rather than re-encrypting them, since they are fetched again
+// when next opened. It returns how many entries were dropped.
+func (c *Cache) Reseal(ctx context.Context, accountID uuid.UUID) (int, error) {
+	dropped := 0
+	after := uuid.Nil
+	for {
+		entries, err := c.repo.ListForAccount(accountID, after, evictBatchSize)
+		if err != nil {
+			return dropped, err
+		}
+		if len(entries) == 0 {
+			return dropped, nil
+		}
+
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return dropped, err
+			}
+			sealed, err := c.store.Get(ctx, entry.ObjectKey)
+			if err != nil && err != storage.ErrNotFound {
+				return dropped, err
+			}
+			if err == nil && !c.vault.BlobNeedsReseal(sealed) {
+				continue
+			}
+
+			// Delete the object first so a failure leaves the row to retry
+			if err := c.store.Delete(ctx, entry.ObjectKey); err != nil {
+				return dropped, err
+			}
+			if err := c.repo.Delete(entry.EmailID, entry.ObjectKey); err != nil {
+				return dropped, err
+			}
+			dropped++
+		}
+		after = entries[len(entries)-1].EmailID
+	}
+}
+
+// Evict deletes expired entries and the least recently opened entries
+// beyond the size limit, and returns how many were removed
+func (c *Cache) Evict(ctx context.Context) (int, error) {
+	evicted := 0
+	for {
+		entries, err := c.repo.ListEvictable(c.maxBytes, evictBatchSize)
+		if err != nil {
+			return evicted, err
+		}
+		if len(entries) == 0 {
+			return evicted, nil
+		}
+
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return evicted, err
+			}
+			// Delete the object first so a failure leaves the row to retry
+			if err := c.store.Delete(ctx, entry.ObjectKey); err != nil {
+				return evicted, err
+			}
+			if err := c.repo.Delete(entry.EmailID, entry.ObjectKey); err != nil {
+				return evicted, err
+			}
+			evicted++
+		}
+	}
+}
+
+// RunEvictor evicts entries periodically until ctx is cancelled
+func (c *Cache) RunEvictor(ctx context.Context) {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+
+	for {
+		evicted, err := c.Evict(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Body cache eviction failed: %v", err)
+		}
+		if evicted > 0 {
+			log.Printf("Evicted %d cached message bodies", evicted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func blobLabel(emailID uuid.UUID) string {
+	return "email_bodies:" + emailID.String()
+}
@@ -0,0 +1,75 @@
+// Package mailbody retrieves full messages, which are not stored in the
+// database, from the provider or from an encrypted cache. Imported mail,
+// which has no provider, is read from the import store.
+package mailbody
+
+import (
+	"context"
+	"log"
+
+	"github.com/jay/dadmail/internal/mailimport"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/storage"
+)
+
+// Fetcher returns the raw RFC 822 source of synced and imported emails
+type Fetcher struct {
+	providers *provider.Registry
+	cache     *Cache
+	imports   *mailimport.Store
+}
+
+// NewFetcher creates a new fetcher. cache may be nil to always fetch from
+// the provider.
+func NewFetcher(providers *provider.Registry, cache *Cache, imports *mailimport.Store) *Fetcher {
+	return &Fetcher{
+		providers: providers,
+		cache:     cache,
+		imports:   imports,
+	}
+}
+
+// Raw returns the raw message of email, which belongs to account. Cache
+// failures are logged and fall back to the provider.
+func (f *Fetcher) Raw(ctx context.Context, account *models.EmailAccount, email *models.Email) ([]byte, error) {
+	// Imported mail is stored for good, so caching it would only copy it
+	if account.Provider == mailimport.ProviderName {
+		raw, err := f.imports.Raw(ctx, email.ID)
+		if err == storage.ErrNotFound {
+			return nil, provider.ErrMessageGone
+		}
+		return raw, err
+	}
+
+	if f.cache != nil {
+		raw, err := f.cache.Get(ctx, email.ID)
+		if err != nil {
+			log.Printf("Failed to read cached body of email %s: %v", email.ID, err)
+		}
+		if raw != nil {
+			return raw, nil
+		}
+	}
+
+	raw, err := f.fetch(ctx, account, email)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.cache != nil {
+		if err := f.cache.Put(ctx, email.ID, raw); err != nil {
+			log.Printf("Failed to cache body of email %s: %v", email.ID, err)
+		}
+	}
+
+	return raw, nil
+}
+
+func (f *Fetcher) fetch(ctx context.Context, account *models.EmailAccount, email *models.Email) ([]byte, error) {
+	p, err := f.providers.Get(account.Provider)
+	if err != nil {
+		return nil, err
+	}
+	return p.FetchMessage(ctx, account, email.ExternalID)
+}
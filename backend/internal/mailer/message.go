@@ -0,0 +1,368 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxLineLength is the length header lines are folded at (RFC 5322 2.1.1)
+const maxLineLength = 78
+
+// ErrInvalidHeader is returned for header text with line breaks or other
+// control characters, which could otherwise add headers of its own, such
+// as a hidden Bcc
+var ErrInvalidHeader = errors.New("header contains control characters")
+
+// Attachment is a file attached to an outgoing message
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	// ContentID marks an inline part the HTML body refers to as cid:
+	ContentID string
+}
+
+// Message is an outgoing email
+type Message struct {
+	From        mail.Address
+	To          []mail.Address
+	Cc          []mail.Address
+	Bcc         []mail.Address
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+
+	// MessageID and Date are generated by Build when empty
+	MessageID string
+	Date      time.Time
+
+	// Threading headers for replies
+	InReplyTo  string
+	References []string
+}
+
+// Recipients returns every envelope recipient, including Bcc
+func (m *Message) Recipients() []string {
+	var rcpts []string
+	seen := map[string]bool{}
+	for _, list := range [][]mail.Address{m.To, m.Cc, m.Bcc} {
+		for _, addr := range list {
+			key := strings.ToLower(addr.Address)
+			if !seen[key] {
+				seen[key] = true
+				rcpts = append(rcpts, addr.Address)
+			}
+		}
+	}
+	return rcpts
+}
+
+// NewMessageID returns a globally unique Message-ID for the given sender
+func NewMessageID(from string) string {
+	domain := "dadmail.local"
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		domain = from[at+1:]
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
+
+// Build renders the message as RFC 5322/MIME. Bcc recipients are not
+// written to the headers. Header text with control characters is rejected
+// with ErrInvalidHeader.
+func (m *Message) Build() ([]byte, error) {
+	if err := m.checkHeaders(); err != nil {
+		return nil, err
+	}
+	if m.MessageID == "" {
+		m.MessageID = NewMessageID(m.From.Address)
+	}
+	if m.Date.IsZero() {
+		m.Date = time.Now()
+	}
+
+	headers := [][2]string{{"From", m.From.String()}}
+	if len(m.To) > 0 {
+		headers = append(headers, [2]string{"To", joinAddresses(m.To)})
+	}
+	if len(m.Cc) > 0 {
+		headers = append(headers, [2]string{"Cc", joinAddresses(m.Cc)})
+	}
+	headers = append(headers,
+		[2]string{"Subject", encodeHeader(m.Subject)},
+		[2]string{"Date", m.Date.Format(time.RFC1123Z)},
+		[2]string{"Message-ID", m.MessageID},
+	)
+	if m.InReplyTo != "" {
+		headers = append(headers, [2]string{"In-Reply-To", m.InReplyTo})
+	}
+	if len(m.References) > 0 {
+		headers = append(headers, [2]string{"References", strings.Join(m.References, " ")})
+	}
+	headers = append(headers, [2]string{"MIME-Version", "1.0"})
+
+	var buf bytes.Buffer
+	for _, h := range headers {
+		if err := writeHeader(&buf, h[0], h[1]); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.writeBody(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// checkHeaders rejects header text before it is encoded, since RFC 2047
+// encoding would hide line breaks that mail clients decode again
+func (m *Message) checkHeaders() error {
+	fields := [][2]string{
+		{"Subject", m.Subject},
+		{"Message-ID", m.MessageID},
+		{"In-Reply-To", m.InReplyTo},
+		{"References", strings.Join(m.References, " ")},
+	}
+	for _, list := range [][]mail.Address{{m.From}, m.To, m.Cc, m.Bcc} {
+		for _, addr := range list {
+			fields = append(fields, [2]string{"address", addr.Name + addr.Address})
+		}
+	}
+	for _, att := range m.Attachments {
+		fields = append(fields, [2]string{"Content-ID", att.ContentID})
+	}
+
+	for _, f := range fields {
+		if !ValidHeaderText(f[1]) {
+			return fmt.Errorf("%w: %s", ErrInvalidHeader, f[0])
+		}
+	}
+	return nil
+}
+
+// ValidHeaderText reports whether s can be used as header text: it has no
+// line breaks or other control characters except tabs
+func ValidHeaderText(s string) bool {
+	for _, r := range s {
+		if r != '\t' && unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeBody writes Content-Type and the body. The structure is
+// multipart/mixed (when there are attachments) around
+// multipart/alternative (when there is both text and HTML).
+func (m *Message) writeBody(buf *bytes.Buffer) error {
+	if len(m.Attachments) == 0 {
+		return m.writeContent(buf, buf)
+	}
+
+	mixed := multipart.NewWriter(buf)
+	if err := writeHeader(buf, "Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mixed.Boundary()})); err != nil {
+		return err
+	}
+	buf.WriteString("\r\n")
+
+	// The body part's own headers are produced by writeContent, so it is
+	// written into a scratch buffer and split into headers and content
+	var part bytes.Buffer
+	if err := m.writeContent(&part, &part); err != nil {
+		return err
+	}
+	header, content, err := splitPart(part.Bytes())
+	if err != nil {
+		return err
+	}
+	w, err := mixed.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+
+	for _, att := range m.Attachments {
+		if err := writeAttachment(mixed, att); err != nil {
+			return err
+		}
+	}
+
+	return mixed.Close()
+}
+
+// writeContent writes the text and/or HTML body including its Content-Type
+// headers
+func (m *Message) writeContent(header io.Writer, body *bytes.Buffer) error {
+	switch {
+	case m.HTML != "" && m.Text != "":
+		alt := multipart.NewWriter(body)
+		if err := writeHeader(header, "Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": alt.Boundary()})); err != nil {
+			return err
+		}
+		body.WriteString("\r\n")
+		if err := writeTextPart(alt, "text/plain", m.Text); err != nil {
+			return err
+		}
+		if err := writeTextPart(alt, "text/html", m.HTML); err != nil {
+			return err
+		}
+		return alt.Close()
+	case m.HTML != "":
+		return writeSinglePart(header, body, "text/html", m.HTML)
+	default:
+		return writeSinglePart(header, body, "text/plain", m.Text)
+	}
+}
+
+func writeSinglePart(header io.Writer, body *bytes.Buffer, contentType, text string) error {
+	if err := writeHeader(header, "Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": "utf-8"})); err != nil {
+		return err
+	}
+	if err := writeHeader(header, "Content-Transfer-Encoding", "quoted-printable"); err != nil {
+		return err
+	}
+	body.WriteString("\r\n")
+	return writeQuotedPrintable(body, text)
+}
+
+func writeTextPart(w *multipart.Writer, contentType, text string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": "utf-8"}))
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	return writeQuotedPrintable(part, text)
+}
+
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(normalizeNewlines(text))); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func writeAttachment(w *multipart.Writer, att Attachment) error {
+	contentType := att.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"name": att.Filename}))
+	disposition := "attachment"
+	if att.ContentID != "" {
+		disposition = "inline"
+		header.Set("Content-ID", "<"+att.ContentID+">")
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": att.Filename}))
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(att.Data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(part, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(part, encoded+"\r\n")
+	return err
+}
+
+// splitPart separates a rendered part into its MIME header and content
+func splitPart(raw []byte) (textproto.MIMEHeader, []byte, error) {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, nil, fmt.Errorf("malformed message part")
+	}
+
+	header := textproto.MIMEHeader{}
+	for _, line := range strings.Split(unfold(string(raw[:end])), "\r\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			header.Add(name, strings.TrimSpace(value))
+		}
+	}
+	return header, raw[end+4:], nil
+}
+
+// writeHeader writes a header field, folding it at whitespace when it is
+// longer than maxLineLength. Values with control characters are rejected
+// so they cannot end the field early.
+func writeHeader(w io.Writer, name, value string) error {
+	if !ValidHeaderText(value) {
+		return fmt.Errorf("%w: %s", ErrInvalidHeader, name)
+	}
+
+	line := name + ": " + value
+	start := len(name) + 2 // never fold inside "Name: "
+	var out strings.Builder
+	for len(line) > maxLineLength {
+		cut := strings.LastIndexAny(line[:maxLineLength], " \t")
+		if cut < start {
+			// A single long word: fold after it (lines may reach 998)
+			next := strings.IndexAny(line[start:], " \t")
+			if next < 0 {
+				break
+			}
+			cut = start + next
+		}
+		out.WriteString(line[:cut] + "\r\n")
+		line = line[cut:]
+		start = 1
+	}
+	out.WriteString(line + "\r\n")
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+func unfold(s string) string {
+	return strings.ReplaceAll(s, "\r\n ", " ")
+}
+
+// encodeHeader applies RFC 2047 encoding to non-ASCII header text
+func encodeHeader(s string) string {
+	for _, r := range s {
+		if r > unicode.MaxASCII {
+			return mime.QEncoding.Encode("utf-8", s)
+		}
+	}
+	return s
+}
+
+func joinAddresses(addrs []mail.Address) string {
+	parts := make([]string, len(addrs))
+	for i := range addrs {
+		parts[i] = addrs[i].String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func normalizeNewlines(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
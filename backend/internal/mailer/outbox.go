@@ -0,0 +1,128 @@
+package mailer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// MaxSendAttempts is how many times a message is tried before it is
+	// marked failed
+	MaxSendAttempts = 8
+
+	outboxPollInterval = 5 * time.Second
+	outboxBatchSize    = 20
+	// outboxLease must outlast a single send (see smtpTimeout) so a message
+	// is never claimed by two workers at once
+	outboxLease = 10 * time.Minute
+
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = time.Hour
+)
+
+// OutboxWorker delivers queued messages, retrying transient failures with
+// exponential backoff
+type OutboxWorker struct {
+	outboxRepo  *repository.OutboxRepository
+	accountRepo *repository.EmailAccountRepository
+	sender      *Sender
+}
+
+// NewOutboxWorker creates a new outbox worker
+func NewOutboxWorker(db *sqlx.DB, sender *Sender) *OutboxWorker {
+	return &OutboxWorker{
+		outboxRepo:  repository.NewOutboxRepository(db),
+		accountRepo: repository.NewEmailAccountRepository(db),
+		sender:      sender,
+	}
+}
+
+// Run delivers due messages until ctx is cancelled
+func (w *OutboxWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			processed, err := w.ProcessDue(ctx)
+			if err != nil {
+				log.Printf("Outbox processing failed: %v", err)
+			}
+			// Keep draining while full batches come back
+			if err != nil || processed < outboxBatchSize || ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue claims and delivers one batch of due messages and returns how
+// many were claimed
+func (w *OutboxWorker) ProcessDue(ctx context.Context) (int, error) {
+	// Sends stop when the lease runs out, before another worker can claim
+	// the batch again
+	ctx, cancel := context.WithTimeout(ctx, outboxLease)
+	defer cancel()
+
+	messages, err := w.outboxRepo.ClaimDue(outboxBatchSize, outboxLease)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range messages {
+		w.deliver(ctx, &messages[i])
+	}
+
+	return len(messages), nil
+}
+
+func (w *OutboxWorker) deliver(ctx context.Context, msg *models.OutboxMessage) {
+	account, err := w.accountRepo.GetByID(msg.AccountID)
+	if err == nil {
+		err = w.sender.SendRaw(ctx, account, msg.FromAddress, msg.Recipients, msg.RawMessage)
+	}
+
+	if err == nil {
+		if err := w.outboxRepo.MarkSent(msg); err != nil {
+			log.Printf("Outbox message %s was sent but could not be marked: %v", msg.ID, err)
+		}
+		return
+	}
+
+	if IsPermanent(err) || msg.Attempts >= MaxSendAttempts {
+		log.Printf("Outbox message %s failed permanently after %d attempts: %v", msg.ID, msg.Attempts, err)
+		if err := w.outboxRepo.MarkFailed(msg, err.Error()); err != nil {
+			log.Printf("Failed to mark outbox message %s failed: %v", msg.ID, err)
+		}
+		return
+	}
+
+	next := time.Now().Add(retryDelay(msg.Attempts))
+	if err := w.outboxRepo.MarkRetry(msg, err.Error(), next); err != nil {
+		log.Printf("Failed to schedule retry for outbox message %s: %v", msg.ID, err)
+	}
+}
+
+// retryDelay returns the backoff before the attempt after the given one:
+// 30s, 1m, 2m, 4m ... capped at an hour
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,266 @@
+package mailer
+
+import (
+	"fmt"
+	"html"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/jay/dadmail/internal/mimeparse"
+)
+
+// maxReferences caps the References header of a reply. The first and the
+// most recent ancestors are kept (RFC 5322 3.6.4 allows trimming).
+const maxReferences = 20
+
+var (
+	replyPrefix   = regexp.MustCompile(`(?i)^\s*re\s*:`)
+	forwardPrefix = regexp.MustCompile(`(?i)^\s*fwd?\s*:`)
+)
+
+// NewReply starts a reply from the given sender to orig, threaded under it.
+// With all, the other recipients of orig are copied, except the sender.
+func NewReply(from mail.Address, orig *mimeparse.Message, all bool) *Message {
+	msg := &Message{
+		From:    from,
+		Subject: ReplySubject(orig.Subject),
+	}
+
+	// Replying to one's own message continues the conversation with the
+	// people it was sent to
+	var to []*mail.Address
+	switch {
+	case orig.From != nil && sameAddress(orig.From.Address, from.Address):
+		to = orig.To
+	case len(orig.ReplyTo) > 0:
+		to = orig.ReplyTo
+	case orig.From != nil:
+		to = []*mail.Address{orig.From}
+	}
+
+	seen := map[string]bool{strings.ToLower(from.Address): true}
+	msg.To = appendAddresses(nil, to, seen)
+	if all {
+		if orig.From != nil {
+			msg.To = appendAddresses(msg.To, []*mail.Address{orig.From}, seen)
+		}
+		msg.Cc = appendAddresses(nil, orig.To, seen)
+		msg.Cc = appendAddresses(msg.Cc, orig.Cc, seen)
+	}
+
+	if orig.MessageID != "" && ValidHeaderText(orig.MessageID) {
+		msg.InReplyTo = "<" + orig.MessageID + ">"
+		msg.References = replyReferences(orig)
+	}
+
+	return msg
+}
+
+// NewForward starts a forward of orig from the given sender. The forward
+// refers to orig but is not a reply, so it has no In-Reply-To.
+func NewForward(from mail.Address, orig *mimeparse.Message) *Message {
+	msg := &Message{
+		From:    from,
+		Subject: ForwardSubject(orig.Subject),
+	}
+	if orig.MessageID != "" && ValidHeaderText(orig.MessageID) {
+		msg.References = []string{"<" + orig.MessageID + ">"}
+	}
+	return msg
+}
+
+// ReplySubject returns subject with a single "Re:" prefix. Control
+// characters of the original subject are replaced.
+func ReplySubject(subject string) string {
+	subject = cleanHeaderText(subject)
+	if replyPrefix.MatchString(subject) {
+		return subject
+	}
+	return "Re: " + subject
+}
+
+// ForwardSubject returns subject with a single "Fwd:" prefix. Control
+// characters of the original subject are replaced.
+func ForwardSubject(subject string) string {
+	subject = cleanHeaderText(subject)
+	if forwardPrefix.MatchString(subject) {
+		return subject
+	}
+	return "Fwd: " + subject
+}
+
+// QuoteReply sets the body to the given text and HTML followed by orig,
+// quoted the way mail clients do. An HTML part is written when either the
+// reply or the original has one.
+func (m *Message) QuoteReply(text, htmlBody string, orig *mimeparse.Message) {
+	attribution := "wrote:"
+	if orig.From != nil {
+		attribution = orig.From.String() + " wrote:"
+	}
+	if !orig.Date.IsZero() {
+		attribution = "On " + orig.Date.Format("Mon, Jan 2, 2006 at 3:04 PM") + ", " + attribution
+	}
+
+	var quoted strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(normalizeLines(orig.PlainText()), "\n"), "\n") {
+		if strings.HasPrefix(line, ">") {
+			quoted.WriteString(">" + line + "\n")
+		} else {
+			quoted.WriteString("> " + line + "\n")
+		}
+	}
+	m.Text = joinBody(text, attribution+"\n"+quoted.String())
+
+	if htmlBody == "" && orig.HTML == "" {
+		m.HTML = ""
+		return
+	}
+	m.HTML = joinHTML(text, htmlBody,
+		`<div>`+html.EscapeString(attribution)+`</div>`+
+			`<blockquote style="margin:0 0 0 .8ex;border-left:1px solid #ccc;padding-left:1ex">`+
+			originalHTML(orig)+`</blockquote>`)
+}
+
+// QuoteForward sets the body to the given text and HTML followed by orig
+// with a summary of its headers
+func (m *Message) QuoteForward(text, htmlBody string, orig *mimeparse.Message) {
+	headers := [][2]string{}
+	if orig.From != nil {
+		headers = append(headers, [2]string{"From", orig.From.String()})
+	}
+	if !orig.Date.IsZero() {
+		headers = append(headers, [2]string{"Date", orig.Date.Format("Mon, Jan 2, 2006 at 3:04 PM")})
+	}
+	headers = append(headers, [2]string{"Subject", orig.Subject})
+	if len(orig.To) > 0 {
+		headers = append(headers, [2]string{"To", listAddresses(orig.To)})
+	}
+	if len(orig.Cc) > 0 {
+		headers = append(headers, [2]string{"Cc", listAddresses(orig.Cc)})
+	}
+
+	const separator = "---------- Forwarded message ----------"
+	var plain strings.Builder
+	plain.WriteString(separator + "\n")
+	for _, h := range headers {
+		plain.WriteString(h[0] + ": " + h[1] + "\n")
+	}
+	plain.WriteString("\n" + normalizeLines(orig.PlainText()))
+	m.Text = joinBody(text, plain.String())
+
+	if htmlBody == "" && orig.HTML == "" {
+		m.HTML = ""
+		return
+	}
+	var rich strings.Builder
+	rich.WriteString(`<div>` + separator + `<br>`)
+	for _, h := range headers {
+		rich.WriteString(`<b>` + h[0] + `:</b> ` + html.EscapeString(h[1]) + `<br>`)
+	}
+	rich.WriteString(`</div><br>` + originalHTML(orig))
+	m.HTML = joinHTML(text, htmlBody, rich.String())
+}
+
+// replyReferences returns the References of a reply to orig: its own
+// references (or the message it replied to) followed by its Message-ID
+func replyReferences(orig *mimeparse.Message) []string {
+	ids := orig.References
+	if len(ids) == 0 && orig.InReplyTo != "" {
+		ids = []string{orig.InReplyTo}
+	}
+	ids = append(append([]string{}, ids...), orig.MessageID)
+	valid := ids[:0]
+	for _, id := range ids {
+		if ValidHeaderText(id) {
+			valid = append(valid, id)
+		}
+	}
+	ids = valid
+	if len(ids) > maxReferences {
+		ids = append(ids[:1], ids[len(ids)-maxReferences+1:]...)
+	}
+
+	refs := make([]string, len(ids))
+	for i, id := range ids {
+		refs[i] = "<" + id + ">"
+	}
+	return refs
+}
+
+// originalHTML returns the (already sanitized) HTML body of orig, or its
+// text as HTML
+func originalHTML(orig *mimeparse.Message) string {
+	if orig.HTML != "" {
+		return orig.HTML
+	}
+	return textToHTML(orig.Text)
+}
+
+func joinBody(text, quoted string) string {
+	text = strings.TrimRight(normalizeLines(text), "\n")
+	if text == "" {
+		return quoted
+	}
+	return text + "\n\n" + quoted
+}
+
+// joinHTML puts the user's HTML, or their text when they wrote no HTML,
+// above the quoted original
+func joinHTML(text, htmlBody, quoted string) string {
+	if htmlBody == "" {
+		htmlBody = textToHTML(strings.TrimRight(normalizeLines(text), "\n"))
+	}
+	if htmlBody == "" {
+		return quoted
+	}
+	return fmt.Sprintf("<div>%s</div><br>%s", htmlBody, quoted)
+}
+
+func textToHTML(text string) string {
+	return strings.ReplaceAll(html.EscapeString(normalizeLines(text)), "\n", "<br>")
+}
+
+func normalizeLines(s string) string {
+	return strings.ReplaceAll(s, "\r\n", "\n")
+}
+
+// appendAddresses adds the addresses not seen yet. Addresses with control
+// characters are dropped and display names cleaned, since they come from
+// the sender of the original.
+func appendAddresses(dst []mail.Address, addrs []*mail.Address, seen map[string]bool) []mail.Address {
+	for _, addr := range addrs {
+		key := strings.ToLower(addr.Address)
+		if addr.Address == "" || seen[key] || !ValidHeaderText(addr.Address) {
+			continue
+		}
+		seen[key] = true
+		dst = append(dst, mail.Address{Name: cleanHeaderText(addr.Name), Address: addr.Address})
+	}
+	return dst
+}
+
+// cleanHeaderText replaces line breaks and other control characters, which
+// a received message can carry in encoded words, with spaces so the text
+// can be copied into the headers of a reply
+func cleanHeaderText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r != '\t' && unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+func listAddresses(addrs []*mail.Address) string {
+	parts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		parts[i] = addr.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func sameAddress(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
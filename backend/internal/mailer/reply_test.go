@@ -0,0 +1,85 @@
+package mailer
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/jay/dadmail/internal/mimeparse"
+)
+
+// injectingOriginal is a received message whose encoded words decode to
+// line breaks followed by a Bcc header
+const injectingOriginal = "From: =?utf-8?Q?Stranger=0D=0ABcc:_evil@z.com?= <stranger@example.com>\r\n" +
+	"To: grandpa@example.com\r\n" +
+	"Cc: =?utf-8?Q?Friend=0ABcc:_evil@z.com?= <friend@example.com>\r\n" +
+	"Subject: =?utf-8?Q?hi=0D=0ABcc:_evil@z.com?=\r\n" +
+	"Message-ID: <orig@example.com>\r\n" +
+	"Date: Sun, 01 Mar 2026 12:00:00 +0000\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+func TestRepliesDropInjectedHeaders(t *testing.T) {
+	orig, err := mimeparse.Parse([]byte(injectingOriginal))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if !strings.Contains(orig.Subject, "\r\n") {
+		t.Fatalf("fixture subject %q does not decode to a line break", orig.Subject)
+	}
+
+	from := mail.Address{Address: "grandpa@example.com"}
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{"reply", NewReply(from, orig, false)},
+		{"reply all", NewReply(from, orig, true)},
+		{"forward", NewForward(from, orig)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "forward" {
+				tt.msg.To = []mail.Address{{Address: "kid@example.com"}}
+			}
+			raw, err := tt.msg.Build()
+			if err != nil {
+				t.Fatalf("Build: %v", err)
+			}
+			header := raw[:bytes.Index(raw, []byte("\r\n\r\n"))]
+			for _, line := range strings.Split(string(header), "\r\n") {
+				if strings.HasPrefix(strings.ToLower(line), "bcc:") {
+					t.Errorf("reply has an injected header %q", line)
+				}
+			}
+			for _, rcpt := range tt.msg.Recipients() {
+				if strings.Contains(rcpt, "evil") {
+					t.Errorf("reply is addressed to %q", rcpt)
+				}
+			}
+		})
+	}
+}
+
+func TestReplySubject(t *testing.T) {
+	tests := []struct {
+		in, reply, forward string
+	}{
+		{"Lunch", "Re: Lunch", "Fwd: Lunch"},
+		{"Re: Lunch", "Re: Lunch", "Fwd: Re: Lunch"},
+		{"FW: Lunch", "Re: FW: Lunch", "FW: Lunch"},
+		{"hi\r\nBcc: evil@z.com", "Re: hi  Bcc: evil@z.com", "Fwd: hi  Bcc: evil@z.com"},
+		{"tab\there", "Re: tab\there", "Fwd: tab\there"},
+	}
+
+	for _, tt := range tests {
+		if got := ReplySubject(tt.in); got != tt.reply {
+			t.Errorf("ReplySubject(%q) = %q, want %q", tt.in, got, tt.reply)
+		}
+		if got := ForwardSubject(tt.in); got != tt.forward {
+			t.Errorf("ForwardSubject(%q) = %q, want %q", tt.in, got, tt.forward)
+		}
+	}
+}
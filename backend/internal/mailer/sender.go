@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+)
+
+// Sender submits outgoing messages through the account's provider
+type Sender struct {
+	providers *provider.Registry
+}
+
+// NewSender creates a new sender
+func NewSender(providers *provider.Registry) *Sender {
+	return &Sender{providers: providers}
+}
+
+// Send renders msg and submits it from account
+func (s *Sender) Send(ctx context.Context, account *models.EmailAccount, msg *Message) error {
+	raw, err := msg.Build()
+	if err != nil {
+		return fmt.Errorf("failed to build message: %w", err)
+	}
+
+	return s.SendRaw(ctx, account, msg.From.Address, msg.Recipients(), raw)
+}
+
+// SendRaw submits an already rendered message from account through its
+// provider: the Gmail, Graph or JMAP API, or the account's SMTP server
+func (s *Sender) SendRaw(ctx context.Context, account *models.EmailAccount, from string, recipients []string, raw []byte) error {
+	p, err := s.providers.Get(account.Provider)
+	if err != nil {
+		return err
+	}
+	return p.Send(ctx, account, from, recipients, raw)
+}
+
+// IsPermanent reports whether a send error will not go away on retry, such
+// as a rejected recipient (SMTP 5xx) or a malformed request (HTTP 4xx)
+func IsPermanent(err error) bool {
+	return provider.IsPermanent(err)
+}
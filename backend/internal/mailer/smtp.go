@@ -0,0 +1,151 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+const (
+	// SecurityTLS connects with implicit TLS (usually port 465)
+	SecurityTLS = "tls"
+	// SecurityStartTLS upgrades a plain connection with STARTTLS (usually port 587)
+	SecurityStartTLS = "starttls"
+	// SecurityNone uses an unencrypted connection (local testing only)
+	SecurityNone = "none"
+
+	smtpTimeout = 2 * time.Minute
+)
+
+// SMTPSettings holds the submission server settings for an account. It
+// mirrors vault.SMTPCredentials.
+type SMTPSettings struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Security string `json:"security"` // tls, starttls, none
+}
+
+// Addr returns the host:port address of the SMTP server
+func (s *SMTPSettings) Addr() string {
+	port := s.Port
+	if port == 0 {
+		port = 587
+		if s.Security == SecurityTLS {
+			port = 465
+		}
+	}
+	return net.JoinHostPort(s.Host, strconv.Itoa(port))
+}
+
+// SubmitSMTP delivers a rendered message to the submission server. STARTTLS
+// is required unless the settings explicitly disable encryption.
+func SubmitSMTP(ctx context.Context, settings *SMTPSettings, from string, recipients []string, raw []byte) error {
+	if len(recipients) == 0 {
+		return fmt.Errorf("message has no recipients")
+	}
+
+	c, err := dialSMTP(ctx, &net.Dialer{Timeout: 30 * time.Second}, settings)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("sender rejected: %w", err)
+	}
+	for _, rcpt := range recipients {
+		if err := c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("recipient %s rejected: %w", rcpt, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("failed to start data: %w", err)
+	}
+	if _, err := w.Write(raw); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("message rejected: %w", err)
+	}
+
+	return c.Quit()
+}
+
+// VerifySMTP checks that the submission server accepts a connection and
+// the configured login without sending anything. It connects through
+// dialer, which lets callers keep user-supplied hosts off private networks.
+func VerifySMTP(ctx context.Context, dialer *net.Dialer, settings *SMTPSettings) error {
+	c, err := dialSMTP(ctx, dialer, settings)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Quit()
+}
+
+// dialSMTP connects to the submission server, starts TLS and
+// authenticates
+func dialSMTP(ctx context.Context, dialer *net.Dialer, settings *SMTPSettings) (*smtp.Client, error) {
+	tlsConfig := &tls.Config{ServerName: settings.Host}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if settings.Security == SecurityTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", settings.Addr())
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", settings.Addr())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", settings.Addr(), err)
+	}
+
+	deadline := time.Now().Add(smtpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, settings.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start SMTP session: %w", err)
+	}
+
+	if settings.Security == SecurityStartTLS || settings.Security == "" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("server does not support STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+
+	// A server that does not offer AUTH would accept the message without
+	// the account's login, so sending with credentials requires it
+	if settings.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("server does not support authentication")
+		}
+		auth := smtp.PlainAuth("", settings.Username, settings.Password, settings.Host)
+		if err := c.Auth(auth); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+
+	return c, nil
+}
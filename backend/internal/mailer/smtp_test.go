@@ -0,0 +1,219 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSink is a minimal in-process SMTP server that records what it
+// receives
+type smtpSink struct {
+	listener net.Listener
+	from     string
+	rcpts    []string
+	data     []byte
+	done     chan struct{}
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	sink := &smtpSink{listener: l, done: make(chan struct{})}
+	go sink.serve()
+	t.Cleanup(func() { l.Close() })
+	return sink
+}
+
+func (s *smtpSink) settings() *SMTPSettings {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return &SMTPSettings{Host: host, Port: p, Security: SecurityNone}
+}
+
+func (s *smtpSink) serve() {
+	defer close(s.done)
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+	reply("220 sink ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250-sink")
+			reply("250 8BITMIME")
+		case "MAIL":
+			s.from = envelopePath(line)
+			reply("250 ok")
+		case "RCPT":
+			s.rcpts = append(s.rcpts, envelopePath(line))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data bytes.Buffer
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			s.data = data.Bytes()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// envelopePath returns the address in angle brackets of a MAIL or RCPT
+// command, dropping parameters such as BODY=8BITMIME
+func envelopePath(line string) string {
+	start, end := strings.Index(line, "<"), strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func TestSubmitSMTPDeliversExactMessage(t *testing.T) {
+	sink := newSMTPSink(t)
+
+	msg := &Message{
+		From:    mail.Address{Name: "Grandpa", Address: "grandpa@example.com"},
+		To:      []mail.Address{{Address: "kid@example.com"}},
+		Cc:      []mail.Address{{Name: "Aunt", Address: "aunt@example.com"}},
+		Bcc:     []mail.Address{{Address: "hidden@example.com"}, {Address: "KID@example.com"}},
+		Subject: "Sunday lunch",
+		Text:    "See you at noon.\n.\nBring the pie.\n",
+		Date:    time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+	}
+	raw, err := msg.Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := SubmitSMTP(ctx, sink.settings(), msg.From.Address, msg.Recipients(), raw); err != nil {
+		t.Fatalf("SubmitSMTP: %v", err)
+	}
+	<-sink.done
+
+	if sink.from != "grandpa@example.com" {
+		t.Errorf("MAIL FROM = %q", sink.from)
+	}
+	wantRcpts := []string{"kid@example.com", "aunt@example.com", "hidden@example.com"}
+	if strings.Join(sink.rcpts, ",") != strings.Join(wantRcpts, ",") {
+		t.Errorf("RCPT TO = %v, want %v", sink.rcpts, wantRcpts)
+	}
+	if !bytes.Equal(sink.data, raw) {
+		t.Errorf("received data differs from the built message:\n%q\nwant\n%q", sink.data, raw)
+	}
+	if bytes.Contains(sink.data, []byte("hidden@example.com")) {
+		t.Errorf("Bcc recipient leaked into the message headers")
+	}
+	if !bytes.Contains(sink.data, []byte("Subject: Sunday lunch\r\n")) {
+		t.Errorf("Subject header missing:\n%s", sink.data)
+	}
+}
+
+func TestSubmitSMTPRequiresAuthWithCredentials(t *testing.T) {
+	sink := newSMTPSink(t)
+	settings := sink.settings()
+	settings.Username = "grandpa@example.com"
+	settings.Password = "secret"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	raw := []byte("Subject: hi\r\n\r\nHello\r\n")
+	err := SubmitSMTP(ctx, settings, "grandpa@example.com", []string{"kid@example.com"}, raw)
+	if err == nil || !strings.Contains(err.Error(), "authentication") {
+		t.Fatalf("SubmitSMTP error = %v, want a missing AUTH error", err)
+	}
+	<-sink.done
+
+	if sink.from != "" || sink.data != nil {
+		t.Errorf("message was submitted without logging in: from %q, data %q", sink.from, sink.data)
+	}
+}
+
+func TestBuildRejectsHeaderInjection(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"subject CRLF", Message{Subject: "hi\r\nBcc: evil@z.com"}},
+		{"subject LF", Message{Subject: "hi\nBcc: evil@z.com"}},
+		{"subject CR", Message{Subject: "hi\rBcc: evil@z.com"}},
+		{"non-ASCII subject CRLF", Message{Subject: "héllo\r\nBcc: evil@z.com"}},
+		{"subject NUL", Message{Subject: "hi\x00there"}},
+		{"display name", Message{From: mail.Address{Name: "Grandpa\r\nBcc: evil@z.com", Address: "grandpa@example.com"}}},
+		{"in-reply-to", Message{InReplyTo: "<a@b>\r\nBcc: evil@z.com"}},
+		{"references", Message{References: []string{"<a@b>", "<c@d>\r\nBcc: evil@z.com"}}},
+		{"content-id", Message{Attachments: []Attachment{{Filename: "a.png", ContentID: "x>\r\nBcc: evil@z.com"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.msg
+			if msg.From.Address == "" {
+				msg.From = mail.Address{Address: "grandpa@example.com"}
+			}
+			msg.To = []mail.Address{{Address: "kid@example.com"}}
+
+			raw, err := msg.Build()
+			if !errors.Is(err, ErrInvalidHeader) {
+				t.Fatalf("Build error = %v, want ErrInvalidHeader; built:\n%s", err, raw)
+			}
+		})
+	}
+}
+
+func TestBuildKeepsTabsInHeaders(t *testing.T) {
+	msg := Message{
+		From:    mail.Address{Address: "grandpa@example.com"},
+		To:      []mail.Address{{Address: "kid@example.com"}},
+		Subject: "a\tb",
+	}
+	if _, err := msg.Build(); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+}
+
+func TestWriteHeaderRejectsControlCharacters(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeHeader(&buf, "Subject", "hi\r\nBcc: evil@z.com"); !errors.Is(err, ErrInvalidHeader) {
+		t.Fatalf("writeHeader error = %v, want ErrInvalidHeader", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("writeHeader wrote %q for a rejected value", buf.String())
+	}
+}
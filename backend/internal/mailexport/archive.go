@@ -0,0 +1,139 @@
+package mailexport
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	// mboxEscape matches a body line that a reader would take for a
+	// message separator, or one that was escaped already (mboxrd)
+	mboxEscape = regexp.MustCompile(`^>*From `)
+
+	// nameUnsafe matches runs of characters left out of file names
+	nameUnsafe = regexp.MustCompile(`[^\p{L}\p{N}._-]+`)
+)
+
+// maxNameLength caps the length of a file name built from a subject or
+// attachment name, in characters
+const maxNameLength = 60
+
+// archive writes the files of an export into a zip archive under unique
+// paths
+type archive struct {
+	zip   *zip.Writer
+	paths map[string]bool
+}
+
+func newArchive(w io.Writer) *archive {
+	return &archive{zip: zip.NewWriter(w), paths: map[string]bool{}}
+}
+
+// create starts a new file in the archive, at name or, if that is taken,
+// at name with a number added. The file must be written in full before the
+// next one is created. It returns the path used.
+func (a *archive) create(name string, modified time.Time) (io.Writer, string, error) {
+	name = a.unique(name)
+
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	if !modified.IsZero() {
+		header.Modified = modified
+	}
+
+	w, err := a.zip.CreateHeader(header)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to add %s to archive: %w", name, err)
+	}
+
+	return w, name, nil
+}
+
+func (a *archive) unique(name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for n := 2; a.paths[candidate]; n++ {
+		candidate = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+	a.paths[candidate] = true
+	return candidate
+}
+
+// close writes the zip directory
+func (a *archive) close() error {
+	if err := a.zip.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	return nil
+}
+
+// writeMbox appends a message to an mbox file in the mboxrd format: a
+// separator line, the message with line endings normalized and separator
+// lines escaped, and a blank line.
+func writeMbox(w io.Writer, sender string, delivered time.Time, raw []byte) error {
+	if sender == "" || strings.ContainsAny(sender, " \t\r\n") {
+		sender = "MAILER-DAEMON"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", sender, delivered.UTC().Format(time.ANSIC))
+
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	raw = bytes.TrimRight(raw, "\n")
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		if mboxEscape.Match(line) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// safeName turns text such as a subject or a category name into a file
+// name, or returns fallback if nothing usable is left
+func safeName(text, fallback string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return '-'
+		}
+		return r
+	}, strings.TrimSpace(text))
+	name = nameUnsafe.ReplaceAllString(name, "")
+	name = strings.Join(strings.FieldsFunc(name, func(r rune) bool { return r == '-' }), "-")
+	name = strings.Trim(name, ".-")
+
+	if runes := []rune(name); len(runes) > maxNameLength {
+		name = strings.TrimRight(string(runes[:maxNameLength]), ".-")
+	}
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+// attachmentName turns an attachment's file name into a safe one, keeping
+// its extension
+func attachmentName(filename, fallback string) string {
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	ext := path.Ext(filename)
+	if len(ext) < 2 || ext == filename || len(ext) > 10 || safeName(ext[1:], "") != ext[1:] {
+		ext = ""
+	}
+
+	base := safeName(strings.TrimSuffix(filename, ext), "")
+	if base == "" {
+		return fallback + ext
+	}
+	return base + ext
+}
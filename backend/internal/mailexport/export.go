@@ -0,0 +1,414 @@
+// Package mailexport writes a user's mailbox into a zip archive they can
+// keep or take elsewhere: the messages as one mbox file per category or as
+// .eml files, the stored attachments, and a manifest.json with the
+// categories, conversations and action items DadMail found.
+package mailexport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/attachments"
+	"github.com/jay/dadmail/internal/mailbody"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// pageSize is how many emails are listed at a time
+	pageSize = 100
+
+	// reportInterval is how often progress is reported while exporting
+	reportInterval = 2 * time.Second
+
+	// maxAccountFailures is how many messages of an account may fail to
+	// download in a row before the rest are left out without trying, so an
+	// unreachable server does not hold up the export for hours
+	maxAccountFailures = 5
+
+	uncategorized = "uncategorized"
+)
+
+// Progress is how far an export has got
+type Progress struct {
+	Total    int
+	Exported int
+	Failed   int
+}
+
+// Exporter writes mailboxes into zip archives
+type Exporter struct {
+	fetcher        *mailbody.Fetcher
+	attachments    *attachments.Store
+	userRepo       *repository.UserRepository
+	accountRepo    *repository.EmailAccountRepository
+	emailRepo      *repository.EmailRepository
+	attachmentRepo *repository.AttachmentRepository
+	categoryRepo   *repository.CategoryRepository
+	threadRepo     *repository.ThreadRepository
+}
+
+// NewExporter creates a new exporter
+func NewExporter(db *sqlx.DB, fetcher *mailbody.Fetcher, attachmentStore *attachments.Store) *Exporter {
+	return &Exporter{
+		fetcher:        fetcher,
+		attachments:    attachmentStore,
+		userRepo:       repository.NewUserRepository(db),
+		accountRepo:    repository.NewEmailAccountRepository(db),
+		emailRepo:      repository.NewEmailRepository(db),
+		attachmentRepo: repository.NewAttachmentRepository(db),
+		categoryRepo:   repository.NewCategoryRepository(db),
+		threadRepo:     repository.NewThreadRepository(db),
+	}
+}
+
+// export holds the state of one archive being written
+type export struct {
+	*Exporter
+	ctx      context.Context
+	format   string
+	archive  *archive
+	manifest *manifest
+	accounts map[uuid.UUID]*models.EmailAccount
+	// accountFailures counts the failed downloads in a row per account
+	accountFailures map[uuid.UUID]int
+	// pending attachments are written after the mail, since zip entries
+	// are written one at a time
+	pending []pendingAttachment
+
+	progress   Progress
+	report     func(Progress)
+	lastReport time.Time
+}
+
+// pendingAttachment is an attachment to write, and its entry in the
+// manifest to complete once written
+type pendingAttachment struct {
+	email      *models.Email
+	attachment models.Attachment
+	manifest   *manifestAttachment
+}
+
+// Export writes the mailbox of the user into w as a zip archive in the
+// given format. report, if not nil, is called periodically with the
+// progress so far. Messages that cannot be downloaded are left out and
+// listed in the manifest; an error is returned only if the export could
+// not continue.
+func (ex *Exporter) Export(ctx context.Context, userID uuid.UUID, format string, w io.Writer, report func(Progress)) (Progress, error) {
+	e := &export{
+		Exporter:        ex,
+		ctx:             ctx,
+		format:          format,
+		archive:         newArchive(w),
+		accounts:        map[uuid.UUID]*models.EmailAccount{},
+		accountFailures: map[uuid.UUID]int{},
+		report:          report,
+		lastReport:      time.Now(),
+	}
+	if err := e.run(userID); err != nil {
+		return e.progress, err
+	}
+	return e.progress, nil
+}
+
+func (e *export) run(userID uuid.UUID) error {
+	user, err := e.userRepo.GetByID(userID)
+	if err != nil {
+		return err
+	}
+	accounts, err := e.accountRepo.ListForUser(userID)
+	if err != nil {
+		return err
+	}
+	categories, err := e.categoryRepo.List()
+	if err != nil {
+		return err
+	}
+	if e.progress.Total, err = e.emailRepo.CountForExport(userID); err != nil {
+		return err
+	}
+
+	e.manifest = &manifest{
+		Version:       manifestVersion,
+		ExportedAt:    time.Now().UTC(),
+		Format:        e.format,
+		User:          manifestUser{ID: user.ID, Email: user.Email, FullName: user.FullName},
+		Accounts:      []manifestAccount{},
+		Categories:    []manifestCategory{},
+		Conversations: []manifestConversation{},
+		ActionItems:   []manifestActionItem{},
+		Emails:        []manifestEmail{},
+		Failures:      []manifestFailure{},
+	}
+	for i := range accounts {
+		account := &accounts[i]
+		e.accounts[account.ID] = account
+		e.manifest.Accounts = append(e.manifest.Accounts, manifestAccount{
+			ID:           account.ID,
+			Provider:     account.Provider,
+			EmailAddress: account.EmailAddress,
+			DisplayName:  account.DisplayName,
+		})
+	}
+
+	for _, category := range categories {
+		entry := manifestCategory{ID: &category.ID, Name: category.Name, Description: category.Description}
+		if err := e.exportCategory(userID, &entry); err != nil {
+			return err
+		}
+	}
+	if err := e.exportCategory(userID, &manifestCategory{Name: uncategorized}); err != nil {
+		return err
+	}
+
+	if err := e.exportAttachments(); err != nil {
+		return err
+	}
+
+	profiles, err := e.threadRepo.ListConversations(userID)
+	if err != nil {
+		return err
+	}
+	e.manifest.addConversations(profiles)
+
+	if err := e.writeManifest(); err != nil {
+		return err
+	}
+	return e.archive.close()
+}
+
+// exportCategory writes the emails of a category, and adds the category to
+// the manifest if it has any
+func (e *export) exportCategory(userID uuid.UUID, category *manifestCategory) error {
+	name := safeName(category.Name, uncategorized)
+
+	var mbox io.Writer
+	var after *repository.EmailCursor
+	for {
+		emails, err := e.emailRepo.ListForExport(userID, category.ID, after, pageSize)
+		if err != nil {
+			return err
+		}
+
+		for i := range emails {
+			if err := e.ctx.Err(); err != nil {
+				return err
+			}
+			email := &emails[i]
+
+			raw, ok := e.download(email)
+			if !ok {
+				continue
+			}
+
+			var file string
+			if e.format == models.ExportMbox {
+				if mbox == nil {
+					if mbox, category.Path, err = e.archive.create(path.Join("mail", name+".mbox"), time.Time{}); err != nil {
+						return err
+					}
+				}
+				if err := writeMbox(mbox, email.FromAddress, email.ReceivedAt, raw); err != nil {
+					return fmt.Errorf("failed to write mbox: %w", err)
+				}
+				file = category.Path
+			} else {
+				if category.Path == "" {
+					category.Path = e.archive.unique(path.Join("mail", name)) + "/"
+				}
+				if file, err = e.writeEML(category.Path, email, raw); err != nil {
+					return err
+				}
+			}
+
+			if err := e.addEmail(email, category.Name, file); err != nil {
+				return err
+			}
+			category.EmailCount++
+		}
+
+		if len(emails) < pageSize {
+			break
+		}
+		last := emails[len(emails)-1]
+		after = &repository.EmailCursor{ReceivedAt: last.ReceivedAt, ID: last.ID}
+	}
+
+	if category.EmailCount > 0 {
+		e.manifest.Categories = append(e.manifest.Categories, *category)
+	}
+	return nil
+}
+
+// download returns the source of an email. A message that cannot be
+// downloaded is recorded as failed and ok is false.
+func (e *export) download(email *models.Email) (raw []byte, ok bool) {
+	account := e.accounts[email.AccountID]
+	if account == nil {
+		e.fail(email, errors.New("account not found"))
+		return nil, false
+	}
+	if e.accountFailures[account.ID] >= maxAccountFailures {
+		e.fail(email, fmt.Errorf("skipped after repeated failures to download from %s", account.EmailAddress))
+		return nil, false
+	}
+
+	raw, err := e.fetcher.Raw(e.ctx, account, email)
+	if err != nil {
+		if e.ctx.Err() == nil {
+			log.Printf("Failed to download email %s for export: %v", email.ID, err)
+		}
+		e.accountFailures[account.ID]++
+		e.fail(email, err)
+		return nil, false
+	}
+
+	e.accountFailures[account.ID] = 0
+	return raw, true
+}
+
+// writeEML writes an email as an .eml file in dir, named by its date and
+// subject
+func (e *export) writeEML(dir string, email *models.Email, raw []byte) (string, error) {
+	subject := ""
+	if email.Subject != nil {
+		subject = *email.Subject
+	}
+	name := fmt.Sprintf("%s_%s.eml", email.ReceivedAt.UTC().Format("2006-01-02"), safeName(subject, "no-subject"))
+
+	w, file, err := e.archive.create(path.Join(dir, name), email.ReceivedAt)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", file, err)
+	}
+	return file, nil
+}
+
+// addEmail lists an exported email in the manifest and queues its stored
+// attachments
+func (e *export) addEmail(email *models.Email, category, file string) error {
+	entry := manifestEmail{
+		ID:         email.ID,
+		AccountID:  email.AccountID,
+		ThreadID:   email.ThreadID,
+		Category:   category,
+		From:       email.FromAddress,
+		FromName:   email.FromName,
+		To:         email.ToAddresses,
+		Cc:         email.CcAddresses,
+		Subject:    email.Subject,
+		ReceivedAt: email.ReceivedAt,
+		IsRead:     email.IsRead,
+		IsStarred:  email.IsStarred,
+		IsArchived: email.IsArchived,
+		Path:       file,
+	}
+
+	if email.HasAttachments {
+		list, err := e.attachmentRepo.ListForEmail(email.ID)
+		if err != nil {
+			return err
+		}
+		entry.Attachments = make([]manifestAttachment, len(list))
+		for i, attachment := range list {
+			entry.Attachments[i] = manifestAttachment{
+				Filename:    attachment.Filename,
+				ContentType: attachment.ContentType,
+				SizeBytes:   attachment.SizeBytes,
+			}
+			e.pending = append(e.pending, pendingAttachment{
+				email:      email,
+				attachment: attachment,
+				manifest:   &entry.Attachments[i],
+			})
+		}
+	}
+
+	e.manifest.Emails = append(e.manifest.Emails, entry)
+	e.progress.Exported++
+	e.reportProgress()
+	return nil
+}
+
+// exportAttachments writes the stored content of the queued attachments.
+// Content missing from storage is recorded as a failure.
+func (e *export) exportAttachments() error {
+	for _, pending := range e.pending {
+		if err := e.ctx.Err(); err != nil {
+			return err
+		}
+		attachment := pending.attachment
+
+		filename := ""
+		if attachment.Filename != nil {
+			filename = *attachment.Filename
+		}
+		name := path.Join("attachments", pending.email.ID.String(), attachmentName(filename, "attachment-"+attachment.Part))
+
+		body, _, err := e.attachments.Open(e.ctx, &attachment)
+		if err != nil {
+			e.manifest.Failures = append(e.manifest.Failures, manifestFailure{
+				EmailID: pending.email.ID,
+				Subject: pending.email.Subject,
+				Path:    name,
+				Error:   err.Error(),
+			})
+			continue
+		}
+
+		w, file, err := e.archive.create(name, pending.email.ReceivedAt)
+		if err == nil {
+			if _, err = io.Copy(w, body); err != nil {
+				err = fmt.Errorf("failed to write %s: %w", file, err)
+			}
+		}
+		body.Close()
+		if err != nil {
+			return err
+		}
+		pending.manifest.Path = file
+	}
+	return nil
+}
+
+func (e *export) writeManifest() error {
+	w, _, err := e.archive.create("manifest.json", time.Time{})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(e.manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// fail records an email left out of the export
+func (e *export) fail(email *models.Email, err error) {
+	e.manifest.Failures = append(e.manifest.Failures, manifestFailure{
+		EmailID: email.ID,
+		Subject: email.Subject,
+		Error:   err.Error(),
+	})
+	e.progress.Failed++
+	e.reportProgress()
+}
+
+func (e *export) reportProgress() {
+	if e.report != nil && time.Since(e.lastReport) >= reportInterval {
+		e.report(e.progress)
+		e.lastReport = time.Now()
+	}
+}
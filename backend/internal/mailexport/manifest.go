@@ -0,0 +1,167 @@
+package mailexport
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+)
+
+// manifestVersion is raised when the layout of manifest.json changes
+const manifestVersion = 1
+
+// manifest describes an export in manifest.json, so the data DadMail keeps
+// beside the messages themselves is not lost
+type manifest struct {
+	Version       int                    `json:"version"`
+	ExportedAt    time.Time              `json:"exported_at"`
+	Format        string                 `json:"format"`
+	User          manifestUser           `json:"user"`
+	Accounts      []manifestAccount      `json:"accounts"`
+	Categories    []manifestCategory     `json:"categories"`
+	Conversations []manifestConversation `json:"conversations"`
+	ActionItems   []manifestActionItem   `json:"action_items"`
+	Emails        []manifestEmail        `json:"emails"`
+	Failures      []manifestFailure      `json:"failures"`
+}
+
+type manifestUser struct {
+	ID       uuid.UUID `json:"id"`
+	Email    string    `json:"email"`
+	FullName string    `json:"full_name"`
+}
+
+type manifestAccount struct {
+	ID           uuid.UUID `json:"id"`
+	Provider     string    `json:"provider"`
+	EmailAddress string    `json:"email_address"`
+	DisplayName  *string   `json:"display_name,omitempty"`
+}
+
+type manifestCategory struct {
+	ID          *uuid.UUID `json:"id,omitempty"` // nil for uncategorized mail
+	Name        string     `json:"name"`
+	Description *string    `json:"description,omitempty"`
+	Path        string     `json:"path,omitempty"` // mbox file or .eml folder
+	EmailCount  int        `json:"email_count"`
+}
+
+type manifestConversation struct {
+	AccountID       uuid.UUID       `json:"account_id"`
+	ThreadID        string          `json:"thread_id"`
+	Subject         *string         `json:"subject,omitempty"`
+	Participants    []string        `json:"participants,omitempty"`
+	Topics          []string        `json:"topics,omitempty"`
+	ImportanceScore int             `json:"importance_score"`
+	ActionItems     json.RawMessage `json:"action_items,omitempty"`
+	LastMessageAt   *time.Time      `json:"last_message_at,omitempty"`
+	Emails          []uuid.UUID     `json:"emails"`
+}
+
+// manifestActionItem is one detected appointment or deadline, with the
+// conversation it was found in
+type manifestActionItem struct {
+	AccountID uuid.UUID       `json:"account_id"`
+	ThreadID  string          `json:"thread_id"`
+	Subject   *string         `json:"subject,omitempty"`
+	Item      json.RawMessage `json:"item"`
+}
+
+type manifestEmail struct {
+	ID          uuid.UUID            `json:"id"`
+	AccountID   uuid.UUID            `json:"account_id"`
+	ThreadID    *string              `json:"thread_id,omitempty"`
+	Category    string               `json:"category"`
+	From        string               `json:"from"`
+	FromName    *string              `json:"from_name,omitempty"`
+	To          []string             `json:"to"`
+	Cc          []string             `json:"cc,omitempty"`
+	Subject     *string              `json:"subject,omitempty"`
+	ReceivedAt  time.Time            `json:"received_at"`
+	IsRead      bool                 `json:"is_read"`
+	IsStarred   bool                 `json:"is_starred"`
+	IsArchived  bool                 `json:"is_archived"`
+	Path        string               `json:"path"`
+	Attachments []manifestAttachment `json:"attachments,omitempty"`
+}
+
+type manifestAttachment struct {
+	Filename    *string `json:"filename,omitempty"`
+	ContentType string  `json:"content_type"`
+	SizeBytes   int64   `json:"size_bytes"`
+	Path        string  `json:"path,omitempty"` // empty if the content was not stored
+}
+
+// manifestFailure is an email or attachment left out of the export
+type manifestFailure struct {
+	EmailID uuid.UUID `json:"email_id"`
+	Subject *string   `json:"subject,omitempty"`
+	Path    string    `json:"path,omitempty"` // set for a missing attachment
+	Error   string    `json:"error"`
+}
+
+// addConversations groups the exported emails into conversations by thread,
+// adding the topics and action items found in each. The email and action
+// item lists of the manifest must be filled in first.
+func (m *manifest) addConversations(profiles []models.Conversation) {
+	type threadKey struct {
+		account uuid.UUID
+		thread  string
+	}
+
+	byThread := map[threadKey]*manifestConversation{}
+	var order []threadKey
+	for _, email := range m.Emails {
+		if email.ThreadID == nil {
+			continue
+		}
+		key := threadKey{email.AccountID, *email.ThreadID}
+		conv := byThread[key]
+		if conv == nil {
+			conv = &manifestConversation{AccountID: email.AccountID, ThreadID: *email.ThreadID, Subject: email.Subject}
+			byThread[key] = conv
+			order = append(order, key)
+		}
+		conv.Emails = append(conv.Emails, email.ID)
+		if conv.LastMessageAt == nil || email.ReceivedAt.After(*conv.LastMessageAt) {
+			received := email.ReceivedAt
+			conv.LastMessageAt = &received
+		}
+	}
+
+	for _, profile := range profiles {
+		conv := byThread[threadKey{profile.AccountID, profile.ThreadID}]
+		if conv == nil {
+			continue
+		}
+		if profile.Subject != nil {
+			conv.Subject = profile.Subject
+		}
+		conv.Participants = profile.Participants
+		conv.Topics = profile.Topics
+		conv.ImportanceScore = profile.ImportanceScore
+
+		if profile.ActionItems == nil {
+			continue
+		}
+		conv.ActionItems = json.RawMessage(*profile.ActionItems)
+
+		var items []json.RawMessage
+		if err := json.Unmarshal(conv.ActionItems, &items); err != nil {
+			items = []json.RawMessage{conv.ActionItems}
+		}
+		for _, item := range items {
+			m.ActionItems = append(m.ActionItems, manifestActionItem{
+				AccountID: conv.AccountID,
+				ThreadID:  conv.ThreadID,
+				Subject:   conv.Subject,
+				Item:      item,
+			})
+		}
+	}
+
+	for _, key := range order {
+		m.Conversations = append(m.Conversations, *byThread[key])
+	}
+}
@@ -0,0 +1,230 @@
+package mailexport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jay/dadmail/internal/attachments"
+	"github.com/jay/dadmail/internal/mailbody"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/storage"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// MaxAttempts is how many times an export is tried before it is marked
+	// failed. Each attempt starts over.
+	MaxAttempts = 3
+
+	// Retention is how long a finished archive can be downloaded before it
+	// is deleted
+	Retention = 7 * 24 * time.Hour
+
+	pollInterval   = 5 * time.Second
+	expireInterval = time.Hour
+	expireBatch    = 100
+
+	// lease is extended whenever progress is saved, so it only has to
+	// outlast uploading the finished archive
+	lease = 30 * time.Minute
+
+	retryBaseDelay = time.Minute
+)
+
+// Worker writes requested exports and deletes them once expired
+type Worker struct {
+	repo     *repository.ExportRepository
+	objects  storage.BlobStore
+	exporter *Exporter
+}
+
+// NewWorker creates a new export worker
+func NewWorker(db *sqlx.DB, fetcher *mailbody.Fetcher, attachmentStore *attachments.Store, objects storage.BlobStore) *Worker {
+	return &Worker{
+		repo:     repository.NewExportRepository(db),
+		objects:  objects,
+		exporter: NewExporter(db, fetcher, attachmentStore),
+	}
+}
+
+// ObjectKey returns the storage key of an export's archive
+func ObjectKey(exp *models.Export) string {
+	return "exports/" + exp.ID.String() + ".zip"
+}
+
+// Filename returns the name an export's archive is downloaded as
+func Filename(exp *models.Export) string {
+	return "dadmail-export-" + exp.CreatedAt.UTC().Format("2006-01-02") + ".zip"
+}
+
+// Run writes due exports until ctx is cancelled
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			processed, err := w.ProcessDue(ctx)
+			if err != nil {
+				log.Printf("Export processing failed: %v", err)
+			}
+			if err != nil || !processed || ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue claims and writes the oldest due export and reports whether
+// there was one
+func (w *Worker) ProcessDue(ctx context.Context) (bool, error) {
+	exp, err := w.repo.ClaimDue(lease)
+	if err != nil || exp == nil {
+		return false, err
+	}
+
+	w.process(ctx, exp)
+	return true, nil
+}
+
+func (w *Worker) process(ctx context.Context, exp *models.Export) {
+	size, err := w.run(ctx, exp)
+	if err == nil {
+		log.Printf("Export %s done: %d emails, %d failed, %d bytes",
+			exp.ID, exp.EmailCount, exp.FailedCount, size)
+		if err := w.repo.Complete(exp, ObjectKey(exp), size, time.Now().Add(Retention)); err != nil {
+			log.Printf("Export %s finished but could not be completed: %v", exp.ID, err)
+		}
+		return
+	}
+
+	if exp.Attempts >= MaxAttempts {
+		log.Printf("Export %s failed permanently after %d attempts: %v", exp.ID, exp.Attempts, err)
+		if err := w.repo.MarkFailed(exp, err.Error()); err != nil {
+			log.Printf("Failed to mark export %s failed: %v", exp.ID, err)
+		}
+		return
+	}
+
+	next := time.Now().Add(retryDelay(exp.Attempts))
+	if err := w.repo.MarkRetry(exp, err.Error(), next); err != nil {
+		log.Printf("Failed to schedule retry for export %s: %v", exp.ID, err)
+	}
+}
+
+// run writes the archive into a temporary file, uploads it and returns its
+// size
+func (w *Worker) run(ctx context.Context, exp *models.Export) (int64, error) {
+	tmp, err := os.CreateTemp("", "dadmail-export-*.zip")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	progress, err := w.exporter.Export(ctx, exp.UserID, exp.Format, tmp, func(progress Progress) {
+		setProgress(exp, progress)
+		if err := w.repo.SaveProgress(exp, lease); err != nil {
+			log.Printf("Failed to save progress of export %s: %v", exp.ID, err)
+		}
+	})
+	setProgress(exp, progress)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.repo.SaveProgress(exp, lease); err != nil {
+		log.Printf("Failed to save progress of export %s: %v", exp.ID, err)
+	}
+
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read temporary file: %w", err)
+	}
+
+	if err := w.objects.PutStream(ctx, ObjectKey(exp), tmp, size, "application/zip"); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Expire deletes the archives of exports past their retention and returns
+// how many were removed
+func (w *Worker) Expire(ctx context.Context) (int, error) {
+	expired := 0
+	for {
+		exports, err := w.repo.ListExpired(expireBatch)
+		if err != nil || len(exports) == 0 {
+			return expired, err
+		}
+
+		for i := range exports {
+			if err := ctx.Err(); err != nil {
+				return expired, err
+			}
+			exp := &exports[i]
+			if exp.ObjectKey != nil {
+				if err := w.objects.Delete(ctx, *exp.ObjectKey); err != nil {
+					return expired, err
+				}
+			}
+			if err := w.repo.MarkExpired(exp.ID); err != nil {
+				return expired, err
+			}
+			expired++
+		}
+	}
+}
+
+// RunExpirer expires exports periodically until ctx is cancelled
+func (w *Worker) RunExpirer(ctx context.Context) {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for {
+		expired, err := w.Expire(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Export expiry failed: %v", err)
+		}
+		if expired > 0 {
+			log.Printf("Deleted %d expired exports", expired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func setProgress(exp *models.Export, progress Progress) {
+	if progress.Total > 0 {
+		exp.EmailTotal = progress.Total
+	}
+	exp.EmailCount = progress.Exported
+	exp.FailedCount = progress.Failed
+}
+
+// retryDelay returns the backoff before the attempt after the given one:
+// 1m, 2m, 4m ...
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+	}
+	return delay
+}
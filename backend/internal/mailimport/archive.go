@@ -0,0 +1,241 @@
+package mailimport
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxMessageBytes is the largest message that is imported; bigger ones are
+// counted as failed
+const maxMessageBytes = 50 << 20
+
+var (
+	// ErrCorrupt marks archives that cannot be read, which no retry fixes
+	ErrCorrupt = errors.New("archive is corrupt")
+
+	errTooLarge = fmt.Errorf("message is larger than %d MB", maxMessageBytes>>20)
+
+	zipMagic = []byte("PK\x03\x04")
+	mboxFrom = []byte("From ")
+	// mboxQuote matches a body line starting with "From " that was
+	// escaped when the mbox was written
+	mboxQuote = regexp.MustCompile(`^>+From `)
+)
+
+// message is one message read from an archive
+type message struct {
+	raw []byte
+	// delivered is the date of the mbox separator line, if any
+	delivered time.Time
+	// err is set instead of raw when the message could not be read
+	err error
+}
+
+// walkFile calls fn for each message of the named file, which is a zip
+// archive of .eml and mbox files, an mbox file or a single message. read is
+// how many bytes of the file have been consumed, for progress reporting.
+func walkFile(filename string, fn func(msg *message, read int64) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat archive: %w", err)
+	}
+
+	head := make([]byte, len(zipMagic))
+	n, _ := io.ReadFull(f, head)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(head[:n], zipMagic):
+		return walkZip(f, info.Size(), fn)
+	case bytes.HasPrefix(head[:n], mboxFrom):
+		return walkMbox(f, fn)
+	default:
+		raw, err := readMessage(f)
+		if err != nil && !errors.Is(err, errTooLarge) {
+			return fmt.Errorf("failed to read message: %w", err)
+		}
+		return fn(&message{raw: raw, err: err}, info.Size())
+	}
+}
+
+// walkZip walks the .eml and mbox files of a zip archive. Other files, such
+// as the metadata macOS adds, are skipped.
+func walkZip(r io.ReaderAt, size int64, fn func(msg *message, read int64) error) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+
+	var done int64
+	for _, file := range zr.File {
+		compressed := int64(file.CompressedSize64)
+		name := path.Base(file.Name)
+		if file.FileInfo().IsDir() || strings.HasPrefix(file.Name, "__MACOSX/") || strings.HasPrefix(name, "._") {
+			done += compressed
+			continue
+		}
+
+		switch strings.ToLower(path.Ext(name)) {
+		case ".eml":
+			rc, err := file.Open()
+			if err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrCorrupt, file.Name, err)
+			}
+			raw, err := readMessage(rc)
+			rc.Close()
+			if err != nil && !errors.Is(err, errTooLarge) {
+				return fmt.Errorf("%w: %s: %v", ErrCorrupt, file.Name, err)
+			}
+			if err := fn(&message{raw: raw, err: err}, done+compressed); err != nil {
+				return err
+			}
+		case ".mbox", ".mbx":
+			rc, err := file.Open()
+			if err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrCorrupt, file.Name, err)
+			}
+			// Progress within the file is estimated from the uncompressed
+			// bytes read, scaled to the compressed size
+			uncompressed := int64(file.UncompressedSize64)
+			err = walkMbox(rc, func(msg *message, read int64) error {
+				if uncompressed > 0 {
+					read = read * compressed / uncompressed
+				}
+				return fn(msg, done+min(read, compressed))
+			})
+			rc.Close()
+			if err != nil {
+				if errors.Is(err, zip.ErrChecksum) || errors.Is(err, io.ErrUnexpectedEOF) {
+					return fmt.Errorf("%w: %s: %v", ErrCorrupt, file.Name, err)
+				}
+				return err
+			}
+		}
+		done += compressed
+	}
+
+	return nil
+}
+
+// walkMbox splits an mbox stream into messages. A message starts at a
+// "From " separator line that follows a blank line or carries a date;
+// lines escaped as ">From " (mboxrd) are unescaped.
+func walkMbox(r io.Reader, fn func(msg *message, read int64) error) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+
+	var (
+		read        int64
+		current     *message
+		buf         bytes.Buffer
+		atLineStart = true
+		prevBlank   = true
+		skipLine    bool // rest of an overlong separator line
+	)
+
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		msg := current
+		current = nil
+		if msg.err == nil {
+			msg.raw = trimSeparatorBlank(append([]byte(nil), buf.Bytes()...))
+		}
+		buf.Reset()
+		return fn(msg, read)
+	}
+
+	for {
+		line, err := br.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return err
+		}
+		read += int64(len(line))
+		startOfLine := atLineStart
+		atLineStart = err == nil
+
+		switch {
+		case skipLine:
+			skipLine = !atLineStart
+		case startOfLine && bytes.HasPrefix(line, mboxFrom) && (prevBlank || !separatorDate(line).IsZero()):
+			if ferr := flush(); ferr != nil {
+				return ferr
+			}
+			current = &message{delivered: separatorDate(line)}
+			skipLine = !atLineStart
+		case current != nil && current.err == nil:
+			if startOfLine && mboxQuote.Match(line) {
+				line = line[1:]
+			}
+			if buf.Len()+len(line) > maxMessageBytes {
+				current.err = errTooLarge
+				buf.Reset()
+			} else {
+				buf.Write(line)
+			}
+		}
+
+		prevBlank = startOfLine && atLineStart && len(bytes.TrimRight(line, "\r\n")) == 0
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return flush()
+}
+
+// separatorDate parses the asctime date of an mbox "From " line, or
+// returns the zero time
+func separatorDate(line []byte) time.Time {
+	fields := strings.Fields(string(line[len(mboxFrom):]))
+	if len(fields) < 6 {
+		return time.Time{}
+	}
+	date, err := time.Parse("Mon Jan 2 15:04:05 2006", strings.Join(fields[len(fields)-5:], " "))
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+// trimSeparatorBlank removes the blank line that separates a message from
+// the next "From " line
+func trimSeparatorBlank(raw []byte) []byte {
+	switch {
+	case bytes.HasSuffix(raw, []byte("\r\n\r\n")):
+		return raw[:len(raw)-2]
+	case bytes.HasSuffix(raw, []byte("\n\n")):
+		return raw[:len(raw)-1]
+	}
+	return raw
+}
+
+// readMessage reads a single message of at most maxMessageBytes
+func readMessage(r io.Reader) ([]byte, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, maxMessageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxMessageBytes {
+		return nil, errTooLarge
+	}
+	return raw, nil
+}
@@ -0,0 +1,226 @@
+// Package mailimport imports historical mail from mbox files and zipped
+// .eml collections into an "import" account that exists only in DadMail.
+// Messages are de-duplicated by Message-ID, so importing an archive twice,
+// or resuming an interrupted import, adds each message once.
+package mailimport
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/mimeparse"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/threading"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// ProviderName identifies the account imported mail is stored under
+const ProviderName = "import"
+
+const (
+	// accountAddress and accountName describe the import account; the
+	// address only keeps it apart from the user's real accounts
+	accountAddress = "import@dadmail.local"
+	accountName    = "Imported mail"
+
+	// reportInterval is how often progress is reported while importing
+	reportInterval = 2 * time.Second
+)
+
+// Progress is how far an import has got
+type Progress struct {
+	BytesTotal     int64
+	BytesProcessed int64
+	Imported       int
+	Duplicates     int
+	Failed         int
+}
+
+// Importer adds the messages of mail archives to a user's import account
+type Importer struct {
+	store       *Store
+	accountRepo *repository.EmailAccountRepository
+	emailRepo   *repository.EmailRepository
+	threadRepo  *repository.ThreadRepository
+}
+
+// NewImporter creates a new importer
+func NewImporter(db *sqlx.DB, store *Store) *Importer {
+	return &Importer{
+		store:       store,
+		accountRepo: repository.NewEmailAccountRepository(db),
+		emailRepo:   repository.NewEmailRepository(db),
+		threadRepo:  repository.NewThreadRepository(db),
+	}
+}
+
+// Account returns the user's import account, creating it if needed
+func (im *Importer) Account(userID uuid.UUID) (*models.EmailAccount, error) {
+	return im.accountRepo.EnsureLocal(userID, ProviderName, accountAddress, accountName)
+}
+
+// ImportFile imports the mbox file, zip archive or single message at the
+// named path for the user. report, if not nil, is called periodically with
+// the progress so far. Messages that cannot be read are counted as failed;
+// an error is returned only if the import could not continue.
+func (im *Importer) ImportFile(ctx context.Context, userID uuid.UUID, name string, report func(Progress)) (Progress, error) {
+	var progress Progress
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return progress, fmt.Errorf("failed to stat archive: %w", err)
+	}
+	progress.BytesTotal = info.Size()
+
+	account, err := im.Account(userID)
+	if err != nil {
+		return progress, err
+	}
+
+	lastReport := time.Now()
+	err = walkFile(name, func(msg *message, read int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		imported, err := im.importMessage(ctx, account.ID, msg)
+		var invalid *invalidError
+		switch {
+		case errors.As(err, &invalid):
+			log.Printf("Skipped unreadable message while importing for user %s: %v", userID, err)
+			progress.Failed++
+		case err != nil:
+			return err
+		case imported:
+			progress.Imported++
+		default:
+			progress.Duplicates++
+		}
+
+		progress.BytesProcessed = read
+		if report != nil && time.Since(lastReport) >= reportInterval {
+			report(progress)
+			lastReport = time.Now()
+		}
+		return nil
+	})
+	if err != nil {
+		return progress, err
+	}
+
+	progress.BytesProcessed = progress.BytesTotal
+	return progress, nil
+}
+
+// invalidError marks a message that cannot be imported, as opposed to a
+// failure of the database or storage
+type invalidError struct {
+	err error
+}
+
+func (e *invalidError) Error() string { return e.err.Error() }
+
+// importMessage stores one message and reports whether it was new
+func (im *Importer) importMessage(ctx context.Context, accountID uuid.UUID, msg *message) (bool, error) {
+	if msg.err != nil {
+		return false, &invalidError{msg.err}
+	}
+	parsed, err := mimeparse.Parse(msg.raw)
+	if err != nil {
+		return false, &invalidError{err}
+	}
+
+	email := toEmail(accountID, msg, parsed)
+	inserted, err := im.emailRepo.Insert(email)
+	if err != nil || !inserted {
+		return false, err
+	}
+
+	// Without its source the email cannot be opened, so it is removed and
+	// left for the next attempt
+	if err := im.store.put(ctx, email.ID, msg.raw); err != nil {
+		if derr := im.emailRepo.DeleteByExternalIDs(accountID, []string{email.ExternalID}); derr != nil {
+			log.Printf("Failed to remove imported email %s without source: %v", email.ID, derr)
+		}
+		return false, err
+	}
+
+	if err := im.emailRepo.SaveBodyText(email.ID, parsed.PlainText()); err != nil {
+		log.Printf("Failed to index body of imported email %s: %v", email.ID, err)
+	}
+
+	thread := threading.NewMessage(parsed.MessageID, parsed.InReplyTo, parsed.References, parsed.Subject, email.ReceivedAt)
+	if _, err := im.threadRepo.Assign(accountID, email.ID, thread); err != nil {
+		log.Printf("Failed to thread imported email %s: %v", email.ID, err)
+	}
+
+	return true, nil
+}
+
+// toEmail converts an imported message into an email row. Imported mail is
+// history, so it is filed as read and archived rather than in the inbox.
+func toEmail(accountID uuid.UUID, msg *message, parsed *mimeparse.Message) *models.Email {
+	email := &models.Email{
+		AccountID:      accountID,
+		ExternalID:     externalID(msg.raw, parsed),
+		ToAddresses:    addressList(parsed.To),
+		CcAddresses:    addressList(parsed.Cc),
+		IsRead:         true,
+		IsArchived:     true,
+		HasAttachments: parsed.HasAttachments(),
+		ReceivedAt:     parsed.Date,
+	}
+
+	if parsed.From != nil {
+		email.FromAddress = parsed.From.Address
+		if name := parsed.From.Name; name != "" {
+			email.FromName = &name
+		}
+	}
+	if subject := parsed.Subject; subject != "" {
+		email.Subject = &subject
+	}
+	if snippet := parsed.Snippet(); snippet != "" {
+		email.Snippet = &snippet
+	}
+	if email.ReceivedAt.IsZero() {
+		email.ReceivedAt = msg.delivered
+	}
+	if email.ReceivedAt.IsZero() {
+		email.ReceivedAt = time.Now()
+	}
+	// Date headers carry the sender's offset; synced mail is sorted in UTC
+	email.ReceivedAt = email.ReceivedAt.UTC()
+
+	return email
+}
+
+// externalID identifies an imported message by its Message-ID, or by its
+// content when it has none
+func externalID(raw []byte, parsed *mimeparse.Message) string {
+	if parsed.MessageID != "" {
+		return "mid:" + threading.Key(parsed.MessageID)
+	}
+	sum := sha256.Sum256(raw)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func addressList(addrs []*mail.Address) pq.StringArray {
+	list := pq.StringArray{}
+	for _, addr := range addrs {
+		if addr.Address != "" {
+			list = append(list, addr.Address)
+		}
+	}
+	return list
+}
@@ -0,0 +1,238 @@
+package mailimport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/storage"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	collectInterval  = time.Hour
+	collectBatchSize = 200
+	// uploadTimeout is how long an upload may stall before its chunks are
+	// deleted and the import fails
+	uploadTimeout = 24 * time.Hour
+)
+
+var _ vault.BlobResealer = (*Store)(nil)
+
+// Store keeps the source of imported messages, and the chunks of uploaded
+// archives, in object storage
+type Store struct {
+	objects storage.BlobStore
+	repo    *repository.ImportRepository
+	vault   *vault.Vault
+}
+
+// NewStore creates a new import store
+func NewStore(db *sqlx.DB, objects storage.BlobStore, v *vault.Vault) *Store {
+	return &Store{
+		objects: objects,
+		repo:    repository.NewImportRepository(db),
+		vault:   v,
+	}
+}
+
+// Raw returns the source of an imported email
+func (s *Store) Raw(ctx context.Context, emailID uuid.UUID) ([]byte, error) {
+	sealed, err := s.objects.Get(ctx, messageKey(emailID))
+	if err != nil {
+		return nil, err
+	}
+	return s.vault.OpenBlob(messageLabel(emailID), sealed)
+}
+
+// put stores the source of an imported email, which must already exist
+func (s *Store) put(ctx context.Context, emailID uuid.UUID, raw []byte) error {
+	sealed, err := s.vault.SealBlob(messageLabel(emailID), raw)
+	if err != nil {
+		return err
+	}
+
+	// The row is written first so the object is collected if the email
+	// goes away before or after the upload
+	key := messageKey(emailID)
+	if err := s.repo.SaveMessage(key, emailID, int64(len(sealed))); err != nil {
+		return err
+	}
+	return s.objects.Put(ctx, key, sealed, "application/octet-stream")
+}
+
+// Reseal re-encrypts the sources of the account's imported emails that are
+// not sealed with the active key, and returns how many it rewrote
+func (s *Store) Reseal(ctx context.Context, accountID uuid.UUID) (int, error) {
+	resealed := 0
+	after := ""
+	for {
+		messages, err := s.repo.ListAccountMessages(accountID, after, collectBatchSize)
+		if err != nil {
+			return resealed, err
+		}
+		if len(messages) == 0 {
+			return resealed, nil
+		}
+
+		for _, msg := range messages {
+			if err := ctx.Err(); err != nil {
+				return resealed, err
+			}
+			ok, err := s.reseal(ctx, msg.ObjectKey, *msg.EmailID)
+			if err != nil {
+				return resealed, fmt.Errorf("imported message %s: %w", *msg.EmailID, err)
+			}
+			if ok {
+				resealed++
+			}
+		}
+		after = messages[len(messages)-1].ObjectKey
+	}
+}
+
+// reseal re-encrypts one stored source if needed and reports whether it did
+func (s *Store) reseal(ctx context.Context, key string, emailID uuid.UUID) (bool, error) {
+	sealed, err := s.objects.Get(ctx, key)
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !s.vault.BlobNeedsReseal(sealed) {
+		return false, nil
+	}
+
+	raw, err := s.vault.OpenBlob(messageLabel(emailID), sealed)
+	if err != nil {
+		return false, err
+	}
+	if sealed, err = s.vault.SealBlob(messageLabel(emailID), raw); err != nil {
+		return false, err
+	}
+	if err := s.objects.Put(ctx, key, sealed, "application/octet-stream"); err != nil {
+		return false, err
+	}
+
+	// If the email was deleted meanwhile the collector may already have
+	// deleted the object and its row, so this write would never be collected
+	live, err := s.repo.ResizeMessage(key, int64(len(sealed)))
+	if err != nil {
+		return false, err
+	}
+	if !live {
+		return false, s.objects.Delete(ctx, key)
+	}
+
+	return true, nil
+}
+
+// PutChunk stores a chunk of an uploaded archive
+func (s *Store) PutChunk(ctx context.Context, imp *models.Import, index int, data []byte) error {
+	return s.objects.Put(ctx, chunkKey(imp.ID, index), data, "application/octet-stream")
+}
+
+// openChunk streams a chunk of an uploaded archive
+func (s *Store) openChunk(ctx context.Context, imp *models.Import, index int) (io.ReadCloser, error) {
+	rc, _, err := s.objects.Open(ctx, chunkKey(imp.ID, index))
+	return rc, err
+}
+
+// DeleteChunks removes the uploaded chunks of an import, including one
+// that was stored but not yet recorded
+func (s *Store) DeleteChunks(ctx context.Context, imp *models.Import) error {
+	for i := 0; i <= imp.ChunkCount; i++ {
+		if err := s.objects.Delete(ctx, chunkKey(imp.ID, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Collect deletes the sources of deleted imported emails and the chunks of
+// abandoned uploads, and returns how many objects were removed
+func (s *Store) Collect(ctx context.Context) (int, error) {
+	deleted := 0
+	for {
+		messages, err := s.repo.ListOrphanedMessages(collectBatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		if len(messages) == 0 {
+			break
+		}
+
+		for _, msg := range messages {
+			if err := ctx.Err(); err != nil {
+				return deleted, err
+			}
+			// Delete the object first so a failure leaves the row to retry
+			if err := s.objects.Delete(ctx, msg.ObjectKey); err != nil {
+				return deleted, err
+			}
+			if err := s.repo.DeleteMessage(msg.ObjectKey); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+
+	abandoned, err := s.repo.ListAbandonedUploads(time.Now().Add(-uploadTimeout), collectBatchSize)
+	if err != nil {
+		return deleted, err
+	}
+	for i := range abandoned {
+		if err := s.DeleteChunks(ctx, &abandoned[i]); err != nil {
+			return deleted, err
+		}
+		if err := s.repo.MarkFailed(&abandoned[i], "Upload was not finished"); err != nil {
+			return deleted, err
+		}
+		deleted += abandoned[i].ChunkCount
+	}
+
+	return deleted, nil
+}
+
+// RunCollector collects unused objects periodically until ctx is cancelled
+func (s *Store) RunCollector(ctx context.Context) {
+	ticker := time.NewTicker(collectInterval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := s.Collect(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Import collection failed: %v", err)
+		}
+		if deleted > 0 {
+			log.Printf("Deleted %d unused import objects", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ChunkKey returns the object storage key of a chunk of an uploaded archive
+func chunkKey(importID uuid.UUID, index int) string {
+	return "imports/uploads/" + importID.String() + "/" + strconv.Itoa(index)
+}
+
+func messageKey(emailID uuid.UUID) string {
+	return "imports/messages/" + emailID.String()
+}
+
+func messageLabel(emailID uuid.UUID) string {
+	return "imported_messages:" + emailID.String()
+}
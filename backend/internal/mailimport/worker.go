@@ -0,0 +1,181 @@
+package mailimport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/storage"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// MaxAttempts is how many times an import is tried before it is marked
+	// failed. Each attempt starts over; messages imported by an earlier
+	// attempt count as duplicates.
+	MaxAttempts = 3
+
+	pollInterval = 5 * time.Second
+	// lease is extended whenever progress is saved, so it only has to
+	// outlast assembling the upload
+	lease = 10 * time.Minute
+
+	retryBaseDelay = time.Minute
+)
+
+// Worker imports uploaded archives
+type Worker struct {
+	repo     *repository.ImportRepository
+	store    *Store
+	importer *Importer
+}
+
+// NewWorker creates a new import worker
+func NewWorker(db *sqlx.DB, store *Store) *Worker {
+	return &Worker{
+		repo:     repository.NewImportRepository(db),
+		store:    store,
+		importer: NewImporter(db, store),
+	}
+}
+
+// Run imports due archives until ctx is cancelled
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			processed, err := w.ProcessDue(ctx)
+			if err != nil {
+				log.Printf("Import processing failed: %v", err)
+			}
+			if err != nil || !processed || ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue claims and runs the oldest due import and reports whether
+// there was one
+func (w *Worker) ProcessDue(ctx context.Context) (bool, error) {
+	imp, err := w.repo.ClaimDue(lease)
+	if err != nil || imp == nil {
+		return false, err
+	}
+
+	w.process(ctx, imp)
+	return true, nil
+}
+
+func (w *Worker) process(ctx context.Context, imp *models.Import) {
+	progress, err := w.run(ctx, imp)
+	setProgress(imp, progress)
+
+	if err == nil {
+		log.Printf("Import %s done: %d imported, %d duplicates, %d failed",
+			imp.ID, progress.Imported, progress.Duplicates, progress.Failed)
+		if err := w.repo.Complete(imp); err != nil {
+			log.Printf("Import %s finished but could not be completed: %v", imp.ID, err)
+			return
+		}
+		w.deleteChunks(imp)
+		return
+	}
+
+	if errors.Is(err, ErrCorrupt) || imp.Attempts >= MaxAttempts {
+		log.Printf("Import %s failed permanently after %d attempts: %v", imp.ID, imp.Attempts, err)
+		if err := w.repo.MarkFailed(imp, err.Error()); err != nil {
+			log.Printf("Failed to mark import %s failed: %v", imp.ID, err)
+			return
+		}
+		w.deleteChunks(imp)
+		return
+	}
+
+	next := time.Now().Add(retryDelay(imp.Attempts))
+	if err := w.repo.MarkRetry(imp, err.Error(), next); err != nil {
+		log.Printf("Failed to schedule retry for import %s: %v", imp.ID, err)
+	}
+}
+
+// run assembles the uploaded chunks into a temporary file and imports it
+func (w *Worker) run(ctx context.Context, imp *models.Import) (Progress, error) {
+	tmp, err := os.CreateTemp("", "dadmail-import-*")
+	if err != nil {
+		return Progress{}, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = w.download(ctx, imp, tmp)
+	if cerr := tmp.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("failed to write temporary file: %w", cerr)
+	}
+	if err != nil {
+		return Progress{}, err
+	}
+
+	return w.importer.ImportFile(ctx, imp.UserID, tmp.Name(), func(progress Progress) {
+		setProgress(imp, progress)
+		if err := w.repo.SaveProgress(imp, lease); err != nil {
+			log.Printf("Failed to save progress of import %s: %v", imp.ID, err)
+		}
+	})
+}
+
+func (w *Worker) download(ctx context.Context, imp *models.Import, dst io.Writer) error {
+	for i := 0; i < imp.ChunkCount; i++ {
+		rc, err := w.store.openChunk(ctx, imp, i)
+		if err == storage.ErrNotFound {
+			return fmt.Errorf("%w: part %d of the upload is missing", ErrCorrupt, i+1)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to download part %d of the upload: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (w *Worker) deleteChunks(imp *models.Import) {
+	if err := w.store.DeleteChunks(context.Background(), imp); err != nil {
+		log.Printf("Failed to delete upload of import %s: %v", imp.ID, err)
+	}
+}
+
+func setProgress(imp *models.Import, progress Progress) {
+	if progress.BytesTotal > 0 {
+		imp.BytesTotal = progress.BytesTotal
+	}
+	imp.BytesProcessed = progress.BytesProcessed
+	imp.Imported = progress.Imported
+	imp.Duplicates = progress.Duplicates
+	imp.Failed = progress.Failed
+}
+
+// retryDelay returns the backoff before the attempt after the given one:
+// 1m, 2m, 4m ...
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+	}
+	return delay
+}
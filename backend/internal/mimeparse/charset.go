@@ -0,0 +1,97 @@
+package mimeparse
+
+import (
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// wordDecoder decodes RFC 2047 encoded words in any charset DecodeCharset
+// understands
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		b, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(DecodeCharset(b, charset)), nil
+	},
+}
+
+// DecodeCharset converts text in the named charset to UTF-8. Unknown
+// charsets and undecodable bytes fall back to the valid UTF-8 in b.
+func DecodeCharset(b []byte, charset string) string {
+	name := strings.ToLower(strings.Trim(strings.TrimSpace(charset), `"`))
+	switch name {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		// Mislabelled 8-bit text is most often Windows-1252
+		if utf8.Valid(b) || name == "utf-8" || name == "utf8" {
+			return strings.ToValidUTF8(string(b), "�")
+		}
+		name = "windows-1252"
+	}
+
+	enc := lookupCharset(name)
+	if enc == nil {
+		return strings.ToValidUTF8(string(b), "�")
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		return strings.ToValidUTF8(string(b), "�")
+	}
+	return string(decoded)
+}
+
+func lookupCharset(name string) encoding.Encoding {
+	candidates := []string{name, strings.ReplaceAll(name, "-", "_"), strings.ReplaceAll(name, "_", "-")}
+	for _, candidate := range candidates {
+		if enc, err := htmlindex.Get(candidate); err == nil {
+			return enc
+		}
+		if enc, err := ianaindex.MIME.Encoding(candidate); err == nil && enc != nil {
+			return enc
+		}
+	}
+	return nil
+}
+
+// DecodeHeader decodes RFC 2047 encoded words in a header value. Raw 8-bit
+// values are treated as UTF-8, falling back to Windows-1252.
+func DecodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		decoded = value
+	}
+	if !utf8.ValidString(decoded) {
+		decoded = DecodeCharset([]byte(decoded), "")
+	}
+	return decoded
+}
+
+// ParseAddress parses a single address header, decoding encoded display
+// names
+func ParseAddress(value string) (*mail.Address, error) {
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	return parser.Parse(value)
+}
+
+// ParseAddressList parses an address list header, decoding encoded display
+// names. Unparseable lists yield nil.
+func ParseAddressList(value string) []*mail.Address {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	addrs, err := parser.ParseList(value)
+	if err != nil {
+		return nil
+	}
+	return addrs
+}
@@ -0,0 +1,164 @@
+package mimeparse
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFixtures(t *testing.T) {
+	tests := []struct {
+		file        string
+		subject     string
+		fromName    string
+		text        string
+		html        string
+		attachments []Attachment
+	}{
+		{
+			file:     "simple-utf8.eml",
+			subject:  "Photos from the weekend 🍖",
+			fromName: "Renée Dupont",
+			text:     "Hi Grandpa,\n\nThe café was lovely. See you Sunday!\nRenée\n",
+		},
+		{
+			file:     "alternative-qp.eml",
+			subject:  "Dinner",
+			fromName: "Sam",
+			text:     "Dinner is at 7 o'clock — don't be late. Café au lait afterwards.\n",
+			html:     `<p style="color: #333">Dinner is at <b>7 o&#39;clock</b> — don&#39;t be late.</p>click` + "\n",
+		},
+		{
+			file:     "windows-1252.eml",
+			subject:  "Your prescription is ready",
+			fromName: "Pharmacy",
+			text:     "Your prescription is ready – pick it up at the counter. Total: €12.50 “Thank you”\n",
+		},
+		{
+			file:     "iso-8859-2.eml",
+			subject:  "Zażółć gęślą jaźń",
+			fromName: "Paweł Nowak",
+			text:     "Dzień dobry! Spotkanie w środę.\n",
+		},
+		{
+			file:     "shift-jis.eml",
+			subject:  "お元気ですか",
+			fromName: "田中",
+			text:     "こんにちは。来週お会いしましょう。\n",
+		},
+		{
+			file:     "inline-cid.eml",
+			subject:  "New baby photo",
+			fromName: "Anna",
+			html:     `<p>Look at her!</p><img src="cid:baby@example.com" alt="baby">`,
+			attachments: []Attachment{
+				{Part: "2", Filename: "baby.png", ContentType: "image/png", Size: 70, ContentID: "baby@example.com", Inline: true},
+			},
+		},
+		{
+			file:     "nested-attachment.eml",
+			subject:  "Appointment letter",
+			fromName: "Clinic",
+			text:     "Your appointment letter is attached.",
+			html:     "<p>Your appointment letter is <i>attached</i>.</p>",
+			attachments: []Attachment{
+				{Part: "2", Filename: "Résumé letter.pdf", ContentType: "application/pdf", Size: 36},
+			},
+		},
+		{
+			file:     "forwarded-rfc822.eml",
+			subject:  "Fwd: Flight details",
+			fromName: "Mike",
+			text:     "See below, this is the flight we talked about.",
+			attachments: []Attachment{
+				{Part: "2", Filename: "Your booking AB123.eml", ContentType: "message/rfc822", Size: 223},
+			},
+		},
+	}
+
+	files, err := filepath.Glob(filepath.Join("testdata", "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(tests) {
+		t.Errorf("testdata has %d fixtures, the table covers %d", len(files), len(tests))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			raw, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := Parse(raw)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+
+			if msg.Subject != tt.subject {
+				t.Errorf("Subject = %q, want %q", msg.Subject, tt.subject)
+			}
+			if msg.From == nil || msg.From.Name != tt.fromName {
+				t.Errorf("From = %v, want name %q", msg.From, tt.fromName)
+			}
+			if msg.Text != tt.text {
+				t.Errorf("Text = %q, want %q", msg.Text, tt.text)
+			}
+			if msg.HTML != tt.html {
+				t.Errorf("HTML = %q, want %q", msg.HTML, tt.html)
+			}
+
+			if len(msg.Attachments) != len(tt.attachments) {
+				t.Fatalf("got %d attachments, want %d: %+v", len(msg.Attachments), len(tt.attachments), msg.Attachments)
+			}
+			for i, want := range tt.attachments {
+				got := msg.Attachments[i]
+				if len(got.Data) != got.Size {
+					t.Errorf("attachment %s: Size = %d, but %d bytes decoded", got.Part, got.Size, len(got.Data))
+				}
+				got.Data = nil
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("attachment %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSanitizesHTML(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "alternative-qp.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	for _, unsafe := range []string{"<script", "alert", "javascript:", "<html", "<body"} {
+		if strings.Contains(msg.HTML, unsafe) {
+			t.Errorf("sanitized HTML contains %q: %s", unsafe, msg.HTML)
+		}
+	}
+}
+
+func TestParseThreadingHeaders(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "nested-attachment.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if msg.MessageID != "nested-1@clinic.example" || msg.InReplyTo != "b@clinic.example" {
+		t.Errorf("Message-ID = %q, In-Reply-To = %q", msg.MessageID, msg.InReplyTo)
+	}
+	if strings.Join(msg.References, " ") != "a@clinic.example b@clinic.example" {
+		t.Errorf("References = %q", msg.References)
+	}
+	if !msg.HasAttachments() {
+		t.Errorf("HasAttachments = false")
+	}
+}
@@ -0,0 +1,329 @@
+// Package mimeparse turns raw RFC 5322 messages into readable text, sanitized
+// HTML and an attachment manifest.
+//
+// Parsing is lenient: malformed parts are skipped and whatever was read
+// before them is kept, because a partially readable message is more useful
+// than an error.
+package mimeparse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jay/dadmail/internal/sanitize"
+)
+
+// maxPartDepth bounds multipart and message/rfc822 nesting
+const maxPartDepth = 10
+
+// Message is a parsed message
+type Message struct {
+	Subject     string          `json:"subject,omitempty"`
+	From        *mail.Address   `json:"from,omitempty"`
+	To          []*mail.Address `json:"to,omitempty"`
+	Cc          []*mail.Address `json:"cc,omitempty"`
+	ReplyTo     []*mail.Address `json:"reply_to,omitempty"`
+	Date        time.Time       `json:"date"`
+	MessageID   string          `json:"message_id,omitempty"`
+	InReplyTo   string          `json:"in_reply_to,omitempty"`
+	References  []string        `json:"references,omitempty"`
+	Text        string          `json:"text,omitempty"`
+	HTML        string          `json:"html,omitempty"` // sanitized
+	Attachments []Attachment    `json:"attachments"`
+}
+
+// Attachment describes a non-body part. Inline parts are images referenced
+// from the HTML body by cid: URL.
+type Attachment struct {
+	Part        string `json:"part"` // dotted part path, e.g. "2.1"
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	ContentID   string `json:"content_id,omitempty"`
+	Inline      bool   `json:"inline"`
+	Data        []byte `json:"-"`
+}
+
+// Parse parses a raw message
+func Parse(raw []byte) (*Message, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message: %w", err)
+	}
+
+	m := &Message{Attachments: []Attachment{}}
+	m.readHeader(msg.Header)
+
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message body: %w", err)
+	}
+
+	w := &walker{msg: m}
+	w.walk(textproto.MIMEHeader(msg.Header), body, "", "", 0)
+	m.Text = w.text
+	m.HTML = sanitize.HTML(w.html)
+
+	return m, nil
+}
+
+// HasAttachments reports whether the message has any non-inline attachment
+func (m *Message) HasAttachments() bool {
+	for _, a := range m.Attachments {
+		if !a.Inline {
+			return true
+		}
+	}
+	return false
+}
+
+// PlainText returns the text body, or the text of the HTML body when the
+// message has no text part
+func (m *Message) PlainText() string {
+	if strings.TrimSpace(m.Text) != "" {
+		return m.Text
+	}
+	return HTMLToText(m.HTML)
+}
+
+// Snippet returns a short preview of the body
+func (m *Message) Snippet() string {
+	return Snippet(m.PlainText())
+}
+
+// Attachment returns the attachment at the given part path
+func (m *Message) Attachment(part string) (*Attachment, bool) {
+	for i := range m.Attachments {
+		if m.Attachments[i].Part == part {
+			return &m.Attachments[i], true
+		}
+	}
+	return nil, false
+}
+
+func (m *Message) readHeader(h mail.Header) {
+	m.Subject = DecodeHeader(h.Get("Subject"))
+	if from := ParseAddressList(h.Get("From")); len(from) > 0 {
+		m.From = from[0]
+	}
+	m.To = ParseAddressList(h.Get("To"))
+	m.Cc = ParseAddressList(h.Get("Cc"))
+	m.ReplyTo = ParseAddressList(h.Get("Reply-To"))
+	if date, err := h.Date(); err == nil {
+		m.Date = date
+	}
+	m.MessageID = firstMessageID(h.Get("Message-Id"))
+	m.InReplyTo = firstMessageID(h.Get("In-Reply-To"))
+	m.References = MessageIDs(h.Get("References"))
+}
+
+// MessageIDs extracts the <id> tokens of a Message-ID style header,
+// without angle brackets
+func MessageIDs(value string) []string {
+	var ids []string
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			return ids
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			return ids
+		}
+		if id := strings.TrimSpace(value[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+}
+
+func firstMessageID(value string) string {
+	if ids := MessageIDs(value); len(ids) > 0 {
+		return ids[0]
+	}
+	return strings.TrimSpace(value)
+}
+
+// IsAttachment reports whether a part with the given media type, disposition,
+// filename and Content-ID is shown to the user as an attachment. Parts
+// referenced by Content-ID are inline unless explicitly disposed as
+// attachments, and unnamed text parts are body text.
+func IsAttachment(mediaType, disposition, filename, contentID string) bool {
+	mediaType = strings.ToLower(mediaType)
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return false
+	case strings.EqualFold(disposition, "attachment"):
+		return true
+	case contentID != "":
+		return false
+	case filename != "":
+		return true
+	case mediaType == "" || strings.HasPrefix(mediaType, "text/"):
+		return false
+	}
+	return true
+}
+
+// walker collects the body and attachments while walking the part tree
+type walker struct {
+	msg  *Message
+	text string
+	html string
+}
+
+func (w *walker) walk(header textproto.MIMEHeader, body []byte, path, parentType string, depth int) {
+	defaultType := "text/plain"
+	if parentType == "multipart/digest" {
+		defaultType = "message/rfc822"
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType == "" {
+		mediaType, params = defaultType, map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth < maxPartDepth && params["boundary"] != "" {
+			w.walkMultipart(body, params["boundary"], path, mediaType, depth)
+		}
+		return
+	}
+
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := DecodeHeader(dispParams["filename"])
+	if filename == "" {
+		filename = DecodeHeader(params["name"])
+	}
+	contentID := strings.Trim(strings.TrimSpace(header.Get("Content-Id")), "<>")
+	data := decodeTransfer(body, header.Get("Content-Transfer-Encoding"))
+
+	if path == "" {
+		path = "1"
+	}
+
+	isText := mediaType == "text/plain" || mediaType == "text/html"
+	if isText && !IsAttachment(mediaType, disposition, filename, contentID) {
+		text := strings.ReplaceAll(DecodeCharset(data, params["charset"]), "\r\n", "\n")
+		w.addText(mediaType, text, parentType == "multipart/alternative")
+		return
+	}
+
+	attachment := Attachment{
+		Part:        path,
+		Filename:    filename,
+		ContentType: mediaType,
+		Size:        len(data),
+		ContentID:   contentID,
+		Inline:      !IsAttachment(mediaType, disposition, filename, contentID),
+		Data:        data,
+	}
+
+	if mediaType == "message/rfc822" || mediaType == "message/global" {
+		nested, err := mail.ReadMessage(bytes.NewReader(data))
+		if err == nil {
+			if attachment.Filename == "" {
+				attachment.Filename = forwardedFilename(DecodeHeader(nested.Header.Get("Subject")))
+			}
+			// A message that only wraps another one shows the wrapped body
+			if w.text == "" && w.html == "" && depth < maxPartDepth {
+				if nestedBody, err := io.ReadAll(nested.Body); err == nil {
+					inner := &walker{msg: &Message{}}
+					inner.walk(textproto.MIMEHeader(nested.Header), nestedBody, "", "", depth+1)
+					w.text, w.html = inner.text, inner.html
+				}
+			}
+		}
+		attachment.Inline = false
+	}
+
+	w.msg.Attachments = append(w.msg.Attachments, attachment)
+}
+
+func (w *walker) walkMultipart(body []byte, boundary, path, mediaType string, depth int) {
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for i := 1; ; i++ {
+		part, err := mr.NextRawPart()
+		if err != nil {
+			// io.EOF, or a malformed part: keep what was found so far
+			return
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return
+		}
+
+		childPath := strconv.Itoa(i)
+		if path != "" {
+			childPath = path + "." + childPath
+		}
+		w.walk(part.Header, data, childPath, mediaType, depth+1)
+	}
+}
+
+// addText stores a body part. Alternatives keep the first part of each
+// type; other inline text parts, such as those around an inline image, are
+// joined.
+func (w *walker) addText(mediaType, text string, alternative bool) {
+	target := &w.text
+	if mediaType == "text/html" {
+		target = &w.html
+	}
+
+	switch {
+	case *target == "":
+		*target = text
+	case !alternative:
+		if mediaType == "text/html" {
+			*target += text
+		} else {
+			*target += "\n" + text
+		}
+	}
+}
+
+func forwardedFilename(subject string) string {
+	subject = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(subject))
+	if subject == "" {
+		subject = "message"
+	}
+	return subject + ".eml"
+}
+
+// decodeTransfer undoes the Content-Transfer-Encoding. Damaged encodings
+// yield whatever decoded cleanly.
+func decodeTransfer(body []byte, encoding string) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body)
+		decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(clean)))
+		if err != nil && len(decoded) == 0 {
+			decoded, _ = base64.RawStdEncoding.DecodeString(strings.TrimRight(string(clean), "="))
+		}
+		return decoded
+	case "quoted-printable":
+		decoded, _ := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		return decoded
+	default:
+		return body
+	}
+}
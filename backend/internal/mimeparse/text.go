@@ -0,0 +1,70 @@
+package mimeparse
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// SnippetLength is the maximum snippet length in characters
+const SnippetLength = 200
+
+var whitespacePattern = regexp.MustCompile(`\s+`)
+
+// blockElements start a new line when HTML is converted to text
+var blockElements = map[string]bool{
+	"br": true, "p": true, "div": true, "tr": true, "li": true, "table": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"blockquote": true, "pre": true, "hr": true,
+}
+
+// HTMLToText extracts the readable text of an HTML document. Truncated
+// input is fine, which lets sync build snippets from partial fetches.
+func HTMLToText(s string) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(s))
+	skip := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.TrimSpace(b.String())
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style", "head", "title":
+				skip++
+			default:
+				if blockElements[string(name)] {
+					b.WriteByte('\n')
+				}
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style", "head", "title":
+				if skip > 0 {
+					skip--
+				}
+			default:
+				if blockElements[string(name)] {
+					b.WriteByte('\n')
+				}
+			}
+		}
+	}
+}
+
+// Snippet collapses whitespace and cuts text down to a short preview
+func Snippet(text string) string {
+	text = strings.TrimSpace(whitespacePattern.ReplaceAllString(text, " "))
+	if utf8.RuneCountInString(text) > SnippetLength {
+		text = string([]rune(text)[:SnippetLength])
+	}
+	return text
+}
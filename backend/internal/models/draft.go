@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Draft is an unsent message saved on the server. Every change increments
+// Version; saves must name the version they edited.
+type Draft struct {
+	ID                uuid.UUID         `db:"id" json:"id"`
+	UserID            uuid.UUID         `db:"user_id" json:"user_id"`
+	AccountID         *uuid.UUID        `db:"account_id" json:"account_id,omitempty"` // nil sends from the primary account
+	To                pq.StringArray    `db:"to_addresses" json:"to"`
+	Cc                pq.StringArray    `db:"cc_addresses" json:"cc"`
+	Bcc               pq.StringArray    `db:"bcc_addresses" json:"bcc"`
+	Subject           string            `db:"subject" json:"subject"`
+	Text              string            `db:"text_body" json:"text"`
+	HTML              string            `db:"html_body" json:"html"`
+	Version           int               `db:"version" json:"version"`
+	DeletedAt         *time.Time        `db:"deleted_at" json:"-"`
+	SyncToProvider    bool              `db:"sync_to_provider" json:"sync_to_provider"`
+	ProviderAccountID *uuid.UUID        `db:"provider_account_id" json:"-"`
+	ProviderDraftID   *string           `db:"provider_draft_id" json:"-"`
+	SyncedVersion     int               `db:"synced_version" json:"synced_version"`
+	SyncAttempts      int               `db:"sync_attempts" json:"-"`
+	SyncNextAt        time.Time         `db:"sync_next_at" json:"-"`
+	SyncLockedUntil   *time.Time        `db:"sync_locked_until" json:"-"`
+	SyncError         *string           `db:"sync_error" json:"sync_error,omitempty"`
+	CreatedAt         time.Time         `db:"created_at" json:"created_at"`
+	UpdatedAt         time.Time         `db:"updated_at" json:"updated_at"`
+	Attachments       []DraftAttachment `db:"-" json:"attachments,omitempty"` // only loaded for a single draft
+}
+
+// DraftAttachment is a file attached to a draft. The content lives in
+// object storage, addressed by its SHA-256 like received attachments.
+type DraftAttachment struct {
+	ID                 uuid.UUID  `db:"id" json:"id"`
+	DraftID            uuid.UUID  `db:"draft_id" json:"draft_id"`
+	Filename           string     `db:"filename" json:"filename"`
+	ContentType        string     `db:"content_type" json:"content_type"`
+	SizeBytes          int64      `db:"size_bytes" json:"size_bytes"`
+	SHA256             string     `db:"sha256" json:"-"`
+	SourceAttachmentID *uuid.UUID `db:"source_attachment_id" json:"source_attachment_id,omitempty"`
+	CreatedAt          time.Time  `db:"created_at" json:"created_at"`
+}
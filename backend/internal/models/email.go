@@ -0,0 +1,147 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// EmailAccount represents an external email account linked to a user
+type EmailAccount struct {
+	ID                   uuid.UUID  `db:"id" json:"id"`
+	UserID               uuid.UUID  `db:"user_id" json:"user_id"`
+	Provider             string     `db:"provider" json:"provider"`
+	EmailAddress         string     `db:"email_address" json:"email_address"`
+	DisplayName          *string    `db:"display_name" json:"display_name,omitempty"`
+	CredentialsEncrypted string     `db:"credentials_encrypted" json:"-"` // Never expose credentials in JSON
+	IsPrimary            bool       `db:"is_primary" json:"is_primary"`
+	SyncEnabled          bool       `db:"sync_enabled" json:"sync_enabled"`
+	LastSyncedAt         *time.Time `db:"last_synced_at" json:"last_synced_at,omitempty"`
+	CreatedAt            time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt            time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+// Email represents the stored metadata of a single message
+type Email struct {
+	ID             uuid.UUID      `db:"id" json:"id"`
+	AccountID      uuid.UUID      `db:"account_id" json:"account_id"`
+	ExternalID     string         `db:"external_id" json:"external_id"`
+	ThreadID       *string        `db:"thread_id" json:"thread_id,omitempty"`
+	FromAddress    string         `db:"from_address" json:"from_address"`
+	FromName       *string        `db:"from_name" json:"from_name,omitempty"`
+	ToAddresses    pq.StringArray `db:"to_addresses" json:"to_addresses"`
+	CcAddresses    pq.StringArray `db:"cc_addresses" json:"cc_addresses"`
+	Subject        *string        `db:"subject" json:"subject,omitempty"`
+	Snippet        *string        `db:"snippet" json:"snippet,omitempty"`
+	CategoryID     *uuid.UUID     `db:"category_id" json:"category_id,omitempty"`
+	IsRead         bool           `db:"is_read" json:"is_read"`
+	IsStarred      bool           `db:"is_starred" json:"is_starred"`
+	HasAttachments bool           `db:"has_attachments" json:"has_attachments"`
+	IsArchived     bool           `db:"is_archived" json:"is_archived"`
+	DeletedAt      *time.Time     `db:"deleted_at" json:"-"`
+	ReceivedAt     time.Time      `db:"received_at" json:"received_at"`
+	CreatedAt      time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// EmailListItem is an email joined with its category's display fields
+type EmailListItem struct {
+	Email
+	CategoryName  *string `db:"category_name" json:"category_name,omitempty"`
+	CategoryColor *string `db:"category_color" json:"category_color,omitempty"`
+	CategoryIcon  *string `db:"category_icon" json:"category_icon,omitempty"`
+}
+
+// Category groups emails by topic, such as medical or financial mail
+type Category struct {
+	ID           uuid.UUID `db:"id" json:"id"`
+	Name         string    `db:"name" json:"name"`
+	Description  *string   `db:"description" json:"description,omitempty"`
+	Color        *string   `db:"color" json:"color,omitempty"`
+	Icon         *string   `db:"icon" json:"icon,omitempty"`
+	IsSystem     bool      `db:"is_system" json:"is_system"`
+	DisplayOrder int       `db:"display_order" json:"display_order"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+}
+
+// Conversation is the profile of a thread, with the topics and action
+// items extracted from it
+type Conversation struct {
+	ID              uuid.UUID      `db:"id" json:"id"`
+	AccountID       uuid.UUID      `db:"account_id" json:"account_id"`
+	ThreadID        string         `db:"thread_id" json:"thread_id"`
+	Participants    pq.StringArray `db:"participants" json:"participants"`
+	Subject         *string        `db:"subject" json:"subject,omitempty"`
+	MessageCount    int            `db:"message_count" json:"message_count"`
+	LastMessageAt   *time.Time     `db:"last_message_at" json:"last_message_at,omitempty"`
+	Topics          pq.StringArray `db:"topics" json:"topics"`
+	ImportanceScore int            `db:"importance_score" json:"importance_score"`
+	HasActionItems  bool           `db:"has_action_items" json:"has_action_items"`
+	ActionItems     *string        `db:"action_items" json:"-"` // JSON array of detected appointments and deadlines
+	CreatedAt       time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt       time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// SyncState tracks incremental sync progress for one folder of an account
+type SyncState struct {
+	AccountID   uuid.UUID `db:"account_id" json:"account_id"`
+	Folder      string    `db:"folder" json:"folder"`
+	UIDValidity int64     `db:"uid_validity" json:"uid_validity"`
+	LastUID     int64     `db:"last_uid" json:"last_uid"`
+	Cursor      *string   `db:"cursor" json:"cursor,omitempty"` // provider change-tracking position
+	UpdatedAt   time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// KeyRotation tracks re-encryption of account credentials with a new key
+type KeyRotation struct {
+	KeyID         string     `db:"key_id" json:"key_id"`
+	LastAccountID *uuid.UUID `db:"last_account_id" json:"last_account_id,omitempty"`
+	StartedAt     time.Time  `db:"started_at" json:"started_at"`
+	CompletedAt   *time.Time `db:"completed_at" json:"completed_at,omitempty"`
+	UpdatedAt     time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+// BodyCacheEntry tracks a message body cached in object storage
+type BodyCacheEntry struct {
+	EmailID        uuid.UUID `db:"email_id" json:"email_id"`
+	ObjectKey      string    `db:"object_key" json:"object_key"`
+	SizeBytes      int64     `db:"size_bytes" json:"size_bytes"`
+	ExpiresAt      time.Time `db:"expires_at" json:"expires_at"`
+	LastAccessedAt time.Time `db:"last_accessed_at" json:"last_accessed_at"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+}
+
+// OAuthState is a pending OAuth authorization request
+type OAuthState struct {
+	State        string    `db:"state" json:"-"`
+	UserID       uuid.UUID `db:"user_id" json:"user_id"`
+	Provider     string    `db:"provider" json:"provider"`
+	CodeVerifier string    `db:"code_verifier" json:"-"`
+	ExpiresAt    time.Time `db:"expires_at" json:"expires_at"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+}
+
+// Attachment is a stored attachment of a received email. The content lives
+// in object storage, addressed by its SHA-256.
+type Attachment struct {
+	ID          uuid.UUID `db:"id" json:"id"`
+	EmailID     uuid.UUID `db:"email_id" json:"email_id"`
+	Part        string    `db:"part" json:"part"`
+	Filename    *string   `db:"filename" json:"filename,omitempty"`
+	ContentType string    `db:"content_type" json:"content_type"`
+	SizeBytes   int64     `db:"size_bytes" json:"size_bytes"`
+	ContentID   *string   `db:"content_id" json:"content_id,omitempty"`
+	IsInline    bool      `db:"is_inline" json:"is_inline"`
+	SHA256      string    `db:"sha256" json:"-"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+// EmailSearchResult is an email matching a search. Highlights are HTML
+// escaped with matched terms wrapped in <mark>.
+type EmailSearchResult struct {
+	EmailListItem
+	Rank             float64 `db:"rank" json:"rank"`
+	SubjectHighlight string  `db:"subject_highlight" json:"subject_highlight"`
+	BodyHighlight    string  `db:"body_highlight" json:"body_highlight"`
+}
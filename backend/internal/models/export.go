@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Export formats: one mbox file per category, or one .eml file per email
+const (
+	ExportMbox = "mbox"
+	ExportEML  = "eml"
+)
+
+// Export statuses
+const (
+	ExportPending   = "pending"
+	ExportExporting = "exporting"
+	ExportDone      = "done"
+	ExportFailed    = "failed"
+	ExportExpired   = "expired"
+)
+
+// Export is a zip archive of a user's mailbox, requested by the user or by
+// a caregiver with full access
+type Export struct {
+	ID            uuid.UUID  `db:"id" json:"id"`
+	UserID        uuid.UUID  `db:"user_id" json:"user_id"`
+	RequestedBy   uuid.UUID  `db:"requested_by" json:"requested_by"`
+	Format        string     `db:"format" json:"format"`
+	Status        string     `db:"status" json:"status"`
+	EmailTotal    int        `db:"email_total" json:"email_total"`
+	EmailCount    int        `db:"email_count" json:"email_count"`
+	FailedCount   int        `db:"failed_count" json:"failed_count"`
+	ObjectKey     *string    `db:"object_key" json:"-"`
+	SizeBytes     *int64     `db:"size_bytes" json:"size_bytes,omitempty"`
+	ExpiresAt     *time.Time `db:"expires_at" json:"expires_at,omitempty"`
+	Attempts      int        `db:"attempts" json:"-"`
+	NextAttemptAt time.Time  `db:"next_attempt_at" json:"-"`
+	LockedUntil   *time.Time `db:"locked_until" json:"-"`
+	LastError     *string    `db:"last_error" json:"error,omitempty"`
+	CompletedAt   *time.Time `db:"completed_at" json:"completed_at,omitempty"`
+	CreatedAt     time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt     time.Time  `db:"updated_at" json:"updated_at"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Import statuses
+const (
+	ImportUploading = "uploading"
+	ImportPending   = "pending"
+	ImportImporting = "importing"
+	ImportDone      = "done"
+	ImportFailed    = "failed"
+)
+
+// Import is an uploaded mail archive and the progress of importing it
+type Import struct {
+	ID             uuid.UUID  `db:"id" json:"id"`
+	UserID         uuid.UUID  `db:"user_id" json:"user_id"`
+	Filename       string     `db:"filename" json:"filename"`
+	Status         string     `db:"status" json:"status"`
+	ChunkCount     int        `db:"chunk_count" json:"chunk_count"`
+	BytesTotal     int64      `db:"bytes_total" json:"bytes_total"`
+	BytesProcessed int64      `db:"bytes_processed" json:"bytes_processed"`
+	Imported       int        `db:"imported_count" json:"imported"`
+	Duplicates     int        `db:"duplicate_count" json:"duplicates"`
+	Failed         int        `db:"failed_count" json:"failed"`
+	Attempts       int        `db:"attempts" json:"-"`
+	NextAttemptAt  time.Time  `db:"next_attempt_at" json:"-"`
+	LockedUntil    *time.Time `db:"locked_until" json:"-"`
+	LastError      *string    `db:"last_error" json:"error,omitempty"`
+	StartedAt      *time.Time `db:"started_at" json:"started_at,omitempty"`
+	CompletedAt    *time.Time `db:"completed_at" json:"completed_at,omitempty"`
+	CreatedAt      time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+// ImportedMessage tracks the stored source of an imported email
+type ImportedMessage struct {
+	ObjectKey string     `db:"object_key" json:"object_key"`
+	EmailID   *uuid.UUID `db:"email_id" json:"email_id,omitempty"` // nil once the email is deleted
+	SizeBytes int64      `db:"size_bytes" json:"size_bytes"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+}
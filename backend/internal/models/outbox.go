@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Outbox statuses
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+)
+
+// OutboxMessage is an outgoing email waiting for (or done with) delivery
+type OutboxMessage struct {
+	ID             uuid.UUID      `db:"id" json:"id"`
+	UserID         uuid.UUID      `db:"user_id" json:"user_id"`
+	AccountID      uuid.UUID      `db:"account_id" json:"account_id"`
+	IdempotencyKey string         `db:"idempotency_key" json:"idempotency_key"`
+	MessageID      string         `db:"message_id" json:"message_id"`
+	FromAddress    string         `db:"from_address" json:"from_address"`
+	Recipients     pq.StringArray `db:"recipients" json:"recipients"`
+	Subject        *string        `db:"subject" json:"subject,omitempty"`
+	RawMessage     []byte         `db:"raw_message" json:"-"`
+	Status         string         `db:"status" json:"status"`
+	Attempts       int            `db:"attempts" json:"attempts"`
+	NextAttemptAt  time.Time      `db:"next_attempt_at" json:"next_attempt_at"`
+	LockedUntil    *time.Time     `db:"locked_until" json:"-"`
+	LastError      *string        `db:"last_error" json:"last_error,omitempty"`
+	SentAt         *time.Time     `db:"sent_at" json:"sent_at,omitempty"`
+	CreatedAt      time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// OutboxAttempt records the outcome of one delivery attempt
+type OutboxAttempt struct {
+	ID          uuid.UUID `db:"id" json:"id"`
+	OutboxID    uuid.UUID `db:"outbox_id" json:"outbox_id"`
+	Attempt     int       `db:"attempt" json:"attempt"`
+	Error       *string   `db:"error" json:"error,omitempty"`
+	AttemptedAt time.Time `db:"attempted_at" json:"attempted_at"`
+}
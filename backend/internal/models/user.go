@@ -28,3 +28,21 @@ type Session struct {
 	ExpiresAt    time.Time `db:"expires_at" json:"expires_at"`
 	CreatedAt    time.Time `db:"created_at" json:"created_at"`
 }
+
+// UserPreferences holds a user's display and privacy settings
+type UserPreferences struct {
+	UserID               uuid.UUID `db:"user_id" json:"-"`
+	Theme                string    `db:"theme" json:"theme"`
+	FontSize             string    `db:"font_size" json:"font_size"`
+	AutoCategorize       bool      `db:"auto_categorize" json:"auto_categorize"`
+	ShowImages           bool      `db:"show_images" json:"show_images"`
+	NotificationsEnabled bool      `db:"notifications_enabled" json:"notifications_enabled"`
+}
+
+// ImageSender is a sender whose remote images a user always shows. Sender
+// is a lower-case address, or @domain for every address of a domain.
+type ImageSender struct {
+	UserID    uuid.UUID `db:"user_id" json:"-"`
+	Sender    string    `db:"sender" json:"sender"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Fields of an email whose changes are written back to the provider
+const (
+	WritebackRead     = "read"
+	WritebackStarred  = "starred"
+	WritebackArchived = "archived"
+	WritebackDeleted  = "deleted"
+)
+
+// Write-back statuses
+const (
+	WritebackPending  = "pending"
+	WritebackApplying = "applying"
+	WritebackFailed   = "failed"
+)
+
+// EmailWriteback is a local state change waiting to be applied on the
+// provider
+type EmailWriteback struct {
+	ID            uuid.UUID  `db:"id" json:"id"`
+	EmailID       uuid.UUID  `db:"email_id" json:"email_id"`
+	AccountID     uuid.UUID  `db:"account_id" json:"account_id"`
+	Field         string     `db:"field" json:"field"`
+	Value         bool       `db:"value" json:"value"`
+	Status        string     `db:"status" json:"status"`
+	Attempts      int        `db:"attempts" json:"attempts"`
+	NextAttemptAt time.Time  `db:"next_attempt_at" json:"next_attempt_at"`
+	LockedUntil   *time.Time `db:"locked_until" json:"-"`
+	LastError     *string    `db:"last_error" json:"last_error,omitempty"`
+	CreatedAt     time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt     time.Time  `db:"updated_at" json:"updated_at"`
+}
@@ -0,0 +1,84 @@
+// Package netguard keeps connections to hosts chosen by users, such as
+// their mail servers, off loopback, private and other reserved networks
+package netguard
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned when a connection would reach a
+// non-public address
+var ErrForbiddenAddress = errors.New("address is not publicly routable")
+
+// denied lists the special-purpose ranges from the IANA IPv4 and IPv6
+// registries that a public server cannot live in
+var denied = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link local
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+
+	netip.MustParsePrefix("::/128"),         // unspecified
+	netip.MustParsePrefix("::1/128"),        // loopback
+	netip.MustParsePrefix("::ffff:0:0/96"),  // IPv4-mapped
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("100::/64"),       // discard only
+	netip.MustParsePrefix("2001::/23"),      // IETF protocol assignments, including Teredo
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("2002::/16"),      // 6to4
+	netip.MustParsePrefix("fc00::/7"),       // unique local
+	netip.MustParsePrefix("fe80::/10"),      // link local
+	netip.MustParsePrefix("fec0::/10"),      // site local
+	netip.MustParsePrefix("ff00::/8"),       // multicast
+}
+
+// Public reports whether addr is outside every special-purpose range.
+// Addresses that embed an IPv4 address are refused outright rather than
+// unwrapped.
+func Public(addr netip.Addr) bool {
+	if !addr.IsValid() || addr.Zone() != "" {
+		return false
+	}
+	for _, prefix := range denied {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Control is a net.Dialer Control function that refuses non-public
+// addresses. It runs for every address a name resolves to and for every
+// connection of a redirect, so it also holds against DNS rebinding.
+func Control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !Public(addr) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// Dialer returns a dialer that only connects to public addresses
+func Dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, Control: Control}
+}
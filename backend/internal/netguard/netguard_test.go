@@ -0,0 +1,78 @@
+package netguard
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestPublic(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"100.63.255.255", true},
+		{"100.128.0.0", true},
+		{"198.20.0.1", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"10.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.0.0.170", false},
+		{"192.0.2.1", false},
+		{"192.168.1.1", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"203.0.113.7", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:93.184.216.34", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"2001:0:4136:e378::1", false},
+		{"2001:db8::1", false},
+		{"2002:7f00:1::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"fe80::1%eth0", false},
+		{"ff02::1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := Public(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("Public(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialerRefusesLoopback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	_, err = Dialer(time.Second).Dial("tcp", l.Addr().String())
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("Dial error = %v, want ErrForbiddenAddress", err)
+	}
+	_, err = Dialer(time.Second).Dial("tcp", net.JoinHostPort("localhost", "25"))
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("Dial localhost error = %v, want ErrForbiddenAddress", err)
+	}
+}
@@ -0,0 +1,364 @@
+// Package fake is a scripted in-memory mail provider for tests. It keeps a
+// mailbox per account and a log of changes that ListChanges replays, so
+// sync, send and write-back can be run end to end, deterministically and
+// without a server.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+)
+
+// ProviderName is the default name of a fake provider
+const ProviderName = "fake"
+
+// defaultBatchSize is how many changes ListChanges returns at a time unless
+// BatchSize is set
+const defaultBatchSize = 50
+
+// Op names a provider operation that failures can be queued for
+type Op string
+
+const (
+	OpListChanges Op = "list_changes"
+	OpFetch       Op = "fetch"
+	OpSend        Op = "send"
+	OpSetFlags    Op = "set_flags"
+	OpMove        Op = "move"
+)
+
+// Message is a message in a fake mailbox. The read, starred and archived
+// fields of Email follow SetFlags and Move.
+type Message struct {
+	Email  models.Email
+	Raw    []byte
+	Folder provider.Folder
+}
+
+// Sent is a message submitted through Send
+type Sent struct {
+	AccountID  uuid.UUID
+	From       string
+	Recipients []string
+	Raw        []byte
+}
+
+// Provider is a scripted provider.MailProvider. Tests Deliver and Remove
+// messages, and change them with SetFlags and Move as another client
+// would; every change is listed by ListChanges. FailNext queues errors,
+// and Sent and Message inspect the outcome.
+type Provider struct {
+	// BatchSize is how many messages or changes ListChanges returns at a
+	// time. Zero means 50.
+	BatchSize int
+
+	name string
+
+	mu        sync.Mutex
+	mailboxes map[uuid.UUID]*mailbox
+	failures  map[Op][]error
+	sent      []Sent
+	nextID    int
+}
+
+// mailbox is one account's messages and change log
+type mailbox struct {
+	messages map[string]*Message
+	// order is the external IDs of the messages in delivery order
+	order []string
+	// log is the external IDs of changed messages; a cursor is a position
+	// in it
+	log []string
+	// expired is the oldest position a cursor may still be at
+	expired int
+}
+
+// New creates an empty fake provider that handles accounts whose provider
+// is name, such as ProviderName, or a real provider's name to stand in
+// for it in a registry
+func New(name string) *Provider {
+	return &Provider{
+		name:      name,
+		mailboxes: map[uuid.UUID]*mailbox{},
+		failures:  map[Op][]error{},
+	}
+}
+
+// Deliver adds a message to an account's mailbox and returns its external
+// ID. An empty email.ExternalID is filled in. Archived email is delivered
+// to the archive, everything else to the inbox.
+func (p *Provider) Deliver(accountID uuid.UUID, email models.Email, raw []byte) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if email.ExternalID == "" {
+		p.nextID++
+		email.ExternalID = fmt.Sprintf("fake-%d", p.nextID)
+	}
+	email.AccountID = accountID
+	folder := provider.FolderInbox
+	if email.IsArchived {
+		folder = provider.FolderArchive
+	}
+
+	box := p.mailbox(accountID)
+	if _, ok := box.messages[email.ExternalID]; !ok {
+		box.order = append(box.order, email.ExternalID)
+	}
+	box.messages[email.ExternalID] = &Message{Email: email, Raw: raw, Folder: folder}
+	box.log = append(box.log, email.ExternalID)
+	return email.ExternalID
+}
+
+// Remove deletes a message for good, as if it was expunged
+func (p *Provider) Remove(accountID uuid.UUID, externalID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	box := p.mailbox(accountID)
+	if _, ok := box.messages[externalID]; !ok {
+		return
+	}
+	delete(box.messages, externalID)
+	for i, id := range box.order {
+		if id == externalID {
+			box.order = append(box.order[:i], box.order[i+1:]...)
+			break
+		}
+	}
+	box.log = append(box.log, externalID)
+}
+
+// FailNext makes the next call of op fail with err. Queued errors are
+// returned in order, one per call.
+func (p *Provider) FailNext(op Op, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[op] = append(p.failures[op], err)
+}
+
+// ExpireCursors makes ListChanges reject the account's current cursors
+// with provider.ErrCursorExpired
+func (p *Provider) ExpireCursors(accountID uuid.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	box := p.mailbox(accountID)
+	box.expired = len(box.log)
+}
+
+// Sent returns the messages submitted through Send, oldest first
+func (p *Provider) Sent() []Sent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Sent(nil), p.sent...)
+}
+
+// Message returns a copy of a message in an account's mailbox
+func (p *Provider) Message(accountID uuid.UUID, externalID string) (*Message, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	msg, ok := p.mailbox(accountID).messages[externalID]
+	if !ok {
+		return nil, false
+	}
+	copied := *msg
+	return &copied, true
+}
+
+// Name returns the name the provider was created with
+func (p *Provider) Name() string {
+	return p.name
+}
+
+// ListChanges lists the mailbox for an empty cursor and replays the change
+// log otherwise. Messages in the trash are listed as removed.
+func (p *Provider) ListChanges(ctx context.Context, account *models.EmailAccount, cursor string) (*provider.Changes, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.failure(OpListChanges); err != nil {
+		return nil, err
+	}
+	box := p.mailbox(account.ID)
+
+	// A listing remembers where the log was when it started, so changes
+	// made while listing are replayed afterwards
+	if cursor == "" {
+		return box.list(len(box.log), 0, p.batchSize()), nil
+	}
+	var head, offset int
+	if _, err := fmt.Sscanf(cursor, "list:%d:%d", &head, &offset); err == nil {
+		return box.list(head, offset, p.batchSize()), nil
+	}
+
+	pos, err := strconv.Atoi(cursor)
+	if err != nil || pos < box.expired || pos > len(box.log) {
+		return nil, provider.ErrCursorExpired
+	}
+	return box.changes(pos, p.batchSize()), nil
+}
+
+// FetchMessage returns the raw source of a message
+func (p *Provider) FetchMessage(ctx context.Context, account *models.EmailAccount, externalID string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.failure(OpFetch); err != nil {
+		return nil, err
+	}
+	msg, ok := p.mailbox(account.ID).messages[externalID]
+	if !ok {
+		return nil, provider.ErrMessageGone
+	}
+	return msg.Raw, nil
+}
+
+// Send records a submitted message
+func (p *Provider) Send(ctx context.Context, account *models.EmailAccount, from string, recipients []string, raw []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.failure(OpSend); err != nil {
+		return err
+	}
+	p.sent = append(p.sent, Sent{
+		AccountID:  account.ID,
+		From:       from,
+		Recipients: append([]string(nil), recipients...),
+		Raw:        raw,
+	})
+	return nil
+}
+
+// SetFlags changes the read and starred flags of a message
+func (p *Provider) SetFlags(ctx context.Context, account *models.EmailAccount, externalID string, flags provider.Flags) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.failure(OpSetFlags); err != nil {
+		return err
+	}
+	box := p.mailbox(account.ID)
+	msg, ok := box.messages[externalID]
+	if !ok {
+		return provider.ErrMessageGone
+	}
+
+	if flags.Read != nil {
+		msg.Email.IsRead = *flags.Read
+	}
+	if flags.Starred != nil {
+		msg.Email.IsStarred = *flags.Starred
+	}
+	box.log = append(box.log, externalID)
+	return nil
+}
+
+// Move moves a message to a folder
+func (p *Provider) Move(ctx context.Context, account *models.EmailAccount, externalID string, folder provider.Folder) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.failure(OpMove); err != nil {
+		return err
+	}
+	switch folder {
+	case provider.FolderInbox, provider.FolderArchive, provider.FolderTrash:
+	default:
+		return provider.ErrUnsupported
+	}
+	box := p.mailbox(account.ID)
+	msg, ok := box.messages[externalID]
+	if !ok {
+		return provider.ErrMessageGone
+	}
+
+	msg.Folder = folder
+	msg.Email.IsArchived = folder == provider.FolderArchive
+	box.log = append(box.log, externalID)
+	return nil
+}
+
+// failure pops the next queued error of op
+func (p *Provider) failure(op Op) error {
+	queue := p.failures[op]
+	if len(queue) == 0 {
+		return nil
+	}
+	p.failures[op] = queue[1:]
+	return queue[0]
+}
+
+func (p *Provider) mailbox(accountID uuid.UUID) *mailbox {
+	box, ok := p.mailboxes[accountID]
+	if !ok {
+		box = &mailbox{messages: map[string]*Message{}}
+		p.mailboxes[accountID] = box
+	}
+	return box
+}
+
+func (p *Provider) batchSize() int {
+	if p.BatchSize > 0 {
+		return p.BatchSize
+	}
+	return defaultBatchSize
+}
+
+// list returns the batch of shown messages from offset on. Once it is
+// done the cursor continues from head.
+func (box *mailbox) list(head, offset, size int) *provider.Changes {
+	var shown []string
+	for _, id := range box.order {
+		if box.messages[id].Folder != provider.FolderTrash {
+			shown = append(shown, id)
+		}
+	}
+
+	changes := &provider.Changes{Cursor: strconv.Itoa(head)}
+	end := offset + size
+	if end < len(shown) {
+		changes.Cursor = fmt.Sprintf("list:%d:%d", head, end)
+		changes.More = true
+	} else {
+		end = len(shown)
+	}
+	for _, id := range shown[min(offset, end):end] {
+		changes.Emails = append(changes.Emails, box.messages[id].Email)
+	}
+	return changes
+}
+
+// changes returns the batch of changes logged from pos on. A message
+// changed several times is listed once, as it is now.
+func (box *mailbox) changes(pos, size int) *provider.Changes {
+	end := min(pos+size, len(box.log))
+	changes := &provider.Changes{
+		Cursor: strconv.Itoa(end),
+		More:   end < len(box.log),
+	}
+
+	listed := map[string]bool{}
+	for _, id := range box.log[pos:end] {
+		if listed[id] {
+			continue
+		}
+		listed[id] = true
+
+		msg, ok := box.messages[id]
+		if !ok || msg.Folder == provider.FolderTrash {
+			changes.Removed = append(changes.Removed, id)
+			continue
+		}
+		changes.Emails = append(changes.Emails, msg.Email)
+	}
+	return changes
+}
@@ -0,0 +1,175 @@
+package fake_test
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/mailer"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/provider/fake"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+	"github.com/jay/dadmail/internal/writeback"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// delivered returns a message from the kid as the fake provider lists it
+func delivered(subject string) models.Email {
+	return models.Email{
+		FromAddress: "kid@example.com",
+		ToAddresses: pq.StringArray{"grandpa@example.com"},
+		CcAddresses: pq.StringArray{},
+		Subject:     &subject,
+		ReceivedAt:  time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+// storedEmails returns the account's emails by external ID, including
+// hidden ones
+func storedEmails(t *testing.T, db *sqlx.DB, accountID uuid.UUID) map[string]models.Email {
+	t.Helper()
+	var emails []models.Email
+	if err := db.Select(&emails, `SELECT * FROM emails WHERE account_id = $1`, accountID); err != nil {
+		t.Fatalf("select emails: %v", err)
+	}
+	byID := map[string]models.Email{}
+	for _, e := range emails {
+		byID[e.ExternalID] = e
+	}
+	return byID
+}
+
+// TestSyncWritebackSend runs a fake account through the sync, write-back
+// and send paths the worker uses for providers that list their changes
+func TestSyncWritebackSend(t *testing.T) {
+	db := testdb.Open(t)
+	userID := testdb.CreateUser(t, db)
+	account := &models.EmailAccount{
+		UserID:               userID,
+		Provider:             fake.ProviderName,
+		EmailAddress:         "grandpa@example.com",
+		CredentialsEncrypted: "unused",
+		SyncEnabled:          true,
+	}
+	if err := repository.NewEmailAccountRepository(db).Create(account); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	p := fake.New(fake.ProviderName)
+	p.BatchSize = 1
+	registry := provider.NewRegistry(p)
+	syncer := provider.NewSyncer(db, registry)
+	worker := writeback.NewWorker(db, registry)
+	writebackRepo := repository.NewWritebackRepository(db)
+	ctx := context.Background()
+
+	lunch := p.Deliver(account.ID, delivered("Lunch on Sunday"), []byte("Subject: Lunch on Sunday\r\n\r\nNoon?\r\n"))
+	spam := p.Deliver(account.ID, delivered("You won"), []byte("Subject: You won\r\n\r\nClick\r\n"))
+
+	// The listing takes one batch per message
+	if err := syncer.SyncAll(ctx); err != nil {
+		t.Fatalf("SyncAll: %v", err)
+	}
+	emails := storedEmails(t, db, account.ID)
+	if len(emails) != 2 || emails[lunch].Subject == nil || *emails[lunch].Subject != "Lunch on Sunday" {
+		t.Fatalf("synced emails = %v", emails)
+	}
+
+	// Grandpa reads and archives the lunch mail and deletes the spam
+	read, archived := true, true
+	if _, err := writebackRepo.Update(userID, []uuid.UUID{emails[lunch].ID}, &repository.EmailChanges{IsRead: &read, IsArchived: &archived}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, err := writebackRepo.Delete(userID, []uuid.UUID{emails[spam].ID}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	t.Run("sync keeps pending changes", func(t *testing.T) {
+		if err := syncer.SyncAccount(ctx, account); err != nil {
+			t.Fatalf("SyncAccount: %v", err)
+		}
+		emails := storedEmails(t, db, account.ID)
+		if e := emails[lunch]; !e.IsRead || !e.IsArchived {
+			t.Errorf("sync overwrote pending changes: read=%v archived=%v", e.IsRead, e.IsArchived)
+		}
+		if e := emails[spam]; e.DeletedAt == nil {
+			t.Errorf("sync restored an email pending deletion")
+		}
+	})
+
+	t.Run("write-back", func(t *testing.T) {
+		// The first attempt at the flag change fails and is retried later
+		p.FailNext(fake.OpSetFlags, errors.New("connection reset"))
+		if _, err := worker.ProcessDue(ctx); err != nil {
+			t.Fatalf("ProcessDue: %v", err)
+		}
+		if msg, _ := p.Message(account.ID, lunch); msg.Email.IsRead {
+			t.Errorf("read flag was applied despite the failure")
+		}
+		if _, err := db.Exec(`UPDATE email_writebacks SET next_attempt_at = NOW()`); err != nil {
+			t.Fatalf("reschedule: %v", err)
+		}
+		if _, err := worker.ProcessDue(ctx); err != nil {
+			t.Fatalf("ProcessDue: %v", err)
+		}
+
+		msg, _ := p.Message(account.ID, lunch)
+		if !msg.Email.IsRead || msg.Folder != provider.FolderArchive {
+			t.Errorf("lunch at the provider: read=%v folder=%s", msg.Email.IsRead, msg.Folder)
+		}
+		if msg, _ := p.Message(account.ID, spam); msg.Folder != provider.FolderTrash {
+			t.Errorf("spam at the provider is in %s, want trash", msg.Folder)
+		}
+		var pending int
+		if err := db.Get(&pending, `SELECT COUNT(*) FROM email_writebacks`); err != nil || pending != 0 {
+			t.Errorf("%d write-backs left, %v", pending, err)
+		}
+
+		// The provider now agrees, so the next sync changes nothing
+		if err := syncer.SyncAccount(ctx, account); err != nil {
+			t.Fatalf("SyncAccount: %v", err)
+		}
+		emails := storedEmails(t, db, account.ID)
+		if _, ok := emails[spam]; ok || len(emails) != 1 {
+			t.Errorf("emails after write-back = %v", emails)
+		}
+		if e := emails[lunch]; !e.IsRead || !e.IsArchived {
+			t.Errorf("lunch after sync: read=%v archived=%v", e.IsRead, e.IsArchived)
+		}
+	})
+
+	t.Run("send", func(t *testing.T) {
+		msg := &mailer.Message{
+			From:    mail.Address{Name: "Grandpa", Address: "grandpa@example.com"},
+			To:      []mail.Address{{Address: "kid@example.com"}},
+			Bcc:     []mail.Address{{Address: "aunt@example.com"}},
+			Subject: "Re: Lunch on Sunday",
+			Text:    "See you at noon.\n",
+		}
+		if err := mailer.NewSender(registry).Send(ctx, account, msg); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+
+		sent := p.Sent()
+		if len(sent) != 1 {
+			t.Fatalf("%d messages sent, want 1", len(sent))
+		}
+		if sent[0].AccountID != account.ID || sent[0].From != "grandpa@example.com" {
+			t.Errorf("sent from %s by %s", sent[0].From, sent[0].AccountID)
+		}
+		if want := []string{"kid@example.com", "aunt@example.com"}; !reflect.DeepEqual(sent[0].Recipients, want) {
+			t.Errorf("recipients = %v, want %v", sent[0].Recipients, want)
+		}
+		if strings.Contains(string(sent[0].Raw), "aunt@example.com") {
+			t.Errorf("rendered message names the Bcc recipient:\n%s", sent[0].Raw)
+		}
+	})
+}
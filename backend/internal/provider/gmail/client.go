@@ -0,0 +1,332 @@
+package gmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrHistoryExpired is returned when the start history ID is too old for
+// the server to compute changes and a full sync is required
+var ErrHistoryExpired = errors.New("gmail history ID expired")
+
+const requestTimeout = time.Minute
+
+// Client is a minimal Gmail REST API client for the authenticated user
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewClient creates a Gmail client. Requests are authorized with tokens from
+// ts, which refreshes the access token when it expires.
+func NewClient(ctx context.Context, baseURL string, ts oauth2.TokenSource) *Client {
+	httpClient := oauth2.NewClient(ctx, ts)
+	httpClient.Timeout = requestTimeout
+
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/") + "/gmail/v1/users/me",
+		httpClient: httpClient,
+	}
+}
+
+// Header is a single message header
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// MessagePart is a node of a message's MIME tree
+type MessagePart struct {
+	PartID   string         `json:"partId"`
+	MimeType string         `json:"mimeType"`
+	Filename string         `json:"filename"`
+	Headers  []Header       `json:"headers"`
+	Parts    []*MessagePart `json:"parts"`
+}
+
+// Message is a Gmail message resource
+type Message struct {
+	ID           string       `json:"id"`
+	ThreadID     string       `json:"threadId"`
+	LabelIDs     []string     `json:"labelIds"`
+	Snippet      string       `json:"snippet"`
+	HistoryID    string       `json:"historyId"`
+	InternalDate string       `json:"internalDate"` // milliseconds since epoch
+	Payload      *MessagePart `json:"payload"`
+}
+
+// Profile is the mailbox profile of the authenticated user
+type Profile struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryID    string `json:"historyId"`
+}
+
+// MessageList is one page of messages.list
+type MessageList struct {
+	Messages      []Message `json:"messages"`
+	NextPageToken string    `json:"nextPageToken"`
+}
+
+// HistoryMessage wraps a message referenced by a history record
+type HistoryMessage struct {
+	Message  Message  `json:"message"`
+	LabelIDs []string `json:"labelIds"`
+}
+
+// History is one change record
+type History struct {
+	ID              string           `json:"id"`
+	MessagesAdded   []HistoryMessage `json:"messagesAdded"`
+	MessagesDeleted []HistoryMessage `json:"messagesDeleted"`
+	LabelsAdded     []HistoryMessage `json:"labelsAdded"`
+	LabelsRemoved   []HistoryMessage `json:"labelsRemoved"`
+}
+
+// HistoryList is one page of history.list
+type HistoryList struct {
+	History       []History `json:"history"`
+	HistoryID     string    `json:"historyId"`
+	NextPageToken string    `json:"nextPageToken"`
+}
+
+// messageFields limits message responses to metadata and the part tree,
+// leaving out body data
+const messageFields = "id,threadId,labelIds,snippet,historyId,internalDate," +
+	"payload(mimeType,filename,headers,parts(mimeType,filename,headers,parts(mimeType,filename,headers,parts(mimeType,filename,headers))))"
+
+// GetProfile returns the mailbox profile, including the current history ID
+func (c *Client) GetProfile(ctx context.Context) (*Profile, error) {
+	profile := &Profile{}
+	if err := c.get(ctx, "/profile", nil, profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// ListMessages returns one page of message IDs, newest first
+func (c *Client) ListMessages(ctx context.Context, pageToken string) (*MessageList, error) {
+	query := url.Values{"maxResults": {"500"}}
+	if pageToken != "" {
+		query.Set("pageToken", pageToken)
+	}
+
+	list := &MessageList{}
+	if err := c.get(ctx, "/messages", query, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetMessage returns the metadata of a single message
+func (c *Client) GetMessage(ctx context.Context, id string) (*Message, error) {
+	query := url.Values{"format": {"full"}, "fields": {messageFields}}
+
+	msg := &Message{}
+	if err := c.get(ctx, "/messages/"+url.PathEscape(id), query, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// GetRawMessage returns the full RFC 822 source of a message
+func (c *Client) GetRawMessage(ctx context.Context, id string) ([]byte, error) {
+	query := url.Values{"format": {"raw"}, "fields": {"raw"}}
+
+	var msg struct {
+		Raw string `json:"raw"`
+	}
+	if err := c.get(ctx, "/messages/"+url.PathEscape(id), query, &msg); err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		// Gmail normally pads, but accept unpadded data too
+		raw, err = base64.RawURLEncoding.DecodeString(msg.Raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode raw message: %w", err)
+	}
+	return raw, nil
+}
+
+// ListHistory returns one page of changes since startHistoryID
+func (c *Client) ListHistory(ctx context.Context, startHistoryID, pageToken string) (*HistoryList, error) {
+	query := url.Values{
+		"startHistoryId": {startHistoryID},
+		"maxResults":     {"500"},
+		"historyTypes":   {"messageAdded", "messageDeleted", "labelAdded", "labelRemoved"},
+	}
+	if pageToken != "" {
+		query.Set("pageToken", pageToken)
+	}
+
+	list := &HistoryList{}
+	err := c.get(ctx, "/history", query, list)
+	if IsNotFound(err) {
+		return nil, ErrHistoryExpired
+	}
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// SendMessage sends a complete RFC 5322 message. Gmail takes the
+// recipients from its headers, so recipients that must not be shown, such
+// as Bcc, are passed separately and added as a Bcc header that Gmail
+// removes before delivery.
+func (c *Client) SendMessage(ctx context.Context, raw []byte, bcc []string) (*Message, error) {
+	if len(bcc) > 0 {
+		raw = append([]byte("Bcc: "+strings.Join(bcc, ", ")+"\r\n"), raw...)
+	}
+	body := map[string]string{"raw": base64.URLEncoding.EncodeToString(raw)}
+
+	msg := &Message{}
+	if err := c.post(ctx, "/messages/send", body, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// ModifyLabels adds and removes labels of a message
+func (c *Client) ModifyLabels(ctx context.Context, id string, add, remove []string) error {
+	body := map[string][]string{"addLabelIds": add, "removeLabelIds": remove}
+	return c.post(ctx, "/messages/"+url.PathEscape(id)+"/modify", body, nil)
+}
+
+// TrashMessage moves a message to the trash
+func (c *Client) TrashMessage(ctx context.Context, id string) error {
+	return c.post(ctx, "/messages/"+url.PathEscape(id)+"/trash", struct{}{}, nil)
+}
+
+// Draft is a Gmail draft
+type Draft struct {
+	ID      string  `json:"id"`
+	Message Message `json:"message"`
+}
+
+// CreateDraft stores a complete RFC 5322 message as a new draft
+func (c *Client) CreateDraft(ctx context.Context, raw []byte) (*Draft, error) {
+	body := map[string]interface{}{"message": map[string]string{"raw": base64.URLEncoding.EncodeToString(raw)}}
+
+	draft := &Draft{}
+	if err := c.post(ctx, "/drafts", body, draft); err != nil {
+		return nil, err
+	}
+	return draft, nil
+}
+
+// UpdateDraft replaces the message of a draft
+func (c *Client) UpdateDraft(ctx context.Context, id string, raw []byte) (*Draft, error) {
+	body := map[string]interface{}{"id": id, "message": map[string]string{"raw": base64.URLEncoding.EncodeToString(raw)}}
+
+	draft := &Draft{}
+	if err := c.put(ctx, "/drafts/"+url.PathEscape(id), body, draft); err != nil {
+		return nil, err
+	}
+	return draft, nil
+}
+
+// DeleteDraft permanently deletes a draft
+func (c *Client) DeleteDraft(ctx context.Context, id string) error {
+	return c.delete(ctx, "/drafts/"+url.PathEscape(id))
+}
+
+// APIError is a non-2xx response from the Gmail API
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("gmail API returned %d: %s", e.StatusCode, e.Body)
+}
+
+// IsNotFound reports whether err is a 404 from the Gmail API
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	return c.do(req, out)
+}
+
+func (c *Client) post(ctx context.Context, path string, body, out interface{}) error {
+	return c.write(ctx, http.MethodPost, path, body, out)
+}
+
+func (c *Client) put(ctx context.Context, path string, body, out interface{}) error {
+	return c.write(ctx, http.MethodPut, path, body, out)
+}
+
+func (c *Client) delete(ctx context.Context, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	return c.do(req, nil)
+}
+
+func (c *Client) write(ctx context.Context, method, path string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, out)
+}
+
+func (c *Client) do(req *http.Request, out interface{}) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("gmail request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &APIError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode gmail response: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/vault"
+)
+
+// Provider implements provider.MailProvider for Gmail. Sync stays with
+// Syncer, which follows the mailbox history rather than a single cursor.
+type Provider struct {
+	connector *Connector
+}
+
+// NewProvider creates a new Gmail provider
+func NewProvider(cfg *config.EmailConfig, v *vault.Vault) *Provider {
+	return &Provider{connector: NewConnector(cfg, v)}
+}
+
+// Name returns ProviderName
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// ListChanges is not supported; Syncer syncs Gmail accounts
+func (p *Provider) ListChanges(ctx context.Context, account *models.EmailAccount, cursor string) (*provider.Changes, error) {
+	return nil, provider.ErrUnsupported
+}
+
+// FetchMessage returns the raw source of a message
+func (p *Provider) FetchMessage(ctx context.Context, account *models.EmailAccount, externalID string) ([]byte, error) {
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := client.GetRawMessage(ctx, externalID)
+	return raw, classify(err)
+}
+
+// Send sends a rendered message. Gmail reads the recipients from the
+// message headers, so Bcc recipients are passed along for SendMessage to
+// add.
+func (p *Provider) Send(ctx context.Context, account *models.EmailAccount, from string, recipients []string, raw []byte) error {
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return err
+	}
+	_, err = client.SendMessage(ctx, raw, provider.HiddenRecipients(raw, recipients))
+	return classify(err)
+}
+
+// SetFlags maps read and starred onto the UNREAD and STARRED labels
+func (p *Provider) SetFlags(ctx context.Context, account *models.EmailAccount, externalID string, flags provider.Flags) error {
+	var add, remove []string
+	if flags.Read != nil {
+		if *flags.Read {
+			remove = append(remove, "UNREAD")
+		} else {
+			add = append(add, "UNREAD")
+		}
+	}
+	if flags.Starred != nil {
+		if *flags.Starred {
+			add = append(add, "STARRED")
+		} else {
+			remove = append(remove, "STARRED")
+		}
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		return nil
+	}
+
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return err
+	}
+	return classify(client.ModifyLabels(ctx, externalID, add, remove))
+}
+
+// Move adds or removes the INBOX label, or moves the message to the trash
+func (p *Provider) Move(ctx context.Context, account *models.EmailAccount, externalID string, folder provider.Folder) error {
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	switch folder {
+	case provider.FolderInbox:
+		err = client.ModifyLabels(ctx, externalID, []string{"INBOX"}, nil)
+	case provider.FolderArchive:
+		err = client.ModifyLabels(ctx, externalID, nil, []string{"INBOX"})
+	case provider.FolderTrash:
+		err = client.TrashMessage(ctx, externalID)
+	default:
+		return provider.ErrUnsupported
+	}
+	return classify(err)
+}
+
+// classify maps Gmail API errors onto the provider errors
+func classify(err error) error {
+	if IsNotFound(err) {
+		return provider.ErrMessageGone
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && provider.IsPermanentStatus(apiErr.StatusCode) {
+		return provider.Permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package gmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/mail"
+	"testing"
+
+	"github.com/jay/dadmail/internal/mailer"
+)
+
+func TestSendAddsBccHeader(t *testing.T) {
+	srv := newGmailServer(t)
+	v, account := newTestAccount(t)
+
+	msg := &mailer.Message{
+		From:    mail.Address{Name: "Grandpa", Address: "grandpa@gmail.com"},
+		To:      []mail.Address{{Address: "kid@example.com"}},
+		Cc:      []mail.Address{{Address: "aunt@example.com"}},
+		Bcc:     []mail.Address{{Address: "hidden@example.com"}, {Address: "KID@example.com"}},
+		Subject: "Sunday lunch",
+		Text:    "See you at noon.\n",
+	}
+	raw, err := msg.Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if err := NewProvider(srv.config(), v).Send(context.Background(), account, msg.From.Address, msg.Recipients(), raw); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if len(srv.sent) != 1 {
+		t.Fatalf("messages.send called %d times, want 1", len(srv.sent))
+	}
+	payload, err := base64.URLEncoding.DecodeString(srv.sent[0])
+	if err != nil {
+		t.Fatalf("raw payload is not base64url: %v", err)
+	}
+	sent, err := mail.ReadMessage(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("raw payload is not a message: %v", err)
+	}
+	if bcc := sent.Header.Get("Bcc"); bcc != "hidden@example.com" {
+		t.Errorf("Bcc header = %q, want only the recipient not in To or Cc", bcc)
+	}
+	if to, cc := sent.Header.Get("To"), sent.Header.Get("Cc"); to != "<kid@example.com>" || cc != "<aunt@example.com>" {
+		t.Errorf("To = %q, Cc = %q", to, cc)
+	}
+	if !bytes.HasSuffix(payload, raw) {
+		t.Errorf("payload does not end with the built message:\n%s", payload)
+	}
+}
+
+func TestSendWithoutBccLeavesMessageAlone(t *testing.T) {
+	srv := newGmailServer(t)
+	v, account := newTestAccount(t)
+
+	raw := []byte("From: grandpa@gmail.com\r\nTo: kid@example.com\r\nSubject: hi\r\n\r\nHello\r\n")
+	if err := NewProvider(srv.config(), v).Send(context.Background(), account, "grandpa@gmail.com", []string{"kid@example.com"}, raw); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	payload, err := base64.URLEncoding.DecodeString(srv.sent[0])
+	if err != nil {
+		t.Fatalf("raw payload is not base64url: %v", err)
+	}
+	if !bytes.Equal(payload, raw) {
+		t.Errorf("payload = %q, want the message unchanged", payload)
+	}
+}
@@ -0,0 +1,395 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/mimeparse"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"golang.org/x/oauth2"
+)
+
+// ProviderName is the email_accounts.provider value handled by this package
+const ProviderName = "gmail"
+
+// historyFolder is the sync_state folder holding the account's history ID.
+// Gmail tracks changes mailbox-wide, so there is one cursor per account.
+const historyFolder = "*"
+
+// DecryptCredentials decrypts an account's Gmail OAuth credentials
+func DecryptCredentials(v *vault.Vault, account *models.EmailAccount) (*vault.OAuthCredentials, error) {
+	creds, err := v.Open(account.ID, account.CredentialsEncrypted)
+	if err != nil {
+		return nil, err
+	}
+	if creds.OAuth == nil || creds.OAuth.RefreshToken == "" {
+		return nil, fmt.Errorf("credentials are missing a refresh token")
+	}
+
+	return creds.OAuth, nil
+}
+
+// Scope grants read, label and send access, which sync and state
+// write-back need
+const Scope = "https://www.googleapis.com/auth/gmail.modify"
+
+// NewOAuthConfig returns the OAuth2 client configuration for Google
+func NewOAuthConfig(cfg *config.EmailConfig) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     cfg.GmailClientID,
+		ClientSecret: cfg.GmailClientSecret,
+		RedirectURL:  cfg.GmailRedirectURL,
+		Scopes:       []string{Scope},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   cfg.GmailAuthURL,
+			TokenURL:  cfg.GmailTokenURL,
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+	}
+}
+
+// Connector builds authorized API clients for stored Gmail accounts
+type Connector struct {
+	vault       *vault.Vault
+	oauthConfig *oauth2.Config
+	apiURL      string
+}
+
+// NewConnector creates a new Gmail connector
+func NewConnector(cfg *config.EmailConfig, v *vault.Vault) *Connector {
+	return &Connector{
+		vault:       v,
+		oauthConfig: NewOAuthConfig(cfg),
+		apiURL:      cfg.GmailAPIURL,
+	}
+}
+
+// Client returns an API client for the account that refreshes its access
+// token automatically
+func (c *Connector) Client(ctx context.Context, account *models.EmailAccount) (*Client, error) {
+	creds, err := DecryptCredentials(c.vault, account)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := c.oauthConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: creds.RefreshToken})
+	return NewClient(ctx, c.apiURL, ts), nil
+}
+
+// Syncer performs history ID based incremental sync of Gmail accounts into
+// the emails table
+type Syncer struct {
+	accountRepo *repository.EmailAccountRepository
+	emailRepo   *repository.EmailRepository
+	stateRepo   *repository.SyncStateRepository
+	connector   *Connector
+}
+
+// NewSyncer creates a new Gmail syncer
+func NewSyncer(db *sqlx.DB, cfg *config.EmailConfig, v *vault.Vault) *Syncer {
+	return &Syncer{
+		accountRepo: repository.NewEmailAccountRepository(db),
+		emailRepo:   repository.NewEmailRepository(db),
+		stateRepo:   repository.NewSyncStateRepository(db),
+		connector:   NewConnector(cfg, v),
+	}
+}
+
+// SyncAll syncs every Gmail account with sync enabled. Failures are logged
+// per account so one broken mailbox does not block the others.
+func (s *Syncer) SyncAll(ctx context.Context) error {
+	accounts, err := s.accountRepo.ListSyncEnabled(ProviderName)
+	if err != nil {
+		return err
+	}
+
+	for i := range accounts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.SyncAccount(ctx, &accounts[i]); err != nil {
+			log.Printf("Gmail sync failed for account %s: %v", accounts[i].ID, err)
+		}
+	}
+
+	return nil
+}
+
+// SyncAccount runs a full sync for accounts without a history ID and an
+// incremental sync otherwise
+func (s *Syncer) SyncAccount(ctx context.Context, account *models.EmailAccount) error {
+	client, err := s.connector.Client(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	state, err := s.stateRepo.Get(account.ID, historyFolder)
+	if err != nil {
+		return err
+	}
+
+	var historyID string
+	if state.Cursor == nil {
+		historyID, err = s.fullSync(ctx, client, account)
+	} else {
+		historyID, err = s.incrementalSync(ctx, client, account, *state.Cursor)
+		if err == ErrHistoryExpired {
+			log.Printf("Gmail history expired for account %s, running full sync", account.ID)
+			historyID, err = s.fullSync(ctx, client, account)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	state.Cursor = &historyID
+	if err := s.stateRepo.Save(state); err != nil {
+		return err
+	}
+
+	return s.accountRepo.UpdateLastSynced(account.ID, time.Now())
+}
+
+// fullSync lists every message, stores it and removes local rows that no
+// longer exist. It returns the history ID to continue from.
+func (s *Syncer) fullSync(ctx context.Context, client *Client, account *models.EmailAccount) (string, error) {
+	// Take the history ID first so changes made during the listing are
+	// picked up by the next incremental sync
+	profile, err := client.GetProfile(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	seen := map[string]bool{}
+	pageToken := ""
+	for {
+		page, err := client.ListMessages(ctx, pageToken)
+		if err != nil {
+			return "", err
+		}
+
+		for _, ref := range page.Messages {
+			stored, err := s.syncMessage(ctx, client, account.ID, ref.ID)
+			if err != nil {
+				return "", err
+			}
+			if stored {
+				seen[ref.ID] = true
+			}
+		}
+
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+
+	known, err := s.emailRepo.ListExternalIDsByPrefix(account.ID, "")
+	if err != nil {
+		return "", err
+	}
+	var removed []string
+	for _, id := range known {
+		if !seen[id] {
+			removed = append(removed, id)
+		}
+	}
+	if err := s.emailRepo.DeleteByExternalIDs(account.ID, removed); err != nil {
+		return "", err
+	}
+
+	return profile.HistoryID, nil
+}
+
+// incrementalSync applies the changes recorded since startHistoryID and
+// returns the new history ID
+func (s *Syncer) incrementalSync(ctx context.Context, client *Client, account *models.EmailAccount, startHistoryID string) (string, error) {
+	changed := map[string]bool{}
+	deleted := map[string]bool{}
+	historyID := startHistoryID
+
+	pageToken := ""
+	for {
+		page, err := client.ListHistory(ctx, startHistoryID, pageToken)
+		if err != nil {
+			return "", err
+		}
+
+		for _, h := range page.History {
+			for _, group := range [][]HistoryMessage{h.MessagesAdded, h.LabelsAdded, h.LabelsRemoved} {
+				for _, m := range group {
+					changed[m.Message.ID] = true
+				}
+			}
+			for _, m := range h.MessagesDeleted {
+				deleted[m.Message.ID] = true
+			}
+		}
+		if page.HistoryID != "" {
+			historyID = page.HistoryID
+		}
+
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+
+	var removed []string
+	for id := range deleted {
+		delete(changed, id)
+		removed = append(removed, id)
+	}
+
+	for id := range changed {
+		stored, err := s.syncMessage(ctx, client, account.ID, id)
+		if err != nil {
+			return "", err
+		}
+		if !stored {
+			removed = append(removed, id)
+		}
+	}
+
+	if err := s.emailRepo.DeleteByExternalIDs(account.ID, removed); err != nil {
+		return "", err
+	}
+
+	return historyID, nil
+}
+
+// syncMessage fetches and stores one message. It returns false when the
+// message is gone or should not be shown (drafts, trash, spam).
+func (s *Syncer) syncMessage(ctx context.Context, client *Client, accountID uuid.UUID, id string) (bool, error) {
+	msg, err := client.GetMessage(ctx, id)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if hasLabel(msg.LabelIDs, "DRAFT") || hasLabel(msg.LabelIDs, "TRASH") || hasLabel(msg.LabelIDs, "SPAM") {
+		return false, nil
+	}
+
+	if err := s.emailRepo.Upsert(toEmail(accountID, msg)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// toEmail converts a Gmail message into an email row
+func toEmail(accountID uuid.UUID, msg *Message) *models.Email {
+	email := &models.Email{
+		AccountID:   accountID,
+		ExternalID:  msg.ID,
+		IsRead:      !hasLabel(msg.LabelIDs, "UNREAD"),
+		IsStarred:   hasLabel(msg.LabelIDs, "STARRED"),
+		IsArchived:  !hasLabel(msg.LabelIDs, "INBOX") && !hasLabel(msg.LabelIDs, "SENT"),
+		ToAddresses: pq.StringArray{},
+		CcAddresses: pq.StringArray{},
+	}
+
+	if msg.ThreadID != "" {
+		threadID := msg.ThreadID
+		email.ThreadID = &threadID
+	}
+	if msg.Snippet != "" {
+		snippet := msg.Snippet
+		email.Snippet = &snippet
+	}
+	if ms, err := strconv.ParseInt(msg.InternalDate, 10, 64); err == nil {
+		email.ReceivedAt = time.UnixMilli(ms).UTC()
+	}
+
+	if msg.Payload != nil {
+		for _, h := range msg.Payload.Headers {
+			switch strings.ToLower(h.Name) {
+			case "from":
+				if addr, err := mimeparse.ParseAddress(h.Value); err == nil {
+					email.FromAddress = addr.Address
+					if addr.Name != "" {
+						name := addr.Name
+						email.FromName = &name
+					}
+				} else {
+					email.FromAddress = h.Value
+				}
+			case "to":
+				email.ToAddresses = parseAddressList(h.Value)
+			case "cc":
+				email.CcAddresses = parseAddressList(h.Value)
+			case "subject":
+				subject := mimeparse.DecodeHeader(h.Value)
+				email.Subject = &subject
+			case "date":
+				if email.ReceivedAt.IsZero() {
+					if t, err := mail.ParseDate(h.Value); err == nil {
+						email.ReceivedAt = t
+					}
+				}
+			}
+		}
+		email.HasAttachments = hasAttachments(msg.Payload)
+	}
+
+	if email.ReceivedAt.IsZero() {
+		email.ReceivedAt = time.Now()
+	}
+
+	return email
+}
+
+func parseAddressList(value string) pq.StringArray {
+	list := pq.StringArray{}
+	for _, addr := range mimeparse.ParseAddressList(value) {
+		list = append(list, addr.Address)
+	}
+	return list
+}
+
+// hasAttachments reports whether any part of the message is an attachment.
+// Inline images referenced by Content-ID do not count.
+func hasAttachments(part *MessagePart) bool {
+	var disposition, contentID string
+	for _, h := range part.Headers {
+		switch strings.ToLower(h.Name) {
+		case "content-disposition":
+			disposition, _, _ = mime.ParseMediaType(h.Value)
+		case "content-id":
+			contentID = strings.Trim(strings.TrimSpace(h.Value), "<>")
+		}
+	}
+	if mimeparse.IsAttachment(part.MimeType, disposition, part.Filename, contentID) {
+		return true
+	}
+
+	for _, child := range part.Parts {
+		if hasAttachments(child) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,319 @@
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jmoiron/sqlx"
+)
+
+// gmailServer is an httptest stand-in for the Gmail API and Google's token
+// endpoint. Every change bumps the history ID and is recorded so
+// history.list can replay it.
+type gmailServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	messages  map[string]*Message
+	order     []string
+	historyID int
+	history   []History
+	// expiredBefore is the oldest start history ID history.list accepts
+	expiredBefore int
+	// sent holds the raw payloads of messages.send
+	sent []string
+}
+
+func newGmailServer(t *testing.T) *gmailServer {
+	t.Helper()
+	s := &gmailServer{messages: map[string]*Message{}, historyID: 100}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"access_token": "access", "token_type": "Bearer", "expires_in": 3600})
+	})
+	mux.HandleFunc("GET /gmail/v1/users/me/profile", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		writeJSON(w, Profile{EmailAddress: "grandpa@gmail.com", HistoryID: strconv.Itoa(s.historyID)})
+	})
+	mux.HandleFunc("GET /gmail/v1/users/me/messages", s.listMessages)
+	mux.HandleFunc("GET /gmail/v1/users/me/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		msg, ok := s.messages[r.PathValue("id")]
+		if !ok {
+			http.Error(w, `{"error":{"code":404}}`, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, msg)
+	})
+	mux.HandleFunc("GET /gmail/v1/users/me/history", s.listHistory)
+	mux.HandleFunc("POST /gmail/v1/users/me/messages/send", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Raw string `json:"raw"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.sent = append(s.sent, body.Raw)
+		writeJSON(w, Message{ID: "sent-" + strconv.Itoa(len(s.sent))})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// config returns an EmailConfig pointing at the stand-in
+func (s *gmailServer) config() *config.EmailConfig {
+	return &config.EmailConfig{
+		GmailClientID: "client",
+		GmailAPIURL:   s.URL,
+		GmailTokenURL: s.URL + "/token",
+	}
+}
+
+// deliver adds a message and records it in the history
+func (s *gmailServer) deliver(id, subject string, labels ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages[id] = &Message{
+		ID:           id,
+		ThreadID:     "thread-" + id,
+		LabelIDs:     labels,
+		Snippet:      "About " + subject,
+		InternalDate: "1772366400000",
+		Payload: &MessagePart{
+			MimeType: "text/plain",
+			Headers: []Header{
+				{Name: "From", Value: "Kid <kid@example.com>"},
+				{Name: "To", Value: "grandpa@gmail.com"},
+				{Name: "Subject", Value: subject},
+			},
+		},
+	}
+	s.order = append(s.order, id)
+	s.record(History{MessagesAdded: []HistoryMessage{{Message: Message{ID: id}}}})
+}
+
+// setLabels replaces the labels of a message, as a label change
+func (s *gmailServer) setLabels(id string, labels ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages[id].LabelIDs = labels
+	s.record(History{LabelsAdded: []HistoryMessage{{Message: Message{ID: id}, LabelIDs: labels}}})
+}
+
+// remove deletes a message for good
+func (s *gmailServer) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.messages, id)
+	for i, o := range s.order {
+		if o == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	s.record(History{MessagesDeleted: []HistoryMessage{{Message: Message{ID: id}}}})
+}
+
+// expireHistory makes history.list reject every start ID handed out so far
+func (s *gmailServer) expireHistory() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiredBefore = s.historyID + 1
+}
+
+func (s *gmailServer) record(h History) {
+	s.historyID++
+	h.ID = strconv.Itoa(s.historyID)
+	s.history = append(s.history, h)
+}
+
+// listMessages pages through the messages two at a time, newest first
+func (s *gmailServer) listMessages(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	list := MessageList{}
+	for i := len(s.order) - 1 - offset; i >= 0 && len(list.Messages) < 2; i-- {
+		list.Messages = append(list.Messages, Message{ID: s.order[i], ThreadID: "thread-" + s.order[i]})
+	}
+	if offset+len(list.Messages) < len(s.order) {
+		list.NextPageToken = strconv.Itoa(offset + len(list.Messages))
+	}
+	writeJSON(w, list)
+}
+
+// listHistory returns the records after startHistoryId, or 404 once the
+// start ID has expired
+func (s *gmailServer) listHistory(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start, err := strconv.Atoi(r.URL.Query().Get("startHistoryId"))
+	if err != nil || start < s.expiredBefore {
+		http.Error(w, `{"error":{"code":404,"message":"Requested entity was not found."}}`, http.StatusNotFound)
+		return
+	}
+	list := HistoryList{HistoryID: strconv.Itoa(s.historyID)}
+	for _, h := range s.history {
+		if id, _ := strconv.Atoi(h.ID); id > start {
+			list.History = append(list.History, h)
+		}
+	}
+	writeJSON(w, list)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// newTestAccount returns a vault and a Gmail account whose credentials
+// are sealed with it
+func newTestAccount(t *testing.T) (*vault.Vault, *models.EmailAccount) {
+	t.Helper()
+
+	v, err := vault.New(map[string]string{"k1": "0123456789abcdef0123456789abcdef"}, "k1")
+	if err != nil {
+		t.Fatalf("vault: %v", err)
+	}
+	account := &models.EmailAccount{
+		ID:           uuid.New(),
+		Provider:     ProviderName,
+		EmailAddress: "grandpa@gmail.com",
+		SyncEnabled:  true,
+	}
+	account.CredentialsEncrypted, err = v.Seal(account.ID, &vault.Credentials{
+		OAuth: &vault.OAuthCredentials{RefreshToken: "refresh"},
+	})
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	return v, account
+}
+
+// storedEmails returns the account's emails by external ID
+func storedEmails(t *testing.T, db *sqlx.DB, accountID uuid.UUID) map[string]models.Email {
+	t.Helper()
+	var emails []models.Email
+	if err := db.Select(&emails, `SELECT * FROM emails WHERE account_id = $1`, accountID); err != nil {
+		t.Fatalf("select emails: %v", err)
+	}
+	byID := map[string]models.Email{}
+	for _, e := range emails {
+		byID[e.ExternalID] = e
+	}
+	return byID
+}
+
+func assertExternalIDs(t *testing.T, emails map[string]models.Email, want ...string) {
+	t.Helper()
+	if len(emails) != len(want) {
+		t.Errorf("stored %d emails, want %d: %v", len(emails), len(want), emails)
+	}
+	for _, id := range want {
+		if _, ok := emails[id]; !ok {
+			t.Errorf("email %s was not stored", id)
+		}
+	}
+}
+
+func storedHistoryID(t *testing.T, db *sqlx.DB, accountID uuid.UUID) string {
+	t.Helper()
+	state, err := repository.NewSyncStateRepository(db).Get(accountID, historyFolder)
+	if err != nil {
+		t.Fatalf("sync state: %v", err)
+	}
+	if state.Cursor == nil {
+		return ""
+	}
+	return *state.Cursor
+}
+
+func TestSyncAccount(t *testing.T) {
+	db := testdb.Open(t)
+	srv := newGmailServer(t)
+	v, account := newTestAccount(t)
+	account.UserID = testdb.CreateUser(t, db)
+	testdb.CreateAccount(t, db, account)
+	syncer := NewSyncer(db, srv.config(), v)
+	ctx := context.Background()
+
+	srv.deliver("m1", "Lunch on Sunday", "INBOX", "UNREAD")
+	srv.deliver("m2", "Photos", "INBOX", "STARRED")
+	srv.deliver("m3", "Old news")
+	srv.deliver("d1", "Unsent", "DRAFT")
+
+	// Full sync: no history ID stored yet
+	if err := syncer.SyncAccount(ctx, account); err != nil {
+		t.Fatalf("full sync: %v", err)
+	}
+	emails := storedEmails(t, db, account.ID)
+	assertExternalIDs(t, emails, "m1", "m2", "m3")
+	m1 := emails["m1"]
+	if m1.Subject == nil || *m1.Subject != "Lunch on Sunday" || m1.FromAddress != "kid@example.com" {
+		t.Errorf("stored metadata = %+v", m1)
+	}
+	if m1.IsRead || !emails["m2"].IsStarred || !emails["m3"].IsArchived {
+		t.Errorf("labels not mapped: m1 read=%v, m2 starred=%v, m3 archived=%v",
+			m1.IsRead, emails["m2"].IsStarred, emails["m3"].IsArchived)
+	}
+	if m1.ThreadID == nil || *m1.ThreadID != "thread-m1" {
+		t.Errorf("thread ID = %v", m1.ThreadID)
+	}
+	if got := storedHistoryID(t, db, account.ID); got != "104" {
+		t.Errorf("history ID after full sync = %q, want 104", got)
+	}
+
+	t.Run("incremental", func(t *testing.T) {
+		srv.deliver("m4", "Birthday", "INBOX", "UNREAD")
+		srv.setLabels("m1", "INBOX")
+		srv.setLabels("m2", "TRASH")
+		srv.remove("m3")
+		if err := syncer.SyncAccount(ctx, account); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+
+		emails := storedEmails(t, db, account.ID)
+		assertExternalIDs(t, emails, "m1", "m4")
+		if !emails["m1"].IsRead {
+			t.Errorf("label change was not applied")
+		}
+		if got := storedHistoryID(t, db, account.ID); got != "108" {
+			t.Errorf("history ID after incremental sync = %q, want 108", got)
+		}
+	})
+
+	t.Run("expired history ID", func(t *testing.T) {
+		srv.expireHistory()
+		srv.deliver("m5", "Recipe", "INBOX")
+		srv.remove("m4")
+
+		if err := syncer.SyncAccount(ctx, account); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		assertExternalIDs(t, storedEmails(t, db, account.ID), "m1", "m5")
+		if got := storedHistoryID(t, db, account.ID); got != "110" {
+			t.Errorf("history ID after fallback = %q, want 110", got)
+		}
+	})
+}
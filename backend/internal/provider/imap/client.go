@@ -0,0 +1,132 @@
+package imap
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/vault"
+)
+
+const (
+	// SecurityTLS connects with implicit TLS (usually port 993)
+	SecurityTLS = "tls"
+	// SecurityStartTLS upgrades a plain connection with STARTTLS (usually port 143)
+	SecurityStartTLS = "starttls"
+	// SecurityNone uses an unencrypted connection (local testing only)
+	SecurityNone = "none"
+
+	dialTimeout    = 30 * time.Second
+	commandTimeout = 2 * time.Minute
+)
+
+// Credentials holds the IMAP login settings of an account. It mirrors
+// vault.IMAPCredentials.
+type Credentials struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Security string `json:"security"` // tls, starttls, none
+}
+
+// Addr returns the host:port address of the IMAP server
+func (c *Credentials) Addr() string {
+	port := c.Port
+	if port == 0 {
+		port = 993
+		if c.Security == SecurityStartTLS || c.Security == SecurityNone {
+			port = 143
+		}
+	}
+	return net.JoinHostPort(c.Host, strconv.Itoa(port))
+}
+
+// DecryptCredentials decrypts and parses an account's IMAP credentials
+func DecryptCredentials(v *vault.Vault, account *models.EmailAccount) (*Credentials, error) {
+	sealed, err := v.Open(account.ID, account.CredentialsEncrypted)
+	if err != nil {
+		return nil, err
+	}
+	if sealed.IMAP == nil || sealed.IMAP.Host == "" || sealed.IMAP.Username == "" {
+		return nil, fmt.Errorf("credentials are missing IMAP host or username")
+	}
+
+	creds := Credentials(*sealed.IMAP)
+	return &creds, nil
+}
+
+// Connect dials the IMAP server described by creds and logs in
+func Connect(creds *Credentials) (*client.Client, error) {
+	return connect(context.Background(), &net.Dialer{Timeout: dialTimeout}, creds)
+}
+
+// Verify checks that the server accepts the login in creds. It connects
+// through dialer, which lets callers keep user-supplied hosts off private
+// networks, and gives up when ctx is done.
+func Verify(ctx context.Context, dialer *net.Dialer, creds *Credentials) error {
+	c, err := connect(ctx, dialer, creds)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = c.Terminate() })
+	defer stop()
+
+	return c.Logout()
+}
+
+// connect dials and logs in, closing the connection if ctx is done first
+func connect(ctx context.Context, dialer *net.Dialer, creds *Credentials) (*client.Client, error) {
+	tlsConfig := &tls.Config{ServerName: creds.Host}
+	d := contextDialer{ctx: ctx, dialer: dialer}
+
+	var (
+		c   *client.Client
+		err error
+	)
+	switch creds.Security {
+	case SecurityTLS, "":
+		c, err = client.DialWithDialerTLS(d, creds.Addr(), tlsConfig)
+	case SecurityStartTLS, SecurityNone:
+		c, err = client.DialWithDialer(d, creds.Addr())
+	default:
+		return nil, fmt.Errorf("unknown IMAP security mode %q", creds.Security)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", creds.Addr(), err)
+	}
+	c.Timeout = commandTimeout
+
+	stop := context.AfterFunc(ctx, func() { _ = c.Terminate() })
+	defer stop()
+
+	if creds.Security == SecurityStartTLS {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			_ = c.Logout()
+			return nil, fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+
+	if err := c.Login(creds.Username, creds.Password); err != nil {
+		_ = c.Logout()
+		return nil, fmt.Errorf("failed to log in: %w", err)
+	}
+
+	return c, nil
+}
+
+// contextDialer adapts a net.Dialer to go-imap's Dialer, which has no
+// context
+type contextDialer struct {
+	ctx    context.Context
+	dialer *net.Dialer
+}
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.dialer.DialContext(d.ctx, network, addr)
+}
@@ -0,0 +1,106 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// defaultDraftsFolder is created to save drafts into when the server has
+// no drafts folder
+const defaultDraftsFolder = "Drafts"
+
+// SaveDraft appends a rendered draft to the drafts folder and removes the
+// previous copy, identified by its Message-ID, once the new one is stored
+func SaveDraft(creds *Credentials, raw []byte, previousMessageID string) error {
+	c, err := Connect(creds)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	folder, err := draftsFolder(c, true)
+	if err != nil {
+		return err
+	}
+
+	flags := []string{goimap.DraftFlag, goimap.SeenFlag}
+	if err := c.Append(folder, flags, time.Now(), bytes.NewBuffer(raw)); err != nil {
+		return fmt.Errorf("failed to append draft to %s: %w", folder, err)
+	}
+
+	if previousMessageID == "" {
+		return nil
+	}
+	return removeDraft(c, folder, previousMessageID)
+}
+
+// DeleteDraft removes the copy of a draft with the given Message-ID from
+// the drafts folder. A copy that is already gone is not an error.
+func DeleteDraft(creds *Credentials, messageID string) error {
+	c, err := Connect(creds)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	folder, err := draftsFolder(c, false)
+	if err != nil || folder == "" {
+		return err
+	}
+	return removeDraft(c, folder, messageID)
+}
+
+// draftsFolder returns the name of the drafts folder, creating it if
+// create is set and the server has none. Without create, a missing folder
+// is returned as "".
+func draftsFolder(c *client.Client, create bool) (string, error) {
+	folders, err := listFolders(c)
+	if err != nil {
+		return "", err
+	}
+	isDrafts := func(info *goimap.MailboxInfo) bool { return hasSpecialUse(info, goimap.DraftsAttr) }
+	if drafts := findFolder(folders, isDrafts); drafts != nil {
+		return drafts.Name, nil
+	}
+	if !create {
+		return "", nil
+	}
+
+	if err := c.Create(defaultDraftsFolder); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", defaultDraftsFolder, err)
+	}
+	return defaultDraftsFolder, nil
+}
+
+// removeDraft flags the messages with the given Message-ID in folder
+// \Deleted and expunges them
+func removeDraft(c *client.Client, folder, messageID string) error {
+	if _, err := c.Select(folder, false); err != nil {
+		return fmt.Errorf("failed to select %s: %w", folder, err)
+	}
+
+	criteria := goimap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", messageID)
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return fmt.Errorf("failed to search %s: %w", folder, err)
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+
+	seqset := new(goimap.SeqSet)
+	seqset.AddNum(uids...)
+	item := goimap.FormatFlagsOp(goimap.AddFlags, true)
+	if err := c.UidStore(seqset, item, []interface{}{goimap.DeletedFlag}, nil); err != nil {
+		return fmt.Errorf("failed to flag draft deleted: %w", err)
+	}
+	if err := c.Expunge(nil); err != nil {
+		return fmt.Errorf("failed to expunge: %w", err)
+	}
+	return nil
+}
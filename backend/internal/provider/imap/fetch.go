@@ -0,0 +1,96 @@
+package imap
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/jay/dadmail/internal/provider"
+)
+
+// ErrMessageGone is returned when a message no longer exists on the server
+// or its folder's UIDVALIDITY changed since it was synced
+var ErrMessageGone = provider.ErrMessageGone
+
+// FetchRaw downloads the full RFC 822 source of the message with the given
+// emails.external_id without marking it as read
+func FetchRaw(creds *Credentials, externalID string) ([]byte, error) {
+	folder, uidValidity, uid, err := parseExternalID(externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := Connect(creds)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Logout()
+
+	mbox, err := c.Select(folder, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select %s: %w", folder, err)
+	}
+	if mbox.UidValidity != uidValidity {
+		return nil, ErrMessageGone
+	}
+
+	seqset := new(goimap.SeqSet)
+	seqset.AddNum(uid)
+	section := &goimap.BodySectionName{Peek: true}
+
+	messages := make(chan *goimap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []goimap.FetchItem{section.FetchItem()}, messages)
+	}()
+
+	var raw []byte
+	for msg := range messages {
+		if body := msg.GetBody(section); body != nil && raw == nil {
+			if raw, err = io.ReadAll(body); err != nil {
+				raw = nil
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to fetch message: %w", err)
+	}
+	if raw == nil {
+		return nil, ErrMessageGone
+	}
+
+	return raw, nil
+}
+
+// parseExternalID splits an external ID built by externalID. Folder names
+// may themselves contain colons, so it is parsed from the right.
+func parseExternalID(id string) (folder string, uidValidity, uid uint32, err error) {
+	rest, uidStr, ok := cutLast(id, ":")
+	if !ok {
+		return "", 0, 0, fmt.Errorf("invalid IMAP external ID %q", id)
+	}
+	folder, validityStr, ok := cutLast(rest, ":")
+	if !ok {
+		return "", 0, 0, fmt.Errorf("invalid IMAP external ID %q", id)
+	}
+
+	v, err := strconv.ParseUint(validityStr, 10, 32)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("invalid IMAP external ID %q", id)
+	}
+	u, err := strconv.ParseUint(uidStr, 10, 32)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("invalid IMAP external ID %q", id)
+	}
+
+	return folder, uint32(v), uint32(u), nil
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,264 @@
+package imap
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+)
+
+const (
+	// idleFolder is the folder watched for new mail
+	idleFolder = "INBOX"
+	// idleRefreshInterval is how often the set of watched accounts is reloaded
+	idleRefreshInterval = time.Minute
+	// idleRestartInterval restarts IDLE before servers drop the connection
+	// (RFC 2177 recommends less than 29 minutes)
+	idleRestartInterval = 25 * time.Minute
+	// idleDebounce groups bursts of EXISTS/EXPUNGE into a single sync
+	idleDebounce = 2 * time.Second
+
+	minBackoff = 5 * time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// IdleManager keeps one IMAP IDLE connection per sync-enabled account and
+// runs an incremental INBOX sync whenever the server announces a change.
+// Accounts beyond the connection cap are left to the periodic sync.
+type IdleManager struct {
+	syncer   *Syncer
+	maxConns int
+
+	mu        sync.Mutex
+	listeners map[uuid.UUID]context.CancelFunc
+	polling   map[uuid.UUID]bool // accounts left to the periodic sync by the cap
+	wg        sync.WaitGroup
+}
+
+// NewIdleManager creates a new IDLE manager that opens at most maxConns
+// connections
+func NewIdleManager(syncer *Syncer, maxConns int) *IdleManager {
+	return &IdleManager{
+		syncer:    syncer,
+		maxConns:  maxConns,
+		listeners: make(map[uuid.UUID]context.CancelFunc),
+		polling:   make(map[uuid.UUID]bool),
+	}
+}
+
+// Run starts and stops listeners as accounts are added, disabled or removed
+// until ctx is cancelled
+func (m *IdleManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(idleRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.refresh(ctx); err != nil {
+			log.Printf("IMAP IDLE refresh failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			m.stopAll()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *IdleManager) refresh(ctx context.Context) error {
+	accounts, err := m.syncer.accountRepo.ListSyncEnabled(ProviderName)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	enabled := make(map[uuid.UUID]bool, len(accounts))
+	for _, account := range accounts {
+		enabled[account.ID] = true
+	}
+	for id, cancel := range m.listeners {
+		if !enabled[id] {
+			cancel()
+			delete(m.listeners, id)
+		}
+	}
+	for id := range m.polling {
+		if !enabled[id] {
+			delete(m.polling, id)
+		}
+	}
+
+	for _, account := range accounts {
+		if _, ok := m.listeners[account.ID]; ok {
+			continue
+		}
+		if len(m.listeners) >= m.maxConns {
+			// Logged once per account rather than on every refresh
+			if !m.polling[account.ID] {
+				log.Printf("IMAP IDLE connection cap (%d) reached, account %s uses periodic sync", m.maxConns, account.ID)
+				m.polling[account.ID] = true
+			}
+			continue
+		}
+		delete(m.polling, account.ID)
+
+		listenerCtx, cancel := context.WithCancel(ctx)
+		m.listeners[account.ID] = cancel
+		m.wg.Add(1)
+		go func(accountID uuid.UUID) {
+			defer m.wg.Done()
+			m.listen(listenerCtx, accountID)
+		}(account.ID)
+	}
+
+	return nil
+}
+
+func (m *IdleManager) stopAll() {
+	m.mu.Lock()
+	for id, cancel := range m.listeners {
+		cancel()
+		delete(m.listeners, id)
+	}
+	m.mu.Unlock()
+
+	m.wg.Wait()
+}
+
+// listen keeps an IDLE session open for one account, reconnecting with
+// exponential backoff after failures
+func (m *IdleManager) listen(ctx context.Context, accountID uuid.UUID) {
+	backoff := minBackoff
+
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := m.session(ctx, accountID)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A session that stayed up for a while was healthy, so start over
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff
+		}
+		log.Printf("IMAP IDLE for account %s disconnected: %v (retrying in %s)", accountID, err, backoff)
+
+		// Jitter keeps reconnects from many accounts from lining up
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// session runs a single connection: sync, IDLE until the server reports a
+// change, sync again, and so on
+func (m *IdleManager) session(ctx context.Context, accountID uuid.UUID) error {
+	// Reload the account so credential changes apply on reconnect
+	account, err := m.syncer.accountRepo.GetByID(accountID)
+	if err != nil {
+		return err
+	}
+	creds, err := DecryptCredentials(m.syncer.vault, account)
+	if err != nil {
+		return err
+	}
+
+	c, err := m.syncer.Connect(creds)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	updates := make(chan client.Update, 32)
+	c.Updates = updates
+	wake := make(chan struct{}, 1)
+	go forwardUpdates(updates, wake, c.LoggedOut())
+
+	for {
+		if err := m.syncInbox(ctx, c, account); err != nil {
+			return err
+		}
+
+		// Changes seen during the sync (including the SELECT itself) are
+		// already covered by it
+		select {
+		case <-wake:
+		default:
+		}
+
+		if err := idleUntilChange(ctx, c, wake); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (m *IdleManager) syncInbox(ctx context.Context, c *client.Client, account *models.EmailAccount) error {
+	if err := m.syncer.syncFolder(ctx, c, account, &goimap.MailboxInfo{Name: idleFolder}); err != nil {
+		return err
+	}
+	return m.syncer.accountRepo.UpdateLastSynced(account.ID, time.Now())
+}
+
+// forwardUpdates drains unilateral server updates so the client never
+// blocks, and signals wake when the mailbox contents changed
+func forwardUpdates(updates <-chan client.Update, wake chan<- struct{}, loggedOut <-chan struct{}) {
+	for {
+		select {
+		case <-loggedOut:
+			return
+		case update := <-updates:
+			switch update.(type) {
+			case *client.MailboxUpdate, *client.ExpungeUpdate:
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// idleUntilChange idles until the server announces EXISTS/EXPUNGE, the
+// connection drops or ctx is cancelled
+func idleUntilChange(ctx context.Context, c *client.Client, wake <-chan struct{}) error {
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Idle(stop, &client.IdleOptions{LogoutTimeout: idleRestartInterval})
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	case <-wake:
+		// Let related updates arrive before syncing
+		select {
+		case <-ctx.Done():
+		case <-time.After(idleDebounce):
+		}
+	}
+
+	close(stop)
+	return <-done
+}
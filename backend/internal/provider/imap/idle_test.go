@@ -0,0 +1,152 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/repository/testdb"
+)
+
+// announce tells IDLE clients how many messages the inbox now holds, as a
+// server does after a delivery
+func (s *imapServer) announce(t *testing.T) {
+	t.Helper()
+	status, err := s.inbox.Status([]goimap.StatusItem{goimap.StatusMessages})
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	update := &backend.MailboxUpdate{Update: backend.NewUpdate("username", "INBOX"), MailboxStatus: status}
+	s.be.updates <- update
+	<-update.Done()
+}
+
+// waitFor polls cond until it holds or the deadline passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestForwardUpdates(t *testing.T) {
+	tests := []struct {
+		name   string
+		update client.Update
+		wake   bool
+	}{
+		{"new mail", &client.MailboxUpdate{Mailbox: &goimap.MailboxStatus{Name: "INBOX", Messages: 2}}, true},
+		{"expunge", &client.ExpungeUpdate{SeqNum: 1}, true},
+		{"status", &client.StatusUpdate{Status: &goimap.StatusResp{Type: goimap.StatusRespOk, Info: "Still here"}}, false},
+		{"flags", &client.MessageUpdate{Message: goimap.NewMessage(1, nil)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updates := make(chan client.Update)
+			wake := make(chan struct{}, 1)
+			loggedOut := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				forwardUpdates(updates, wake, loggedOut)
+				close(done)
+			}()
+
+			// Sending twice shows a full wake channel never blocks the client
+			updates <- tt.update
+			updates <- tt.update
+			close(loggedOut)
+			<-done
+
+			select {
+			case <-wake:
+				if !tt.wake {
+					t.Errorf("%T woke the listener", tt.update)
+				}
+			default:
+				if tt.wake {
+					t.Errorf("%T did not wake the listener", tt.update)
+				}
+			}
+		})
+	}
+}
+
+func TestIdleManagerSyncsOnNewMail(t *testing.T) {
+	db := testdb.Open(t)
+	srv := newIMAPServer(t)
+	syncer, account := newTestSyncer(t, db, srv)
+	srv.deliver(t, "Lunch on Sunday")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		NewIdleManager(syncer, 10).Run(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	// The listener syncs when it connects
+	waitFor(t, "the first sync", func() bool { return len(storedEmails(t, db, account.ID)) == 1 })
+
+	// and again when the server announces new mail. An announcement that
+	// arrives before the listener idles is covered by the sync it just
+	// ran, so keep announcing until one is seen while idling.
+	srv.deliver(t, "Photos from the zoo")
+	waitFor(t, "the sync after new mail", func() bool {
+		srv.announce(t)
+		return len(storedEmails(t, db, account.ID)) == 2
+	})
+}
+
+func TestIdleManagerConnectionCap(t *testing.T) {
+	db := testdb.Open(t)
+	srv := newIMAPServer(t)
+	syncer, first := newTestSyncer(t, db, srv)
+	_, second := newTestSyncer(t, db, srv)
+
+	var logged bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&logged)
+	defer log.SetOutput(prev)
+
+	m := NewIdleManager(syncer, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < 3; i++ {
+		if err := m.refresh(ctx); err != nil {
+			t.Fatalf("refresh: %v", err)
+		}
+	}
+
+	m.mu.Lock()
+	for _, id := range []uuid.UUID{first.ID, second.ID} {
+		_, listening := m.listeners[id]
+		if listening == m.polling[id] {
+			t.Errorf("account %s: listening=%v polling=%v, want exactly one", id, listening, m.polling[id])
+		}
+	}
+	if len(m.listeners) != 1 {
+		t.Errorf("%d accounts listening, want 1", len(m.listeners))
+	}
+	m.mu.Unlock()
+
+	cancel()
+	m.stopAll()
+	if n := strings.Count(logged.String(), "connection cap"); n != 1 {
+		t.Errorf("cap logged %d times over three refreshes, want once:\n%s", n, logged.String())
+	}
+}
@@ -0,0 +1,208 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/mimeparse"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/threading"
+	"github.com/lib/pq"
+)
+
+// snippetFetchBytes is how much of the text part is fetched to build a snippet
+const snippetFetchBytes = 2048
+
+// referencesSection fetches the References header, which the envelope
+// does not include
+var referencesSection = &goimap.BodySectionName{
+	BodyPartName: goimap.BodyPartName{
+		Specifier: goimap.HeaderSpecifier,
+		Fields:    []string{"References"},
+	},
+	Peek: true,
+}
+
+// externalIDPrefix returns the external ID prefix shared by all messages of a
+// folder within one UIDVALIDITY epoch
+func externalIDPrefix(folder string, uidValidity uint32) string {
+	return fmt.Sprintf("%s:%d:", folder, uidValidity)
+}
+
+// externalID builds the emails.external_id of an IMAP message
+func externalID(folder string, uidValidity, uid uint32) string {
+	return externalIDPrefix(folder, uidValidity) + strconv.FormatUint(uint64(uid), 10)
+}
+
+// toEmail converts fetched message metadata into an email row
+func toEmail(accountID uuid.UUID, folder string, uidValidity uint32, msg *goimap.Message) *models.Email {
+	email := &models.Email{
+		AccountID:  accountID,
+		ExternalID: externalID(folder, uidValidity, msg.Uid),
+		ReceivedAt: msg.InternalDate,
+	}
+
+	if env := msg.Envelope; env != nil {
+		if len(env.From) > 0 {
+			email.FromAddress = env.From[0].Address()
+			if name := env.From[0].PersonalName; name != "" {
+				email.FromName = &name
+			}
+		}
+		email.ToAddresses = addressList(env.To)
+		email.CcAddresses = addressList(env.Cc)
+		if env.Subject != "" {
+			subject := env.Subject
+			email.Subject = &subject
+		}
+		if email.ReceivedAt.IsZero() {
+			email.ReceivedAt = env.Date
+		}
+	}
+
+	email.IsRead, email.IsStarred = flagState(msg.Flags)
+	if msg.BodyStructure != nil {
+		email.HasAttachments = hasAttachments(msg.BodyStructure)
+	}
+
+	return email
+}
+
+// threadMessage extracts the threading headers of a message fetched with
+// its envelope and referencesSection
+func threadMessage(msg *goimap.Message, receivedAt time.Time) *threading.Message {
+	var messageID, inReplyTo, subject string
+	if env := msg.Envelope; env != nil {
+		messageID = firstMessageID(env.MessageId)
+		inReplyTo = firstMessageID(env.InReplyTo)
+		subject = env.Subject
+	}
+
+	var references []string
+	if body := msg.GetBody(referencesSection); body != nil {
+		if header, err := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader(); err == nil {
+			references = mimeparse.MessageIDs(header.Get("References"))
+		}
+	}
+
+	return threading.NewMessage(messageID, inReplyTo, references, subject, receivedAt)
+}
+
+func firstMessageID(value string) string {
+	if ids := mimeparse.MessageIDs(value); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+func addressList(addrs []*goimap.Address) pq.StringArray {
+	list := pq.StringArray{}
+	for _, addr := range addrs {
+		if a := addr.Address(); a != "" {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// flagState maps IMAP flags onto the is_read and is_starred columns
+func flagState(flags []string) (isRead, isStarred bool) {
+	for _, flag := range flags {
+		switch flag {
+		case goimap.SeenFlag:
+			isRead = true
+		case goimap.FlaggedFlag:
+			isStarred = true
+		}
+	}
+	return isRead, isStarred
+}
+
+// hasAttachments reports whether any part of the message is an attachment
+func hasAttachments(bs *goimap.BodyStructure) bool {
+	found := false
+	bs.Walk(func(path []int, part *goimap.BodyStructure) bool {
+		if found {
+			return false
+		}
+		name, _ := part.Filename()
+		mediaType := strings.ToLower(part.MIMEType + "/" + part.MIMESubType)
+		found = mimeparse.IsAttachment(mediaType, part.Disposition, name, part.Id)
+		return strings.EqualFold(part.MIMEType, "multipart")
+	})
+	return found
+}
+
+// snippetPart finds the part to build the snippet from, preferring
+// text/plain over text/html. It returns nil if the message has no text part.
+func snippetPart(bs *goimap.BodyStructure) ([]int, *goimap.BodyStructure) {
+	var (
+		htmlPath []int
+		htmlPart *goimap.BodyStructure
+		textPath []int
+		textPart *goimap.BodyStructure
+	)
+
+	bs.Walk(func(path []int, part *goimap.BodyStructure) bool {
+		if textPart != nil {
+			return false
+		}
+		if !strings.EqualFold(part.MIMEType, "text") || strings.EqualFold(part.Disposition, "attachment") {
+			return true
+		}
+		switch strings.ToLower(part.MIMESubType) {
+		case "plain":
+			textPath, textPart = path, part
+		case "html":
+			if htmlPart == nil {
+				htmlPath, htmlPart = path, part
+			}
+		}
+		return true
+	})
+
+	if textPart != nil {
+		return textPath, textPart
+	}
+	return htmlPath, htmlPart
+}
+
+// buildSnippet decodes the start of a text part into a short preview
+func buildSnippet(raw []byte, part *goimap.BodyStructure) string {
+	var decoded []byte
+	switch strings.ToLower(part.Encoding) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, raw)
+		clean = clean[:len(clean)/4*4]
+		decoded = make([]byte, base64.StdEncoding.DecodedLen(len(clean)))
+		n, _ := base64.StdEncoding.Decode(decoded, clean)
+		decoded = decoded[:n]
+	case "quoted-printable":
+		// The fetch is truncated, so a trailing partial escape may fail to
+		// decode; keep whatever was decoded before it
+		decoded, _ = io.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+	default:
+		decoded = raw
+	}
+
+	text := mimeparse.DecodeCharset(decoded, part.Params["charset"])
+	if strings.EqualFold(part.MIMESubType, "html") {
+		text = mimeparse.HTMLToText(text)
+	}
+	return mimeparse.Snippet(text)
+}
@@ -0,0 +1,120 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/jay/dadmail/internal/mailer"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/vault"
+)
+
+// Provider implements provider.MailProvider for IMAP accounts, which send
+// through their SMTP server. Sync stays with Syncer, which keeps a UID
+// cursor per folder.
+type Provider struct {
+	vault *vault.Vault
+}
+
+// NewProvider creates a new IMAP provider
+func NewProvider(v *vault.Vault) *Provider {
+	return &Provider{vault: v}
+}
+
+// Name returns ProviderName
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// ListChanges is not supported; Syncer syncs IMAP accounts
+func (p *Provider) ListChanges(ctx context.Context, account *models.EmailAccount, cursor string) (*provider.Changes, error) {
+	return nil, provider.ErrUnsupported
+}
+
+// FetchMessage returns the raw source of a message
+func (p *Provider) FetchMessage(ctx context.Context, account *models.EmailAccount, externalID string) ([]byte, error) {
+	creds, err := DecryptCredentials(p.vault, account)
+	if err != nil {
+		return nil, err
+	}
+	return FetchRaw(creds, externalID)
+}
+
+// Send submits a rendered message through the account's SMTP server. A
+// rejection (SMTP 5xx) is permanent.
+func (p *Provider) Send(ctx context.Context, account *models.EmailAccount, from string, recipients []string, raw []byte) error {
+	settings, err := p.smtpSettings(account)
+	if err != nil {
+		return err
+	}
+
+	err = mailer.SubmitSMTP(ctx, settings, from, recipients, raw)
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) && smtpErr.Code >= 500 {
+		return provider.Permanent(err)
+	}
+	return err
+}
+
+// SetFlags maps read and starred onto the \Seen and \Flagged flags
+func (p *Provider) SetFlags(ctx context.Context, account *models.EmailAccount, externalID string, flags provider.Flags) error {
+	creds, err := DecryptCredentials(p.vault, account)
+	if err != nil {
+		return err
+	}
+
+	if flags.Read != nil {
+		if err := SetFlag(creds, externalID, goimap.SeenFlag, *flags.Read); err != nil {
+			return err
+		}
+	}
+	if flags.Starred != nil {
+		if err := SetFlag(creds, externalID, goimap.FlaggedFlag, *flags.Starred); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move moves a message between the inbox and the archive folder, or to the
+// trash
+func (p *Provider) Move(ctx context.Context, account *models.EmailAccount, externalID string, folder provider.Folder) error {
+	creds, err := DecryptCredentials(p.vault, account)
+	if err != nil {
+		return err
+	}
+
+	switch folder {
+	case provider.FolderInbox:
+		return Archive(creds, externalID, false)
+	case provider.FolderArchive:
+		return Archive(creds, externalID, true)
+	case provider.FolderTrash:
+		return Delete(creds, externalID)
+	default:
+		return provider.ErrUnsupported
+	}
+}
+
+// smtpSettings reads the SMTP section of an account's stored credentials.
+// The IMAP login is reused when no separate SMTP login is stored.
+func (p *Provider) smtpSettings(account *models.EmailAccount) (*mailer.SMTPSettings, error) {
+	creds, err := p.vault.Open(account.ID, account.CredentialsEncrypted)
+	if err != nil {
+		return nil, err
+	}
+	if creds.SMTP == nil || creds.SMTP.Host == "" {
+		return nil, fmt.Errorf("account has no SMTP settings")
+	}
+
+	settings := mailer.SMTPSettings(*creds.SMTP)
+	if settings.Username == "" && creds.IMAP != nil {
+		settings.Username = creds.IMAP.Username
+		settings.Password = creds.IMAP.Password
+	}
+	return &settings, nil
+}
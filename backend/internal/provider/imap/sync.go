@@ -0,0 +1,479 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/threading"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jmoiron/sqlx"
+)
+
+// ProviderName is the email_accounts.provider value handled by this package
+const ProviderName = "imap"
+
+// fetchBatchSize is the number of new messages fetched per round trip.
+// Sync state is saved after every batch so an interrupted sync resumes
+// where it stopped.
+const fetchBatchSize = 200
+
+// threadBatchSize is the number of stored messages without a thread, such
+// as those synced before threading existed, threaded per folder and sync
+const threadBatchSize = 500
+
+// Syncer performs UID based incremental sync of IMAP accounts into the
+// emails table
+type Syncer struct {
+	accountRepo *repository.EmailAccountRepository
+	emailRepo   *repository.EmailRepository
+	stateRepo   *repository.SyncStateRepository
+	threadRepo  *repository.ThreadRepository
+	vault       *vault.Vault
+
+	// Connect opens an authenticated connection. It defaults to the package
+	// level Connect and can be replaced to reach an in-process server.
+	Connect func(creds *Credentials) (*client.Client, error)
+}
+
+// NewSyncer creates a new IMAP syncer
+func NewSyncer(db *sqlx.DB, v *vault.Vault) *Syncer {
+	return &Syncer{
+		accountRepo: repository.NewEmailAccountRepository(db),
+		emailRepo:   repository.NewEmailRepository(db),
+		stateRepo:   repository.NewSyncStateRepository(db),
+		threadRepo:  repository.NewThreadRepository(db),
+		vault:       v,
+		Connect:     Connect,
+	}
+}
+
+// SyncAll syncs every IMAP account with sync enabled. Failures are logged
+// per account so one broken mailbox does not block the others.
+func (s *Syncer) SyncAll(ctx context.Context) error {
+	accounts, err := s.accountRepo.ListSyncEnabled(ProviderName)
+	if err != nil {
+		return err
+	}
+
+	for i := range accounts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.SyncAccount(ctx, &accounts[i]); err != nil {
+			log.Printf("IMAP sync failed for account %s: %v", accounts[i].ID, err)
+		}
+	}
+
+	return nil
+}
+
+// SyncAccount syncs all selectable folders of one account
+func (s *Syncer) SyncAccount(ctx context.Context, account *models.EmailAccount) error {
+	creds, err := DecryptCredentials(s.vault, account)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.Connect(creds)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	folders, err := listFolders(c)
+	if err != nil {
+		return err
+	}
+
+	for _, folder := range folders {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if skipFolder(folder) {
+			// Drop mail synced from these folders before they were skipped
+			if err := s.emailRepo.DeleteByExternalIDPrefix(account.ID, folder.Name+":"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.syncFolder(ctx, c, account, folder); err != nil {
+			return fmt.Errorf("folder %q: %w", folder.Name, err)
+		}
+	}
+
+	return s.accountRepo.UpdateLastSynced(account.ID, time.Now())
+}
+
+func (s *Syncer) syncFolder(ctx context.Context, c *client.Client, account *models.EmailAccount, info *goimap.MailboxInfo) error {
+	folder := info.Name
+	mbox, err := c.Select(folder, true)
+	if err != nil {
+		return fmt.Errorf("failed to select: %w", err)
+	}
+
+	state, err := s.stateRepo.Get(account.ID, folder)
+	if err != nil {
+		return err
+	}
+
+	// A changed UIDVALIDITY invalidates every UID we know for the folder
+	if state.UIDValidity != int64(mbox.UidValidity) {
+		if state.UIDValidity != 0 {
+			stale := externalIDPrefix(folder, uint32(state.UIDValidity))
+			if err := s.emailRepo.DeleteByExternalIDPrefix(account.ID, stale); err != nil {
+				return err
+			}
+		}
+		state.UIDValidity = int64(mbox.UidValidity)
+		state.LastUID = 0
+	}
+
+	if state.LastUID > 0 {
+		if err := s.reconcile(c, account, folder, mbox, uint32(state.LastUID)); err != nil {
+			return err
+		}
+		if err := s.threadUnthreaded(c, account, folder, mbox.UidValidity); err != nil {
+			return err
+		}
+	}
+
+	if mbox.Messages == 0 {
+		return s.stateRepo.Save(state)
+	}
+
+	newRange := new(goimap.SeqSet)
+	newRange.AddRange(uint32(state.LastUID)+1, 0)
+	uids, err := c.UidSearch(&goimap.SearchCriteria{Uid: newRange})
+	if err != nil {
+		return fmt.Errorf("failed to search new messages: %w", err)
+	}
+
+	// "n:*" always matches the highest UID, even when it is below n
+	pending := uids[:0]
+	for _, uid := range uids {
+		if int64(uid) > state.LastUID {
+			pending = append(pending, uid)
+		}
+	}
+
+	for start := 0; start < len(pending); start += fetchBatchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := start + fetchBatchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		highest, err := s.fetchNew(c, account, folder, isArchiveFolder(info), mbox.UidValidity, pending[start:end])
+		if err != nil {
+			return err
+		}
+		if int64(highest) > state.LastUID {
+			state.LastUID = int64(highest)
+		}
+		if err := s.stateRepo.Save(state); err != nil {
+			return err
+		}
+	}
+
+	return s.stateRepo.Save(state)
+}
+
+// reconcile refreshes flags of already synced messages and removes rows for
+// messages that were expunged on the server
+func (s *Syncer) reconcile(c *client.Client, account *models.EmailAccount, folder string, mbox *goimap.MailboxStatus, lastUID uint32) error {
+	prefix := externalIDPrefix(folder, mbox.UidValidity)
+	known, err := s.emailRepo.ListExternalIDsByPrefix(account.ID, prefix)
+	if err != nil {
+		return err
+	}
+
+	present := make(map[string]bool, len(known))
+	if mbox.Messages > 0 {
+		seqset := new(goimap.SeqSet)
+		seqset.AddRange(1, lastUID)
+
+		messages := make(chan *goimap.Message, 64)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqset, []goimap.FetchItem{goimap.FetchUid, goimap.FetchFlags}, messages)
+		}()
+
+		var updateErr error
+		for msg := range messages {
+			id := externalID(folder, mbox.UidValidity, msg.Uid)
+			present[id] = true
+			if updateErr == nil {
+				isRead, isStarred := flagState(msg.Flags)
+				updateErr = s.emailRepo.UpdateFlags(account.ID, id, isRead, isStarred)
+			}
+		}
+		if err := <-done; err != nil {
+			return fmt.Errorf("failed to fetch flags: %w", err)
+		}
+		if updateErr != nil {
+			return updateErr
+		}
+	}
+
+	var expunged []string
+	for _, id := range known {
+		if !present[id] {
+			expunged = append(expunged, id)
+		}
+	}
+	return s.emailRepo.DeleteByExternalIDs(account.ID, expunged)
+}
+
+// fetchNew fetches and stores metadata for the given UIDs and returns the
+// highest UID stored
+func (s *Syncer) fetchNew(c *client.Client, account *models.EmailAccount, folder string, archived bool, uidValidity uint32, uids []uint32) (uint32, error) {
+	seqset := new(goimap.SeqSet)
+	seqset.AddNum(uids...)
+
+	items := []goimap.FetchItem{
+		goimap.FetchUid,
+		goimap.FetchFlags,
+		goimap.FetchInternalDate,
+		goimap.FetchEnvelope,
+		goimap.FetchBodyStructure,
+		referencesSection.FetchItem(),
+	}
+
+	messages := make(chan *goimap.Message, 64)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, items, messages)
+	}()
+
+	var fetched []*goimap.Message
+	for msg := range messages {
+		fetched = append(fetched, msg)
+	}
+	if err := <-done; err != nil {
+		return 0, fmt.Errorf("failed to fetch messages: %w", err)
+	}
+
+	snippets, err := fetchSnippets(c, fetched)
+	if err != nil {
+		return 0, err
+	}
+
+	var highest uint32
+	for _, msg := range fetched {
+		email := toEmail(account.ID, folder, uidValidity, msg)
+		email.IsArchived = archived
+		if snippet := snippets[msg.Uid]; snippet != "" {
+			email.Snippet = &snippet
+		}
+		if err := s.emailRepo.Upsert(email); err != nil {
+			return highest, err
+		}
+		s.thread(email, threadMessage(msg, email.ReceivedAt))
+		if msg.Uid > highest {
+			highest = msg.Uid
+		}
+	}
+
+	return highest, nil
+}
+
+// threadUnthreaded threads stored messages of a folder that have no thread
+// yet, fetching their threading headers
+func (s *Syncer) threadUnthreaded(c *client.Client, account *models.EmailAccount, folder string, uidValidity uint32) error {
+	emails, err := s.emailRepo.ListUnthreaded(account.ID, externalIDPrefix(folder, uidValidity), threadBatchSize)
+	if err != nil || len(emails) == 0 {
+		return err
+	}
+
+	byUID := make(map[uint32]*models.Email, len(emails))
+	seqset := new(goimap.SeqSet)
+	for i := range emails {
+		_, _, uid, err := parseExternalID(emails[i].ExternalID)
+		if err != nil {
+			continue
+		}
+		byUID[uid] = &emails[i]
+		seqset.AddNum(uid)
+	}
+	if len(byUID) == 0 {
+		return nil
+	}
+
+	messages := make(chan *goimap.Message, 64)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []goimap.FetchItem{goimap.FetchUid, goimap.FetchEnvelope, referencesSection.FetchItem()}, messages)
+	}()
+
+	for msg := range messages {
+		if email := byUID[msg.Uid]; email != nil {
+			s.thread(email, threadMessage(msg, email.ReceivedAt))
+		}
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("failed to fetch threading headers: %w", err)
+	}
+
+	return nil
+}
+
+// thread assigns a stored email to its thread. Failures are logged; the
+// email is retried by threadUnthreaded on the next sync.
+func (s *Syncer) thread(email *models.Email, msg *threading.Message) {
+	threadID, err := s.threadRepo.Assign(email.AccountID, email.ID, msg)
+	if err != nil {
+		log.Printf("Failed to thread email %s: %v", email.ID, err)
+		return
+	}
+	email.ThreadID = &threadID
+}
+
+// fetchSnippets fetches the beginning of each message's text part. Messages
+// are grouped by part path so most batches need a single round trip.
+func fetchSnippets(c *client.Client, messages []*goimap.Message) (map[uint32]string, error) {
+	type group struct {
+		section *goimap.BodySectionName
+		parts   map[uint32]*goimap.BodyStructure
+	}
+	groups := map[string]*group{}
+
+	for _, msg := range messages {
+		if msg.BodyStructure == nil {
+			continue
+		}
+		path, part := snippetPart(msg.BodyStructure)
+		if part == nil {
+			continue
+		}
+
+		key := fmt.Sprint(path)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{
+				section: &goimap.BodySectionName{
+					BodyPartName: goimap.BodyPartName{Path: path},
+					Peek:         true,
+					Partial:      []int{0, snippetFetchBytes},
+				},
+				parts: map[uint32]*goimap.BodyStructure{},
+			}
+			groups[key] = g
+		}
+		g.parts[msg.Uid] = part
+	}
+
+	snippets := make(map[uint32]string, len(messages))
+	for _, g := range groups {
+		seqset := new(goimap.SeqSet)
+		for uid := range g.parts {
+			seqset.AddNum(uid)
+		}
+
+		results := make(chan *goimap.Message, 64)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqset, []goimap.FetchItem{goimap.FetchUid, g.section.FetchItem()}, results)
+		}()
+
+		for msg := range results {
+			body := msg.GetBody(g.section)
+			part := g.parts[msg.Uid]
+			if body == nil || part == nil {
+				continue
+			}
+			raw, err := io.ReadAll(body)
+			if err != nil {
+				continue
+			}
+			snippets[msg.Uid] = buildSnippet(raw, part)
+		}
+		if err := <-done; err != nil {
+			return nil, fmt.Errorf("failed to fetch snippets: %w", err)
+		}
+	}
+
+	return snippets, nil
+}
+
+// listFolders returns the selectable folders of the mailbox. Virtual "all
+// mail" folders are skipped because they duplicate every other folder.
+func listFolders(c *client.Client) ([]*goimap.MailboxInfo, error) {
+	mailboxes := make(chan *goimap.MailboxInfo, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", mailboxes)
+	}()
+
+	var folders []*goimap.MailboxInfo
+	for m := range mailboxes {
+		if hasAttr(m.Attributes, goimap.NoSelectAttr) || hasAttr(m.Attributes, goimap.AllAttr) {
+			continue
+		}
+		folders = append(folders, m)
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to list folders: %w", err)
+	}
+
+	return folders, nil
+}
+
+// specialUseNames are the usual names of special-use folders on servers
+// that do not advertise SPECIAL-USE attributes
+var specialUseNames = map[string][]string{
+	goimap.ArchiveAttr: {"Archive", "Archives"},
+	goimap.DraftsAttr:  {"Drafts"},
+	goimap.JunkAttr:    {"Junk", "Spam", "Junk E-mail"},
+	goimap.TrashAttr:   {"Trash", "Deleted Items", "Deleted Messages"},
+}
+
+// hasSpecialUse reports whether a folder has the given special use, by
+// attribute or, failing that, by name
+func hasSpecialUse(info *goimap.MailboxInfo, attr string) bool {
+	if hasAttr(info.Attributes, attr) {
+		return true
+	}
+
+	name := info.Name
+	if info.Delimiter != "" {
+		name = name[strings.LastIndex(name, info.Delimiter)+len(info.Delimiter):]
+	}
+	for _, n := range specialUseNames[attr] {
+		if strings.EqualFold(name, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipFolder reports whether a folder holds mail that is not shown: deleted
+// messages, spam and unsent drafts
+func skipFolder(info *goimap.MailboxInfo) bool {
+	return isTrashFolder(info) ||
+		hasSpecialUse(info, goimap.JunkAttr) ||
+		hasSpecialUse(info, goimap.DraftsAttr)
+}
+
+// isArchiveFolder reports whether mail in a folder counts as archived
+func isArchiveFolder(info *goimap.MailboxInfo) bool {
+	return hasSpecialUse(info, goimap.ArchiveAttr)
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
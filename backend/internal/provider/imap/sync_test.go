@@ -0,0 +1,279 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jmoiron/sqlx"
+)
+
+// testBackend is go-imap's memory backend with a UIDVALIDITY that tests
+// can change, which the memory backend fixes at 1, and unilateral updates
+// that tests can send, which the memory backend never does
+type testBackend struct {
+	*memory.Backend
+	uidValidity atomic.Uint32
+	updates     chan backend.Update
+}
+
+func (be *testBackend) Updates() <-chan backend.Update {
+	return be.updates
+}
+
+func (be *testBackend) Login(info *goimap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := be.Backend.Login(info, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &testUser{User: user, be: be}, nil
+}
+
+type testUser struct {
+	backend.User
+	be *testBackend
+}
+
+func (u *testUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &testMailbox{Mailbox: mbox, be: u.be}, nil
+}
+
+type testMailbox struct {
+	backend.Mailbox
+	be *testBackend
+}
+
+func (m *testMailbox) Status(items []goimap.StatusItem) (*goimap.MailboxStatus, error) {
+	status, err := m.Mailbox.Status(items)
+	if err == nil && status.UidValidity != 0 {
+		status.UidValidity = m.be.uidValidity.Load()
+	}
+	return status, err
+}
+
+// imapServer is an in-process IMAP server holding the memory backend's
+// single user, username/password
+type imapServer struct {
+	addr  string
+	be    *testBackend
+	inbox *memory.Mailbox
+}
+
+func newIMAPServer(t *testing.T) *imapServer {
+	t.Helper()
+
+	be := &testBackend{Backend: memory.New(), updates: make(chan backend.Update, 8)}
+	be.uidValidity.Store(1)
+	user, err := be.Backend.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatalf("memory login: %v", err)
+	}
+	inbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatalf("memory inbox: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	return &imapServer{addr: l.Addr().String(), be: be, inbox: inbox.(*memory.Mailbox)}
+}
+
+// deliver appends a message to the inbox, which the backend gives the next
+// UID
+func (s *imapServer) deliver(t *testing.T, subject string, flags ...string) {
+	t.Helper()
+	body := fmt.Sprintf("From: Kid <kid@example.com>\r\n"+
+		"To: grandpa@example.com\r\n"+
+		"Subject: %s\r\n"+
+		"Date: Sun, 01 Mar 2026 12:00:00 +0000\r\n"+
+		"Message-ID: <%s@example.com>\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n"+
+		"Hello from %s\r\n", subject, uuid.NewString(), subject)
+	if err := s.inbox.CreateMessage(flags, time.Now(), bytes.NewBufferString(body)); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+}
+
+// message returns the inbox message with the given UID
+func (s *imapServer) message(t *testing.T, uid uint32) *memory.Message {
+	t.Helper()
+	for _, msg := range s.inbox.Messages {
+		if msg.Uid == uid {
+			return msg
+		}
+	}
+	t.Fatalf("no message with UID %d", uid)
+	return nil
+}
+
+// newTestSyncer returns a syncer for an IMAP account on srv, connecting
+// through the Connect hook
+func newTestSyncer(t *testing.T, db *sqlx.DB, srv *imapServer) (*Syncer, *models.EmailAccount) {
+	t.Helper()
+
+	v, err := vault.New(map[string]string{"k1": "0123456789abcdef0123456789abcdef"}, "k1")
+	if err != nil {
+		t.Fatalf("vault: %v", err)
+	}
+
+	account := &models.EmailAccount{
+		ID:           uuid.New(),
+		UserID:       testdb.CreateUser(t, db),
+		Provider:     ProviderName,
+		EmailAddress: "grandpa@example.com",
+		SyncEnabled:  true,
+	}
+	account.CredentialsEncrypted, err = v.Seal(account.ID, &vault.Credentials{
+		IMAP: &vault.IMAPCredentials{Host: "imap.example.com", Username: "username", Password: "password", Security: SecurityTLS},
+	})
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	testdb.CreateAccount(t, db, account)
+
+	syncer := NewSyncer(db, v)
+	syncer.Connect = func(creds *Credentials) (*client.Client, error) {
+		c, err := client.Dial(srv.addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Login(creds.Username, creds.Password); err != nil {
+			c.Logout()
+			return nil, err
+		}
+		return c, nil
+	}
+	return syncer, account
+}
+
+// storedEmails returns the account's emails by external ID
+func storedEmails(t *testing.T, db *sqlx.DB, accountID uuid.UUID) map[string]models.Email {
+	t.Helper()
+	var emails []models.Email
+	if err := db.Select(&emails, `SELECT * FROM emails WHERE account_id = $1`, accountID); err != nil {
+		t.Fatalf("select emails: %v", err)
+	}
+	byID := map[string]models.Email{}
+	for _, e := range emails {
+		byID[e.ExternalID] = e
+	}
+	return byID
+}
+
+func assertExternalIDs(t *testing.T, emails map[string]models.Email, want ...string) {
+	t.Helper()
+	if len(emails) != len(want) {
+		t.Errorf("stored %d emails, want %d: %v", len(emails), len(want), emails)
+	}
+	for _, id := range want {
+		if _, ok := emails[id]; !ok {
+			t.Errorf("email %s was not stored", id)
+		}
+	}
+}
+
+func TestSyncAccount(t *testing.T) {
+	db := testdb.Open(t)
+	srv := newIMAPServer(t)
+	syncer, account := newTestSyncer(t, db, srv)
+	stateRepo := repository.NewSyncStateRepository(db)
+	ctx := context.Background()
+
+	// The memory backend starts with one read message, UID 6
+	srv.deliver(t, "Lunch on Sunday")
+	if err := syncer.SyncAccount(ctx, account); err != nil {
+		t.Fatalf("initial sync: %v", err)
+	}
+	emails := storedEmails(t, db, account.ID)
+	assertExternalIDs(t, emails, "INBOX:1:6", "INBOX:1:7")
+	lunch := emails["INBOX:1:7"]
+	if lunch.Subject == nil || *lunch.Subject != "Lunch on Sunday" || lunch.FromAddress != "kid@example.com" {
+		t.Errorf("stored metadata = %+v", lunch)
+	}
+	if lunch.IsRead || !emails["INBOX:1:6"].IsRead {
+		t.Errorf("read flags not synced: 6 read=%v, 7 read=%v", emails["INBOX:1:6"].IsRead, lunch.IsRead)
+	}
+	if lunch.Snippet == nil || *lunch.Snippet != "Hello from Lunch on Sunday" {
+		t.Errorf("snippet = %v", lunch.Snippet)
+	}
+	if lunch.ThreadID == nil {
+		t.Errorf("email was not threaded")
+	}
+
+	t.Run("incremental", func(t *testing.T) {
+		srv.deliver(t, "Photos", goimap.FlaggedFlag)
+		srv.message(t, 6).Flags = nil
+		if err := syncer.SyncAccount(ctx, account); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+
+		emails := storedEmails(t, db, account.ID)
+		assertExternalIDs(t, emails, "INBOX:1:6", "INBOX:1:7", "INBOX:1:8")
+		if !emails["INBOX:1:8"].IsStarred {
+			t.Errorf("new flagged message is not starred")
+		}
+		if emails["INBOX:1:6"].IsRead {
+			t.Errorf("flag change of a known message was not synced")
+		}
+		state, err := stateRepo.Get(account.ID, "INBOX")
+		if err != nil {
+			t.Fatalf("sync state: %v", err)
+		}
+		if state.UIDValidity != 1 || state.LastUID != 8 {
+			t.Errorf("sync state = %d/%d, want 1/8", state.UIDValidity, state.LastUID)
+		}
+	})
+
+	t.Run("expunge", func(t *testing.T) {
+		srv.message(t, 7).Flags = []string{goimap.DeletedFlag}
+		if err := srv.inbox.Expunge(); err != nil {
+			t.Fatalf("Expunge: %v", err)
+		}
+		if err := syncer.SyncAccount(ctx, account); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		assertExternalIDs(t, storedEmails(t, db, account.ID), "INBOX:1:6", "INBOX:1:8")
+	})
+
+	t.Run("uidvalidity reset", func(t *testing.T) {
+		srv.be.uidValidity.Store(2)
+		if err := syncer.SyncAccount(ctx, account); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		assertExternalIDs(t, storedEmails(t, db, account.ID), "INBOX:2:6", "INBOX:2:8")
+
+		state, err := stateRepo.Get(account.ID, "INBOX")
+		if err != nil {
+			t.Fatalf("sync state: %v", err)
+		}
+		if state.UIDValidity != 2 || state.LastUID != 8 {
+			t.Errorf("sync state = %d/%d, want 2/8", state.UIDValidity, state.LastUID)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package imap
+
+import (
+	"fmt"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// defaultArchiveFolder is created to archive into when the server has no
+// archive folder
+const defaultArchiveFolder = "Archive"
+
+// SetFlag adds or removes a flag, such as \Seen or \Flagged, on the message
+// with the given emails.external_id
+func SetFlag(creds *Credentials, externalID, flag string, value bool) error {
+	return withMessage(creds, externalID, func(c *client.Client, _ []*goimap.MailboxInfo, _ *goimap.MailboxInfo, seqset *goimap.SeqSet) error {
+		var op goimap.FlagsOp = goimap.AddFlags
+		if !value {
+			op = goimap.RemoveFlags
+		}
+		item := goimap.FormatFlagsOp(op, true)
+		if err := c.UidStore(seqset, item, []interface{}{flag}, nil); err != nil {
+			return fmt.Errorf("failed to store flags: %w", err)
+		}
+		return nil
+	})
+}
+
+// Archive moves a message into the archive folder, or from there back to
+// the inbox. Messages already in the right place are left alone.
+func Archive(creds *Credentials, externalID string, archived bool) error {
+	return withMessage(creds, externalID, func(c *client.Client, folders []*goimap.MailboxInfo, current *goimap.MailboxInfo, seqset *goimap.SeqSet) error {
+		if isArchiveFolder(current) == archived {
+			return nil
+		}
+
+		dest := "INBOX"
+		if archived {
+			dest = defaultArchiveFolder
+			if archive := findFolder(folders, isArchiveFolder); archive != nil {
+				dest = archive.Name
+			} else if err := c.Create(dest); err != nil {
+				return fmt.Errorf("failed to create %s: %w", dest, err)
+			}
+		}
+
+		if err := c.UidMove(seqset, dest); err != nil {
+			return fmt.Errorf("failed to move to %s: %w", dest, err)
+		}
+		return nil
+	})
+}
+
+// Delete moves a message to the trash folder. Without one, the message is
+// flagged \Deleted and expunged.
+func Delete(creds *Credentials, externalID string) error {
+	return withMessage(creds, externalID, func(c *client.Client, folders []*goimap.MailboxInfo, current *goimap.MailboxInfo, seqset *goimap.SeqSet) error {
+		if trash := findFolder(folders, isTrashFolder); trash != nil {
+			if trash.Name == current.Name {
+				return nil
+			}
+			if err := c.UidMove(seqset, trash.Name); err != nil {
+				return fmt.Errorf("failed to move to %s: %w", trash.Name, err)
+			}
+			return nil
+		}
+
+		item := goimap.FormatFlagsOp(goimap.AddFlags, true)
+		if err := c.UidStore(seqset, item, []interface{}{goimap.DeletedFlag}, nil); err != nil {
+			return fmt.Errorf("failed to flag message deleted: %w", err)
+		}
+		// EXPUNGE also removes other messages already flagged \Deleted in
+		// the folder, as any client closing the folder would
+		if err := c.Expunge(nil); err != nil {
+			return fmt.Errorf("failed to expunge: %w", err)
+		}
+		return nil
+	})
+}
+
+// withMessage connects, selects the folder of a message for writing and
+// calls fn with the folder list, the selected folder and the message's UID
+func withMessage(creds *Credentials, externalID string, fn func(c *client.Client, folders []*goimap.MailboxInfo, current *goimap.MailboxInfo, seqset *goimap.SeqSet) error) error {
+	folder, uidValidity, uid, err := parseExternalID(externalID)
+	if err != nil {
+		return err
+	}
+
+	c, err := Connect(creds)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	folders, err := listFolders(c)
+	if err != nil {
+		return err
+	}
+	current := findFolder(folders, func(info *goimap.MailboxInfo) bool { return info.Name == folder })
+	if current == nil {
+		return ErrMessageGone
+	}
+
+	mbox, err := c.Select(folder, false)
+	if err != nil {
+		return fmt.Errorf("failed to select %s: %w", folder, err)
+	}
+	if mbox.UidValidity != uidValidity {
+		return ErrMessageGone
+	}
+
+	seqset := new(goimap.SeqSet)
+	seqset.AddNum(uid)
+	return fn(c, folders, current, seqset)
+}
+
+// isTrashFolder reports whether a folder holds deleted mail
+func isTrashFolder(info *goimap.MailboxInfo) bool {
+	return hasSpecialUse(info, goimap.TrashAttr)
+}
+
+func findFolder(folders []*goimap.MailboxInfo, match func(*goimap.MailboxInfo) bool) *goimap.MailboxInfo {
+	for _, f := range folders {
+		if match(f) {
+			return f
+		}
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/vault"
+)
+
+// Capabilities used by the client (RFC 8620, RFC 8621)
+const (
+	CapabilityCore       = "urn:ietf:params:jmap:core"
+	CapabilityMail       = "urn:ietf:params:jmap:mail"
+	CapabilitySubmission = "urn:ietf:params:jmap:submission"
+)
+
+const (
+	requestTimeout = time.Minute
+
+	// maxRawMessageBytes caps a downloaded message source
+	maxRawMessageBytes = 150 << 20
+
+	// wellKnownPath is where a server announces its session resource
+	wellKnownPath = "/.well-known/jmap"
+)
+
+// Session is the JMAP session resource, which names the account holding
+// the user's mail and the URLs of the API
+type Session struct {
+	Capabilities    map[string]json.RawMessage `json:"capabilities"`
+	PrimaryAccounts map[string]string          `json:"primaryAccounts"`
+	Username        string                     `json:"username"`
+	APIURL          string                     `json:"apiUrl"`
+	DownloadURL     string                     `json:"downloadUrl"`
+	UploadURL       string                     `json:"uploadUrl"`
+	EventSourceURL  string                     `json:"eventSourceUrl"`
+	State           string                     `json:"state"`
+}
+
+// Client is a minimal JMAP mail client for one account
+type Client struct {
+	httpClient *http.Client
+	session    *Session
+	accountID  string
+	// mailboxes maps mailbox roles, such as inbox, to mailbox IDs. It is
+	// loaded on first use.
+	mailboxes map[string]string
+}
+
+// Connect discovers the session of the server named by creds and returns
+// a client for the user's mail account
+func Connect(ctx context.Context, creds *vault.JMAPCredentials) (*Client, error) {
+	return connect(ctx, creds, http.DefaultTransport)
+}
+
+func connect(ctx context.Context, creds *vault.JMAPCredentials, base http.RoundTripper) (*Client, error) {
+	sessionURL, err := SessionURL(creds.SessionURL)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		httpClient: &http.Client{
+			Timeout:   requestTimeout,
+			Transport: &authTransport{creds: creds, base: base},
+		},
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, sessionURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	if err := c.do(req, session); err != nil {
+		return nil, fmt.Errorf("failed to get JMAP session: %w", err)
+	}
+
+	if _, ok := session.Capabilities[CapabilityMail]; !ok {
+		return nil, errors.New("server does not support JMAP mail")
+	}
+	c.accountID = session.PrimaryAccounts[CapabilityMail]
+	if c.accountID == "" || session.APIURL == "" {
+		return nil, errors.New("JMAP session has no mail account")
+	}
+
+	c.session = session
+	return c, nil
+}
+
+// SessionURL returns the URL of the session resource. A bare host name
+// means the server's well-known location.
+func SessionURL(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "://") {
+		value = "https://" + value
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", fmt.Errorf("invalid JMAP session URL %q", value)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = wellKnownPath
+	}
+	return u.String(), nil
+}
+
+// Session returns the session the client was created with
+func (c *Client) Session() *Session {
+	return c.session
+}
+
+// AccountID returns the ID of the JMAP account holding the user's mail
+func (c *Client) AccountID() string {
+	return c.accountID
+}
+
+// Invocation is a method call or response: its name, arguments and call ID
+type Invocation struct {
+	Name   string
+	Args   interface{}
+	CallID string
+}
+
+// MarshalJSON encodes an invocation as the array the protocol uses
+func (inv Invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{inv.Name, inv.Args, inv.CallID})
+}
+
+// response is a method response whose arguments are decoded on demand
+type response struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+}
+
+func (r *response) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	if len(parts) != 3 {
+		return fmt.Errorf("method response has %d parts", len(parts))
+	}
+	if err := json.Unmarshal(parts[0], &r.Name); err != nil {
+		return err
+	}
+	r.Args = parts[1]
+	return json.Unmarshal(parts[2], &r.CallID)
+}
+
+// ResultRef refers to part of the result of an earlier call in the same
+// request, such as the IDs found by an Email/query
+type ResultRef struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// Responses are the method responses of a request by call ID
+type Responses map[string]*response
+
+// Get decodes the response to the call with the given ID into out. A
+// method error is returned as a *MethodError.
+func (r Responses) Get(callID string, out interface{}) error {
+	resp := r[callID]
+	if resp == nil {
+		return fmt.Errorf("no response to JMAP call %s", callID)
+	}
+	if resp.Name == "error" {
+		methodErr := &MethodError{}
+		if err := json.Unmarshal(resp.Args, methodErr); err != nil {
+			return fmt.Errorf("failed to decode JMAP error: %w", err)
+		}
+		return methodErr
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Args, out); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", resp.Name, err)
+	}
+	return nil
+}
+
+// Call sends method calls in a single request
+func (c *Client) Call(ctx context.Context, calls ...Invocation) (Responses, error) {
+	using := []string{CapabilityCore, CapabilityMail}
+	for _, call := range calls {
+		if strings.HasPrefix(call.Name, "EmailSubmission/") || strings.HasPrefix(call.Name, "Identity/") {
+			using = append(using, CapabilitySubmission)
+			break
+		}
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"using":       using,
+		"methodCalls": calls,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, c.session.APIURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var result struct {
+		MethodResponses []*response `json:"methodResponses"`
+	}
+	if err := c.do(req, &result); err != nil {
+		return nil, err
+	}
+
+	responses := Responses{}
+	for _, resp := range result.MethodResponses {
+		// The first response to a call is its result; later ones, such as
+		// the implicit Email/set of a submission, are not needed
+		if _, ok := responses[resp.CallID]; !ok {
+			responses[resp.CallID] = resp
+		}
+	}
+	return responses, nil
+}
+
+// call sends a single method call and decodes its response into out
+func (c *Client) call(ctx context.Context, name string, args, out interface{}) error {
+	responses, err := c.Call(ctx, Invocation{Name: name, Args: args, CallID: "0"})
+	if err != nil {
+		return err
+	}
+	return responses.Get("0", out)
+}
+
+// Upload stores data as a blob and returns its ID
+func (c *Client) Upload(ctx context.Context, data []byte, contentType string) (string, error) {
+	u := expandTemplate(c.session.UploadURL, map[string]string{"accountId": c.accountID})
+
+	req, err := c.newRequest(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	var blob struct {
+		BlobID string `json:"blobId"`
+	}
+	if err := c.do(req, &blob); err != nil {
+		return "", err
+	}
+	if blob.BlobID == "" {
+		return "", errors.New("JMAP upload returned no blob ID")
+	}
+	return blob.BlobID, nil
+}
+
+// Download returns the content of a message blob
+func (c *Client) Download(ctx context.Context, blobID string) ([]byte, error) {
+	u := expandTemplate(c.session.DownloadURL, map[string]string{
+		"accountId": c.accountID,
+		"blobId":    blobID,
+		"name":      "message.eml",
+		"type":      "message/rfc822",
+	})
+
+	req, err := c.newRequest(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxRawMessageBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+	if len(raw) > maxRawMessageBytes {
+		return nil, fmt.Errorf("message is larger than %d MB", maxRawMessageBytes>>20)
+	}
+	return raw, nil
+}
+
+// APIError is a non-2xx HTTP response from the server
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("JMAP server returned %d: %s", e.StatusCode, e.Body)
+}
+
+// MethodError is an error response to a method call, or a record the
+// server did not create, update or destroy
+type MethodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (e *MethodError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("JMAP %s: %s", e.Type, e.Description)
+	}
+	return "JMAP " + e.Type
+}
+
+// IsNotFound reports whether err says a record or blob does not exist
+func IsNotFound(err error) bool {
+	var methodErr *MethodError
+	if errors.As(err, &methodErr) {
+		return methodErr.Type == "notFound"
+	}
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsPermanent reports whether retrying err cannot succeed: the server
+// rejected the request itself, or the mailbox it needs does not exist
+func IsPermanent(err error) bool {
+	if errors.Is(err, ErrNoMailbox) {
+		return true
+	}
+
+	var methodErr *MethodError
+	if errors.As(err, &methodErr) {
+		switch methodErr.Type {
+		case "serverUnavailable", "serverFail", "serverPartialFail", "rateLimit", "overQuota":
+			return false
+		}
+		return true
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return provider.IsPermanentStatus(apiErr.StatusCode)
+	}
+	return false
+}
+
+func (c *Client) newRequest(ctx context.Context, method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request, out interface{}) error {
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode JMAP response: %w", err)
+	}
+	return nil
+}
+
+// send performs a request and returns the response if it succeeded. The
+// caller must close its body.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("JMAP request failed: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+
+	return resp, nil
+}
+
+// authTransport authorizes every request, including those following the
+// redirect from the well-known session location
+type authTransport struct {
+	creds *vault.JMAPCredentials
+	base  http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if t.creds.Username == "" {
+		req.Header.Set("Authorization", "Bearer "+t.creds.Password)
+	} else {
+		req.SetBasicAuth(t.creds.Username, t.creds.Password)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// expandTemplate fills in the variables of a session URL template
+// (RFC 6570 level 1, the only level servers use here)
+func expandTemplate(template string, vars map[string]string) string {
+	for name, value := range vars {
+		template = strings.ReplaceAll(template, "{"+name+"}", url.PathEscape(value))
+	}
+	return template
+}
@@ -0,0 +1,635 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jay/dadmail/internal/netguard"
+	"github.com/jay/dadmail/internal/vault"
+)
+
+// Mailbox IDs of the stand-in account
+const (
+	mbInbox   = "mb-inbox"
+	mbArchive = "mb-archive"
+	mbSent    = "mb-sent"
+	mbDrafts  = "mb-drafts"
+	mbTrash   = "mb-trash"
+)
+
+// emailChange is one entry of the stand-in's change log
+type emailChange struct {
+	state int
+	id    string
+	kind  string // created, updated, destroyed
+}
+
+// jmapServer is an httptest stand-in for a JMAP server with a single mail
+// account. The session lives at /session, which /.well-known/jmap
+// redirects to; the API, upload and download resources serve the methods
+// the client uses. Every change to an email bumps the Email state.
+type jmapServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	emails map[string]*Email
+	blobs  map[string][]byte
+	nextID int
+	state  int
+	log    []emailChange
+	// expiredBefore is the oldest state Email/changes calculates changes
+	// from
+	expiredBefore int
+	// rejectSubmissions makes EmailSubmission/set refuse to send
+	rejectSubmissions bool
+	// calls records the method calls received, submissions the created
+	// EmailSubmission objects
+	calls       []Invocation
+	submissions []map[string]interface{}
+	// authorized counts the requests with the expected credentials
+	authorized int
+}
+
+func newJMAPServer(t *testing.T) *jmapServer {
+	t.Helper()
+	s := &jmapServer{emails: map[string]*Email{}, blobs: map[string][]byte{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/jmap", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/session", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("GET /session", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, Session{
+			Capabilities: map[string]json.RawMessage{
+				CapabilityCore:       json.RawMessage(`{}`),
+				CapabilityMail:       json.RawMessage(`{}`),
+				CapabilitySubmission: json.RawMessage(`{}`),
+			},
+			PrimaryAccounts: map[string]string{CapabilityMail: "acc1", CapabilitySubmission: "acc1"},
+			Username:        "grandpa@example.com",
+			APIURL:          s.URL + "/api",
+			DownloadURL:     s.URL + "/download/{accountId}/{blobId}/{name}?type={type}",
+			UploadURL:       s.URL + "/upload/{accountId}",
+			State:           "session-1",
+		})
+	})
+	mux.HandleFunc("POST /api", s.api)
+	mux.HandleFunc("POST /upload/acc1", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		blobID := s.newID("blob")
+		s.blobs[blobID] = data
+		writeJSON(w, map[string]interface{}{"accountId": "acc1", "blobId": blobID, "size": len(data)})
+	})
+	mux.HandleFunc("GET /download/acc1/{blob}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		data, ok := s.blobs[r.PathValue("blob")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	})
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "grandpa" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.mu.Lock()
+		s.authorized++
+		s.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// creds returns the login of the stand-in's account
+func (s *jmapServer) creds() *vault.JMAPCredentials {
+	return &vault.JMAPCredentials{SessionURL: s.URL, Username: "grandpa", Password: "secret"}
+}
+
+func (s *jmapServer) newID(prefix string) string {
+	s.nextID++
+	return prefix + strconv.Itoa(s.nextID)
+}
+
+// record bumps the Email state for a change to an email
+func (s *jmapServer) record(id, kind string) {
+	s.state++
+	s.log = append(s.log, emailChange{state: s.state, id: id, kind: kind})
+}
+
+// deliver adds an email to a mailbox and returns its ID
+func (s *jmapServer) deliver(mailbox, subject string, keywords ...string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.newID("e")
+	email := &Email{
+		ID:         id,
+		BlobID:     "blob-" + id,
+		ThreadID:   "thread-" + id,
+		MailboxIDs: map[string]bool{mailbox: true},
+		Keywords:   map[string]bool{},
+		From:       []EmailAddress{{Name: "Kid", Email: "kid@example.com"}},
+		To:         []EmailAddress{{Email: "grandpa@example.com"}},
+		Subject:    subject,
+		Preview:    "About " + subject,
+		ReceivedAt: time.Date(2026, 3, 1, 12, 0, s.nextID, 0, time.UTC),
+	}
+	for _, k := range keywords {
+		email.Keywords[k] = true
+	}
+	s.emails[id] = email
+	s.blobs[email.BlobID] = []byte("Subject: " + subject + "\r\n\r\nHello\r\n")
+	s.record(id, "created")
+	return id
+}
+
+// update changes an email in place
+func (s *jmapServer) update(id string, fn func(email *Email)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.emails[id])
+	s.record(id, "updated")
+}
+
+// destroy deletes an email for good
+func (s *jmapServer) destroy(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.emails, id)
+	s.record(id, "destroyed")
+}
+
+// expireStates makes Email/changes refuse every state handed out so far
+func (s *jmapServer) expireStates() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiredBefore = s.state + 1
+}
+
+// authorizedRequests returns the number of requests that carried the
+// account's login
+func (s *jmapServer) authorizedRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authorized
+}
+
+// methodCalls returns the names of the method calls received so far
+func (s *jmapServer) methodCalls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, len(s.calls))
+	for i, call := range s.calls {
+		names[i] = call.Name
+	}
+	return names
+}
+
+// api runs the method calls of a request in order, resolving result
+// references and creation IDs as it goes
+func (s *jmapServer) api(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Using       []string            `json:"using"`
+		MethodCalls [][]json.RawMessage `json:"methodCalls"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := map[string]map[string]interface{}{}
+	created := map[string]string{}
+	var responses []Invocation
+	for _, raw := range req.MethodCalls {
+		var name, callID string
+		var args map[string]interface{}
+		if len(raw) != 3 || json.Unmarshal(raw[0], &name) != nil ||
+			json.Unmarshal(raw[1], &args) != nil || json.Unmarshal(raw[2], &callID) != nil {
+			http.Error(w, "malformed method call", http.StatusBadRequest)
+			return
+		}
+		s.calls = append(s.calls, Invocation{Name: name, Args: args, CallID: callID})
+
+		if err := resolveRefs(args, results); err != nil {
+			responses = append(responses, Invocation{Name: "error", Args: err, CallID: callID})
+			continue
+		}
+		if name == "EmailSubmission/set" && !contains(req.Using, CapabilitySubmission) {
+			responses = append(responses, Invocation{Name: "error", Args: &MethodError{Type: "unknownMethod"}, CallID: callID})
+			continue
+		}
+		result, err := s.method(name, args, created)
+		if err != nil {
+			responses = append(responses, Invocation{Name: "error", Args: err, CallID: callID})
+			continue
+		}
+		results[callID] = result
+		responses = append(responses, Invocation{Name: name, Args: result, CallID: callID})
+	}
+
+	writeJSON(w, map[string]interface{}{"methodResponses": responses, "sessionState": "session-1"})
+}
+
+// resolveRefs replaces "#name" arguments that are result references with
+// the referenced value
+func resolveRefs(args map[string]interface{}, results map[string]map[string]interface{}) *MethodError {
+	for key, value := range args {
+		ref, ok := value.(map[string]interface{})
+		if !strings.HasPrefix(key, "#") || !ok {
+			continue
+		}
+		result, found := results[fmt.Sprint(ref["resultOf"])]
+		if !found {
+			return &MethodError{Type: "invalidResultReference"}
+		}
+		delete(args, key)
+		args[key[1:]] = result[strings.TrimPrefix(fmt.Sprint(ref["path"]), "/")]
+	}
+	return nil
+}
+
+func (s *jmapServer) method(name string, args map[string]interface{}, created map[string]string) (map[string]interface{}, *MethodError) {
+	switch name {
+	case "Mailbox/get":
+		var list []map[string]string
+		for _, role := range []string{RoleInbox, RoleArchive, RoleSent, RoleDrafts, RoleTrash} {
+			list = append(list, map[string]string{"id": "mb-" + role, "role": role})
+		}
+		return map[string]interface{}{"state": "m1", "list": list, "notFound": []string{}}, nil
+
+	case "Identity/get":
+		list := []map[string]string{
+			{"id": "id-other", "email": "other@example.org"},
+			{"id": "id-domain", "email": "*@example.com"},
+		}
+		return map[string]interface{}{"state": "i1", "list": list, "notFound": []string{}}, nil
+
+	case "Email/get":
+		list := []*Email{}
+		notFound := []string{}
+		for _, id := range stringList(args["ids"]) {
+			if email, ok := s.emails[id]; ok {
+				list = append(list, email)
+			} else {
+				notFound = append(notFound, id)
+			}
+		}
+		return map[string]interface{}{"state": s.emailState(), "list": list, "notFound": notFound}, nil
+
+	case "Email/query":
+		return s.query(args), nil
+
+	case "Email/changes":
+		return s.changes(args)
+
+	case "Email/import":
+		return s.importEmails(args, created), nil
+
+	case "Email/set":
+		return s.setEmails(args), nil
+
+	case "EmailSubmission/set":
+		return s.submit(args, created), nil
+	}
+	return nil, &MethodError{Type: "unknownMethod"}
+}
+
+func (s *jmapServer) emailState() string {
+	return "s" + strconv.Itoa(s.state)
+}
+
+// query lists the emails outside the excluded mailboxes, newest first
+func (s *jmapServer) query(args map[string]interface{}) map[string]interface{} {
+	filter, _ := args["filter"].(map[string]interface{})
+	excluded := map[string]bool{}
+	for _, id := range stringList(filter["inMailboxOtherThan"]) {
+		excluded[id] = true
+	}
+
+	var emails []*Email
+	for _, email := range s.emails {
+		for mailbox, in := range email.MailboxIDs {
+			if in && !excluded[mailbox] {
+				emails = append(emails, email)
+				break
+			}
+		}
+	}
+	sort.Slice(emails, func(i, j int) bool { return emails[i].ReceivedAt.After(emails[j].ReceivedAt) })
+
+	start := 0
+	if anchor, ok := args["anchor"].(string); ok {
+		for i, email := range emails {
+			if email.ID == anchor {
+				start = i + 1
+			}
+		}
+	}
+	ids := []string{}
+	limit := int(args["limit"].(float64))
+	for i := start; i < len(emails) && len(ids) < limit; i++ {
+		ids = append(ids, emails[i].ID)
+	}
+	return map[string]interface{}{"queryState": s.emailState(), "ids": ids, "position": start}
+}
+
+// changes lists the emails created, updated and destroyed since a state
+func (s *jmapServer) changes(args map[string]interface{}) (map[string]interface{}, *MethodError) {
+	since, err := strconv.Atoi(strings.TrimPrefix(fmt.Sprint(args["sinceState"]), "s"))
+	if err != nil || since < s.expiredBefore {
+		return nil, &MethodError{Type: "cannotCalculateChanges"}
+	}
+
+	first := map[string]string{}
+	last := map[string]string{}
+	var ids []string
+	for _, c := range s.log {
+		if c.state <= since {
+			continue
+		}
+		if _, ok := first[c.id]; !ok {
+			first[c.id] = c.kind
+			ids = append(ids, c.id)
+		}
+		last[c.id] = c.kind
+	}
+
+	created, updated, destroyed := []string{}, []string{}, []string{}
+	for _, id := range ids {
+		switch {
+		case first[id] == "created" && last[id] == "destroyed":
+		case first[id] == "created":
+			created = append(created, id)
+		case last[id] == "destroyed":
+			destroyed = append(destroyed, id)
+		default:
+			updated = append(updated, id)
+		}
+	}
+	return map[string]interface{}{
+		"oldState":       "s" + strconv.Itoa(since),
+		"newState":       s.emailState(),
+		"hasMoreChanges": false,
+		"created":        created,
+		"updated":        updated,
+		"destroyed":      destroyed,
+	}, nil
+}
+
+// importEmails stores uploaded messages as emails
+func (s *jmapServer) importEmails(args map[string]interface{}, created map[string]string) map[string]interface{} {
+	createdEmails := map[string]interface{}{}
+	notCreated := map[string]interface{}{}
+	emails, _ := args["emails"].(map[string]interface{})
+	for creationID, value := range emails {
+		spec := value.(map[string]interface{})
+		blobID := fmt.Sprint(spec["blobId"])
+		if _, ok := s.blobs[blobID]; !ok {
+			notCreated[creationID] = &MethodError{Type: "blobNotFound"}
+			continue
+		}
+
+		id := s.newID("e")
+		email := &Email{ID: id, BlobID: blobID, ThreadID: "thread-" + id, MailboxIDs: map[string]bool{}, Keywords: map[string]bool{}}
+		for mailbox := range spec["mailboxIds"].(map[string]interface{}) {
+			email.MailboxIDs[mailbox] = true
+		}
+		for keyword := range spec["keywords"].(map[string]interface{}) {
+			email.Keywords[keyword] = true
+		}
+		s.emails[id] = email
+		s.record(id, "created")
+		created[creationID] = id
+		createdEmails[creationID] = map[string]string{"id": id, "blobId": blobID}
+	}
+	return map[string]interface{}{"created": createdEmails, "notCreated": notCreated}
+}
+
+// setEmails applies updates and destroys emails
+func (s *jmapServer) setEmails(args map[string]interface{}) map[string]interface{} {
+	notUpdated := map[string]interface{}{}
+	notDestroyed := map[string]interface{}{}
+
+	updates, _ := args["update"].(map[string]interface{})
+	for id, patch := range updates {
+		if !s.patch(id, patch.(map[string]interface{})) {
+			notUpdated[id] = &MethodError{Type: "notFound"}
+		}
+	}
+	for _, id := range stringList(args["destroy"]) {
+		if _, ok := s.emails[id]; !ok {
+			notDestroyed[id] = &MethodError{Type: "notFound"}
+			continue
+		}
+		delete(s.emails, id)
+		s.record(id, "destroyed")
+	}
+	return map[string]interface{}{"newState": s.emailState(), "notUpdated": notUpdated, "notDestroyed": notDestroyed}
+}
+
+// patch applies a PatchObject to an email and reports whether it exists
+func (s *jmapServer) patch(id string, patch map[string]interface{}) bool {
+	email, ok := s.emails[id]
+	if !ok {
+		return false
+	}
+	for path, value := range patch {
+		property, key, _ := strings.Cut(path, "/")
+		set := email.Keywords
+		if property == "mailboxIds" {
+			set = email.MailboxIDs
+		}
+		if key == "" {
+			// The whole property is replaced
+			clear(set)
+			for k := range value.(map[string]interface{}) {
+				set[k] = true
+			}
+			continue
+		}
+		if value == nil {
+			delete(set, key)
+		} else {
+			set[key] = true
+		}
+	}
+	s.record(id, "updated")
+	return true
+}
+
+// submit creates EmailSubmission objects and, once sent, applies
+// onSuccessUpdateEmail and onSuccessDestroyEmail
+func (s *jmapServer) submit(args map[string]interface{}, created map[string]string) map[string]interface{} {
+	createdSubmissions := map[string]interface{}{}
+	notCreated := map[string]interface{}{}
+	sentEmails := map[string]string{}
+
+	creates, _ := args["create"].(map[string]interface{})
+	for creationID, value := range creates {
+		submission := value.(map[string]interface{})
+		emailID := fmt.Sprint(submission["emailId"])
+		if strings.HasPrefix(emailID, "#") {
+			emailID = created[emailID[1:]]
+		}
+		if _, ok := s.emails[emailID]; !ok {
+			notCreated[creationID] = &MethodError{Type: "invalidEmail"}
+			continue
+		}
+		if s.rejectSubmissions {
+			notCreated[creationID] = &MethodError{Type: "forbiddenToSend", Description: "sending is disabled"}
+			continue
+		}
+		submission["emailId"] = emailID
+		s.submissions = append(s.submissions, submission)
+		sentEmails["#"+creationID] = emailID
+		createdSubmissions[creationID] = map[string]string{"id": s.newID("sub")}
+	}
+
+	updates, _ := args["onSuccessUpdateEmail"].(map[string]interface{})
+	for ref, patch := range updates {
+		if id, ok := sentEmails[ref]; ok {
+			s.patch(id, patch.(map[string]interface{}))
+		}
+	}
+	for _, ref := range stringList(args["onSuccessDestroyEmail"]) {
+		if id, ok := sentEmails[ref]; ok {
+			delete(s.emails, id)
+			s.record(id, "destroyed")
+		}
+	}
+	return map[string]interface{}{"created": createdSubmissions, "notCreated": notCreated}
+}
+
+// stringList reads a list of IDs from request arguments, or from the
+// result a reference resolved to
+func stringList(value interface{}) []string {
+	if list, ok := value.([]string); ok {
+		return list
+	}
+	items, _ := value.([]interface{})
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		list = append(list, fmt.Sprint(item))
+	}
+	return list
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestConnect(t *testing.T) {
+	srv := newJMAPServer(t)
+	ctx := context.Background()
+
+	t.Run("well-known session", func(t *testing.T) {
+		client, err := Connect(ctx, srv.creds())
+		if err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+		if client.AccountID() != "acc1" || client.Session().APIURL != srv.URL+"/api" {
+			t.Errorf("session = %+v", client.Session())
+		}
+		// The redirect to the session resource is authorized too
+		if n := srv.authorizedRequests(); n != 2 {
+			t.Errorf("%d authorized requests, want 2", n)
+		}
+	})
+
+	t.Run("session URL", func(t *testing.T) {
+		creds := srv.creds()
+		creds.SessionURL = srv.URL + "/session"
+		if _, err := Connect(ctx, creds); err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		creds := srv.creds()
+		creds.Password = "wrong"
+		_, err := Connect(ctx, creds)
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Connect error = %v, want 401", err)
+		}
+	})
+
+	t.Run("no mail capability", func(t *testing.T) {
+		plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, Session{Capabilities: map[string]json.RawMessage{CapabilityCore: json.RawMessage(`{}`)}})
+		}))
+		defer plain.Close()
+		if _, err := Connect(ctx, &vault.JMAPCredentials{SessionURL: plain.URL, Password: "token"}); err == nil {
+			t.Errorf("Connect accepted a server without JMAP mail")
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	srv := newJMAPServer(t)
+	ctx := context.Background()
+
+	if err := Verify(ctx, &net.Dialer{Timeout: time.Second}, srv.creds()); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	// The stand-in listens on loopback, which a guarded dialer refuses
+	if err := Verify(ctx, netguard.Dialer(time.Second), srv.creds()); !errors.Is(err, netguard.ErrForbiddenAddress) {
+		t.Errorf("Verify error = %v, want ErrForbiddenAddress", err)
+	}
+}
+
+func TestSessionURL(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"jmap.example.com", "https://jmap.example.com/.well-known/jmap"},
+		{" https://jmap.example.com/ ", "https://jmap.example.com/.well-known/jmap"},
+		{"https://jmap.example.com/api/session", "https://jmap.example.com/api/session"},
+		{"http://localhost:8080", "http://localhost:8080/.well-known/jmap"},
+	}
+	for _, tt := range tests {
+		got, err := SessionURL(tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("SessionURL(%q) = %q, %v; want %q", tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{"ftp://jmap.example.com", "https://"} {
+		if _, err := SessionURL(value); err == nil {
+			t.Errorf("SessionURL(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package jmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNoMailbox is returned when a change needs a mailbox with a role, such
+// as the archive, that the account does not have
+var ErrNoMailbox = errors.New("no mailbox with this role")
+
+// ErrCannotCalculateChanges is returned when a state is too old for the
+// server to compute changes and a full sync is required
+var ErrCannotCalculateChanges = errors.New("JMAP state too old to calculate changes")
+
+// Mailbox roles (RFC 8621 section 2)
+const (
+	RoleInbox   = "inbox"
+	RoleArchive = "archive"
+	RoleSent    = "sent"
+	RoleDrafts  = "drafts"
+	RoleTrash   = "trash"
+	RoleJunk    = "junk"
+)
+
+// Keywords of an email
+const (
+	KeywordSeen    = "$seen"
+	KeywordFlagged = "$flagged"
+	KeywordDraft   = "$draft"
+)
+
+// EmailAddress is a name and address
+type EmailAddress struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Email is a JMAP email object
+type Email struct {
+	ID            string          `json:"id"`
+	BlobID        string          `json:"blobId"`
+	ThreadID      string          `json:"threadId"`
+	MailboxIDs    map[string]bool `json:"mailboxIds"`
+	Keywords      map[string]bool `json:"keywords"`
+	From          []EmailAddress  `json:"from"`
+	To            []EmailAddress  `json:"to"`
+	Cc            []EmailAddress  `json:"cc"`
+	Subject       string          `json:"subject"`
+	Preview       string          `json:"preview"`
+	ReceivedAt    time.Time       `json:"receivedAt"`
+	HasAttachment bool            `json:"hasAttachment"`
+}
+
+// emailProperties limits email responses to the metadata sync stores
+var emailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "from", "to", "cc",
+	"subject", "preview", "receivedAt", "hasAttachment",
+}
+
+// EmailChanges are the changes to emails since a state
+type EmailChanges struct {
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+}
+
+// envelopeAddress is an SMTP envelope address of a submission
+type envelopeAddress struct {
+	Email string `json:"email"`
+}
+
+type emailGetResponse struct {
+	State    string   `json:"state"`
+	List     []Email  `json:"list"`
+	NotFound []string `json:"notFound"`
+}
+
+type setResponse struct {
+	Created      map[string]struct{ ID string } `json:"created"`
+	NotCreated   map[string]*MethodError        `json:"notCreated"`
+	NotUpdated   map[string]*MethodError        `json:"notUpdated"`
+	NotDestroyed map[string]*MethodError        `json:"notDestroyed"`
+}
+
+// Mailboxes returns the IDs of the account's mailboxes by role
+func (c *Client) Mailboxes(ctx context.Context) (map[string]string, error) {
+	if c.mailboxes != nil {
+		return c.mailboxes, nil
+	}
+
+	var result struct {
+		List []struct {
+			ID   string `json:"id"`
+			Role string `json:"role"`
+		} `json:"list"`
+	}
+	err := c.call(ctx, "Mailbox/get", map[string]interface{}{
+		"accountId":  c.accountID,
+		"ids":        nil,
+		"properties": []string{"id", "role"},
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	mailboxes := map[string]string{}
+	for _, mailbox := range result.List {
+		if mailbox.Role != "" {
+			mailboxes[mailbox.Role] = mailbox.ID
+		}
+	}
+	c.mailboxes = mailboxes
+	return mailboxes, nil
+}
+
+// mailbox returns the ID of the mailbox with the given role
+func (c *Client) mailbox(ctx context.Context, role string) (string, error) {
+	mailboxes, err := c.Mailboxes(ctx)
+	if err != nil {
+		return "", err
+	}
+	id, ok := mailboxes[role]
+	if !ok {
+		return "", fmt.Errorf("%s: %w", role, ErrNoMailbox)
+	}
+	return id, nil
+}
+
+// EmailState returns the current state of the account's emails
+func (c *Client) EmailState(ctx context.Context) (string, error) {
+	var result emailGetResponse
+	err := c.call(ctx, "Email/get", map[string]interface{}{
+		"accountId": c.accountID,
+		"ids":       []string{},
+	}, &result)
+	if err != nil {
+		return "", err
+	}
+	return result.State, nil
+}
+
+// QueryEmails returns up to limit emails matching filter, newest first,
+// starting after the email with ID anchor, or at the newest if anchor is
+// empty
+func (c *Client) QueryEmails(ctx context.Context, filter interface{}, anchor string, limit int) ([]Email, error) {
+	query := map[string]interface{}{
+		"accountId": c.accountID,
+		"filter":    filter,
+		"sort":      []map[string]interface{}{{"property": "receivedAt", "isAscending": false}},
+		"limit":     limit,
+	}
+	if anchor != "" {
+		query["anchor"] = anchor
+		query["anchorOffset"] = 1
+	}
+
+	responses, err := c.Call(ctx,
+		Invocation{Name: "Email/query", Args: query, CallID: "q"},
+		Invocation{Name: "Email/get", CallID: "g", Args: map[string]interface{}{
+			"accountId":  c.accountID,
+			"#ids":       ResultRef{ResultOf: "q", Name: "Email/query", Path: "/ids"},
+			"properties": emailProperties,
+		}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := responses.Get("q", nil); err != nil {
+		return nil, err
+	}
+
+	var result emailGetResponse
+	if err := responses.Get("g", &result); err != nil {
+		return nil, err
+	}
+	return result.List, nil
+}
+
+// Changes returns up to maxChanges changes to emails since a state, and
+// the created and updated emails that still exist
+func (c *Client) Changes(ctx context.Context, since string, maxChanges int) (*EmailChanges, []Email, error) {
+	get := func(path string) map[string]interface{} {
+		return map[string]interface{}{
+			"accountId":  c.accountID,
+			"#ids":       ResultRef{ResultOf: "c", Name: "Email/changes", Path: path},
+			"properties": emailProperties,
+		}
+	}
+
+	responses, err := c.Call(ctx,
+		Invocation{Name: "Email/changes", CallID: "c", Args: map[string]interface{}{
+			"accountId":  c.accountID,
+			"sinceState": since,
+			"maxChanges": maxChanges,
+		}},
+		Invocation{Name: "Email/get", Args: get("/created"), CallID: "gc"},
+		Invocation{Name: "Email/get", Args: get("/updated"), CallID: "gu"},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes := &EmailChanges{}
+	if err := responses.Get("c", changes); err != nil {
+		var methodErr *MethodError
+		if errors.As(err, &methodErr) && methodErr.Type == "cannotCalculateChanges" {
+			return nil, nil, ErrCannotCalculateChanges
+		}
+		return nil, nil, err
+	}
+
+	var emails []Email
+	for _, callID := range []string{"gc", "gu"} {
+		var result emailGetResponse
+		if err := responses.Get(callID, &result); err != nil {
+			return nil, nil, err
+		}
+		emails = append(emails, result.List...)
+	}
+	return changes, emails, nil
+}
+
+// GetEmail returns the metadata of a single email
+func (c *Client) GetEmail(ctx context.Context, id string) (*Email, error) {
+	var result emailGetResponse
+	err := c.call(ctx, "Email/get", map[string]interface{}{
+		"accountId":  c.accountID,
+		"ids":        []string{id},
+		"properties": emailProperties,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.List) == 0 {
+		return nil, &MethodError{Type: "notFound", Description: "email " + id}
+	}
+	return &result.List[0], nil
+}
+
+// GetRawMessage returns the full RFC 822 source of an email
+func (c *Client) GetRawMessage(ctx context.Context, id string) ([]byte, error) {
+	email, err := c.GetEmail(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Download(ctx, email.BlobID)
+}
+
+// SetKeyword adds or removes a keyword, such as $seen, on an email
+func (c *Client) SetKeyword(ctx context.Context, id, keyword string, on bool) error {
+	var value interface{}
+	if on {
+		value = true
+	}
+	return c.update(ctx, id, map[string]interface{}{"keywords/" + keyword: value})
+}
+
+// SetArchived moves an email from the inbox to the archive, or back
+func (c *Client) SetArchived(ctx context.Context, id string, archived bool) error {
+	inbox, err := c.mailbox(ctx, RoleInbox)
+	if err != nil {
+		return err
+	}
+	archive, err := c.mailbox(ctx, RoleArchive)
+	if err != nil {
+		return err
+	}
+
+	from, to := inbox, archive
+	if !archived {
+		from, to = archive, inbox
+	}
+	return c.update(ctx, id, map[string]interface{}{
+		"mailboxIds/" + from: nil,
+		"mailboxIds/" + to:   true,
+	})
+}
+
+// Trash moves an email out of all its mailboxes into the trash
+func (c *Client) Trash(ctx context.Context, id string) error {
+	trash, err := c.mailbox(ctx, RoleTrash)
+	if err != nil {
+		return err
+	}
+	return c.update(ctx, id, map[string]interface{}{
+		"mailboxIds": map[string]bool{trash: true},
+	})
+}
+
+// CreateDraft stores a complete MIME message in the drafts mailbox and
+// returns the ID of the new email
+func (c *Client) CreateDraft(ctx context.Context, raw []byte) (string, error) {
+	drafts, err := c.mailbox(ctx, RoleDrafts)
+	if err != nil {
+		return "", err
+	}
+	blobID, err := c.Upload(ctx, raw, "message/rfc822")
+	if err != nil {
+		return "", err
+	}
+
+	var result setResponse
+	err = c.call(ctx, "Email/import", c.importDraft(blobID, drafts), &result)
+	if err != nil {
+		return "", err
+	}
+	if setErr := result.NotCreated["draft"]; setErr != nil {
+		return "", setErr
+	}
+	return result.Created["draft"].ID, nil
+}
+
+// DeleteEmail permanently deletes an email, such as a draft
+func (c *Client) DeleteEmail(ctx context.Context, id string) error {
+	var result setResponse
+	err := c.call(ctx, "Email/set", map[string]interface{}{
+		"accountId": c.accountID,
+		"destroy":   []string{id},
+	}, &result)
+	if err != nil {
+		return err
+	}
+	if setErr := result.NotDestroyed[id]; setErr != nil {
+		return setErr
+	}
+	return nil
+}
+
+// Send submits a complete MIME message to the recipients from the identity
+// with the from address. The message is stored as a draft, submitted and,
+// once sent, moved to the sent mailbox, so a failed submission leaves no
+// sent copy behind.
+func (c *Client) Send(ctx context.Context, raw []byte, from string, recipients []string) error {
+	drafts, err := c.mailbox(ctx, RoleDrafts)
+	if err != nil {
+		return err
+	}
+	identityID, err := c.identity(ctx, from)
+	if err != nil {
+		return err
+	}
+	blobID, err := c.Upload(ctx, raw, "message/rfc822")
+	if err != nil {
+		return err
+	}
+
+	rcptTo := make([]envelopeAddress, len(recipients))
+	for i, r := range recipients {
+		rcptTo[i] = envelopeAddress{Email: r}
+	}
+	submission := map[string]interface{}{
+		"accountId": c.accountID,
+		"create": map[string]interface{}{
+			"send": map[string]interface{}{
+				"identityId": identityID,
+				"emailId":    "#draft",
+				"envelope": map[string]interface{}{
+					"mailFrom": envelopeAddress{Email: from},
+					"rcptTo":   rcptTo,
+				},
+			},
+		},
+	}
+	if sent, err := c.mailbox(ctx, RoleSent); err == nil {
+		submission["onSuccessUpdateEmail"] = map[string]interface{}{
+			"#send": map[string]interface{}{
+				"mailboxIds/" + drafts:     nil,
+				"mailboxIds/" + sent:       true,
+				"keywords/" + KeywordDraft: nil,
+			},
+		}
+	} else {
+		submission["onSuccessDestroyEmail"] = []string{"#send"}
+	}
+
+	responses, err := c.Call(ctx,
+		Invocation{Name: "Email/import", Args: c.importDraft(blobID, drafts), CallID: "i"},
+		Invocation{Name: "EmailSubmission/set", Args: submission, CallID: "s"},
+	)
+	if err != nil {
+		return err
+	}
+
+	var imported setResponse
+	if err := responses.Get("i", &imported); err != nil {
+		return err
+	}
+	if setErr := imported.NotCreated["draft"]; setErr != nil {
+		return setErr
+	}
+
+	var submitted setResponse
+	err = responses.Get("s", &submitted)
+	if err == nil && submitted.NotCreated["send"] != nil {
+		err = submitted.NotCreated["send"]
+	}
+	if err != nil {
+		// Remove the unsent copy, so a retry does not leave a second one
+		if id := imported.Created["draft"].ID; id != "" {
+			_ = c.DeleteEmail(ctx, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// identity returns the ID of the sending identity for an address: one with
+// that address, else a wildcard identity of its domain
+func (c *Client) identity(ctx context.Context, address string) (string, error) {
+	var result struct {
+		List []struct {
+			ID    string `json:"id"`
+			Email string `json:"email"`
+		} `json:"list"`
+	}
+	err := c.call(ctx, "Identity/get", map[string]interface{}{
+		"accountId": c.accountID,
+		"ids":       nil,
+	}, &result)
+	if err != nil {
+		return "", err
+	}
+
+	address = strings.ToLower(address)
+	wildcard := ""
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		wildcard = "*" + address[at:]
+	}
+	match := ""
+	for _, identity := range result.List {
+		switch strings.ToLower(identity.Email) {
+		case address:
+			return identity.ID, nil
+		case wildcard:
+			match = identity.ID
+		}
+	}
+	if match == "" {
+		return "", &MethodError{Type: "forbiddenFrom", Description: "no sending identity for " + address}
+	}
+	return match, nil
+}
+
+// importDraft returns the arguments of an Email/import that stores an
+// uploaded message as a draft with creation ID "draft"
+func (c *Client) importDraft(blobID, drafts string) map[string]interface{} {
+	return map[string]interface{}{
+		"accountId": c.accountID,
+		"emails": map[string]interface{}{
+			"draft": map[string]interface{}{
+				"blobId":     blobID,
+				"mailboxIds": map[string]bool{drafts: true},
+				"keywords":   map[string]bool{KeywordDraft: true, KeywordSeen: true},
+			},
+		},
+	}
+}
+
+// update applies a patch to an email
+func (c *Client) update(ctx context.Context, id string, patch map[string]interface{}) error {
+	var result setResponse
+	err := c.call(ctx, "Email/set", map[string]interface{}{
+		"accountId": c.accountID,
+		"update":    map[string]interface{}{id: patch},
+	}, &result)
+	if err != nil {
+		return err
+	}
+	if setErr := result.NotUpdated[id]; setErr != nil {
+		return setErr
+	}
+	return nil
+}
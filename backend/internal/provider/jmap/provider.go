@@ -0,0 +1,124 @@
+package jmap
+
+import (
+	"context"
+
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/vault"
+)
+
+// Provider implements provider.MailProvider for JMAP. JMAP tracks changes
+// per account, so its state is the whole change cursor and accounts are
+// synced by provider.Syncer.
+type Provider struct {
+	connector *Connector
+}
+
+// NewProvider creates a new JMAP provider
+func NewProvider(v *vault.Vault) *Provider {
+	return &Provider{connector: NewConnector(v)}
+}
+
+// Name returns ProviderName
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// ListChanges lists the shown emails page by page for an empty cursor, and
+// the changes since the cursor's Email state otherwise. Mail in drafts,
+// trash or junk is not shown.
+func (p *Provider) ListChanges(ctx context.Context, account *models.EmailAccount, position string) (*provider.Changes, error) {
+	pos, err := parseCursor(position)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	box, err := newMailbox(ctx, client, account.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if pos.State == "" || pos.Listing {
+		return box.list(ctx, pos)
+	}
+	return box.changes(ctx, pos)
+}
+
+// FetchMessage returns the raw source of a message
+func (p *Provider) FetchMessage(ctx context.Context, account *models.EmailAccount, externalID string) ([]byte, error) {
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := client.GetRawMessage(ctx, externalID)
+	return raw, classify(err)
+}
+
+// Send submits a rendered message through EmailSubmission
+func (p *Provider) Send(ctx context.Context, account *models.EmailAccount, from string, recipients []string, raw []byte) error {
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return err
+	}
+	return classify(client.Send(ctx, raw, from, recipients))
+}
+
+// SetFlags maps read and starred onto the $seen and $flagged keywords
+func (p *Provider) SetFlags(ctx context.Context, account *models.EmailAccount, externalID string, flags provider.Flags) error {
+	if flags.Read == nil && flags.Starred == nil {
+		return nil
+	}
+
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return err
+	}
+	if flags.Read != nil {
+		if err := client.SetKeyword(ctx, externalID, KeywordSeen, *flags.Read); err != nil {
+			return classify(err)
+		}
+	}
+	if flags.Starred != nil {
+		if err := client.SetKeyword(ctx, externalID, KeywordFlagged, *flags.Starred); err != nil {
+			return classify(err)
+		}
+	}
+	return nil
+}
+
+// Move moves a message between the inbox and the archive mailbox, or to
+// the trash
+func (p *Provider) Move(ctx context.Context, account *models.EmailAccount, externalID string, folder provider.Folder) error {
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return err
+	}
+
+	switch folder {
+	case provider.FolderInbox:
+		err = client.SetArchived(ctx, externalID, false)
+	case provider.FolderArchive:
+		err = client.SetArchived(ctx, externalID, true)
+	case provider.FolderTrash:
+		err = client.Trash(ctx, externalID)
+	default:
+		return provider.ErrUnsupported
+	}
+	return classify(err)
+}
+
+// classify maps JMAP errors onto the provider errors
+func classify(err error) error {
+	if IsNotFound(err) {
+		return provider.ErrMessageGone
+	}
+	if IsPermanent(err) {
+		return provider.Permanent(err)
+	}
+	return err
+}
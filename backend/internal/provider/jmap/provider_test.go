@@ -0,0 +1,224 @@
+package jmap
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/vault"
+)
+
+// newTestProvider returns a provider and an account for the stand-in's
+// mailbox, with the login sealed in the account's credentials
+func newTestProvider(t *testing.T, srv *jmapServer) (*Provider, *models.EmailAccount) {
+	t.Helper()
+
+	v, err := vault.New(map[string]string{"k1": "0123456789abcdef0123456789abcdef"}, "k1")
+	if err != nil {
+		t.Fatalf("vault: %v", err)
+	}
+	account := &models.EmailAccount{
+		ID:           uuid.New(),
+		Provider:     ProviderName,
+		EmailAddress: "grandpa@example.com",
+		SyncEnabled:  true,
+	}
+	account.CredentialsEncrypted, err = v.Seal(account.ID, &vault.Credentials{JMAP: srv.creds()})
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	return NewProvider(v), account
+}
+
+// externalIDs returns the sorted external IDs of a batch of emails
+func externalIDs(emails []models.Email) []string {
+	ids := []string{}
+	for _, e := range emails {
+		ids = append(ids, e.ExternalID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sorted(ids ...string) []string {
+	if ids == nil {
+		ids = []string{}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestListChanges(t *testing.T) {
+	srv := newJMAPServer(t)
+	p, account := newTestProvider(t, srv)
+	ctx := context.Background()
+
+	lunch := srv.deliver(mbInbox, "Lunch on Sunday")
+	photos := srv.deliver(mbInbox, "Photos", KeywordSeen, KeywordFlagged)
+	old := srv.deliver(mbArchive, "Old news", KeywordSeen)
+	thanks := srv.deliver(mbSent, "Thanks", KeywordSeen)
+	srv.deliver(mbDrafts, "Unsent", KeywordDraft)
+	srv.deliver(mbTrash, "Spam offer")
+
+	// An empty cursor lists the shown mail
+	changes, err := p.ListChanges(ctx, account, "")
+	if err != nil {
+		t.Fatalf("listing: %v", err)
+	}
+	if got, want := externalIDs(changes.Emails), sorted(lunch, photos, old, thanks); !reflect.DeepEqual(got, want) {
+		t.Errorf("listed %v, want %v", got, want)
+	}
+	if changes.More || len(changes.Removed) != 0 {
+		t.Errorf("listing More = %v, Removed = %v", changes.More, changes.Removed)
+	}
+	byID := map[string]models.Email{}
+	for _, e := range changes.Emails {
+		byID[e.ExternalID] = e
+	}
+	if e := byID[lunch]; e.Subject == nil || *e.Subject != "Lunch on Sunday" || e.FromAddress != "kid@example.com" ||
+		e.ThreadID == nil || *e.ThreadID != "thread-"+lunch || e.IsRead || e.IsArchived {
+		t.Errorf("listed email = %+v", e)
+	}
+	if !byID[photos].IsRead || !byID[photos].IsStarred || !byID[old].IsArchived || byID[thanks].IsArchived {
+		t.Errorf("keywords and mailboxes not mapped: %+v", byID)
+	}
+	cursor := changes.Cursor
+
+	t.Run("changes", func(t *testing.T) {
+		birthday := srv.deliver(mbInbox, "Birthday")
+		srv.update(lunch, func(e *Email) { e.Keywords[KeywordSeen] = true })
+		srv.update(photos, func(e *Email) { e.MailboxIDs = map[string]bool{mbTrash: true} })
+		srv.destroy(old)
+		// Created and destroyed since the cursor: never seen
+		srv.destroy(srv.deliver(mbInbox, "Gone already"))
+
+		changes, err := p.ListChanges(ctx, account, cursor)
+		if err != nil {
+			t.Fatalf("ListChanges: %v", err)
+		}
+		if got, want := externalIDs(changes.Emails), sorted(birthday, lunch); !reflect.DeepEqual(got, want) {
+			t.Errorf("changed emails %v, want %v", got, want)
+		}
+		if got, want := sorted(changes.Removed...), sorted(photos, old); !reflect.DeepEqual(got, want) {
+			t.Errorf("removed %v, want %v", got, want)
+		}
+		for _, e := range changes.Emails {
+			if e.ExternalID == lunch && !e.IsRead {
+				t.Errorf("keyword change was not listed")
+			}
+		}
+		if changes.Cursor == cursor || changes.More {
+			t.Errorf("cursor = %q, More = %v", changes.Cursor, changes.More)
+		}
+		cursor = changes.Cursor
+
+		// Nothing changed since
+		changes, err = p.ListChanges(ctx, account, cursor)
+		if err != nil {
+			t.Fatalf("ListChanges: %v", err)
+		}
+		if len(changes.Emails) != 0 || len(changes.Removed) != 0 || changes.Cursor != cursor {
+			t.Errorf("no-op changes = %+v", changes)
+		}
+	})
+
+	t.Run("cannot calculate changes", func(t *testing.T) {
+		srv.expireStates()
+		srv.deliver(mbInbox, "Recipe")
+		if _, err := p.ListChanges(ctx, account, cursor); !errors.Is(err, provider.ErrCursorExpired) {
+			t.Errorf("ListChanges error = %v, want ErrCursorExpired", err)
+		}
+
+		client, err := Connect(ctx, srv.creds())
+		if err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+		if _, _, err := client.Changes(ctx, "s1", maxChanges); err != ErrCannotCalculateChanges {
+			t.Errorf("Changes error = %v, want ErrCannotCalculateChanges", err)
+		}
+	})
+
+	t.Run("malformed cursor", func(t *testing.T) {
+		if _, err := p.ListChanges(ctx, account, "not json"); !errors.Is(err, provider.ErrCursorExpired) {
+			t.Errorf("ListChanges error = %v, want ErrCursorExpired", err)
+		}
+	})
+}
+
+func TestSend(t *testing.T) {
+	srv := newJMAPServer(t)
+	p, account := newTestProvider(t, srv)
+	ctx := context.Background()
+	raw := []byte("From: grandpa@example.com\r\nTo: kid@example.com\r\nSubject: Lunch\r\n\r\nSee you at noon.\r\n")
+	recipients := []string{"kid@example.com", "hidden@example.com"}
+
+	if err := p.Send(ctx, account, "Grandpa@Example.com", recipients, raw); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if len(srv.submissions) != 1 {
+		t.Fatalf("%d submissions, want 1", len(srv.submissions))
+	}
+	submission := srv.submissions[0]
+	if submission["identityId"] != "id-domain" {
+		t.Errorf("identityId = %v, want the domain's wildcard identity", submission["identityId"])
+	}
+	envelope := submission["envelope"].(map[string]interface{})
+	if from := envelope["mailFrom"].(map[string]interface{})["email"]; from != "Grandpa@Example.com" {
+		t.Errorf("envelope mailFrom = %v", from)
+	}
+	var rcptTo []string
+	for _, rcpt := range envelope["rcptTo"].([]interface{}) {
+		rcptTo = append(rcptTo, rcpt.(map[string]interface{})["email"].(string))
+	}
+	if !reflect.DeepEqual(rcptTo, recipients) {
+		t.Errorf("envelope rcptTo = %v, want %v", rcptTo, recipients)
+	}
+
+	// The sent copy was moved out of the drafts into the sent mailbox
+	sent := srv.emails[submission["emailId"].(string)]
+	if sent == nil {
+		t.Fatalf("submitted email %v does not exist", submission["emailId"])
+	}
+	if !reflect.DeepEqual(sent.MailboxIDs, map[string]bool{mbSent: true}) || sent.Keywords[KeywordDraft] || !sent.Keywords[KeywordSeen] {
+		t.Errorf("sent copy has mailboxes %v and keywords %v", sent.MailboxIDs, sent.Keywords)
+	}
+	if got := string(srv.blobs[sent.BlobID]); got != string(raw) {
+		t.Errorf("uploaded message = %q", got)
+	}
+
+	t.Run("rejected submission", func(t *testing.T) {
+		srv.rejectSubmissions = true
+		before := len(srv.emails)
+
+		err := p.Send(ctx, account, "grandpa@example.com", recipients, raw)
+		if err == nil || !provider.IsPermanent(err) {
+			t.Fatalf("Send error = %v, want a permanent error", err)
+		}
+		var methodErr *MethodError
+		if !errors.As(err, &methodErr) || methodErr.Type != "forbiddenToSend" {
+			t.Errorf("Send error = %v, want forbiddenToSend", err)
+		}
+		// The unsent draft is removed so a retry does not leave a second copy
+		if len(srv.emails) != before {
+			t.Errorf("%d emails after a rejected submission, want %d", len(srv.emails), before)
+		}
+		calls := srv.methodCalls()
+		if last := calls[len(calls)-1]; last != "Email/set" {
+			t.Errorf("last method call = %s, want the Email/set destroying the draft", last)
+		}
+	})
+
+	t.Run("no identity", func(t *testing.T) {
+		srv.rejectSubmissions = false
+		err := p.Send(ctx, account, "grandpa@elsewhere.org", recipients, raw)
+		if !provider.IsPermanent(err) {
+			t.Errorf("Send error = %v, want a permanent error", err)
+		}
+	})
+}
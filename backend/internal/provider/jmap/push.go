@@ -0,0 +1,330 @@
+package jmap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// pushRefreshInterval is how often the set of watched accounts is
+	// reloaded
+	pushRefreshInterval = time.Minute
+	// pushPingInterval is how often the server is asked to send a ping, so
+	// a dead connection is noticed
+	pushPingInterval = 60 * time.Second
+	// pushIdleTimeout drops a connection that sent nothing, not even a
+	// ping, for this long
+	pushIdleTimeout = 3 * pushPingInterval
+	// pushDebounce groups bursts of state changes into a single sync
+	pushDebounce = 2 * time.Second
+
+	minBackoff = 5 * time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// AccountSyncer syncs a single account, such as provider.Syncer
+type AccountSyncer interface {
+	SyncAccount(ctx context.Context, account *models.EmailAccount) error
+}
+
+// PushManager keeps one EventSource connection per sync-enabled account
+// and syncs the account whenever the server announces that its emails
+// changed. Accounts beyond the connection cap, and servers without push,
+// are left to the periodic sync.
+type PushManager struct {
+	accountRepo *repository.EmailAccountRepository
+	connector   *Connector
+	syncer      AccountSyncer
+	maxConns    int
+
+	mu        sync.Mutex
+	listeners map[uuid.UUID]context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewPushManager creates a new push manager that opens at most maxConns
+// connections
+func NewPushManager(db *sqlx.DB, v *vault.Vault, syncer AccountSyncer, maxConns int) *PushManager {
+	return &PushManager{
+		accountRepo: repository.NewEmailAccountRepository(db),
+		connector:   NewConnector(v),
+		syncer:      syncer,
+		maxConns:    maxConns,
+		listeners:   make(map[uuid.UUID]context.CancelFunc),
+	}
+}
+
+// Run starts and stops listeners as accounts are added, disabled or removed
+// until ctx is cancelled
+func (m *PushManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(pushRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.refresh(ctx); err != nil {
+			log.Printf("JMAP push refresh failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			m.stopAll()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *PushManager) refresh(ctx context.Context) error {
+	accounts, err := m.accountRepo.ListSyncEnabled(ProviderName)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	enabled := make(map[uuid.UUID]bool, len(accounts))
+	for _, account := range accounts {
+		enabled[account.ID] = true
+	}
+	for id, cancel := range m.listeners {
+		if !enabled[id] {
+			cancel()
+			delete(m.listeners, id)
+		}
+	}
+
+	for _, account := range accounts {
+		if _, ok := m.listeners[account.ID]; ok {
+			continue
+		}
+		if len(m.listeners) >= m.maxConns {
+			log.Printf("JMAP push connection cap (%d) reached, remaining accounts use periodic sync", m.maxConns)
+			break
+		}
+
+		listenerCtx, cancel := context.WithCancel(ctx)
+		m.listeners[account.ID] = cancel
+		m.wg.Add(1)
+		go func(accountID uuid.UUID) {
+			defer m.wg.Done()
+			m.listen(listenerCtx, accountID)
+		}(account.ID)
+	}
+
+	return nil
+}
+
+func (m *PushManager) stopAll() {
+	m.mu.Lock()
+	for id, cancel := range m.listeners {
+		cancel()
+		delete(m.listeners, id)
+	}
+	m.mu.Unlock()
+
+	m.wg.Wait()
+}
+
+// errNoPush is returned for servers that do not offer an EventSource URL
+var errNoPush = errors.New("server does not support push")
+
+// listen keeps an EventSource connection open for one account,
+// reconnecting with exponential backoff after failures
+func (m *PushManager) listen(ctx context.Context, accountID uuid.UUID) {
+	backoff := minBackoff
+
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := m.session(ctx, accountID)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A connection that stayed up for a while was healthy, so start over
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff
+		}
+		if err == errNoPush {
+			backoff = maxBackoff
+		}
+		log.Printf("JMAP push for account %s disconnected: %v (retrying in %s)", accountID, err, backoff)
+
+		// Jitter keeps reconnects from many accounts from lining up
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// session runs a single connection: sync, wait until the server reports a
+// change to the account's emails, sync again, and so on
+func (m *PushManager) session(ctx context.Context, accountID uuid.UUID) error {
+	// Reload the account so credential changes apply on reconnect
+	account, err := m.accountRepo.GetByID(accountID)
+	if err != nil {
+		return err
+	}
+	client, err := m.connector.Client(ctx, account)
+	if err != nil {
+		return err
+	}
+	if client.Session().EventSourceURL == "" {
+		return errNoPush
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wake := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.watch(streamCtx, wake)
+	}()
+
+	for {
+		if err := m.syncer.SyncAccount(ctx, account); err != nil {
+			return err
+		}
+
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return nil
+		case <-wake:
+		}
+
+		// Let related changes arrive before syncing
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return nil
+		case <-time.After(pushDebounce):
+		}
+		select {
+		case <-wake:
+		default:
+		}
+	}
+}
+
+// stateChange is the data of a push "state" event
+type stateChange struct {
+	Changed map[string]map[string]string `json:"changed"`
+}
+
+// watch reads the account's EventSource stream until it fails or ctx is
+// cancelled, and signals wake whenever the account's emails changed
+func (c *Client) watch(ctx context.Context, wake chan<- struct{}) error {
+	u := expandTemplate(c.session.EventSourceURL, map[string]string{
+		"types":      "Email",
+		"closeafter": "no",
+		"ping":       fmt.Sprintf("%d", int(pushPingInterval/time.Second)),
+	})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// The stream stays open, so it must not be cut off by the request
+	// timeout; the idle timer below notices dead connections instead
+	stream := &http.Client{Transport: c.httpClient.Transport}
+	resp, err := stream.Do(req)
+	if err != nil {
+		return fmt.Errorf("JMAP push request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &APIError{StatusCode: resp.StatusCode, Body: resp.Status}
+	}
+
+	var silent atomic.Bool
+	idle := time.AfterFunc(pushIdleTimeout, func() {
+		silent.Store(true)
+		cancel()
+	})
+	defer idle.Stop()
+
+	event, data := "", ""
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		idle.Reset(pushIdleTimeout)
+
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// A blank line ends the event
+			if event == "state" && c.emailChanged(data) {
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, ":"):
+			// Comment, used by some servers to keep the connection open
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				event = value
+			case "data":
+				if data != "" {
+					data += "\n"
+				}
+				data += value
+			}
+		}
+	}
+	if silent.Load() {
+		return fmt.Errorf("JMAP push stream sent nothing for %s", pushIdleTimeout)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("JMAP push stream failed: %w", err)
+	}
+	return errors.New("JMAP push stream closed")
+}
+
+// emailChanged reports whether a state change covers the client's account
+// emails
+func (c *Client) emailChanged(data string) bool {
+	var change stateChange
+	if err := json.Unmarshal([]byte(data), &change); err != nil {
+		return false
+	}
+	_, ok := change.Changed[c.accountID]["Email"]
+	return ok
+}
@@ -0,0 +1,277 @@
+// Package jmap connects mailboxes over JMAP (RFC 8620, RFC 8621), as
+// offered by Fastmail and self-hosted servers such as Stalwart and Cyrus:
+// session discovery, state based sync, push over EventSource, state
+// write-back, drafts and sending through EmailSubmission.
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/lib/pq"
+)
+
+// ProviderName is the email_accounts.provider value handled by this package
+const ProviderName = "jmap"
+
+const (
+	// queryPageSize is how many emails a listing returns at a time
+	queryPageSize = 100
+	// maxChanges is how many changes are read at a time
+	maxChanges = 256
+)
+
+// hiddenRoles are the mailboxes whose mail is not shown unless it is also
+// in another mailbox
+var hiddenRoles = []string{RoleDrafts, RoleTrash, RoleJunk}
+
+// DecryptCredentials decrypts an account's JMAP login
+func DecryptCredentials(v *vault.Vault, account *models.EmailAccount) (*vault.JMAPCredentials, error) {
+	creds, err := v.Open(account.ID, account.CredentialsEncrypted)
+	if err != nil {
+		return nil, err
+	}
+	if creds.JMAP == nil || creds.JMAP.SessionURL == "" {
+		return nil, fmt.Errorf("credentials are missing JMAP settings")
+	}
+
+	return creds.JMAP, nil
+}
+
+// Verify checks that the server accepts a login and offers JMAP mail. It
+// connects through dialer, which lets callers keep user-supplied hosts off
+// private networks, and does not follow a proxy from the environment.
+func Verify(ctx context.Context, dialer *net.Dialer, creds *vault.JMAPCredentials) error {
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	defer transport.CloseIdleConnections()
+
+	_, err := connect(ctx, creds, transport)
+	return err
+}
+
+// Connector builds clients for stored JMAP accounts
+type Connector struct {
+	vault *vault.Vault
+}
+
+// NewConnector creates a new JMAP connector
+func NewConnector(v *vault.Vault) *Connector {
+	return &Connector{vault: v}
+}
+
+// Client discovers the account's session and returns a client for it
+func (c *Connector) Client(ctx context.Context, account *models.EmailAccount) (*Client, error) {
+	creds, err := DecryptCredentials(c.vault, account)
+	if err != nil {
+		return nil, err
+	}
+	return Connect(ctx, creds)
+}
+
+// cursor is the position ListChanges continues from: the Email state, and
+// while the mailbox is being listed, the last email listed so far
+type cursor struct {
+	State   string `json:"state"`
+	Listing bool   `json:"listing,omitempty"`
+	Anchor  string `json:"anchor,omitempty"`
+}
+
+// parseCursor reads a cursor written by encode. A cursor that does not
+// parse is treated as expired, so the mailbox is listed again.
+func parseCursor(value string) (cursor, error) {
+	var pos cursor
+	if value == "" {
+		return pos, nil
+	}
+	if err := json.Unmarshal([]byte(value), &pos); err != nil || pos.State == "" {
+		return pos, provider.ErrCursorExpired
+	}
+	return pos, nil
+}
+
+func (pos cursor) encode() string {
+	data, _ := json.Marshal(pos)
+	return string(data)
+}
+
+// mailbox is the state of one account's ListChanges call
+type mailbox struct {
+	client    *Client
+	accountID uuid.UUID
+	inbox     string
+	sent      string
+	// hidden are the IDs of the mailboxes with hiddenRoles
+	hidden map[string]bool
+}
+
+func newMailbox(ctx context.Context, client *Client, accountID uuid.UUID) (*mailbox, error) {
+	mailboxes, err := client.Mailboxes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	box := &mailbox{
+		client:    client,
+		accountID: accountID,
+		inbox:     mailboxes[RoleInbox],
+		sent:      mailboxes[RoleSent],
+		hidden:    map[string]bool{},
+	}
+	for _, role := range hiddenRoles {
+		if id, ok := mailboxes[role]; ok {
+			box.hidden[id] = true
+		}
+	}
+	return box, nil
+}
+
+// list returns the next page of shown emails. The state captured before
+// the first page is where the changes continue from once the listing is
+// done, so changes made while listing are not missed.
+func (box *mailbox) list(ctx context.Context, pos cursor) (*provider.Changes, error) {
+	if !pos.Listing {
+		state, err := box.client.EmailState(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pos = cursor{State: state, Listing: true}
+	}
+
+	hidden := make([]string, 0, len(box.hidden))
+	for id := range box.hidden {
+		hidden = append(hidden, id)
+	}
+	filter := map[string]interface{}{"inMailboxOtherThan": hidden}
+
+	emails, err := box.client.QueryEmails(ctx, filter, pos.Anchor, queryPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &provider.Changes{}
+	for i := range emails {
+		if box.shown(&emails[i]) {
+			changes.Emails = append(changes.Emails, *box.toEmail(&emails[i]))
+		}
+	}
+
+	if len(emails) < queryPageSize {
+		changes.Cursor = cursor{State: pos.State}.encode()
+		return changes, nil
+	}
+	pos.Anchor = emails[len(emails)-1].ID
+	changes.Cursor = pos.encode()
+	changes.More = true
+	return changes, nil
+}
+
+// changes returns the changes since pos.State
+func (box *mailbox) changes(ctx context.Context, pos cursor) (*provider.Changes, error) {
+	changed, emails, err := box.client.Changes(ctx, pos.State, maxChanges)
+	if err == ErrCannotCalculateChanges {
+		return nil, provider.ErrCursorExpired
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Emails that moved into trash, junk or drafts are removed like
+	// destroyed ones, as are changed emails destroyed meanwhile
+	changes := &provider.Changes{
+		Removed: changed.Destroyed,
+		Cursor:  cursor{State: changed.NewState}.encode(),
+		More:    changed.HasMoreChanges,
+	}
+	kept := map[string]bool{}
+	for i := range emails {
+		email := &emails[i]
+		if !box.shown(email) {
+			continue
+		}
+		changes.Emails = append(changes.Emails, *box.toEmail(email))
+		kept[email.ID] = true
+	}
+	for _, ids := range [][]string{changed.Created, changed.Updated} {
+		for _, id := range ids {
+			if !kept[id] {
+				changes.Removed = append(changes.Removed, id)
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// shown reports whether an email belongs in the mailbox: it is no draft
+// and is in a mailbox other than drafts, trash and junk
+func (box *mailbox) shown(email *Email) bool {
+	if email.Keywords[KeywordDraft] {
+		return false
+	}
+	for id, in := range email.MailboxIDs {
+		if in && !box.hidden[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// toEmail converts a JMAP email into an email row. The JMAP thread ID
+// threads the message like Gmail's thread ID does.
+func (box *mailbox) toEmail(msg *Email) *models.Email {
+	email := &models.Email{
+		AccountID:      box.accountID,
+		ExternalID:     msg.ID,
+		IsRead:         msg.Keywords[KeywordSeen],
+		IsStarred:      msg.Keywords[KeywordFlagged],
+		IsArchived:     !msg.MailboxIDs[box.inbox] && !msg.MailboxIDs[box.sent],
+		HasAttachments: msg.HasAttachment,
+		ReceivedAt:     msg.ReceivedAt,
+		ToAddresses:    addressList(msg.To),
+		CcAddresses:    addressList(msg.Cc),
+	}
+
+	if msg.ThreadID != "" {
+		threadID := msg.ThreadID
+		email.ThreadID = &threadID
+	}
+	if len(msg.From) > 0 {
+		email.FromAddress = msg.From[0].Email
+		if name := msg.From[0].Name; name != "" && name != email.FromAddress {
+			email.FromName = &name
+		}
+	}
+	if msg.Subject != "" {
+		subject := msg.Subject
+		email.Subject = &subject
+	}
+	if msg.Preview != "" {
+		snippet := msg.Preview
+		email.Snippet = &snippet
+	}
+	if email.ReceivedAt.IsZero() {
+		email.ReceivedAt = time.Now()
+	}
+
+	return email
+}
+
+func addressList(addresses []EmailAddress) pq.StringArray {
+	list := pq.StringArray{}
+	for _, a := range addresses {
+		if a.Email != "" {
+			list = append(list, a.Email)
+		}
+	}
+	return list
+}
@@ -0,0 +1,372 @@
+package outlook
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrDeltaExpired is returned when a delta link is too old for the server
+// to compute changes and a full sync is required
+var ErrDeltaExpired = errors.New("graph delta token expired")
+
+const (
+	requestTimeout = time.Minute
+
+	// deltaPageSize is how many messages a delta page holds
+	deltaPageSize = 100
+
+	// maxRawMessageBytes caps a downloaded message source
+	maxRawMessageBytes = 150 << 20
+)
+
+// Client is a minimal Microsoft Graph mail client for the signed-in user.
+// Messages are addressed by immutable IDs, which do not change when a
+// message moves between folders.
+type Client struct {
+	baseURL    string
+	origin     string
+	httpClient *http.Client
+	ts         oauth2.TokenSource
+}
+
+// NewClient creates a Graph client. Requests are authorized with tokens from
+// ts, which refreshes the access token when it expires.
+func NewClient(ctx context.Context, baseURL string, ts oauth2.TokenSource) *Client {
+	ts = oauth2.ReuseTokenSource(nil, ts)
+	httpClient := oauth2.NewClient(ctx, ts)
+	httpClient.Timeout = requestTimeout
+
+	baseURL = strings.TrimRight(baseURL, "/")
+	origin := baseURL
+	if u, err := url.Parse(baseURL); err == nil {
+		origin = u.Scheme + "://" + u.Host
+	}
+
+	return &Client{
+		baseURL:    baseURL + "/v1.0/me",
+		origin:     origin,
+		httpClient: httpClient,
+		ts:         ts,
+	}
+}
+
+// Token returns the current OAuth token. Microsoft issues a new refresh
+// token whenever the access token is refreshed.
+func (c *Client) Token() (*oauth2.Token, error) {
+	return c.ts.Token()
+}
+
+// EmailAddress is a name and address
+type EmailAddress struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// Recipient is a sender or recipient of a message
+type Recipient struct {
+	EmailAddress EmailAddress `json:"emailAddress"`
+}
+
+// Flag is the follow-up flag of a message, shown as a star
+type Flag struct {
+	FlagStatus string `json:"flagStatus"` // notFlagged, flagged, complete
+}
+
+// Removed marks a message that left the folder in a delta response
+type Removed struct {
+	Reason string `json:"reason"` // changed, deleted
+}
+
+// Message is a Graph message resource
+type Message struct {
+	ID               string      `json:"id"`
+	ConversationID   string      `json:"conversationId"`
+	ParentFolderID   string      `json:"parentFolderId"`
+	Subject          string      `json:"subject"`
+	BodyPreview      string      `json:"bodyPreview"`
+	From             *Recipient  `json:"from"`
+	ToRecipients     []Recipient `json:"toRecipients"`
+	CcRecipients     []Recipient `json:"ccRecipients"`
+	ReceivedDateTime time.Time   `json:"receivedDateTime"`
+	IsRead           bool        `json:"isRead"`
+	IsDraft          bool        `json:"isDraft"`
+	HasAttachments   bool        `json:"hasAttachments"`
+	Flag             *Flag       `json:"flag"`
+	Removed          *Removed    `json:"@removed"`
+}
+
+// MessagePage is one page of a delta query. The last page has a delta link
+// to continue from instead of a next link.
+type MessagePage struct {
+	Value     []Message `json:"value"`
+	NextLink  string    `json:"@odata.nextLink"`
+	DeltaLink string    `json:"@odata.deltaLink"`
+}
+
+// MailFolder is a Graph mail folder
+type MailFolder struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+}
+
+// Profile is the signed-in user
+type Profile struct {
+	DisplayName       string `json:"displayName"`
+	Mail              string `json:"mail"`
+	UserPrincipalName string `json:"userPrincipalName"`
+}
+
+// Address returns the user's email address. Personal accounts may only
+// have a user principal name.
+func (p *Profile) Address() string {
+	if p.Mail != "" {
+		return p.Mail
+	}
+	return p.UserPrincipalName
+}
+
+// messageFields limits message responses to the metadata sync stores
+const messageFields = "id,conversationId,parentFolderId,subject,bodyPreview,from,toRecipients," +
+	"ccRecipients,receivedDateTime,isRead,isDraft,hasAttachments,flag"
+
+// GetProfile returns the signed-in user
+func (c *Client) GetProfile(ctx context.Context) (*Profile, error) {
+	query := url.Values{"$select": {"displayName,mail,userPrincipalName"}}
+
+	profile := &Profile{}
+	if err := c.get(ctx, c.baseURL, query, profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// GetFolder returns a mail folder by ID or well-known name, such as inbox
+func (c *Client) GetFolder(ctx context.Context, id string) (*MailFolder, error) {
+	query := url.Values{"$select": {"id,displayName"}}
+
+	folder := &MailFolder{}
+	if err := c.get(ctx, c.baseURL+"/mailFolders/"+url.PathEscape(id), query, folder); err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+// Delta returns one page of the changes to the messages of a folder. An
+// empty link starts over and returns every message; otherwise link is the
+// next or delta link of the previous page.
+func (c *Client) Delta(ctx context.Context, folder, link string) (*MessagePage, error) {
+	var query url.Values
+	if link == "" {
+		link = c.baseURL + "/mailFolders/" + url.PathEscape(folder) + "/messages/delta"
+		query = url.Values{"$select": {messageFields}}
+	} else if !strings.HasPrefix(link, c.origin+"/") {
+		// Links carry the access token, so never follow one elsewhere
+		return nil, fmt.Errorf("delta link points outside the Graph API: %s", link)
+	}
+
+	page := &MessagePage{}
+	err := c.get(ctx, link, query, page)
+	if isStatus(err, http.StatusGone) {
+		return nil, ErrDeltaExpired
+	}
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// GetMessage returns the metadata of a single message
+func (c *Client) GetMessage(ctx context.Context, id string) (*Message, error) {
+	query := url.Values{"$select": {messageFields}}
+
+	msg := &Message{}
+	if err := c.get(ctx, c.messageURL(id), query, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// GetRawMessage returns the full RFC 822 source of a message
+func (c *Client) GetRawMessage(ctx context.Context, id string) ([]byte, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, c.messageURL(id)+"/$value", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxRawMessageBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read raw message: %w", err)
+	}
+	if len(raw) > maxRawMessageBytes {
+		return nil, fmt.Errorf("message is larger than %d MB", maxRawMessageBytes>>20)
+	}
+	return raw, nil
+}
+
+// SendMail sends a complete MIME message. Graph takes the recipients from
+// its headers, so recipients that must not be shown, such as Bcc, are
+// passed separately and added as a Bcc header that Graph removes before
+// delivery.
+func (c *Client) SendMail(ctx context.Context, raw []byte, bcc []string) error {
+	if len(bcc) > 0 {
+		raw = append([]byte("Bcc: "+strings.Join(bcc, ", ")+"\r\n"), raw...)
+	}
+	return c.postMIME(ctx, c.baseURL+"/sendMail", raw, nil)
+}
+
+// UpdateMessage changes properties of a message, such as isRead
+func (c *Client) UpdateMessage(ctx context.Context, id string, fields map[string]interface{}) error {
+	return c.write(ctx, http.MethodPatch, c.messageURL(id), fields, nil)
+}
+
+// MoveMessage moves a message to a folder, given by ID or well-known name
+func (c *Client) MoveMessage(ctx context.Context, id, destination string) error {
+	body := map[string]string{"destinationId": destination}
+	return c.write(ctx, http.MethodPost, c.messageURL(id)+"/move", body, nil)
+}
+
+// CreateDraft stores a complete MIME message as a new draft in the Drafts
+// folder
+func (c *Client) CreateDraft(ctx context.Context, raw []byte) (*Message, error) {
+	msg := &Message{}
+	if err := c.postMIME(ctx, c.baseURL+"/messages", raw, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// DeleteMessage permanently deletes a message, such as a draft
+func (c *Client) DeleteMessage(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, c.messageURL(id), nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, nil)
+}
+
+// APIError is a non-2xx response from the Graph API
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("graph API returned %d: %s", e.StatusCode, e.Body)
+}
+
+// IsNotFound reports whether err is a 404 from the Graph API
+func IsNotFound(err error) bool {
+	return isStatus(err, http.StatusNotFound)
+}
+
+func isStatus(err error, status int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
+
+func (c *Client) messageURL(id string) string {
+	return c.baseURL + "/messages/" + url.PathEscape(id)
+}
+
+func (c *Client) get(ctx context.Context, u string, query url.Values, out interface{}) error {
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Prefer", fmt.Sprintf("odata.maxpagesize=%d", deltaPageSize))
+
+	return c.do(req, out)
+}
+
+func (c *Client) write(ctx context.Context, method, u string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	req, err := c.newRequest(ctx, method, u, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, out)
+}
+
+// postMIME posts a MIME message, which Graph expects base64 encoded
+func (c *Client) postMIME(ctx context.Context, u string, raw []byte, out interface{}) error {
+	payload := base64.StdEncoding.EncodeToString(raw)
+
+	req, err := c.newRequest(ctx, http.MethodPost, u, strings.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	return c.do(req, out)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Add("Prefer", `IdType="ImmutableId"`)
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request, out interface{}) error {
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode graph response: %w", err)
+	}
+
+	return nil
+}
+
+// send performs a request and returns the response if it succeeded. The
+// caller must close its body.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("graph request failed: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+
+	return resp, nil
+}
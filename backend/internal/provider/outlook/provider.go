@@ -0,0 +1,110 @@
+package outlook
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/vault"
+)
+
+// Provider implements provider.MailProvider for Outlook. Sync stays with
+// Syncer, which keeps a delta link per folder.
+type Provider struct {
+	connector *Connector
+}
+
+// NewProvider creates a new Outlook provider
+func NewProvider(cfg *config.EmailConfig, v *vault.Vault) *Provider {
+	return &Provider{connector: NewConnector(cfg, v)}
+}
+
+// Name returns ProviderName
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// ListChanges is not supported; Syncer syncs Outlook accounts
+func (p *Provider) ListChanges(ctx context.Context, account *models.EmailAccount, cursor string) (*provider.Changes, error) {
+	return nil, provider.ErrUnsupported
+}
+
+// FetchMessage returns the raw source of a message
+func (p *Provider) FetchMessage(ctx context.Context, account *models.EmailAccount, externalID string) ([]byte, error) {
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := client.GetRawMessage(ctx, externalID)
+	return raw, classify(err)
+}
+
+// Send sends a rendered message. Graph drops the Bcc header of MIME
+// messages, so Bcc recipients are passed separately.
+func (p *Provider) Send(ctx context.Context, account *models.EmailAccount, from string, recipients []string, raw []byte) error {
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return err
+	}
+	return classify(client.SendMail(ctx, raw, provider.HiddenRecipients(raw, recipients)))
+}
+
+// SetFlags maps read onto isRead and starred onto the follow-up flag
+func (p *Provider) SetFlags(ctx context.Context, account *models.EmailAccount, externalID string, flags provider.Flags) error {
+	fields := map[string]interface{}{}
+	if flags.Read != nil {
+		fields["isRead"] = *flags.Read
+	}
+	if flags.Starred != nil {
+		status := "notFlagged"
+		if *flags.Starred {
+			status = "flagged"
+		}
+		fields["flag"] = Flag{FlagStatus: status}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return err
+	}
+	return classify(client.UpdateMessage(ctx, externalID, fields))
+}
+
+// Move moves a message between the inbox and the archive folder, or to
+// Deleted Items, which is not synced
+func (p *Provider) Move(ctx context.Context, account *models.EmailAccount, externalID string, folder provider.Folder) error {
+	var destination string
+	switch folder {
+	case provider.FolderInbox:
+		destination = FolderInbox
+	case provider.FolderArchive:
+		destination = FolderArchive
+	case provider.FolderTrash:
+		destination = FolderDeleted
+	default:
+		return provider.ErrUnsupported
+	}
+
+	client, err := p.connector.Client(ctx, account)
+	if err != nil {
+		return err
+	}
+	return classify(client.MoveMessage(ctx, externalID, destination))
+}
+
+// classify maps Graph API errors onto the provider errors
+func classify(err error) error {
+	if IsNotFound(err) {
+		return provider.ErrMessageGone
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && provider.IsPermanentStatus(apiErr.StatusCode) {
+		return provider.Permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package outlook
+
+import (
+	"bytes"
+	"context"
+	"net/mail"
+	"testing"
+
+	"github.com/jay/dadmail/internal/mailer"
+)
+
+func TestSendAddsBccHeader(t *testing.T) {
+	srv := newGraphServer(t)
+	v, account := newTestAccount(t)
+
+	msg := &mailer.Message{
+		From:    mail.Address{Name: "Grandpa", Address: "grandpa@outlook.com"},
+		To:      []mail.Address{{Address: "kid@example.com"}},
+		Cc:      []mail.Address{{Address: "aunt@example.com"}},
+		Bcc:     []mail.Address{{Address: "hidden@example.com"}, {Address: "KID@example.com"}},
+		Subject: "Sunday lunch",
+		Text:    "See you at noon.\n",
+	}
+	raw, err := msg.Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if err := NewProvider(srv.config(), v).Send(context.Background(), account, msg.From.Address, msg.Recipients(), raw); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if len(srv.sent) != 1 {
+		t.Fatalf("sendMail called %d times, want 1", len(srv.sent))
+	}
+	sent, err := mail.ReadMessage(bytes.NewReader(srv.sent[0]))
+	if err != nil {
+		t.Fatalf("payload is not a message: %v", err)
+	}
+	if bcc := sent.Header.Get("Bcc"); bcc != "hidden@example.com" {
+		t.Errorf("Bcc header = %q, want only the recipient not in To or Cc", bcc)
+	}
+	if to, cc := sent.Header.Get("To"), sent.Header.Get("Cc"); to != "<kid@example.com>" || cc != "<aunt@example.com>" {
+		t.Errorf("To = %q, Cc = %q", to, cc)
+	}
+	if !bytes.HasSuffix(srv.sent[0], raw) {
+		t.Errorf("payload does not end with the built message:\n%s", srv.sent[0])
+	}
+}
+
+func TestSendWithoutBccLeavesMessageAlone(t *testing.T) {
+	srv := newGraphServer(t)
+	v, account := newTestAccount(t)
+
+	raw := []byte("From: grandpa@outlook.com\r\nTo: kid@example.com\r\nSubject: hi\r\n\r\nHello\r\n")
+	if err := NewProvider(srv.config(), v).Send(context.Background(), account, "grandpa@outlook.com", []string{"kid@example.com"}, raw); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if len(srv.sent) != 1 || !bytes.Equal(srv.sent[0], raw) {
+		t.Errorf("payloads = %q, want the message unchanged", srv.sent)
+	}
+}
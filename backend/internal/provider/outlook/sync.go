@@ -0,0 +1,416 @@
+// Package outlook connects Outlook.com and Microsoft 365 mailboxes through
+// the Microsoft Graph API: OAuth linking, delta query sync of the inbox,
+// archive and sent folders, state write-back, drafts and sending.
+package outlook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"golang.org/x/oauth2"
+)
+
+// ProviderName is the email_accounts.provider value handled by this package
+const ProviderName = "outlook"
+
+// Well-known folders that are synced. Delta queries track one folder each,
+// so every folder has its own sync_state row holding its delta link. Mail
+// in other folders, such as Drafts, Deleted Items and Junk Email, is not
+// shown.
+const (
+	FolderInbox   = "inbox"
+	FolderArchive = "archive"
+	FolderSent    = "sentitems"
+	FolderDeleted = "deleteditems"
+)
+
+var syncFolders = []string{FolderInbox, FolderArchive, FolderSent}
+
+// DecryptCredentials decrypts an account's Microsoft OAuth credentials
+func DecryptCredentials(v *vault.Vault, account *models.EmailAccount) (*vault.OAuthCredentials, error) {
+	creds, err := v.Open(account.ID, account.CredentialsEncrypted)
+	if err != nil {
+		return nil, err
+	}
+	if creds.OAuth == nil || creds.OAuth.RefreshToken == "" {
+		return nil, fmt.Errorf("credentials are missing a refresh token")
+	}
+
+	return creds.OAuth, nil
+}
+
+// Scopes grant read, write and send access to mail, which sync and state
+// write-back need, and a refresh token (offline_access)
+var Scopes = []string{
+	"offline_access",
+	"https://graph.microsoft.com/User.Read",
+	"https://graph.microsoft.com/Mail.ReadWrite",
+	"https://graph.microsoft.com/Mail.Send",
+}
+
+// NewOAuthConfig returns the OAuth2 client configuration for the Microsoft
+// identity platform
+func NewOAuthConfig(cfg *config.EmailConfig) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     cfg.OutlookClientID,
+		ClientSecret: cfg.OutlookClientSecret,
+		RedirectURL:  cfg.OutlookRedirectURL,
+		Scopes:       Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   cfg.OutlookAuthURL,
+			TokenURL:  cfg.OutlookTokenURL,
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+	}
+}
+
+// Connector builds authorized API clients for stored Outlook accounts
+type Connector struct {
+	vault       *vault.Vault
+	oauthConfig *oauth2.Config
+	apiURL      string
+}
+
+// NewConnector creates a new Outlook connector
+func NewConnector(cfg *config.EmailConfig, v *vault.Vault) *Connector {
+	return &Connector{
+		vault:       v,
+		oauthConfig: NewOAuthConfig(cfg),
+		apiURL:      cfg.OutlookAPIURL,
+	}
+}
+
+// Client returns an API client for the account that refreshes its access
+// token automatically
+func (c *Connector) Client(ctx context.Context, account *models.EmailAccount) (*Client, error) {
+	creds, err := DecryptCredentials(c.vault, account)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := c.oauthConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: creds.RefreshToken})
+	return NewClient(ctx, c.apiURL, ts), nil
+}
+
+// Syncer performs delta query based incremental sync of Outlook accounts
+// into the emails table
+type Syncer struct {
+	accountRepo *repository.EmailAccountRepository
+	emailRepo   *repository.EmailRepository
+	stateRepo   *repository.SyncStateRepository
+	connector   *Connector
+	vault       *vault.Vault
+}
+
+// NewSyncer creates a new Outlook syncer
+func NewSyncer(db *sqlx.DB, cfg *config.EmailConfig, v *vault.Vault) *Syncer {
+	return &Syncer{
+		accountRepo: repository.NewEmailAccountRepository(db),
+		emailRepo:   repository.NewEmailRepository(db),
+		stateRepo:   repository.NewSyncStateRepository(db),
+		connector:   NewConnector(cfg, v),
+		vault:       v,
+	}
+}
+
+// SyncAll syncs every Outlook account with sync enabled. Failures are
+// logged per account so one broken mailbox does not block the others.
+func (s *Syncer) SyncAll(ctx context.Context) error {
+	accounts, err := s.accountRepo.ListSyncEnabled(ProviderName)
+	if err != nil {
+		return err
+	}
+
+	for i := range accounts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.SyncAccount(ctx, &accounts[i]); err != nil {
+			log.Printf("Outlook sync failed for account %s: %v", accounts[i].ID, err)
+		}
+	}
+
+	return nil
+}
+
+// mailbox is the state of one account's sync run
+type mailbox struct {
+	client    *Client
+	accountID uuid.UUID
+	// folders maps the IDs of the synced folders to their well-known names
+	folders map[string]string
+	states  map[string]*models.SyncState
+}
+
+// SyncAccount runs a full sync when a folder has no delta link and an
+// incremental sync otherwise
+func (s *Syncer) SyncAccount(ctx context.Context, account *models.EmailAccount) error {
+	client, err := s.connector.Client(ctx, account)
+	if err != nil {
+		return err
+	}
+	defer s.keepRefreshToken(account, client)
+
+	box := &mailbox{
+		client:    client,
+		accountID: account.ID,
+		folders:   map[string]string{},
+		states:    map[string]*models.SyncState{},
+	}
+	full := false
+	for _, name := range syncFolders {
+		folder, err := client.GetFolder(ctx, name)
+		if IsNotFound(err) {
+			// Not every mailbox has an archive folder
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		box.folders[folder.ID] = name
+
+		state, err := s.stateRepo.Get(account.ID, name)
+		if err != nil {
+			return err
+		}
+		box.states[name] = state
+		full = full || state.Cursor == nil
+	}
+
+	if !full {
+		err = s.incrementalSync(ctx, box)
+		if err == ErrDeltaExpired {
+			log.Printf("Outlook delta expired for account %s, running full sync", account.ID)
+			full = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if full {
+		if err := s.fullSync(ctx, box); err != nil {
+			return err
+		}
+	}
+
+	for _, state := range box.states {
+		if err := s.stateRepo.Save(state); err != nil {
+			return err
+		}
+	}
+
+	return s.accountRepo.UpdateLastSynced(account.ID, time.Now())
+}
+
+// fullSync lists the messages of every synced folder, stores them and
+// removes local rows that no longer exist
+func (s *Syncer) fullSync(ctx context.Context, box *mailbox) error {
+	seen := map[string]bool{}
+	for name, state := range box.states {
+		link, err := s.syncFolder(ctx, box, name, "", func(msg *Message) error {
+			if err := s.emailRepo.Upsert(toEmail(box.accountID, msg, name)); err != nil {
+				return err
+			}
+			seen[msg.ID] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		state.Cursor = &link
+	}
+
+	known, err := s.emailRepo.ListExternalIDsByPrefix(box.accountID, "")
+	if err != nil {
+		return err
+	}
+	var removed []string
+	for _, id := range known {
+		if !seen[id] {
+			removed = append(removed, id)
+		}
+	}
+
+	return s.emailRepo.DeleteByExternalIDs(box.accountID, removed)
+}
+
+// incrementalSync applies the changes of every synced folder since its
+// delta link
+func (s *Syncer) incrementalSync(ctx context.Context, box *mailbox) error {
+	changed := map[string]bool{}
+	left := map[string]bool{}
+	links := map[string]string{}
+
+	for name, state := range box.states {
+		link, err := s.syncFolder(ctx, box, name, *state.Cursor, func(msg *Message) error {
+			if msg.Removed != nil {
+				left[msg.ID] = true
+				return nil
+			}
+			if err := s.emailRepo.Upsert(toEmail(box.accountID, msg, name)); err != nil {
+				return err
+			}
+			changed[msg.ID] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		links[name] = link
+	}
+
+	// A message that left one folder may have moved into another, possibly
+	// after that folder's changes were read, so ask where it is now rather
+	// than dropping it with its local state
+	var removed []string
+	for id := range left {
+		if changed[id] {
+			continue
+		}
+		msg, err := box.client.GetMessage(ctx, id)
+		if IsNotFound(err) {
+			removed = append(removed, id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		name, synced := box.folders[msg.ParentFolderID]
+		if !synced || msg.IsDraft {
+			removed = append(removed, id)
+			continue
+		}
+		if err := s.emailRepo.Upsert(toEmail(box.accountID, msg, name)); err != nil {
+			return err
+		}
+	}
+
+	if err := s.emailRepo.DeleteByExternalIDs(box.accountID, removed); err != nil {
+		return err
+	}
+
+	for name, link := range links {
+		link := link
+		box.states[name].Cursor = &link
+	}
+	return nil
+}
+
+// syncFolder pages through the changes of a folder since link, or through
+// all its messages if link is empty, and returns the delta link to
+// continue from
+func (s *Syncer) syncFolder(ctx context.Context, box *mailbox, name, link string, fn func(msg *Message) error) (string, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		page, err := box.client.Delta(ctx, name, link)
+		if err != nil {
+			return "", err
+		}
+
+		for i := range page.Value {
+			msg := &page.Value[i]
+			if msg.IsDraft && msg.Removed == nil {
+				continue
+			}
+			if err := fn(msg); err != nil {
+				return "", err
+			}
+		}
+
+		if page.NextLink == "" {
+			if page.DeltaLink == "" {
+				return "", fmt.Errorf("delta response for folder %s has no next or delta link", name)
+			}
+			return page.DeltaLink, nil
+		}
+		link = page.NextLink
+	}
+}
+
+// keepRefreshToken stores the refresh token Microsoft issued with the
+// latest access token. Each refresh token expires 90 days after it was
+// issued, so the stored one must be replaced while the account is in use;
+// the previous token stays valid, so others holding it are unaffected.
+func (s *Syncer) keepRefreshToken(account *models.EmailAccount, client *Client) {
+	token, err := client.Token()
+	if err != nil || token.RefreshToken == "" {
+		return
+	}
+
+	creds, err := DecryptCredentials(s.vault, account)
+	if err != nil || creds.RefreshToken == token.RefreshToken {
+		return
+	}
+
+	encrypted, err := s.vault.Seal(account.ID, &vault.Credentials{
+		OAuth: &vault.OAuthCredentials{RefreshToken: token.RefreshToken},
+	})
+	if err == nil {
+		_, err = s.accountRepo.ReplaceCredentials(account.ID, account.CredentialsEncrypted, encrypted)
+	}
+	if err != nil {
+		log.Printf("Failed to store new refresh token of Outlook account %s: %v", account.ID, err)
+	}
+}
+
+// toEmail converts a Graph message in the named folder into an email row.
+// The conversation ID threads the message like Gmail's thread ID does.
+func toEmail(accountID uuid.UUID, msg *Message, folder string) *models.Email {
+	email := &models.Email{
+		AccountID:      accountID,
+		ExternalID:     msg.ID,
+		IsRead:         msg.IsRead,
+		IsStarred:      msg.Flag != nil && msg.Flag.FlagStatus == "flagged",
+		IsArchived:     folder != FolderInbox && folder != FolderSent,
+		HasAttachments: msg.HasAttachments,
+		ReceivedAt:     msg.ReceivedDateTime,
+		ToAddresses:    recipientList(msg.ToRecipients),
+		CcAddresses:    recipientList(msg.CcRecipients),
+	}
+
+	if msg.ConversationID != "" {
+		threadID := msg.ConversationID
+		email.ThreadID = &threadID
+	}
+	if msg.From != nil {
+		email.FromAddress = msg.From.EmailAddress.Address
+		if name := msg.From.EmailAddress.Name; name != "" && name != email.FromAddress {
+			email.FromName = &name
+		}
+	}
+	if msg.Subject != "" {
+		subject := msg.Subject
+		email.Subject = &subject
+	}
+	if msg.BodyPreview != "" {
+		snippet := msg.BodyPreview
+		email.Snippet = &snippet
+	}
+	if email.ReceivedAt.IsZero() {
+		email.ReceivedAt = time.Now()
+	}
+
+	return email
+}
+
+func recipientList(recipients []Recipient) pq.StringArray {
+	list := pq.StringArray{}
+	for _, r := range recipients {
+		if r.EmailAddress.Address != "" {
+			list = append(list, r.EmailAddress.Address)
+		}
+	}
+	return list
+}
@@ -0,0 +1,389 @@
+package outlook
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+	"github.com/jay/dadmail/internal/vault"
+	"github.com/jmoiron/sqlx"
+)
+
+// change is one entry of the stand-in's change log: a message that
+// appeared in or changed within a folder, or left it
+type change struct {
+	folder  string
+	id      string
+	removed string // reason the message left the folder, if it did
+}
+
+// graphServer is an httptest stand-in for the Graph mail API and the
+// Microsoft token endpoint. Folders are addressed by their well-known
+// names, and delta links are positions in a change log, so a delta query
+// replays the folder's changes after its position.
+type graphServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	messages map[string]*Message
+	order    []string
+	log      []change
+	// expiredBefore is the oldest log position delta links are accepted
+	// for
+	expiredBefore int
+	// sent holds the decoded MIME payloads of sendMail
+	sent [][]byte
+}
+
+func newGraphServer(t *testing.T) *graphServer {
+	t.Helper()
+	s := &graphServer{messages: map[string]*Message{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"access_token": "access", "token_type": "Bearer", "expires_in": 3600})
+	})
+	mux.HandleFunc("GET /v1.0/me/mailFolders/{folder}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, MailFolder{ID: folderID(r.PathValue("folder")), DisplayName: r.PathValue("folder")})
+	})
+	mux.HandleFunc("GET /v1.0/me/mailFolders/{folder}/messages/delta", s.listFolder)
+	mux.HandleFunc("GET /delta/{folder}/{position}", s.listChanges)
+	mux.HandleFunc("GET /v1.0/me/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		msg, ok := s.messages[r.PathValue("id")]
+		if !ok {
+			http.Error(w, `{"error":{"code":"ErrorItemNotFound"}}`, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, msg)
+	})
+	mux.HandleFunc("POST /v1.0/me/sendMail", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		raw, err := base64.StdEncoding.DecodeString(string(body))
+		if err != nil || r.Header.Get("Content-Type") != "text/plain" {
+			http.Error(w, `{"error":{"code":"ErrorMimeContentInvalidBase64String"}}`, http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.sent = append(s.sent, raw)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// config returns an EmailConfig pointing at the stand-in
+func (s *graphServer) config() *config.EmailConfig {
+	return &config.EmailConfig{
+		OutlookClientID: "client",
+		OutlookAPIURL:   s.URL,
+		OutlookTokenURL: s.URL + "/token",
+	}
+}
+
+func folderID(name string) string {
+	return "folder-" + name
+}
+
+// deliver adds a message to a folder
+func (s *graphServer) deliver(id, folder, subject string, draft bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages[id] = &Message{
+		ID:               id,
+		ConversationID:   "conversation-" + id,
+		ParentFolderID:   folderID(folder),
+		Subject:          subject,
+		BodyPreview:      "About " + subject,
+		From:             &Recipient{EmailAddress: EmailAddress{Name: "Kid", Address: "kid@example.com"}},
+		ToRecipients:     []Recipient{{EmailAddress: EmailAddress{Address: "grandpa@outlook.com"}}},
+		ReceivedDateTime: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+		IsDraft:          draft,
+		Flag:             &Flag{FlagStatus: "notFlagged"},
+	}
+	s.order = append(s.order, id)
+	s.log = append(s.log, change{folder: folder, id: id})
+}
+
+// update changes a message in place
+func (s *graphServer) update(id string, fn func(msg *Message)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := s.messages[id]
+	fn(msg)
+	s.log = append(s.log, change{folder: folderName(msg.ParentFolderID), id: id})
+}
+
+// move moves a message to another folder, which it leaves with the reason
+// "changed" as far as delta queries of the old folder are concerned
+func (s *graphServer) move(id, folder string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := s.messages[id]
+	s.log = append(s.log,
+		change{folder: folderName(msg.ParentFolderID), id: id, removed: "changed"},
+		change{folder: folder, id: id})
+	msg.ParentFolderID = folderID(folder)
+}
+
+// remove deletes a message for good
+func (s *graphServer) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := s.messages[id]
+	delete(s.messages, id)
+	for i, o := range s.order {
+		if o == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	s.log = append(s.log, change{folder: folderName(msg.ParentFolderID), id: id, removed: "deleted"})
+}
+
+// expireDeltaLinks makes every delta link handed out so far expire
+func (s *graphServer) expireDeltaLinks() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiredBefore = len(s.log) + 1
+}
+
+func folderName(id string) string {
+	return id[len("folder-"):]
+}
+
+// deltaLink returns the link to list the folder's changes after the
+// current end of the log
+func (s *graphServer) deltaLink(folder string) string {
+	return s.URL + "/delta/" + folder + "/" + strconv.Itoa(len(s.log))
+}
+
+// listFolder pages through the messages of a folder one at a time, then
+// hands out a delta link
+func (s *graphServer) listFolder(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	folder := r.PathValue("folder")
+	skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+	var inFolder []Message
+	for _, id := range s.order {
+		if msg := s.messages[id]; msg.ParentFolderID == folderID(folder) {
+			inFolder = append(inFolder, *msg)
+		}
+	}
+
+	page := MessagePage{}
+	if skip < len(inFolder) {
+		page.Value = inFolder[skip : skip+1]
+	}
+	if skip+1 < len(inFolder) {
+		page.NextLink = s.URL + r.URL.Path + "?skip=" + strconv.Itoa(skip+1)
+	} else {
+		page.DeltaLink = s.deltaLink(folder)
+	}
+	writeJSON(w, page)
+}
+
+// listChanges returns the folder's changes after the position in a delta
+// link, or 410 Gone once the link has expired
+func (s *graphServer) listChanges(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	folder := r.PathValue("folder")
+	position, err := strconv.Atoi(r.PathValue("position"))
+	if err != nil || position < s.expiredBefore {
+		http.Error(w, `{"error":{"code":"SyncStateNotFound"}}`, http.StatusGone)
+		return
+	}
+
+	// The latest change of each message wins
+	latest := map[string]change{}
+	var ids []string
+	for _, c := range s.log[position:] {
+		if c.folder != folder {
+			continue
+		}
+		if _, ok := latest[c.id]; !ok {
+			ids = append(ids, c.id)
+		}
+		latest[c.id] = c
+	}
+
+	page := MessagePage{Value: []Message{}, DeltaLink: s.deltaLink(folder)}
+	for _, id := range ids {
+		c := latest[id]
+		if c.removed != "" {
+			page.Value = append(page.Value, Message{ID: id, Removed: &Removed{Reason: c.removed}})
+			continue
+		}
+		page.Value = append(page.Value, *s.messages[id])
+	}
+	writeJSON(w, page)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// newTestAccount returns a vault and an Outlook account whose credentials
+// are sealed with it
+func newTestAccount(t *testing.T) (*vault.Vault, *models.EmailAccount) {
+	t.Helper()
+
+	v, err := vault.New(map[string]string{"k1": "0123456789abcdef0123456789abcdef"}, "k1")
+	if err != nil {
+		t.Fatalf("vault: %v", err)
+	}
+	account := &models.EmailAccount{
+		ID:           uuid.New(),
+		Provider:     ProviderName,
+		EmailAddress: "grandpa@outlook.com",
+		SyncEnabled:  true,
+	}
+	account.CredentialsEncrypted, err = v.Seal(account.ID, &vault.Credentials{
+		OAuth: &vault.OAuthCredentials{RefreshToken: "refresh"},
+	})
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	return v, account
+}
+
+// storedEmails returns the account's emails by external ID
+func storedEmails(t *testing.T, db *sqlx.DB, accountID uuid.UUID) map[string]models.Email {
+	t.Helper()
+	var emails []models.Email
+	if err := db.Select(&emails, `SELECT * FROM emails WHERE account_id = $1`, accountID); err != nil {
+		t.Fatalf("select emails: %v", err)
+	}
+	byID := map[string]models.Email{}
+	for _, e := range emails {
+		byID[e.ExternalID] = e
+	}
+	return byID
+}
+
+func assertExternalIDs(t *testing.T, emails map[string]models.Email, want ...string) {
+	t.Helper()
+	if len(emails) != len(want) {
+		t.Errorf("stored %d emails, want %d: %v", len(emails), len(want), emails)
+	}
+	for _, id := range want {
+		if _, ok := emails[id]; !ok {
+			t.Errorf("email %s was not stored", id)
+		}
+	}
+}
+
+// storedDeltaLink returns the delta link saved for a folder
+func storedDeltaLink(t *testing.T, db *sqlx.DB, accountID uuid.UUID, folder string) string {
+	t.Helper()
+	state, err := repository.NewSyncStateRepository(db).Get(accountID, folder)
+	if err != nil {
+		t.Fatalf("sync state: %v", err)
+	}
+	if state.Cursor == nil {
+		return ""
+	}
+	return *state.Cursor
+}
+
+func TestSyncAccount(t *testing.T) {
+	db := testdb.Open(t)
+	srv := newGraphServer(t)
+	v, account := newTestAccount(t)
+	account.UserID = testdb.CreateUser(t, db)
+	if err := repository.NewEmailAccountRepository(db).Create(account); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	syncer := NewSyncer(db, srv.config(), v)
+	ctx := context.Background()
+
+	srv.deliver("m1", FolderInbox, "Lunch on Sunday", false)
+	srv.deliver("m2", FolderInbox, "Photos", false)
+	srv.update("m2", func(msg *Message) { msg.Flag.FlagStatus = "flagged" })
+	srv.deliver("d1", FolderInbox, "Unsent", true)
+	srv.deliver("a1", FolderArchive, "Old news", false)
+	srv.deliver("s1", FolderSent, "Thanks", false)
+
+	// Full sync: no delta links stored yet
+	if err := syncer.SyncAccount(ctx, account); err != nil {
+		t.Fatalf("full sync: %v", err)
+	}
+	emails := storedEmails(t, db, account.ID)
+	assertExternalIDs(t, emails, "m1", "m2", "a1", "s1")
+	m1 := emails["m1"]
+	if m1.Subject == nil || *m1.Subject != "Lunch on Sunday" || m1.FromAddress != "kid@example.com" {
+		t.Errorf("stored metadata = %+v", m1)
+	}
+	if m1.ThreadID == nil || *m1.ThreadID != "conversation-m1" {
+		t.Errorf("thread ID = %v", m1.ThreadID)
+	}
+	if !emails["m2"].IsStarred || !emails["a1"].IsArchived || emails["s1"].IsArchived || m1.IsArchived {
+		t.Errorf("folders and flags not mapped: m2 starred=%v, a1 archived=%v, s1 archived=%v",
+			emails["m2"].IsStarred, emails["a1"].IsArchived, emails["s1"].IsArchived)
+	}
+	for _, folder := range syncFolders {
+		if got, want := storedDeltaLink(t, db, account.ID, folder), srv.URL+"/delta/"+folder+"/6"; got != want {
+			t.Errorf("delta link of %s = %q, want %q", folder, got, want)
+		}
+	}
+
+	t.Run("delta", func(t *testing.T) {
+		srv.deliver("m3", FolderInbox, "Birthday", false)
+		srv.update("m1", func(msg *Message) { msg.IsRead = true })
+		// Moves between synced folders keep the email
+		srv.move("m2", FolderArchive)
+		// Moves out of the synced folders remove it
+		srv.move("a1", FolderDeleted)
+		srv.remove("s1")
+		if err := syncer.SyncAccount(ctx, account); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+
+		emails := storedEmails(t, db, account.ID)
+		assertExternalIDs(t, emails, "m1", "m2", "m3")
+		if !emails["m1"].IsRead {
+			t.Errorf("read change was not applied")
+		}
+		if !emails["m2"].IsArchived || !emails["m2"].IsStarred {
+			t.Errorf("moved email lost its state: archived=%v starred=%v", emails["m2"].IsArchived, emails["m2"].IsStarred)
+		}
+		if got, want := storedDeltaLink(t, db, account.ID, FolderInbox), srv.URL+"/delta/inbox/13"; got != want {
+			t.Errorf("delta link = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("expired delta link", func(t *testing.T) {
+		srv.expireDeltaLinks()
+		srv.deliver("m4", FolderInbox, "Recipe", false)
+		srv.remove("m3")
+
+		if err := syncer.SyncAccount(ctx, account); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		assertExternalIDs(t, storedEmails(t, db, account.ID), "m1", "m2", "m4")
+		if got, want := storedDeltaLink(t, db, account.ID, FolderInbox), srv.URL+"/delta/inbox/15"; got != want {
+			t.Errorf("delta link after full sync = %q, want %q", got, want)
+		}
+	})
+}
@@ -0,0 +1,187 @@
+// Package provider defines the interface every mail provider implements,
+// keyed by email_accounts.provider, and a registry that resolves providers
+// by name. The subpackages implement it for IMAP, Gmail, Outlook and JMAP,
+// and fake is a scripted in-memory provider for tests.
+//
+// Sending and write-back go through MailProvider for every provider, but
+// Syncer only syncs providers that implement ListChanges: JMAP and fake.
+// IMAP, Gmail and Outlook return ErrUnsupported from it and are synced by
+// their own packages' syncers, which cmd/worker runs alongside Syncer.
+package provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"github.com/jay/dadmail/internal/models"
+)
+
+var (
+	// ErrMessageGone is returned when a message no longer exists at the
+	// provider
+	ErrMessageGone = errors.New("message no longer exists on the server")
+
+	// ErrUnsupported is returned for operations a provider does not offer,
+	// and by the registry for unknown providers
+	ErrUnsupported = errors.New("operation not supported")
+
+	// ErrCursorExpired is returned by ListChanges when a cursor is too old
+	// to list changes since, so the mailbox must be listed again
+	ErrCursorExpired = errors.New("change cursor expired")
+)
+
+// Folder is a place a message can be moved to
+type Folder string
+
+const (
+	FolderInbox   Folder = "inbox"
+	FolderArchive Folder = "archive"
+	FolderTrash   Folder = "trash"
+)
+
+// Flags are message flags to change. Nil fields are left as they are.
+type Flags struct {
+	Read    *bool
+	Starred *bool
+}
+
+// Changes is one batch of changes to a mailbox
+type Changes struct {
+	// Emails are new or changed messages to store
+	Emails []models.Email
+	// Removed are the external IDs of messages that are gone, or no longer
+	// shown, such as mail moved to the trash
+	Removed []string
+	// Cursor lists the changes after this batch
+	Cursor string
+	// More is true when further changes can be listed right away
+	More bool
+}
+
+// MailProvider is the provider-specific side of a mailbox. Messages are
+// addressed by their external ID. Implementations return ErrMessageGone for
+// messages that no longer exist, and mark failures that retrying cannot
+// fix with Permanent.
+type MailProvider interface {
+	// Name returns the email_accounts.provider value the provider handles
+	Name() string
+
+	// ListChanges returns a batch of changes since cursor. An empty cursor
+	// lists the whole mailbox, in batches until More is false. Providers
+	// whose sync needs more state than a cursor keep their own syncer and
+	// return ErrUnsupported.
+	ListChanges(ctx context.Context, account *models.EmailAccount, cursor string) (*Changes, error)
+
+	// FetchMessage returns the raw RFC 822 source of a message
+	FetchMessage(ctx context.Context, account *models.EmailAccount, externalID string) ([]byte, error)
+
+	// Send submits a rendered message from the account to the recipients,
+	// which include any Bcc recipients not named in the message
+	Send(ctx context.Context, account *models.EmailAccount, from string, recipients []string, raw []byte) error
+
+	// SetFlags changes the read and starred flags of a message
+	SetFlags(ctx context.Context, account *models.EmailAccount, externalID string, flags Flags) error
+
+	// Move moves a message to a folder
+	Move(ctx context.Context, account *models.EmailAccount, externalID string, folder Folder) error
+}
+
+// Permanent marks err as a failure that retrying cannot fix, such as a
+// request the provider rejected
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// IsPermanent reports whether retrying err cannot succeed: it was marked
+// Permanent, or the operation is unsupported
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent) || errors.Is(err, ErrUnsupported)
+}
+
+// IsPermanentStatus reports whether an HTTP status means the provider
+// rejected the request itself. Expired tokens, timeouts and rate limits are
+// worth retrying.
+func IsPermanentStatus(status int) bool {
+	return status >= 400 && status < 500 &&
+		status != http.StatusUnauthorized &&
+		status != http.StatusRequestTimeout &&
+		status != http.StatusTooManyRequests
+}
+
+// HiddenRecipients returns the recipients a rendered message does not name
+// in its To or Cc header, which are its Bcc recipients. Providers that take
+// the recipients from the message headers need them added as a Bcc header.
+func HiddenRecipients(raw []byte, recipients []string) []string {
+	shown := map[string]bool{}
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		for _, header := range []string{"To", "Cc"} {
+			addrs, _ := msg.Header.AddressList(header)
+			for _, addr := range addrs {
+				shown[strings.ToLower(addr.Address)] = true
+			}
+		}
+	}
+
+	var hidden []string
+	for _, r := range recipients {
+		if !shown[strings.ToLower(r)] {
+			hidden = append(hidden, r)
+		}
+	}
+	return hidden
+}
+
+// Registry resolves providers by name
+type Registry struct {
+	providers map[string]MailProvider
+}
+
+// NewRegistry creates a registry of the given providers
+func NewRegistry(providers ...MailProvider) *Registry {
+	r := &Registry{providers: map[string]MailProvider{}}
+	for _, p := range providers {
+		r.Register(p)
+	}
+	return r
+}
+
+// Register adds a provider, replacing any with the same name
+func (r *Registry) Register(p MailProvider) {
+	r.providers[p.Name()] = p
+}
+
+// Get returns the provider with the given name
+func (r *Registry) Get(name string) (MailProvider, error) {
+	p, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("no provider named %q: %w", name, ErrUnsupported)
+	}
+	return p, nil
+}
+
+// Names returns the names of the registered providers in order
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,24 @@
+// Package providers builds the registry of the mail providers DadMail
+// supports.
+package providers
+
+import (
+	"github.com/jay/dadmail/internal/config"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/provider/gmail"
+	"github.com/jay/dadmail/internal/provider/imap"
+	"github.com/jay/dadmail/internal/provider/jmap"
+	"github.com/jay/dadmail/internal/provider/outlook"
+	"github.com/jay/dadmail/internal/vault"
+)
+
+// NewRegistry returns a registry of the IMAP, Gmail, Outlook and JMAP
+// providers
+func NewRegistry(cfg *config.EmailConfig, v *vault.Vault) *provider.Registry {
+	return provider.NewRegistry(
+		imap.NewProvider(v),
+		gmail.NewProvider(cfg, v),
+		outlook.NewProvider(cfg, v),
+		jmap.NewProvider(v),
+	)
+}
@@ -0,0 +1,149 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jmoiron/sqlx"
+)
+
+// cursorFolder is the sync_state folder holding an account's change cursor
+const cursorFolder = "*"
+
+// Syncer syncs accounts of providers that list their changes into the
+// emails table
+type Syncer struct {
+	providers   *Registry
+	accountRepo *repository.EmailAccountRepository
+	emailRepo   *repository.EmailRepository
+	stateRepo   *repository.SyncStateRepository
+}
+
+// NewSyncer creates a new change syncer
+func NewSyncer(db *sqlx.DB, providers *Registry) *Syncer {
+	return &Syncer{
+		providers:   providers,
+		accountRepo: repository.NewEmailAccountRepository(db),
+		emailRepo:   repository.NewEmailRepository(db),
+		stateRepo:   repository.NewSyncStateRepository(db),
+	}
+}
+
+// SyncAll syncs every sync-enabled account of the registered providers
+// that list changes. Failures are logged per account so one broken mailbox
+// does not block the others.
+func (s *Syncer) SyncAll(ctx context.Context) error {
+	for _, name := range s.providers.Names() {
+		accounts, err := s.accountRepo.ListSyncEnabled(name)
+		if err != nil {
+			return err
+		}
+
+		for i := range accounts {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			err := s.SyncAccount(ctx, &accounts[i])
+			if errors.Is(err, ErrUnsupported) {
+				// Synced by the provider's own syncer
+				break
+			}
+			if err != nil {
+				log.Printf("Sync failed for %s account %s: %v", name, accounts[i].ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SyncAccount applies the changes since the stored cursor, or lists the
+// whole mailbox if there is none or it expired
+func (s *Syncer) SyncAccount(ctx context.Context, account *models.EmailAccount) error {
+	p, err := s.providers.Get(account.Provider)
+	if err != nil {
+		return err
+	}
+	state, err := s.stateRepo.Get(account.ID, cursorFolder)
+	if err != nil {
+		return err
+	}
+
+	cursor := ""
+	if state.Cursor != nil {
+		cursor = *state.Cursor
+	}
+	cursor, err = s.apply(ctx, p, account, cursor)
+	if errors.Is(err, ErrCursorExpired) {
+		log.Printf("Change cursor expired for account %s, listing the mailbox again", account.ID)
+		cursor, err = s.apply(ctx, p, account, "")
+	}
+	if err != nil {
+		return err
+	}
+
+	state.Cursor = &cursor
+	if err := s.stateRepo.Save(state); err != nil {
+		return err
+	}
+
+	return s.accountRepo.UpdateLastSynced(account.ID, time.Now())
+}
+
+// apply stores the batches of changes since cursor and returns the cursor
+// to continue from. Listing the whole mailbox also removes local rows that
+// were not listed.
+func (s *Syncer) apply(ctx context.Context, p MailProvider, account *models.EmailAccount, cursor string) (string, error) {
+	listing := cursor == ""
+	seen := map[string]bool{}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		changes, err := p.ListChanges(ctx, account, cursor)
+		if err != nil {
+			return "", err
+		}
+
+		for i := range changes.Emails {
+			email := &changes.Emails[i]
+			email.AccountID = account.ID
+			if err := s.emailRepo.Upsert(email); err != nil {
+				return "", err
+			}
+			seen[email.ExternalID] = true
+		}
+		if err := s.emailRepo.DeleteByExternalIDs(account.ID, changes.Removed); err != nil {
+			return "", err
+		}
+
+		cursor = changes.Cursor
+		if !changes.More {
+			break
+		}
+	}
+
+	if listing {
+		known, err := s.emailRepo.ListExternalIDsByPrefix(account.ID, "")
+		if err != nil {
+			return "", err
+		}
+		var removed []string
+		for _, id := range known {
+			if !seen[id] {
+				removed = append(removed, id)
+			}
+		}
+		if err := s.emailRepo.DeleteByExternalIDs(account.ID, removed); err != nil {
+			return "", err
+		}
+	}
+
+	return cursor, nil
+}
@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// AttachmentRepository handles attachment database operations
+type AttachmentRepository struct {
+	db *sqlx.DB
+}
+
+// NewAttachmentRepository creates a new attachment repository
+func NewAttachmentRepository(db *sqlx.DB) *AttachmentRepository {
+	return &AttachmentRepository{db: db}
+}
+
+// SaveAll records the attachments of an email and their blobs, replacing
+// earlier rows for the same parts, and returns the stored rows
+func (r *AttachmentRepository) SaveAll(emailID uuid.UUID, attachments []models.Attachment) ([]models.Attachment, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	saved := make([]models.Attachment, 0, len(attachments))
+	for _, a := range attachments {
+		_, err := tx.Exec(`
+			INSERT INTO attachment_blobs (sha256, size_bytes) VALUES ($1, $2)
+			ON CONFLICT (sha256) DO NOTHING
+		`, a.SHA256, a.SizeBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save attachment blob: %w", err)
+		}
+
+		row := models.Attachment{}
+		err = tx.Get(&row, `
+			INSERT INTO attachments (email_id, part, filename, content_type, size_bytes, content_id, is_inline, sha256)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (email_id, part) DO UPDATE SET
+				filename = EXCLUDED.filename,
+				content_type = EXCLUDED.content_type,
+				size_bytes = EXCLUDED.size_bytes,
+				content_id = EXCLUDED.content_id,
+				is_inline = EXCLUDED.is_inline,
+				sha256 = EXCLUDED.sha256
+			RETURNING *
+		`, emailID, a.Part, a.Filename, a.ContentType, a.SizeBytes, a.ContentID, a.IsInline, a.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save attachment: %w", err)
+		}
+		saved = append(saved, row)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit attachments: %w", err)
+	}
+
+	return saved, nil
+}
+
+// ListForEmail returns the stored attachments of an email in part order
+func (r *AttachmentRepository) ListForEmail(emailID uuid.UUID) ([]models.Attachment, error) {
+	attachments := []models.Attachment{}
+	query := `SELECT * FROM attachments WHERE email_id = $1 ORDER BY string_to_array(part, '.')::int[]`
+
+	if err := r.db.Select(&attachments, query, emailID); err != nil {
+		return nil, fmt.Errorf("failed to list attachments: %w", err)
+	}
+
+	return attachments, nil
+}
+
+// Get retrieves an attachment of an email
+func (r *AttachmentRepository) Get(emailID, id uuid.UUID) (*models.Attachment, error) {
+	attachment := &models.Attachment{}
+	query := `SELECT * FROM attachments WHERE id = $1 AND email_id = $2`
+
+	err := r.db.Get(attachment, query, id, emailID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("attachment not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attachment: %w", err)
+	}
+
+	return attachment, nil
+}
+
+// ListUnreferencedBlobs returns up to limit blobs older than minAge that no
+// attachment or draft attachment refers to
+func (r *AttachmentRepository) ListUnreferencedBlobs(minAge time.Duration, limit int) ([]string, error) {
+	hashes := []string{}
+	query := `
+		SELECT b.sha256 FROM attachment_blobs b
+		WHERE b.created_at < NOW() - make_interval(secs => $1)
+			AND NOT EXISTS (SELECT 1 FROM attachments att WHERE att.sha256 = b.sha256)
+			AND NOT EXISTS (SELECT 1 FROM draft_attachments da WHERE da.sha256 = b.sha256)
+		ORDER BY b.created_at
+		LIMIT $2
+	`
+
+	if err := r.db.Select(&hashes, query, minAge.Seconds(), limit); err != nil {
+		return nil, fmt.Errorf("failed to list unreferenced attachment blobs: %w", err)
+	}
+
+	return hashes, nil
+}
+
+// DeleteBlob removes a blob row if it is still unreferenced and reports
+// whether it was removed
+func (r *AttachmentRepository) DeleteBlob(hash string) (bool, error) {
+	query := `
+		DELETE FROM attachment_blobs b
+		WHERE b.sha256 = $1
+			AND NOT EXISTS (SELECT 1 FROM attachments att WHERE att.sha256 = b.sha256)
+			AND NOT EXISTS (SELECT 1 FROM draft_attachments da WHERE da.sha256 = b.sha256)
+	`
+
+	result, err := r.db.Exec(query, hash)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete attachment blob: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete attachment blob: %w", err)
+	}
+
+	return n > 0, nil
+}
@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// BodyCacheRepository handles message body cache bookkeeping
+type BodyCacheRepository struct {
+	db *sqlx.DB
+}
+
+// NewBodyCacheRepository creates a new body cache repository
+func NewBodyCacheRepository(db *sqlx.DB) *BodyCacheRepository {
+	return &BodyCacheRepository{db: db}
+}
+
+// Touch returns the unexpired cache entry of an email and records the
+// access, or nil if the body is not cached
+func (r *BodyCacheRepository) Touch(emailID uuid.UUID) (*models.BodyCacheEntry, error) {
+	entry := &models.BodyCacheEntry{}
+	query := `
+		UPDATE body_cache SET last_accessed_at = NOW()
+		WHERE email_id = $1 AND expires_at > NOW()
+		RETURNING *
+	`
+
+	err := r.db.Get(entry, query, emailID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get body cache entry: %w", err)
+	}
+
+	return entry, nil
+}
+
+// Save records a cached body, replacing any previous entry. It returns the
+// object key of the replaced entry, if any, so its object can be deleted.
+func (r *BodyCacheRepository) Save(emailID uuid.UUID, objectKey string, sizeBytes int64, expiresAt time.Time) (replacedKey *string, err error) {
+	query := `
+		WITH previous AS (SELECT object_key FROM body_cache WHERE email_id = $1)
+		INSERT INTO body_cache (email_id, object_key, size_bytes, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (email_id) DO UPDATE SET
+			object_key = EXCLUDED.object_key,
+			size_bytes = EXCLUDED.size_bytes,
+			expires_at = EXCLUDED.expires_at,
+			last_accessed_at = NOW()
+		RETURNING (SELECT object_key FROM previous)
+	`
+
+	if err := r.db.Get(&replacedKey, query, emailID, objectKey, sizeBytes, expiresAt); err != nil {
+		return nil, fmt.Errorf("failed to save body cache entry: %w", err)
+	}
+
+	return replacedKey, nil
+}
+
+// ListEvictable returns up to limit entries that have expired or fall
+// outside the maxBytes most recently used bytes of the cache
+func (r *BodyCacheRepository) ListEvictable(maxBytes int64, limit int) ([]models.BodyCacheEntry, error) {
+	entries := []models.BodyCacheEntry{}
+	query := `
+		SELECT email_id, object_key, size_bytes, expires_at, last_accessed_at, created_at
+		FROM (
+			SELECT *, SUM(size_bytes) OVER (ORDER BY last_accessed_at DESC, email_id) AS running_bytes
+			FROM body_cache
+		) c
+		WHERE expires_at <= NOW() OR running_bytes > $1
+		ORDER BY last_accessed_at ASC
+		LIMIT $2
+	`
+
+	if err := r.db.Select(&entries, query, maxBytes, limit); err != nil {
+		return nil, fmt.Errorf("failed to list evictable body cache entries: %w", err)
+	}
+
+	return entries, nil
+}
+
+// ListForAccount returns up to limit cache entries of the account's
+// emails, ordered by email ID after the given ID
+func (r *BodyCacheRepository) ListForAccount(accountID, after uuid.UUID, limit int) ([]models.BodyCacheEntry, error) {
+	entries := []models.BodyCacheEntry{}
+	query := `
+		SELECT c.* FROM body_cache c
+		JOIN emails e ON e.id = c.email_id
+		WHERE e.account_id = $1 AND c.email_id > $2
+		ORDER BY c.email_id ASC
+		LIMIT $3
+	`
+
+	if err := r.db.Select(&entries, query, accountID, after, limit); err != nil {
+		return nil, fmt.Errorf("failed to list body cache entries: %w", err)
+	}
+
+	return entries, nil
+}
+
+// Delete removes a cache entry if it still points at objectKey
+func (r *BodyCacheRepository) Delete(emailID uuid.UUID, objectKey string) error {
+	query := `DELETE FROM body_cache WHERE email_id = $1 AND object_key = $2`
+
+	if _, err := r.db.Exec(query, emailID, objectKey); err != nil {
+		return fmt.Errorf("failed to delete body cache entry: %w", err)
+	}
+
+	return nil
+}
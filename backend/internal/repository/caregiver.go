@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// Caregiver access levels, from least to most trusted
+const (
+	AccessView   = "view"
+	AccessManage = "manage"
+	AccessFull   = "full"
+)
+
+// CaregiverRepository handles caregiver access database operations
+type CaregiverRepository struct {
+	db *sqlx.DB
+}
+
+// NewCaregiverRepository creates a new caregiver repository
+func NewCaregiverRepository(db *sqlx.DB) *CaregiverRepository {
+	return &CaregiverRepository{db: db}
+}
+
+// CanExport reports whether the caregiver may export the senior's mail:
+// their access must be active, at the full level, and allow reading emails
+func (r *CaregiverRepository) CanExport(seniorID, caregiverID uuid.UUID) (bool, error) {
+	var ok bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM caregiver_access
+			WHERE senior_id = $1 AND caregiver_id = $2 AND status = 'active'
+				AND access_level = $3 AND can_view_emails
+		)
+	`
+
+	if err := r.db.Get(&ok, query, seniorID, caregiverID, AccessFull); err != nil {
+		return false, fmt.Errorf("failed to check caregiver access: %w", err)
+	}
+
+	return ok, nil
+}
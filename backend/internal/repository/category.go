@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"fmt"
+
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// CategoryRepository handles email category database operations
+type CategoryRepository struct {
+	db *sqlx.DB
+}
+
+// NewCategoryRepository creates a new category repository
+func NewCategoryRepository(db *sqlx.DB) *CategoryRepository {
+	return &CategoryRepository{db: db}
+}
+
+// List retrieves all categories in display order
+func (r *CategoryRepository) List() ([]models.Category, error) {
+	categories := []models.Category{}
+	query := `
+		SELECT id, name, description, color, icon,
+			COALESCE(is_system, false) AS is_system, COALESCE(display_order, 0) AS display_order, created_at
+		FROM categories
+		ORDER BY display_order ASC, name ASC
+	`
+
+	if err := r.db.Select(&categories, query); err != nil {
+		return nil, fmt.Errorf("failed to list categories: %w", err)
+	}
+
+	return categories, nil
+}
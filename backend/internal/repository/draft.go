@@ -0,0 +1,388 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// draftSyncDelay is how long after the last save a draft is copied to the
+// provider, so autosaves while typing are pushed once
+const draftSyncDelay = 30 * time.Second
+
+// DraftRepository handles draft database operations
+type DraftRepository struct {
+	db *sqlx.DB
+}
+
+// NewDraftRepository creates a new draft repository
+func NewDraftRepository(db *sqlx.DB) *DraftRepository {
+	return &DraftRepository{db: db}
+}
+
+// DraftChanges are the fields of a draft to change. Nil fields are left
+// unchanged; an AccountID of uuid.Nil sends from the primary account.
+type DraftChanges struct {
+	AccountID      *uuid.UUID
+	To             *[]string
+	Cc             *[]string
+	Bcc            *[]string
+	Subject        *string
+	Text           *string
+	HTML           *string
+	SyncToProvider *bool
+}
+
+// Create stores a new draft
+func (r *DraftRepository) Create(draft *models.Draft) error {
+	if draft.ID == uuid.Nil {
+		draft.ID = uuid.New()
+	}
+
+	query := `
+		INSERT INTO drafts (
+			id, user_id, account_id, to_addresses, cc_addresses, bcc_addresses,
+			subject, text_body, html_body, sync_to_provider, sync_next_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW() + make_interval(secs => $11))
+		RETURNING *
+	`
+
+	err := r.db.Get(draft, query, draft.ID, draft.UserID, draft.AccountID,
+		nonNilArray(draft.To), nonNilArray(draft.Cc), nonNilArray(draft.Bcc),
+		draft.Subject, draft.Text, draft.HTML, draft.SyncToProvider, draftSyncDelay.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to create draft: %w", err)
+	}
+
+	return nil
+}
+
+// GetForUser retrieves a draft if it belongs to the user
+func (r *DraftRepository) GetForUser(userID, id uuid.UUID) (*models.Draft, error) {
+	draft := &models.Draft{}
+	query := `SELECT * FROM drafts WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL`
+
+	err := r.db.Get(draft, query, id, userID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("draft not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get draft: %w", err)
+	}
+
+	return draft, nil
+}
+
+// ListForUser retrieves the user's drafts, most recently changed first
+func (r *DraftRepository) ListForUser(userID uuid.UUID) ([]models.Draft, error) {
+	drafts := []models.Draft{}
+	query := `
+		SELECT * FROM drafts
+		WHERE user_id = $1 AND deleted_at IS NULL
+		ORDER BY updated_at DESC
+	`
+
+	if err := r.db.Select(&drafts, query, userID); err != nil {
+		return nil, fmt.Errorf("failed to list drafts: %w", err)
+	}
+
+	return drafts, nil
+}
+
+// Update applies changes to a draft if it is still at the given version.
+// If the draft was changed since, the current draft is returned and
+// updated is false.
+func (r *DraftRepository) Update(userID, id uuid.UUID, version int, changes *DraftChanges) (draft *models.Draft, updated bool, err error) {
+	sets, args := changes.sets()
+	args = append(args, draftSyncDelay.Seconds(), id, userID, version)
+	n := len(args)
+	sets = append(sets,
+		"version = version + 1",
+		fmt.Sprintf("sync_next_at = NOW() + make_interval(secs => $%d)", n-3),
+		"sync_attempts = 0",
+	)
+	query := fmt.Sprintf(`
+		UPDATE drafts SET %s
+		WHERE id = $%d AND user_id = $%d AND version = $%d AND deleted_at IS NULL
+		RETURNING *
+	`, strings.Join(sets, ", "), n-2, n-1, n)
+
+	draft = &models.Draft{}
+	err = r.db.Get(draft, query, args...)
+	if err == nil {
+		return draft, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, false, fmt.Errorf("failed to update draft: %w", err)
+	}
+
+	// Either the draft does not exist or the version did not match
+	current, err := r.GetForUser(userID, id)
+	if err != nil {
+		return nil, false, err
+	}
+	return current, false, nil
+}
+
+// sets returns the SET clauses and arguments for the changed fields
+func (c *DraftChanges) sets() ([]string, []interface{}) {
+	var sets []string
+	var args []interface{}
+	add := func(set string, arg interface{}) {
+		args = append(args, arg)
+		sets = append(sets, strings.ReplaceAll(set, "?", fmt.Sprintf("$%d", len(args))))
+	}
+
+	if c.AccountID != nil {
+		add("account_id = NULLIF(?::uuid, '00000000-0000-0000-0000-000000000000')", *c.AccountID)
+	}
+	if c.To != nil {
+		add("to_addresses = ?", nonNilArray(*c.To))
+	}
+	if c.Cc != nil {
+		add("cc_addresses = ?", nonNilArray(*c.Cc))
+	}
+	if c.Bcc != nil {
+		add("bcc_addresses = ?", nonNilArray(*c.Bcc))
+	}
+	if c.Subject != nil {
+		add("subject = ?", *c.Subject)
+	}
+	if c.Text != nil {
+		add("text_body = ?", *c.Text)
+	}
+	if c.HTML != nil {
+		add("html_body = ?", *c.HTML)
+	}
+	if c.SyncToProvider != nil {
+		add("sync_to_provider = ?", *c.SyncToProvider)
+	}
+
+	return sets, args
+}
+
+// nonNilArray returns list as an array; a nil list would be stored as NULL
+func nonNilArray(list []string) pq.StringArray {
+	if list == nil {
+		return pq.StringArray{}
+	}
+	return pq.StringArray(list)
+}
+
+// Delete removes a draft. A draft with a copy at the provider is hidden
+// until the copy has been removed.
+func (r *DraftRepository) Delete(userID, id uuid.UUID) error {
+	result, err := r.db.Exec(`
+		DELETE FROM drafts
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL AND provider_draft_id IS NULL
+			AND (sync_locked_until IS NULL OR sync_locked_until < NOW())
+	`, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete draft: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to delete draft: %w", err)
+	} else if n > 0 {
+		return nil
+	}
+
+	// The provider copy exists, or is being written right now
+	result, err = r.db.Exec(`
+		UPDATE drafts SET deleted_at = NOW(), version = version + 1, sync_next_at = NOW(), sync_attempts = 0
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL
+	`, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete draft: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete draft: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("draft not found")
+	}
+
+	return nil
+}
+
+// ListAttachments returns the attachments of a draft in the order they
+// were added
+func (r *DraftRepository) ListAttachments(draftID uuid.UUID) ([]models.DraftAttachment, error) {
+	attachments := []models.DraftAttachment{}
+	query := `SELECT * FROM draft_attachments WHERE draft_id = $1 ORDER BY created_at, id`
+
+	if err := r.db.Select(&attachments, query, draftID); err != nil {
+		return nil, fmt.Errorf("failed to list draft attachments: %w", err)
+	}
+
+	return attachments, nil
+}
+
+// AddAttachment records an attachment of a draft and its blob, and counts
+// as a change of the draft
+func (r *DraftRepository) AddAttachment(attachment *models.DraftAttachment) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO attachment_blobs (sha256, size_bytes) VALUES ($1, $2)
+		ON CONFLICT (sha256) DO NOTHING
+	`, attachment.SHA256, attachment.SizeBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save attachment blob: %w", err)
+	}
+
+	err = tx.Get(attachment, `
+		INSERT INTO draft_attachments (id, draft_id, filename, content_type, size_bytes, sha256, source_attachment_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING *
+	`, uuid.New(), attachment.DraftID, attachment.Filename, attachment.ContentType, attachment.SizeBytes,
+		attachment.SHA256, attachment.SourceAttachmentID)
+	if err != nil {
+		return fmt.Errorf("failed to add draft attachment: %w", err)
+	}
+
+	if err := touchDraft(tx, attachment.DraftID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit draft attachment: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveAttachment removes an attachment from a draft
+func (r *DraftRepository) RemoveAttachment(draftID, id uuid.UUID) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM draft_attachments WHERE id = $1 AND draft_id = $2`, id, draftID)
+	if err != nil {
+		return fmt.Errorf("failed to remove draft attachment: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to remove draft attachment: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("draft attachment not found")
+	}
+
+	if err := touchDraft(tx, draftID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit draft attachment removal: %w", err)
+	}
+
+	return nil
+}
+
+// touchDraft records a change of a draft made outside Update
+func touchDraft(tx *sqlx.Tx, id uuid.UUID) error {
+	_, err := tx.Exec(`
+		UPDATE drafts SET version = version + 1, sync_next_at = NOW() + make_interval(secs => $2), sync_attempts = 0
+		WHERE id = $1
+	`, id, draftSyncDelay.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to update draft version: %w", err)
+	}
+	return nil
+}
+
+// ClaimDue leases up to limit drafts whose provider copy is out of date.
+// The claimed drafts keep the version the worker is syncing.
+func (r *DraftRepository) ClaimDue(limit int, lease time.Duration) ([]models.Draft, error) {
+	drafts := []models.Draft{}
+	query := `
+		UPDATE drafts SET sync_locked_until = $1, sync_attempts = sync_attempts + 1
+		WHERE id IN (
+			SELECT id FROM drafts
+			WHERE synced_version < version AND (sync_to_provider OR provider_draft_id IS NOT NULL)
+				AND sync_next_at <= NOW()
+				AND (sync_locked_until IS NULL OR sync_locked_until < NOW())
+			ORDER BY sync_next_at ASC
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *
+	`
+
+	if err := r.db.Select(&drafts, query, time.Now().Add(lease), limit); err != nil {
+		return nil, fmt.Errorf("failed to claim drafts: %w", err)
+	}
+
+	return drafts, nil
+}
+
+// CompleteSync records that the provider copy matches the claimed version
+// of a draft. A deleted draft whose copy is gone is removed.
+func (r *DraftRepository) CompleteSync(draft *models.Draft, providerAccountID *uuid.UUID, providerDraftID *string) error {
+	return r.finishSync(draft, `
+		UPDATE drafts SET synced_version = $2, provider_account_id = $3, provider_draft_id = $4,
+			sync_locked_until = NULL, sync_attempts = 0, sync_error = NULL
+		WHERE id = $1
+	`, draft.Version, providerAccountID, providerDraftID)
+}
+
+// MarkSyncRetry records a failed sync and schedules the next attempt
+func (r *DraftRepository) MarkSyncRetry(draft *models.Draft, lastError string, next time.Time) error {
+	_, err := r.db.Exec(`
+		UPDATE drafts SET sync_error = $2, sync_next_at = GREATEST(sync_next_at, $3), sync_locked_until = NULL
+		WHERE id = $1
+	`, draft.ID, lastError, next)
+	if err != nil {
+		return fmt.Errorf("failed to schedule draft sync retry: %w", err)
+	}
+	return nil
+}
+
+// MarkSyncFailed gives up syncing the claimed version of a draft. A later
+// change tries again; a deleted draft is removed, leaving any copy behind.
+func (r *DraftRepository) MarkSyncFailed(draft *models.Draft, lastError string) error {
+	return r.finishSync(draft, `
+		UPDATE drafts SET synced_version = $2, sync_error = $3, sync_locked_until = NULL, sync_attempts = 0
+		WHERE id = $1
+	`, draft.Version, lastError)
+}
+
+func (r *DraftRepository) finishSync(draft *models.Draft, update string, args ...interface{}) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(update, append([]interface{}{draft.ID}, args...)...); err != nil {
+		return fmt.Errorf("failed to update draft sync: %w", err)
+	}
+	_, err = tx.Exec(`
+		DELETE FROM drafts
+		WHERE id = $1 AND deleted_at IS NOT NULL AND (provider_draft_id IS NULL OR synced_version = version)
+	`, draft.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete draft: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit draft sync: %w", err)
+	}
+
+	return nil
+}
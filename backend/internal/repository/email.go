@@ -0,0 +1,397 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// EmailRepository handles email metadata database operations
+type EmailRepository struct {
+	db *sqlx.DB
+}
+
+// NewEmailRepository creates a new email repository
+func NewEmailRepository(db *sqlx.DB) *EmailRepository {
+	return &EmailRepository{db: db}
+}
+
+// Upsert inserts an email or updates the existing row with the same
+// (account_id, external_id). State the user changed locally is kept until
+// the change has been written back to the provider.
+func (r *EmailRepository) Upsert(email *models.Email) error {
+	if email.ID == uuid.Nil {
+		email.ID = uuid.New()
+	}
+	// received_at has no time zone, so store every source's time as UTC
+	email.ReceivedAt = email.ReceivedAt.UTC()
+	now := time.Now()
+
+	query := `
+		INSERT INTO emails (
+			id, account_id, external_id, thread_id,
+			from_address, from_name, to_addresses, cc_addresses, subject, snippet,
+			is_read, is_starred, has_attachments, is_archived, received_at, created_at, updated_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $16)
+		ON CONFLICT (account_id, external_id) DO UPDATE SET
+			thread_id = COALESCE(EXCLUDED.thread_id, emails.thread_id),
+			from_address = EXCLUDED.from_address,
+			from_name = EXCLUDED.from_name,
+			to_addresses = EXCLUDED.to_addresses,
+			cc_addresses = EXCLUDED.cc_addresses,
+			subject = EXCLUDED.subject,
+			snippet = EXCLUDED.snippet,
+			is_read = CASE WHEN ` + pendingWriteback(models.WritebackRead) + ` THEN emails.is_read ELSE EXCLUDED.is_read END,
+			is_starred = CASE WHEN ` + pendingWriteback(models.WritebackStarred) + ` THEN emails.is_starred ELSE EXCLUDED.is_starred END,
+			is_archived = CASE WHEN ` + pendingWriteback(models.WritebackArchived) + ` THEN emails.is_archived ELSE EXCLUDED.is_archived END,
+			deleted_at = CASE WHEN ` + pendingWriteback(models.WritebackDeleted) + ` THEN emails.deleted_at END,
+			has_attachments = EXCLUDED.has_attachments,
+			received_at = EXCLUDED.received_at
+		RETURNING id, created_at, updated_at
+	`
+
+	row := r.db.QueryRowx(query,
+		email.ID, email.AccountID, email.ExternalID, email.ThreadID,
+		email.FromAddress, email.FromName, email.ToAddresses, email.CcAddresses, email.Subject, email.Snippet,
+		email.IsRead, email.IsStarred, email.HasAttachments, email.IsArchived, email.ReceivedAt, now,
+	)
+	if err := row.Scan(&email.ID, &email.CreatedAt, &email.UpdatedAt); err != nil {
+		return fmt.Errorf("failed to upsert email: %w", err)
+	}
+
+	return nil
+}
+
+// Insert adds an email unless the account already has one with the same
+// external ID, and reports whether it was added
+func (r *EmailRepository) Insert(email *models.Email) (bool, error) {
+	if email.ID == uuid.Nil {
+		email.ID = uuid.New()
+	}
+	email.ReceivedAt = email.ReceivedAt.UTC()
+	now := time.Now()
+
+	query := `
+		INSERT INTO emails (
+			id, account_id, external_id, thread_id,
+			from_address, from_name, to_addresses, cc_addresses, subject, snippet,
+			is_read, is_starred, has_attachments, is_archived, received_at, created_at, updated_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $16)
+		ON CONFLICT (account_id, external_id) DO NOTHING
+		RETURNING created_at, updated_at
+	`
+
+	row := r.db.QueryRowx(query,
+		email.ID, email.AccountID, email.ExternalID, email.ThreadID,
+		email.FromAddress, email.FromName, email.ToAddresses, email.CcAddresses, email.Subject, email.Snippet,
+		email.IsRead, email.IsStarred, email.HasAttachments, email.IsArchived, email.ReceivedAt, now,
+	)
+	err := row.Scan(&email.CreatedAt, &email.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to insert email: %w", err)
+	}
+
+	return true, nil
+}
+
+// UpdateFlags updates the read and starred state of an email reported by
+// the provider. Fields with a change waiting for write-back keep their
+// local value, and a deletion the provider did not carry out is undone.
+func (r *EmailRepository) UpdateFlags(accountID uuid.UUID, externalID string, isRead, isStarred bool) error {
+	query := `
+		UPDATE emails SET
+			is_read = CASE WHEN ` + pendingWriteback(models.WritebackRead) + ` THEN is_read ELSE $1 END,
+			is_starred = CASE WHEN ` + pendingWriteback(models.WritebackStarred) + ` THEN is_starred ELSE $2 END,
+			deleted_at = CASE WHEN ` + pendingWriteback(models.WritebackDeleted) + ` THEN deleted_at END
+		WHERE account_id = $3 AND external_id = $4
+		AND (is_read IS DISTINCT FROM $1 OR is_starred IS DISTINCT FROM $2 OR deleted_at IS NOT NULL)
+	`
+
+	_, err := r.db.Exec(query, isRead, isStarred, accountID, externalID)
+	if err != nil {
+		return fmt.Errorf("failed to update email flags: %w", err)
+	}
+
+	return nil
+}
+
+// ListExternalIDsByPrefix returns the external IDs of an account's emails
+// that start with the given prefix
+func (r *EmailRepository) ListExternalIDsByPrefix(accountID uuid.UUID, prefix string) ([]string, error) {
+	ids := []string{}
+	query := `SELECT external_id FROM emails WHERE account_id = $1 AND starts_with(external_id, $2)`
+
+	if err := r.db.Select(&ids, query, accountID, prefix); err != nil {
+		return nil, fmt.Errorf("failed to list external IDs: %w", err)
+	}
+
+	return ids, nil
+}
+
+// ListUnthreaded returns up to limit emails of an account without a thread
+// whose external ID starts with the given prefix
+func (r *EmailRepository) ListUnthreaded(accountID uuid.UUID, prefix string, limit int) ([]models.Email, error) {
+	emails := []models.Email{}
+	query := `
+		SELECT * FROM emails
+		WHERE account_id = $1 AND thread_id IS NULL AND starts_with(external_id, $2)
+		ORDER BY received_at
+		LIMIT $3
+	`
+
+	if err := r.db.Select(&emails, query, accountID, prefix, limit); err != nil {
+		return nil, fmt.Errorf("failed to list unthreaded emails: %w", err)
+	}
+
+	return emails, nil
+}
+
+// DeleteByExternalIDs deletes the given emails of an account
+func (r *EmailRepository) DeleteByExternalIDs(accountID uuid.UUID, externalIDs []string) error {
+	if len(externalIDs) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In(`DELETE FROM emails WHERE account_id = ? AND external_id IN (?)`, accountID, externalIDs)
+	if err != nil {
+		return fmt.Errorf("failed to build delete query: %w", err)
+	}
+
+	if _, err := r.db.Exec(r.db.Rebind(query), args...); err != nil {
+		return fmt.Errorf("failed to delete emails: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteByExternalIDPrefix deletes all emails of an account whose external
+// ID starts with the given prefix
+func (r *EmailRepository) DeleteByExternalIDPrefix(accountID uuid.UUID, prefix string) error {
+	query := `DELETE FROM emails WHERE account_id = $1 AND starts_with(external_id, $2)`
+
+	_, err := r.db.Exec(query, accountID, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to delete emails: %w", err)
+	}
+
+	return nil
+}
+
+// GetByID retrieves an email, including a deleted one
+func (r *EmailRepository) GetByID(id uuid.UUID) (*models.Email, error) {
+	email := &models.Email{}
+	query := `SELECT * FROM emails WHERE id = $1`
+
+	err := r.db.Get(email, query, id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("email not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get email: %w", err)
+	}
+
+	return email, nil
+}
+
+// GetForUser retrieves an email with its category if it belongs to one of
+// the user's accounts
+func (r *EmailRepository) GetForUser(userID, id uuid.UUID) (*models.EmailListItem, error) {
+	email := &models.EmailListItem{}
+	query := `
+		SELECT e.*, c.name AS category_name, c.color AS category_color, c.icon AS category_icon
+		FROM emails e
+		JOIN email_accounts a ON a.id = e.account_id
+		LEFT JOIN categories c ON c.id = e.category_id
+		WHERE e.id = $1 AND a.user_id = $2 AND e.deleted_at IS NULL
+	`
+
+	err := r.db.Get(email, query, id, userID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("email not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get email: %w", err)
+	}
+
+	return email, nil
+}
+
+// viewableBy restricts a query joined with email_accounts a to emails the
+// user $1 may read: their own, or those of a senior who granted them active
+// caregiver access to emails
+const viewableBy = `(
+	a.user_id = $1 OR EXISTS (
+		SELECT 1 FROM caregiver_access ca
+		WHERE ca.senior_id = a.user_id AND ca.caregiver_id = $1
+			AND ca.status = 'active' AND ca.can_view_emails
+	)
+)`
+
+// GetForViewer retrieves an email the user may read, either as the owner
+// or as an authorized caregiver of the owner
+func (r *EmailRepository) GetForViewer(userID, id uuid.UUID) (*models.Email, error) {
+	email := &models.Email{}
+	query := `
+		SELECT e.*
+		FROM emails e
+		JOIN email_accounts a ON a.id = e.account_id
+		WHERE e.id = $2 AND e.deleted_at IS NULL AND ` + viewableBy
+
+	err := r.db.Get(email, query, userID, id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("email not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get email: %w", err)
+	}
+
+	return email, nil
+}
+
+// timestampLayout formats times for comparison with TIMESTAMP columns
+// without involving the session time zone
+const timestampLayout = "2006-01-02 15:04:05.999999"
+
+// EmailCursor is the position after the last email of a page
+type EmailCursor struct {
+	ReceivedAt time.Time
+	ID         uuid.UUID
+}
+
+// EmailFilter selects emails across a user's accounts. Nil fields do not
+// filter.
+type EmailFilter struct {
+	UserID         uuid.UUID
+	AccountID      *uuid.UUID
+	CategoryID     *uuid.UUID
+	CategoryName   *string
+	Unread         *bool
+	Starred        *bool
+	HasAttachments *bool
+	Archived       bool       // archived emails instead of the inbox
+	Since          *time.Time // received at or after
+	Until          *time.Time // received before
+	After          *EmailCursor
+	Limit          int
+}
+
+// List retrieves one page of emails newest first, paginated by
+// (received_at, id). next is nil on the last page.
+func (r *EmailRepository) List(filter *EmailFilter) (emails []models.EmailListItem, next *EmailCursor, err error) {
+	conds := []string{"a.user_id = $1", "e.deleted_at IS NULL"}
+	args := []interface{}{filter.UserID}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, strings.ReplaceAll(cond, "?", fmt.Sprintf("$%d", len(args))))
+	}
+
+	add("e.is_archived = ?", filter.Archived)
+	if filter.AccountID != nil {
+		add("e.account_id = ?", *filter.AccountID)
+	}
+	if filter.CategoryID != nil {
+		add("e.category_id = ?", *filter.CategoryID)
+	}
+	if filter.CategoryName != nil {
+		add("c.name = ?", *filter.CategoryName)
+	}
+	if filter.Unread != nil {
+		add("e.is_read = ?", !*filter.Unread)
+	}
+	if filter.Starred != nil {
+		add("e.is_starred = ?", *filter.Starred)
+	}
+	if filter.HasAttachments != nil {
+		add("e.has_attachments = ?", *filter.HasAttachments)
+	}
+	if filter.Since != nil {
+		add("e.received_at >= ?::timestamp", filter.Since.UTC().Format(timestampLayout))
+	}
+	if filter.Until != nil {
+		add("e.received_at < ?::timestamp", filter.Until.UTC().Format(timestampLayout))
+	}
+	if filter.After != nil {
+		args = append(args, filter.After.ReceivedAt.Format(timestampLayout), filter.After.ID)
+		conds = append(conds, fmt.Sprintf("(e.received_at, e.id) < ($%d::timestamp, $%d)", len(args)-1, len(args)))
+	}
+
+	// Fetch one extra row to learn whether another page exists
+	args = append(args, filter.Limit+1)
+	query := fmt.Sprintf(`
+		SELECT e.*, c.name AS category_name, c.color AS category_color, c.icon AS category_icon
+		FROM emails e
+		JOIN email_accounts a ON a.id = e.account_id
+		LEFT JOIN categories c ON c.id = e.category_id
+		WHERE %s
+		ORDER BY e.received_at DESC, e.id DESC
+		LIMIT $%d
+	`, strings.Join(conds, " AND "), len(args))
+
+	emails = []models.EmailListItem{}
+	if err := r.db.Select(&emails, query, args...); err != nil {
+		return nil, nil, fmt.Errorf("failed to list emails: %w", err)
+	}
+
+	if len(emails) > filter.Limit {
+		emails = emails[:filter.Limit]
+		last := emails[len(emails)-1]
+		next = &EmailCursor{ReceivedAt: last.ReceivedAt, ID: last.ID}
+	}
+
+	return emails, next, nil
+}
+
+// ListForExport retrieves up to limit of the user's emails in a category,
+// or without one if categoryID is nil, oldest first after the cursor
+func (r *EmailRepository) ListForExport(userID uuid.UUID, categoryID *uuid.UUID, after *EmailCursor, limit int) ([]models.Email, error) {
+	conds := []string{"a.user_id = $1", "e.deleted_at IS NULL", "e.category_id IS NOT DISTINCT FROM $2"}
+	args := []interface{}{userID, categoryID}
+	if after != nil {
+		args = append(args, after.ReceivedAt.Format(timestampLayout), after.ID)
+		conds = append(conds, fmt.Sprintf("(e.received_at, e.id) > ($%d::timestamp, $%d)", len(args)-1, len(args)))
+	}
+
+	args = append(args, limit)
+	query := fmt.Sprintf(`
+		SELECT e.*
+		FROM emails e
+		JOIN email_accounts a ON a.id = e.account_id
+		WHERE %s
+		ORDER BY e.received_at ASC, e.id ASC
+		LIMIT $%d
+	`, strings.Join(conds, " AND "), len(args))
+
+	emails := []models.Email{}
+	if err := r.db.Select(&emails, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to list emails for export: %w", err)
+	}
+
+	return emails, nil
+}
+
+// CountForExport counts the user's emails that an export includes
+func (r *EmailRepository) CountForExport(userID uuid.UUID) (int, error) {
+	var count int
+	query := `
+		SELECT COUNT(*)
+		FROM emails e
+		JOIN email_accounts a ON a.id = e.account_id
+		WHERE a.user_id = $1 AND e.deleted_at IS NULL
+	`
+
+	if err := r.db.Get(&count, query, userID); err != nil {
+		return 0, fmt.Errorf("failed to count emails: %w", err)
+	}
+
+	return count, nil
+}
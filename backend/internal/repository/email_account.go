@@ -0,0 +1,353 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// EmailAccountRepository handles email account database operations
+type EmailAccountRepository struct {
+	db *sqlx.DB
+}
+
+// NewEmailAccountRepository creates a new email account repository
+func NewEmailAccountRepository(db *sqlx.DB) *EmailAccountRepository {
+	return &EmailAccountRepository{db: db}
+}
+
+// IDForAddress returns the ID of the user's account for emailAddress, or a
+// new ID if the address is not linked yet. Credentials are sealed against
+// this ID before UpsertCredentials is called.
+func (r *EmailAccountRepository) IDForAddress(userID uuid.UUID, emailAddress string) (uuid.UUID, error) {
+	var id uuid.UUID
+	query := `SELECT id FROM email_accounts WHERE user_id = $1 AND email_address = $2`
+
+	err := r.db.Get(&id, query, userID, emailAddress)
+	if err == sql.ErrNoRows {
+		return uuid.New(), nil
+	}
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to get email account: %w", err)
+	}
+
+	return id, nil
+}
+
+// UpsertCredentials links an external account to a user, or replaces the
+// stored credentials if the user already linked that address. The account
+// becomes primary if the user has no primary account yet. id must come from IDForAddress; if
+// the address was linked under another ID in the meantime nothing is
+// written, since the credentials are bound to id.
+func (r *EmailAccountRepository) UpsertCredentials(id, userID uuid.UUID, provider, emailAddress string, displayName *string, credentialsEncrypted string) (*models.EmailAccount, error) {
+	account := &models.EmailAccount{}
+	query := `
+		INSERT INTO email_accounts (id, user_id, provider, email_address, display_name, credentials_encrypted, is_primary)
+		VALUES ($1, $2, $3, $4, $5, $6, NOT EXISTS (SELECT 1 FROM email_accounts WHERE user_id = $2 AND is_primary))
+		ON CONFLICT (user_id, email_address) DO UPDATE SET
+			provider = EXCLUDED.provider,
+			display_name = COALESCE(EXCLUDED.display_name, email_accounts.display_name),
+			credentials_encrypted = EXCLUDED.credentials_encrypted
+		WHERE email_accounts.id = EXCLUDED.id
+		RETURNING *
+	`
+
+	err := r.db.Get(account, query, id, userID, provider, emailAddress, displayName, credentialsEncrypted)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("email account was linked concurrently")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save email account: %w", err)
+	}
+
+	return account, nil
+}
+
+// Create inserts a new email account. The account becomes primary if the
+// user has no primary account yet.
+func (r *EmailAccountRepository) Create(account *models.EmailAccount) error {
+	if account.ID == uuid.Nil {
+		account.ID = uuid.New()
+	}
+
+	query := `
+		INSERT INTO email_accounts (id, user_id, provider, email_address, display_name, credentials_encrypted, is_primary, sync_enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, NOT EXISTS (SELECT 1 FROM email_accounts WHERE user_id = $2 AND is_primary), $7)
+		RETURNING is_primary, created_at, updated_at
+	`
+
+	err := r.db.QueryRowx(query, account.ID, account.UserID, account.Provider, account.EmailAddress,
+		account.DisplayName, account.CredentialsEncrypted, account.SyncEnabled,
+	).Scan(&account.IsPrimary, &account.CreatedAt, &account.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create email account: %w", err)
+	}
+
+	return nil
+}
+
+// EnsureLocal returns the user's account for mail that exists only in
+// DadMail, such as imported mail, creating it if needed. Local accounts
+// have no credentials, are never synced and never become primary.
+func (r *EmailAccountRepository) EnsureLocal(userID uuid.UUID, provider, emailAddress, displayName string) (*models.EmailAccount, error) {
+	query := `
+		INSERT INTO email_accounts (user_id, provider, email_address, display_name, credentials_encrypted, is_primary, sync_enabled)
+		VALUES ($1, $2, $3, $4, '', false, false)
+		ON CONFLICT (user_id, email_address) DO NOTHING
+	`
+	if _, err := r.db.Exec(query, userID, provider, emailAddress, displayName); err != nil {
+		return nil, fmt.Errorf("failed to create local email account: %w", err)
+	}
+
+	account, err := r.GetByAddress(userID, emailAddress)
+	if err != nil {
+		return nil, err
+	}
+	if account.Provider != provider {
+		return nil, fmt.Errorf("address %s is linked to a %s account", emailAddress, account.Provider)
+	}
+
+	return account, nil
+}
+
+// GetByID retrieves an email account by ID
+func (r *EmailAccountRepository) GetByID(id uuid.UUID) (*models.EmailAccount, error) {
+	account := &models.EmailAccount{}
+	query := `SELECT * FROM email_accounts WHERE id = $1`
+
+	err := r.db.Get(account, query, id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("email account not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get email account: %w", err)
+	}
+
+	return account, nil
+}
+
+// GetForUser retrieves an email account by ID if it belongs to the user
+func (r *EmailAccountRepository) GetForUser(userID, id uuid.UUID) (*models.EmailAccount, error) {
+	account := &models.EmailAccount{}
+	query := `SELECT * FROM email_accounts WHERE id = $1 AND user_id = $2`
+
+	err := r.db.Get(account, query, id, userID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("email account not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get email account: %w", err)
+	}
+
+	return account, nil
+}
+
+// GetByAddress retrieves the user's account for an email address
+func (r *EmailAccountRepository) GetByAddress(userID uuid.UUID, emailAddress string) (*models.EmailAccount, error) {
+	account := &models.EmailAccount{}
+	query := `SELECT * FROM email_accounts WHERE user_id = $1 AND email_address = $2`
+
+	err := r.db.Get(account, query, userID, emailAddress)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("email account not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get email account: %w", err)
+	}
+
+	return account, nil
+}
+
+// GetPrimary retrieves the user's primary email account, falling back to
+// the oldest account if none is marked primary. Accounts of imported mail
+// cannot send, so they are never returned.
+func (r *EmailAccountRepository) GetPrimary(userID uuid.UUID) (*models.EmailAccount, error) {
+	account := &models.EmailAccount{}
+	query := `
+		SELECT * FROM email_accounts
+		WHERE user_id = $1 AND provider <> 'import'
+		ORDER BY is_primary DESC, created_at ASC
+		LIMIT 1
+	`
+
+	err := r.db.Get(account, query, userID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("email account not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get email account: %w", err)
+	}
+
+	return account, nil
+}
+
+// ListForUser retrieves all of a user's email accounts, primary first
+func (r *EmailAccountRepository) ListForUser(userID uuid.UUID) ([]models.EmailAccount, error) {
+	accounts := []models.EmailAccount{}
+	query := `
+		SELECT * FROM email_accounts
+		WHERE user_id = $1
+		ORDER BY is_primary DESC, created_at ASC
+	`
+
+	if err := r.db.Select(&accounts, query, userID); err != nil {
+		return nil, fmt.Errorf("failed to list email accounts: %w", err)
+	}
+
+	return accounts, nil
+}
+
+// Update saves an account's display name, sync flag and credentials
+func (r *EmailAccountRepository) Update(account *models.EmailAccount) error {
+	query := `
+		UPDATE email_accounts
+		SET display_name = $1, sync_enabled = $2, credentials_encrypted = $3
+		WHERE id = $4 AND user_id = $5
+		RETURNING updated_at
+	`
+
+	err := r.db.QueryRowx(query, account.DisplayName, account.SyncEnabled, account.CredentialsEncrypted,
+		account.ID, account.UserID,
+	).Scan(&account.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("email account not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update email account: %w", err)
+	}
+
+	return nil
+}
+
+// SetPrimary makes the account the user's only primary account. Accounts
+// of imported mail cannot become primary.
+func (r *EmailAccountRepository) SetPrimary(userID, id uuid.UUID) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Clear the old primary first; at most one may exist at any time
+	_, err = tx.Exec(`UPDATE email_accounts SET is_primary = false WHERE user_id = $1 AND is_primary AND id <> $2`, userID, id)
+	if err != nil {
+		return fmt.Errorf("failed to clear primary account: %w", err)
+	}
+
+	result, err := tx.Exec(`UPDATE email_accounts SET is_primary = true WHERE id = $1 AND user_id = $2 AND provider <> 'import'`, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set primary account: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("email account not found or cannot be primary")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit primary account: %w", err)
+	}
+
+	return nil
+}
+
+// Delete removes an account and everything synced from it. If it was the
+// primary account, the user's oldest remaining account with credentials
+// becomes primary.
+func (r *EmailAccountRepository) Delete(userID, id uuid.UUID) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var wasPrimary bool
+	err = tx.Get(&wasPrimary, `DELETE FROM email_accounts WHERE id = $1 AND user_id = $2 RETURNING is_primary`, id, userID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("email account not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete email account: %w", err)
+	}
+
+	if wasPrimary {
+		_, err = tx.Exec(`
+			UPDATE email_accounts SET is_primary = true
+			WHERE id = (
+				SELECT id FROM email_accounts
+				WHERE user_id = $1 AND credentials_encrypted <> ''
+				ORDER BY created_at ASC LIMIT 1
+			)
+		`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to promote primary account: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit account deletion: %w", err)
+	}
+
+	return nil
+}
+
+// ListSyncEnabled retrieves all accounts for a provider that have sync enabled
+func (r *EmailAccountRepository) ListSyncEnabled(provider string) ([]models.EmailAccount, error) {
+	accounts := []models.EmailAccount{}
+	query := `
+		SELECT * FROM email_accounts
+		WHERE provider = $1 AND sync_enabled = true
+		ORDER BY last_synced_at ASC NULLS FIRST
+	`
+
+	if err := r.db.Select(&accounts, query, provider); err != nil {
+		return nil, fmt.Errorf("failed to list email accounts: %w", err)
+	}
+
+	return accounts, nil
+}
+
+// UpdateLastSynced updates the account's last synced timestamp
+func (r *EmailAccountRepository) UpdateLastSynced(id uuid.UUID, syncedAt time.Time) error {
+	query := `UPDATE email_accounts SET last_synced_at = $1 WHERE id = $2`
+
+	_, err := r.db.Exec(query, syncedAt, id)
+	if err != nil {
+		return fmt.Errorf("failed to update last synced: %w", err)
+	}
+
+	return nil
+}
+
+// ListAfter retrieves up to limit accounts with an ID greater than afterID,
+// in ID order, for jobs that walk every account
+func (r *EmailAccountRepository) ListAfter(afterID uuid.UUID, limit int) ([]models.EmailAccount, error) {
+	accounts := []models.EmailAccount{}
+	query := `SELECT * FROM email_accounts WHERE id > $1 ORDER BY id ASC LIMIT $2`
+
+	if err := r.db.Select(&accounts, query, afterID, limit); err != nil {
+		return nil, fmt.Errorf("failed to list email accounts: %w", err)
+	}
+
+	return accounts, nil
+}
+
+// ReplaceCredentials swaps an account's stored credentials if they still
+// equal oldEncrypted, and reports whether the row was updated
+func (r *EmailAccountRepository) ReplaceCredentials(id uuid.UUID, oldEncrypted, newEncrypted string) (bool, error) {
+	query := `UPDATE email_accounts SET credentials_encrypted = $1 WHERE id = $2 AND credentials_encrypted = $3`
+
+	result, err := r.db.Exec(query, newEncrypted, id, oldEncrypted)
+	if err != nil {
+		return false, fmt.Errorf("failed to update credentials: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to update credentials: %w", err)
+	}
+
+	return rows > 0, nil
+}
@@ -0,0 +1,30 @@
+package repository_test
+
+import (
+	"testing"
+
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+)
+
+func TestPrimaryAccountSkipsImportedMail(t *testing.T) {
+	db := testdb.Open(t)
+	userID := testdb.CreateUser(t, db)
+	repo := repository.NewEmailAccountRepository(db)
+
+	// The import account is the user's oldest and nothing is primary yet
+	imported, err := repo.EnsureLocal(userID, "import", "old@example.com", "Old mail")
+	if err != nil {
+		t.Fatalf("EnsureLocal: %v", err)
+	}
+	if _, err := repo.GetPrimary(userID); err == nil {
+		t.Errorf("GetPrimary returned the import account")
+	}
+
+	if err := repo.SetPrimary(userID, imported.ID); err == nil {
+		t.Errorf("SetPrimary accepted the import account")
+	}
+	if _, err := repo.GetPrimary(userID); err == nil {
+		t.Errorf("GetPrimary returned an account after SetPrimary was rejected")
+	}
+}
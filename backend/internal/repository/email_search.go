@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+)
+
+const (
+	// maxSearchBodyBytes caps the body text kept for search
+	maxSearchBodyBytes = 100000
+
+	// Highlight delimiters are control characters that cannot occur in
+	// indexed text, so the highlight can be HTML escaped before they are
+	// turned into <mark> tags
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+// EmailSearch is a parsed search over a user's emails. Empty fields do not
+// filter; with no Text, matches are ordered newest first.
+type EmailSearch struct {
+	UserID   uuid.UUID
+	Text     string // web search syntax: words, "phrases" and -excluded words
+	From     string // substring of the sender name or address
+	Category string // category name
+	Before   *time.Time
+	After    *time.Time
+	Limit    int
+	Offset   int
+}
+
+// SaveBodyText records the plain text body of an email for search
+func (r *EmailRepository) SaveBodyText(emailID uuid.UUID, text string) error {
+	if len(text) > maxSearchBodyBytes {
+		text = text[:maxSearchBodyBytes]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+
+	query := `
+		INSERT INTO email_search (email_id, body_text, document) VALUES ($1, $2, ''::tsvector)
+		ON CONFLICT (email_id) DO UPDATE SET body_text = EXCLUDED.body_text
+		WHERE email_search.body_text IS DISTINCT FROM EXCLUDED.body_text
+	`
+
+	if _, err := r.db.Exec(query, emailID, strings.ToValidUTF8(text, "")); err != nil {
+		return fmt.Errorf("failed to save email body text: %w", err)
+	}
+
+	return nil
+}
+
+// HasBodyText reports whether the body text of an email has been saved
+func (r *EmailRepository) HasBodyText(emailID uuid.UUID) (bool, error) {
+	var saved bool
+	query := `SELECT EXISTS (SELECT 1 FROM email_search WHERE email_id = $1 AND body_text IS NOT NULL)`
+
+	if err := r.db.Get(&saved, query, emailID); err != nil {
+		return false, fmt.Errorf("failed to check email body text: %w", err)
+	}
+
+	return saved, nil
+}
+
+// Search returns emails matching the search, best matches first
+func (r *EmailRepository) Search(search *EmailSearch) ([]models.EmailSearchResult, error) {
+	conds := []string{"a.user_id = $1", "e.deleted_at IS NULL"}
+	args := []interface{}{search.UserID}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, strings.ReplaceAll(cond, "?", fmt.Sprintf("$%d", len(args))))
+	}
+
+	rank := "0::float8"
+	order := "e.received_at DESC, e.id DESC"
+	subjectHighlight := "coalesce(e.subject, '')"
+	bodyHighlight := "coalesce(e.snippet, '')"
+
+	if search.Text != "" {
+		args = append(args, search.Text)
+		tsquery := fmt.Sprintf("websearch_to_tsquery('english', $%d)", len(args))
+		conds = append(conds, "s.document @@ "+tsquery)
+
+		rank = "ts_rank_cd(s.document, " + tsquery + ")::float8"
+		order = "rank DESC, " + order
+		selectors := "StartSel=" + highlightStart + ", StopSel=" + highlightStop
+		args = append(args, selectors+", HighlightAll=true", selectors+", MaxFragments=2, MaxWords=25, MinWords=10")
+		subjectHighlight = fmt.Sprintf("ts_headline('english', coalesce(e.subject, ''), %s, $%d)", tsquery, len(args)-1)
+		bodyHighlight = fmt.Sprintf("ts_headline('english', coalesce(s.body_text, e.snippet, ''), %s, $%d)", tsquery, len(args))
+	}
+	if search.From != "" {
+		add("(e.from_address ILIKE ? OR e.from_name ILIKE ?)", "%"+escapeLike(search.From)+"%")
+	}
+	if search.Category != "" {
+		add("c.name ILIKE ?", escapeLike(search.Category))
+	}
+	if search.Before != nil {
+		add("e.received_at < ?::timestamp", search.Before.UTC().Format(timestampLayout))
+	}
+	if search.After != nil {
+		add("e.received_at >= ?::timestamp", search.After.UTC().Format(timestampLayout))
+	}
+
+	args = append(args, search.Limit, search.Offset)
+	query := fmt.Sprintf(`
+		SELECT e.*, c.name AS category_name, c.color AS category_color, c.icon AS category_icon,
+			%s AS rank, %s AS subject_highlight, %s AS body_highlight
+		FROM emails e
+		JOIN email_accounts a ON a.id = e.account_id
+		LEFT JOIN email_search s ON s.email_id = e.id
+		LEFT JOIN categories c ON c.id = e.category_id
+		WHERE %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d
+	`, rank, subjectHighlight, bodyHighlight, strings.Join(conds, " AND "), order, len(args)-1, len(args))
+
+	results := []models.EmailSearchResult{}
+	if err := r.db.Select(&results, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to search emails: %w", err)
+	}
+
+	for i := range results {
+		results[i].SubjectHighlight = markHighlight(results[i].SubjectHighlight)
+		results[i].BodyHighlight = markHighlight(results[i].BodyHighlight)
+	}
+
+	return results, nil
+}
+
+// markHighlight escapes a ts_headline result for HTML and marks the
+// matched terms
+func markHighlight(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, highlightStart, "<mark>")
+	return strings.ReplaceAll(s, highlightStop, "</mark>")
+}
+
+// escapeLike escapes the LIKE wildcards in s
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,37 @@
+package repository_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+)
+
+func TestHasBodyText(t *testing.T) {
+	db := testdb.Open(t)
+	account := newTestAccount(t, db)
+	repo := repository.NewEmailRepository(db)
+
+	email := &models.Email{
+		AccountID:   account.ID,
+		ExternalID:  "INBOX:1:1",
+		FromAddress: "kid@example.com",
+		ReceivedAt:  time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC),
+	}
+	if err := repo.Upsert(email); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+
+	// The search row exists from the insert, but without a body
+	if saved, err := repo.HasBodyText(email.ID); err != nil || saved {
+		t.Fatalf("HasBodyText before saving = %v, %v", saved, err)
+	}
+	if err := repo.SaveBodyText(email.ID, "Lunch at noon on Sunday"); err != nil {
+		t.Fatalf("SaveBodyText: %v", err)
+	}
+	if saved, err := repo.HasBodyText(email.ID); err != nil || !saved {
+		t.Errorf("HasBodyText after saving = %v, %v", saved, err)
+	}
+}
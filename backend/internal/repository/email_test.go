@@ -0,0 +1,164 @@
+package repository_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+	"github.com/jmoiron/sqlx"
+)
+
+// newTestAccount creates an IMAP account for a new user
+func newTestAccount(t *testing.T, db *sqlx.DB) *models.EmailAccount {
+	t.Helper()
+	account := &models.EmailAccount{
+		UserID:               testdb.CreateUser(t, db),
+		Provider:             "imap",
+		EmailAddress:         "grandpa@example.com",
+		CredentialsEncrypted: "unused",
+		SyncEnabled:          true,
+	}
+	testdb.CreateAccount(t, db, account)
+	return account
+}
+
+func TestUpsertStoresReceivedAtInUTC(t *testing.T) {
+	db := testdb.Open(t)
+	account := newTestAccount(t, db)
+	repo := repository.NewEmailRepository(db)
+
+	// 09:30 in New York is 14:30 UTC
+	newYork := time.FixedZone("EST", -5*60*60)
+	email := &models.Email{
+		AccountID:   account.ID,
+		ExternalID:  "INBOX:1:1",
+		FromAddress: "kid@example.com",
+		ReceivedAt:  time.Date(2026, 1, 10, 9, 30, 0, 0, newYork),
+	}
+	if err := repo.Upsert(email); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+
+	var stored string
+	if err := db.Get(&stored, `SELECT to_char(received_at, 'YYYY-MM-DD HH24:MI') FROM emails WHERE id = $1`, email.ID); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if stored != "2026-01-10 14:30" {
+		t.Errorf("received_at stored as %s, want the UTC time 2026-01-10 14:30", stored)
+	}
+	if email.ID == uuid.Nil || !email.ReceivedAt.Equal(time.Date(2026, 1, 10, 14, 30, 0, 0, time.UTC)) {
+		t.Errorf("email after Upsert = %+v", email)
+	}
+}
+
+func TestListPagesAcrossTimeZones(t *testing.T) {
+	db := testdb.Open(t)
+	account := newTestAccount(t, db)
+	repo := repository.NewEmailRepository(db)
+
+	// Received an hour apart, oldest first, but their local wall-clock
+	// times run the other way
+	tokyo := time.FixedZone("JST", 9*60*60)
+	newYork := time.FixedZone("EST", -5*60*60)
+	receivedAt := []time.Time{
+		time.Date(2026, 1, 10, 19, 0, 0, 0, tokyo),
+		time.Date(2026, 1, 10, 6, 0, 0, 0, newYork),
+		time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC),
+	}
+	var want []uuid.UUID
+	for i, at := range receivedAt {
+		email := &models.Email{
+			AccountID:   account.ID,
+			ExternalID:  "INBOX:1:" + string(rune('1'+i)),
+			FromAddress: "kid@example.com",
+			ReceivedAt:  at,
+		}
+		if err := repo.Upsert(email); err != nil {
+			t.Fatalf("Upsert: %v", err)
+		}
+		want = append([]uuid.UUID{email.ID}, want...)
+	}
+
+	var got []uuid.UUID
+	filter := &repository.EmailFilter{UserID: account.UserID, Limit: 1}
+	for page := 0; page < len(receivedAt)+1; page++ {
+		emails, next, err := repo.List(filter)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		for _, e := range emails {
+			got = append(got, e.ID)
+		}
+		if next == nil {
+			break
+		}
+		filter.After = next
+	}
+	if len(got) != len(want) {
+		t.Fatalf("paged through %d emails, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("page %d is email %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestListForExportPagesAcrossTimeZones(t *testing.T) {
+	db := testdb.Open(t)
+	account := newTestAccount(t, db)
+	repo := repository.NewEmailRepository(db)
+
+	// Two hours apart, the later one with the earlier wall-clock time
+	first := &models.Email{AccountID: account.ID, ExternalID: "INBOX:1:1", FromAddress: "kid@example.com",
+		ReceivedAt: time.Date(2026, 1, 10, 20, 0, 0, 0, time.FixedZone("JST", 9*60*60))}
+	second := &models.Email{AccountID: account.ID, ExternalID: "INBOX:1:2", FromAddress: "kid@example.com",
+		ReceivedAt: time.Date(2026, 1, 10, 8, 0, 0, 0, time.FixedZone("EST", -5*60*60))}
+	for _, e := range []*models.Email{second, first} {
+		if err := repo.Upsert(e); err != nil {
+			t.Fatalf("Upsert: %v", err)
+		}
+	}
+
+	var after *repository.EmailCursor
+	for _, want := range []*models.Email{first, second} {
+		emails, err := repo.ListForExport(account.UserID, nil, after, 1)
+		if err != nil {
+			t.Fatalf("ListForExport: %v", err)
+		}
+		if len(emails) != 1 || emails[0].ID != want.ID {
+			t.Fatalf("page = %v, want %s", emails, want.ExternalID)
+		}
+		after = &repository.EmailCursor{ReceivedAt: emails[0].ReceivedAt, ID: emails[0].ID}
+	}
+	if emails, err := repo.ListForExport(account.UserID, nil, after, 1); err != nil || len(emails) != 0 {
+		t.Errorf("page after the last = %v, %v", emails, err)
+	}
+}
+
+func TestInsertStoresReceivedAtInUTC(t *testing.T) {
+	db := testdb.Open(t)
+	account := newTestAccount(t, db)
+	repo := repository.NewEmailRepository(db)
+
+	email := &models.Email{
+		AccountID:   account.ID,
+		ExternalID:  "mid:lunch@example.com",
+		FromAddress: "kid@example.com",
+		ReceivedAt:  time.Date(2026, 1, 10, 23, 30, 0, 0, time.FixedZone("CET", 60*60)),
+	}
+	if added, err := repo.Insert(email); err != nil || !added {
+		t.Fatalf("Insert = %v, %v", added, err)
+	}
+
+	var stored string
+	if err := db.Get(&stored, `SELECT to_char(received_at, 'YYYY-MM-DD HH24:MI') FROM emails WHERE id = $1`, email.ID); err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if stored != "2026-01-10 22:30" {
+		t.Errorf("received_at stored as %s, want the UTC time 2026-01-10 22:30", stored)
+	}
+}
@@ -0,0 +1,219 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// ExportRepository handles mailbox export jobs
+type ExportRepository struct {
+	db *sqlx.DB
+}
+
+// NewExportRepository creates a new export repository
+func NewExportRepository(db *sqlx.DB) *ExportRepository {
+	return &ExportRepository{db: db}
+}
+
+// Create queues an export of a user's mailbox. Only one export of a
+// mailbox runs at a time: if one is already pending or running, it is
+// returned instead and created is false.
+func (r *ExportRepository) Create(exp *models.Export) (created bool, err error) {
+	if exp.ID == uuid.Nil {
+		exp.ID = uuid.New()
+	}
+
+	query := `
+		INSERT INTO exports (id, user_id, requested_by, format)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) WHERE status IN ('pending', 'exporting') DO NOTHING
+		RETURNING *
+	`
+
+	err = r.db.Get(exp, query, exp.ID, exp.UserID, exp.RequestedBy, exp.Format)
+	if err == nil {
+		return true, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, fmt.Errorf("failed to create export: %w", err)
+	}
+
+	err = r.db.Get(exp, `
+		SELECT * FROM exports WHERE user_id = $1 AND status IN ('pending', 'exporting')
+	`, exp.UserID)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("export finished while being requested")
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get running export: %w", err)
+	}
+
+	return false, nil
+}
+
+// exportVisibleTo restricts a query on exports to those the user $1 may see:
+// exports of their own mailbox, and those they requested while they still
+// have full caregiver access to the mailbox, including reading emails
+const exportVisibleTo = `(
+	user_id = $1 OR (requested_by = $1 AND EXISTS (
+		SELECT 1 FROM caregiver_access ca
+		WHERE ca.senior_id = exports.user_id AND ca.caregiver_id = $1
+			AND ca.status = 'active' AND ca.access_level = 'full' AND ca.can_view_emails
+	))
+)`
+
+// GetVisible retrieves an export the user may see
+func (r *ExportRepository) GetVisible(userID, id uuid.UUID) (*models.Export, error) {
+	exp := &models.Export{}
+	query := `SELECT * FROM exports WHERE id = $2 AND ` + exportVisibleTo
+
+	err := r.db.Get(exp, query, userID, id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("export not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get export: %w", err)
+	}
+
+	return exp, nil
+}
+
+// ListVisible retrieves the exports the user may see, newest first
+func (r *ExportRepository) ListVisible(userID uuid.UUID) ([]models.Export, error) {
+	exports := []models.Export{}
+	query := `SELECT * FROM exports WHERE ` + exportVisibleTo + ` ORDER BY created_at DESC`
+
+	if err := r.db.Select(&exports, query, userID); err != nil {
+		return nil, fmt.Errorf("failed to list exports: %w", err)
+	}
+
+	return exports, nil
+}
+
+// ClaimDue leases the oldest due export to the caller, or returns nil if
+// there is none. An export whose previous lease expired is claimed again
+// and starts over.
+func (r *ExportRepository) ClaimDue(lease time.Duration) (*models.Export, error) {
+	exp := &models.Export{}
+	query := `
+		UPDATE exports SET status = 'exporting', locked_until = $1, attempts = attempts + 1,
+			email_count = 0, failed_count = 0
+		WHERE id = (
+			SELECT id FROM exports
+			WHERE (status = 'pending' AND next_attempt_at <= NOW())
+			   OR (status = 'exporting' AND locked_until < NOW())
+			ORDER BY created_at ASC
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *
+	`
+
+	err := r.db.Get(exp, query, time.Now().Add(lease))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim export: %w", err)
+	}
+
+	return exp, nil
+}
+
+// SaveProgress records the progress of a claimed export and extends its
+// lease
+func (r *ExportRepository) SaveProgress(exp *models.Export, lease time.Duration) error {
+	query := `
+		UPDATE exports SET email_total = $2, email_count = $3, failed_count = $4, locked_until = $5
+		WHERE id = $1
+	`
+
+	_, err := r.db.Exec(query, exp.ID, exp.EmailTotal, exp.EmailCount, exp.FailedCount, time.Now().Add(lease))
+	if err != nil {
+		return fmt.Errorf("failed to save export progress: %w", err)
+	}
+
+	return nil
+}
+
+// Complete records the finished archive of an export, which can be
+// downloaded until expiresAt
+func (r *ExportRepository) Complete(exp *models.Export, objectKey string, sizeBytes int64, expiresAt time.Time) error {
+	query := `
+		UPDATE exports SET status = 'done', email_total = $2, email_count = $3, failed_count = $4,
+			object_key = $5, size_bytes = $6, expires_at = $7::timestamp,
+			locked_until = NULL, last_error = NULL, completed_at = NOW()
+		WHERE id = $1
+		RETURNING *
+	`
+
+	err := r.db.Get(exp, query, exp.ID, exp.EmailTotal, exp.EmailCount, exp.FailedCount,
+		objectKey, sizeBytes, expiresAt.UTC().Format(timestampLayout))
+	if err != nil {
+		return fmt.Errorf("failed to complete export: %w", err)
+	}
+
+	return nil
+}
+
+// MarkRetry records a failed attempt and schedules the next one
+func (r *ExportRepository) MarkRetry(exp *models.Export, attemptErr string, nextAttemptAt time.Time) error {
+	query := `
+		UPDATE exports SET status = 'pending', locked_until = NULL, last_error = $2, next_attempt_at = $3
+		WHERE id = $1
+	`
+
+	if _, err := r.db.Exec(query, exp.ID, attemptErr, nextAttemptAt); err != nil {
+		return fmt.Errorf("failed to schedule export retry: %w", err)
+	}
+
+	return nil
+}
+
+// MarkFailed gives up on an export
+func (r *ExportRepository) MarkFailed(exp *models.Export, attemptErr string) error {
+	query := `
+		UPDATE exports SET status = 'failed', locked_until = NULL, last_error = $2, completed_at = NOW()
+		WHERE id = $1
+	`
+
+	if _, err := r.db.Exec(query, exp.ID, attemptErr); err != nil {
+		return fmt.Errorf("failed to mark export failed: %w", err)
+	}
+
+	return nil
+}
+
+// ListExpired retrieves up to limit finished exports whose download link
+// has expired
+func (r *ExportRepository) ListExpired(limit int) ([]models.Export, error) {
+	exports := []models.Export{}
+	query := `
+		SELECT * FROM exports
+		WHERE status = 'done' AND expires_at <= $1::timestamp
+		ORDER BY expires_at ASC
+		LIMIT $2
+	`
+
+	if err := r.db.Select(&exports, query, time.Now().UTC().Format(timestampLayout), limit); err != nil {
+		return nil, fmt.Errorf("failed to list expired exports: %w", err)
+	}
+
+	return exports, nil
+}
+
+// MarkExpired records that the archive of an export has been deleted
+func (r *ExportRepository) MarkExpired(id uuid.UUID) error {
+	query := `UPDATE exports SET status = 'expired', object_key = NULL WHERE id = $1 AND status = 'done'`
+
+	if _, err := r.db.Exec(query, id); err != nil {
+		return fmt.Errorf("failed to mark export expired: %w", err)
+	}
+
+	return nil
+}
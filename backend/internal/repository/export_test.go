@@ -0,0 +1,57 @@
+package repository_test
+
+import (
+	"testing"
+
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+)
+
+func TestCaregiverExportRequiresEmailAccess(t *testing.T) {
+	db := testdb.Open(t)
+	seniorID := testdb.CreateUser(t, db)
+	caregiverID := testdb.CreateUser(t, db)
+	caregivers := repository.NewCaregiverRepository(db)
+	exports := repository.NewExportRepository(db)
+
+	// Full access, but not to the mail itself
+	_, err := db.Exec(`
+		INSERT INTO caregiver_access (senior_id, caregiver_id, access_level, status, can_view_emails)
+		VALUES ($1, $2, 'full', 'active', false)
+	`, seniorID, caregiverID)
+	if err != nil {
+		t.Fatalf("grant access: %v", err)
+	}
+	exp := &models.Export{UserID: seniorID, RequestedBy: caregiverID, Format: models.ExportMbox}
+	if _, err := exports.Create(exp); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	visible := func() (canExport bool, got, listed int) {
+		t.Helper()
+		canExport, err := caregivers.CanExport(seniorID, caregiverID)
+		if err != nil {
+			t.Fatalf("CanExport: %v", err)
+		}
+		if _, err := exports.GetVisible(caregiverID, exp.ID); err == nil {
+			got = 1
+		}
+		list, err := exports.ListVisible(caregiverID)
+		if err != nil {
+			t.Fatalf("ListVisible: %v", err)
+		}
+		return canExport, got, len(list)
+	}
+
+	if canExport, got, listed := visible(); canExport || got != 0 || listed != 0 {
+		t.Errorf("without email access: CanExport = %v, got %d, listed %d exports; want none", canExport, got, listed)
+	}
+
+	if _, err := db.Exec(`UPDATE caregiver_access SET can_view_emails = true`); err != nil {
+		t.Fatalf("allow emails: %v", err)
+	}
+	if canExport, got, listed := visible(); !canExport || got != 1 || listed != 1 {
+		t.Errorf("with email access: CanExport = %v, got %d, listed %d exports; want the export", canExport, got, listed)
+	}
+}
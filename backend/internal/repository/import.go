@@ -0,0 +1,298 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// ImportRepository handles mail import jobs and the imported messages they
+// store
+type ImportRepository struct {
+	db *sqlx.DB
+}
+
+// NewImportRepository creates a new import repository
+func NewImportRepository(db *sqlx.DB) *ImportRepository {
+	return &ImportRepository{db: db}
+}
+
+// Create starts a new import waiting for its upload
+func (r *ImportRepository) Create(imp *models.Import) error {
+	if imp.ID == uuid.Nil {
+		imp.ID = uuid.New()
+	}
+
+	query := `INSERT INTO imports (id, user_id, filename) VALUES ($1, $2, $3) RETURNING *`
+	if err := r.db.Get(imp, query, imp.ID, imp.UserID, imp.Filename); err != nil {
+		return fmt.Errorf("failed to create import: %w", err)
+	}
+
+	return nil
+}
+
+// GetForUser retrieves an import if it belongs to the user
+func (r *ImportRepository) GetForUser(userID, id uuid.UUID) (*models.Import, error) {
+	imp := &models.Import{}
+	query := `SELECT * FROM imports WHERE id = $1 AND user_id = $2`
+
+	err := r.db.Get(imp, query, id, userID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("import not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get import: %w", err)
+	}
+
+	return imp, nil
+}
+
+// ListForUser retrieves the user's imports, newest first
+func (r *ImportRepository) ListForUser(userID uuid.UUID) ([]models.Import, error) {
+	imports := []models.Import{}
+	query := `SELECT * FROM imports WHERE user_id = $1 ORDER BY created_at DESC`
+
+	if err := r.db.Select(&imports, query, userID); err != nil {
+		return nil, fmt.Errorf("failed to list imports: %w", err)
+	}
+
+	return imports, nil
+}
+
+// AddChunk records an uploaded chunk of an import's archive. Chunks must
+// arrive in order: if index is not the next chunk, or the upload is
+// finished, the current import is returned and added is false.
+func (r *ImportRepository) AddChunk(userID, id uuid.UUID, index int, sizeBytes int64) (imp *models.Import, added bool, err error) {
+	imp = &models.Import{}
+	query := `
+		UPDATE imports SET chunk_count = chunk_count + 1, bytes_total = bytes_total + $4
+		WHERE id = $1 AND user_id = $2 AND status = 'uploading' AND chunk_count = $3
+		RETURNING *
+	`
+
+	err = r.db.Get(imp, query, id, userID, index, sizeBytes)
+	if err == sql.ErrNoRows {
+		imp, err = r.GetForUser(userID, id)
+		return imp, false, err
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to add import chunk: %w", err)
+	}
+
+	return imp, true, nil
+}
+
+// Start queues an uploaded import for the worker. If the import is not
+// uploading or has no chunks, the current import is returned and started
+// is false.
+func (r *ImportRepository) Start(userID, id uuid.UUID) (imp *models.Import, started bool, err error) {
+	imp = &models.Import{}
+	query := `
+		UPDATE imports SET status = 'pending', next_attempt_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND status = 'uploading' AND chunk_count > 0
+		RETURNING *
+	`
+
+	err = r.db.Get(imp, query, id, userID)
+	if err == sql.ErrNoRows {
+		imp, err = r.GetForUser(userID, id)
+		return imp, false, err
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to start import: %w", err)
+	}
+
+	return imp, true, nil
+}
+
+// ClaimDue leases the oldest due import to the caller, or returns nil if
+// there is none. An import whose previous lease expired is claimed again
+// and starts over.
+func (r *ImportRepository) ClaimDue(lease time.Duration) (*models.Import, error) {
+	imp := &models.Import{}
+	query := `
+		UPDATE imports SET status = 'importing', locked_until = $1, attempts = attempts + 1,
+			bytes_processed = 0, imported_count = 0, duplicate_count = 0, failed_count = 0,
+			started_at = COALESCE(started_at, NOW())
+		WHERE id = (
+			SELECT id FROM imports
+			WHERE (status = 'pending' AND next_attempt_at <= NOW())
+			   OR (status = 'importing' AND locked_until < NOW())
+			ORDER BY created_at ASC
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *
+	`
+
+	err := r.db.Get(imp, query, time.Now().Add(lease))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim import: %w", err)
+	}
+
+	return imp, nil
+}
+
+// SaveProgress records the progress of a claimed import and extends its
+// lease
+func (r *ImportRepository) SaveProgress(imp *models.Import, lease time.Duration) error {
+	query := `
+		UPDATE imports SET bytes_total = $2, bytes_processed = $3,
+			imported_count = $4, duplicate_count = $5, failed_count = $6, locked_until = $7
+		WHERE id = $1
+	`
+
+	_, err := r.db.Exec(query, imp.ID, imp.BytesTotal, imp.BytesProcessed,
+		imp.Imported, imp.Duplicates, imp.Failed, time.Now().Add(lease))
+	if err != nil {
+		return fmt.Errorf("failed to save import progress: %w", err)
+	}
+
+	return nil
+}
+
+// Complete records the final progress of a finished import
+func (r *ImportRepository) Complete(imp *models.Import) error {
+	query := `
+		UPDATE imports SET status = 'done', bytes_total = $2, bytes_processed = $3,
+			imported_count = $4, duplicate_count = $5, failed_count = $6,
+			locked_until = NULL, last_error = NULL, completed_at = NOW()
+		WHERE id = $1
+	`
+
+	_, err := r.db.Exec(query, imp.ID, imp.BytesTotal, imp.BytesProcessed,
+		imp.Imported, imp.Duplicates, imp.Failed)
+	if err != nil {
+		return fmt.Errorf("failed to complete import: %w", err)
+	}
+
+	return nil
+}
+
+// MarkRetry records a failed attempt and schedules the next one
+func (r *ImportRepository) MarkRetry(imp *models.Import, attemptErr string, nextAttemptAt time.Time) error {
+	query := `
+		UPDATE imports SET status = 'pending', locked_until = NULL, last_error = $2, next_attempt_at = $3
+		WHERE id = $1
+	`
+
+	if _, err := r.db.Exec(query, imp.ID, attemptErr, nextAttemptAt); err != nil {
+		return fmt.Errorf("failed to schedule import retry: %w", err)
+	}
+
+	return nil
+}
+
+// MarkFailed gives up on an import
+func (r *ImportRepository) MarkFailed(imp *models.Import, attemptErr string) error {
+	query := `
+		UPDATE imports SET status = 'failed', locked_until = NULL, last_error = $2, completed_at = NOW()
+		WHERE id = $1
+	`
+
+	if _, err := r.db.Exec(query, imp.ID, attemptErr); err != nil {
+		return fmt.Errorf("failed to mark import failed: %w", err)
+	}
+
+	return nil
+}
+
+// ListAbandonedUploads retrieves up to limit imports whose upload has not
+// progressed since before the given time
+func (r *ImportRepository) ListAbandonedUploads(before time.Time, limit int) ([]models.Import, error) {
+	imports := []models.Import{}
+	query := `
+		SELECT * FROM imports
+		WHERE status = 'uploading' AND updated_at < $1
+		ORDER BY updated_at ASC
+		LIMIT $2
+	`
+
+	if err := r.db.Select(&imports, query, before, limit); err != nil {
+		return nil, fmt.Errorf("failed to list abandoned imports: %w", err)
+	}
+
+	return imports, nil
+}
+
+// SaveMessage records the stored source of an imported email
+func (r *ImportRepository) SaveMessage(objectKey string, emailID uuid.UUID, sizeBytes int64) error {
+	query := `INSERT INTO imported_messages (object_key, email_id, size_bytes) VALUES ($1, $2, $3)`
+
+	if _, err := r.db.Exec(query, objectKey, emailID, sizeBytes); err != nil {
+		return fmt.Errorf("failed to save imported message: %w", err)
+	}
+
+	return nil
+}
+
+// ListAccountMessages retrieves up to limit stored sources of the
+// account's emails, ordered by object key after the given key
+func (r *ImportRepository) ListAccountMessages(accountID uuid.UUID, afterKey string, limit int) ([]models.ImportedMessage, error) {
+	messages := []models.ImportedMessage{}
+	query := `
+		SELECT m.* FROM imported_messages m
+		JOIN emails e ON e.id = m.email_id
+		WHERE e.account_id = $1 AND m.object_key > $2
+		ORDER BY m.object_key ASC
+		LIMIT $3
+	`
+
+	if err := r.db.Select(&messages, query, accountID, afterKey, limit); err != nil {
+		return nil, fmt.Errorf("failed to list imported messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// ResizeMessage records the new size of a stored source that was written
+// again. It reports false if the email has been deleted meanwhile, so the
+// object is left for the caller to delete.
+func (r *ImportRepository) ResizeMessage(objectKey string, sizeBytes int64) (bool, error) {
+	query := `UPDATE imported_messages SET size_bytes = $2 WHERE object_key = $1 AND email_id IS NOT NULL`
+
+	result, err := r.db.Exec(query, objectKey, sizeBytes)
+	if err != nil {
+		return false, fmt.Errorf("failed to resize imported message: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+
+	return rows > 0, nil
+}
+
+// ListOrphanedMessages retrieves up to limit stored sources whose email
+// has been deleted
+func (r *ImportRepository) ListOrphanedMessages(limit int) ([]models.ImportedMessage, error) {
+	messages := []models.ImportedMessage{}
+	query := `
+		SELECT * FROM imported_messages
+		WHERE email_id IS NULL
+		ORDER BY created_at ASC
+		LIMIT $1
+	`
+
+	if err := r.db.Select(&messages, query, limit); err != nil {
+		return nil, fmt.Errorf("failed to list orphaned imported messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// DeleteMessage removes the record of a stored source whose email has
+// been deleted
+func (r *ImportRepository) DeleteMessage(objectKey string) error {
+	query := `DELETE FROM imported_messages WHERE object_key = $1 AND email_id IS NULL`
+
+	if _, err := r.db.Exec(query, objectKey); err != nil {
+		return fmt.Errorf("failed to delete imported message: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// KeyRotationRepository handles credential re-encryption progress
+type KeyRotationRepository struct {
+	db *sqlx.DB
+}
+
+// NewKeyRotationRepository creates a new key rotation repository
+func NewKeyRotationRepository(db *sqlx.DB) *KeyRotationRepository {
+	return &KeyRotationRepository{db: db}
+}
+
+// Start returns the rotation to keyID, creating it if it has not started.
+// A key that is made active again after another one starts over, since
+// credentials and mail were sealed with the other key meanwhile.
+func (r *KeyRotationRepository) Start(keyID string) (*models.KeyRotation, error) {
+	rotation := &models.KeyRotation{}
+	query := `
+		WITH latest AS (
+			SELECT key_id FROM key_rotations ORDER BY started_at DESC LIMIT 1
+		)
+		INSERT INTO key_rotations (key_id) VALUES ($1)
+		ON CONFLICT (key_id) DO UPDATE SET
+			started_at = CASE WHEN EXCLUDED.key_id = (SELECT key_id FROM latest) THEN key_rotations.started_at ELSE NOW() END,
+			last_account_id = CASE WHEN EXCLUDED.key_id = (SELECT key_id FROM latest) THEN key_rotations.last_account_id END,
+			completed_at = CASE WHEN EXCLUDED.key_id = (SELECT key_id FROM latest) THEN key_rotations.completed_at END
+		RETURNING *
+	`
+
+	if err := r.db.Get(rotation, query, keyID); err != nil {
+		return nil, fmt.Errorf("failed to start key rotation: %w", err)
+	}
+
+	return rotation, nil
+}
+
+// SaveProgress records the last account the rotation finished. A nil
+// lastAccountID restarts the walk from the beginning.
+func (r *KeyRotationRepository) SaveProgress(keyID string, lastAccountID *uuid.UUID) error {
+	query := `UPDATE key_rotations SET last_account_id = $1 WHERE key_id = $2`
+
+	if _, err := r.db.Exec(query, lastAccountID, keyID); err != nil {
+		return fmt.Errorf("failed to save key rotation progress: %w", err)
+	}
+
+	return nil
+}
+
+// Complete marks the rotation to keyID as finished
+func (r *KeyRotationRepository) Complete(keyID string) error {
+	query := `UPDATE key_rotations SET completed_at = NOW() WHERE key_id = $1`
+
+	if _, err := r.db.Exec(query, keyID); err != nil {
+		return fmt.Errorf("failed to complete key rotation: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package repository_test
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+)
+
+func TestKeyRotationRestartsWhenKeyIsReactivated(t *testing.T) {
+	db := testdb.Open(t)
+	repo := repository.NewKeyRotationRepository(db)
+
+	start := func(keyID string) (completed bool, last *uuid.UUID) {
+		t.Helper()
+		rotation, err := repo.Start(keyID)
+		if err != nil {
+			t.Fatalf("Start(%s): %v", keyID, err)
+		}
+		return rotation.CompletedAt != nil, rotation.LastAccountID
+	}
+
+	start("k1")
+	if err := repo.Complete("k1"); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if completed, _ := start("k1"); !completed {
+		t.Errorf("restarting with the same active key reopened its rotation")
+	}
+
+	// Rotate to k2, and back to k1 while k2 is half done
+	start("k2")
+	progress := uuid.New()
+	if err := repo.SaveProgress("k2", &progress); err != nil {
+		t.Fatalf("SaveProgress: %v", err)
+	}
+	if _, last := start("k2"); last == nil || *last != progress {
+		t.Errorf("resumed k2 rotation after %v, want %s", last, progress)
+	}
+	if completed, last := start("k1"); completed || last != nil {
+		t.Errorf("reactivated k1 rotation: completed = %v, last account = %v; want a new rotation", completed, last)
+	}
+	if _, last := start("k2"); last != nil {
+		t.Errorf("reactivated k2 rotation resumed after %s, want a new rotation", last)
+	}
+}
@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// OAuthStateRepository handles pending OAuth authorization requests
+type OAuthStateRepository struct {
+	db *sqlx.DB
+}
+
+// NewOAuthStateRepository creates a new OAuth state repository
+func NewOAuthStateRepository(db *sqlx.DB) *OAuthStateRepository {
+	return &OAuthStateRepository{db: db}
+}
+
+// Create stores a new pending authorization request
+func (r *OAuthStateRepository) Create(state string, userID uuid.UUID, provider, codeVerifier string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO oauth_states (state, user_id, provider, code_verifier, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+
+	_, err := r.db.Exec(query, state, userID, provider, codeVerifier, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create oauth state: %w", err)
+	}
+
+	return nil
+}
+
+// Consume deletes and returns an unexpired state issued to the given user,
+// so each state can only be used once and only by the user who started the
+// flow
+func (r *OAuthStateRepository) Consume(state, provider string, userID uuid.UUID) (*models.OAuthState, error) {
+	oauthState := &models.OAuthState{}
+	query := `
+		DELETE FROM oauth_states
+		WHERE state = $1 AND provider = $2 AND user_id = $3 AND expires_at > NOW()
+		RETURNING *
+	`
+
+	err := r.db.Get(oauthState, query, state, provider, userID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("oauth state not found or expired")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume oauth state: %w", err)
+	}
+
+	return oauthState, nil
+}
+
+// DeleteExpired deletes all expired states
+func (r *OAuthStateRepository) DeleteExpired() error {
+	query := `DELETE FROM oauth_states WHERE expires_at <= NOW()`
+
+	_, err := r.db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to delete expired oauth states: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrLeaseLost is returned when a claimed message's lease expired and
+// another worker claimed it again before the holder finished
+var ErrLeaseLost = errors.New("outbox lease expired and the message was claimed again")
+
+// OutboxRepository handles outgoing message queue operations
+type OutboxRepository struct {
+	db *sqlx.DB
+}
+
+// NewOutboxRepository creates a new outbox repository
+func NewOutboxRepository(db *sqlx.DB) *OutboxRepository {
+	return &OutboxRepository{db: db}
+}
+
+// Enqueue stores a message for delivery. If the user already enqueued a
+// message with the same idempotency key, the existing entry is returned
+// and created is false.
+func (r *OutboxRepository) Enqueue(msg *models.OutboxMessage) (stored *models.OutboxMessage, created bool, err error) {
+	if msg.ID == uuid.Nil {
+		msg.ID = uuid.New()
+	}
+
+	query := `
+		INSERT INTO outbox (id, user_id, account_id, idempotency_key, message_id, from_address, recipients, subject, raw_message)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (user_id, idempotency_key) DO NOTHING
+		RETURNING *
+	`
+
+	stored = &models.OutboxMessage{}
+	err = r.db.Get(stored, query, msg.ID, msg.UserID, msg.AccountID, msg.IdempotencyKey, msg.MessageID,
+		msg.FromAddress, msg.Recipients, msg.Subject, msg.RawMessage)
+	if err == nil {
+		return stored, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, false, fmt.Errorf("failed to enqueue message: %w", err)
+	}
+
+	// Conflict: this request was already accepted
+	err = r.db.Get(stored, `SELECT * FROM outbox WHERE user_id = $1 AND idempotency_key = $2`, msg.UserID, msg.IdempotencyKey)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get existing message: %w", err)
+	}
+	return stored, false, nil
+}
+
+// GetForUser retrieves an outbox entry by ID if it belongs to the user
+func (r *OutboxRepository) GetForUser(userID, id uuid.UUID) (*models.OutboxMessage, error) {
+	msg := &models.OutboxMessage{}
+	query := `SELECT * FROM outbox WHERE id = $1 AND user_id = $2`
+
+	err := r.db.Get(msg, query, id, userID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("outbox message not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get outbox message: %w", err)
+	}
+
+	return msg, nil
+}
+
+// ListForUser retrieves the user's most recent outbox entries, optionally
+// filtered by status
+func (r *OutboxRepository) ListForUser(userID uuid.UUID, status string, limit int) ([]models.OutboxMessage, error) {
+	messages := []models.OutboxMessage{}
+	query := `
+		SELECT * FROM outbox
+		WHERE user_id = $1 AND ($2::text = '' OR status = $2)
+		ORDER BY created_at DESC
+		LIMIT $3
+	`
+
+	if err := r.db.Select(&messages, query, userID, status, limit); err != nil {
+		return nil, fmt.Errorf("failed to list outbox messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// ListAttempts retrieves the delivery attempts of an outbox entry
+func (r *OutboxRepository) ListAttempts(outboxID uuid.UUID) ([]models.OutboxAttempt, error) {
+	attempts := []models.OutboxAttempt{}
+	query := `SELECT * FROM outbox_attempts WHERE outbox_id = $1 ORDER BY attempt ASC`
+
+	if err := r.db.Select(&attempts, query, outboxID); err != nil {
+		return nil, fmt.Errorf("failed to list outbox attempts: %w", err)
+	}
+
+	return attempts, nil
+}
+
+// ClaimDue leases up to limit due messages to the caller. Messages whose
+// previous lease expired (a worker died mid-send) are claimed again.
+func (r *OutboxRepository) ClaimDue(limit int, lease time.Duration) ([]models.OutboxMessage, error) {
+	messages := []models.OutboxMessage{}
+	query := `
+		UPDATE outbox SET status = 'sending', locked_until = $1, attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE (status = 'pending' AND next_attempt_at <= NOW())
+			   OR (status = 'sending' AND locked_until < NOW())
+			ORDER BY next_attempt_at ASC
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *
+	`
+
+	if err := r.db.Select(&messages, query, time.Now().Add(lease), limit); err != nil {
+		return nil, fmt.Errorf("failed to claim outbox messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// MarkSent records a successful delivery. Like MarkRetry and MarkFailed,
+// it returns ErrLeaseLost if the message was claimed again since msg was
+// claimed.
+func (r *OutboxRepository) MarkSent(msg *models.OutboxMessage) error {
+	return r.finishAttempt(msg, nil, `
+		UPDATE outbox SET status = 'sent', sent_at = NOW(), locked_until = NULL, last_error = NULL
+		WHERE id = $1 AND status = 'sending' AND attempts = $2
+	`)
+}
+
+// MarkRetry records a failed attempt and schedules the next one
+func (r *OutboxRepository) MarkRetry(msg *models.OutboxMessage, attemptErr string, nextAttemptAt time.Time) error {
+	return r.finishAttempt(msg, &attemptErr, `
+		UPDATE outbox SET status = 'pending', locked_until = NULL, last_error = $3, next_attempt_at = $4
+		WHERE id = $1 AND status = 'sending' AND attempts = $2
+	`, attemptErr, nextAttemptAt)
+}
+
+// MarkFailed records a failed attempt and gives up on the message
+func (r *OutboxRepository) MarkFailed(msg *models.OutboxMessage, attemptErr string) error {
+	return r.finishAttempt(msg, &attemptErr, `
+		UPDATE outbox SET status = 'failed', locked_until = NULL, last_error = $3
+		WHERE id = $1 AND status = 'sending' AND attempts = $2
+	`, attemptErr)
+}
+
+// finishAttempt updates the outbox row and logs the attempt in one
+// transaction. The update only applies to the claim msg came from: every
+// claim increments attempts, so a stale claim no longer matches.
+func (r *OutboxRepository) finishAttempt(msg *models.OutboxMessage, attemptErr *string, update string, args ...interface{}) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(update, append([]interface{}{msg.ID, msg.Attempts}, args...)...)
+	if err != nil {
+		return fmt.Errorf("failed to update outbox message: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrLeaseLost
+	}
+
+	_, err = tx.Exec(`INSERT INTO outbox_attempts (id, outbox_id, attempt, error) VALUES ($1, $2, $3, $4)`,
+		uuid.New(), msg.ID, msg.Attempts, attemptErr)
+	if err != nil {
+		return fmt.Errorf("failed to record outbox attempt: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit outbox update: %w", err)
+	}
+
+	return nil
+}
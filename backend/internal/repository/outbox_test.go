@@ -0,0 +1,70 @@
+package repository_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+)
+
+func TestOutboxStaleClaimCannotFinish(t *testing.T) {
+	db := testdb.Open(t)
+	account := newTestAccount(t, db)
+	repo := repository.NewOutboxRepository(db)
+
+	msg, _, err := repo.Enqueue(&models.OutboxMessage{
+		UserID:         account.UserID,
+		AccountID:      account.ID,
+		IdempotencyKey: uuid.NewString(),
+		MessageID:      "<lunch@example.com>",
+		FromAddress:    "grandpa@example.com",
+		Recipients:     []string{"kid@example.com"},
+		RawMessage:     []byte("Subject: Lunch\r\n\r\nNoon?\r\n"),
+	})
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	// The first worker's lease runs out and a second worker claims the
+	// message again
+	stale, err := repo.ClaimDue(10, -time.Second)
+	if err != nil || len(stale) != 1 {
+		t.Fatalf("first ClaimDue = %v, %v", stale, err)
+	}
+	current, err := repo.ClaimDue(10, time.Minute)
+	if err != nil || len(current) != 1 || current[0].Attempts != 2 {
+		t.Fatalf("second ClaimDue = %v, %v", current, err)
+	}
+
+	if err := repo.MarkSent(&stale[0]); !errors.Is(err, repository.ErrLeaseLost) {
+		t.Errorf("MarkSent with the stale claim = %v, want ErrLeaseLost", err)
+	}
+	if err := repo.MarkRetry(&stale[0], "timeout", time.Now()); !errors.Is(err, repository.ErrLeaseLost) {
+		t.Errorf("MarkRetry with the stale claim = %v, want ErrLeaseLost", err)
+	}
+	if err := repo.MarkFailed(&current[0], "550 no such user"); err != nil {
+		t.Fatalf("MarkFailed: %v", err)
+	}
+	if err := repo.MarkSent(&current[0]); !errors.Is(err, repository.ErrLeaseLost) {
+		t.Errorf("MarkSent after the message finished = %v, want ErrLeaseLost", err)
+	}
+
+	stored, err := repo.GetForUser(account.UserID, msg.ID)
+	if err != nil {
+		t.Fatalf("GetForUser: %v", err)
+	}
+	if stored.Status != models.OutboxFailed || stored.SentAt != nil {
+		t.Errorf("status = %s, sent at %v; want the second worker's failure", stored.Status, stored.SentAt)
+	}
+	attempts, err := repo.ListAttempts(msg.ID)
+	if err != nil {
+		t.Fatalf("ListAttempts: %v", err)
+	}
+	if len(attempts) != 1 || attempts[0].Attempt != 2 {
+		t.Errorf("attempts = %+v, want only the second claim's", attempts)
+	}
+}
@@ -0,0 +1,144 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// PreferencesRepository handles user preference database operations
+type PreferencesRepository struct {
+	db *sqlx.DB
+}
+
+// NewPreferencesRepository creates a new preferences repository
+func NewPreferencesRepository(db *sqlx.DB) *PreferencesRepository {
+	return &PreferencesRepository{db: db}
+}
+
+// DefaultPreferences returns the preferences of a user who never changed
+// them, matching the user_preferences column defaults
+func DefaultPreferences(userID uuid.UUID) *models.UserPreferences {
+	return &models.UserPreferences{
+		UserID:               userID,
+		Theme:                "light",
+		FontSize:             "large",
+		AutoCategorize:       true,
+		ShowImages:           false,
+		NotificationsEnabled: true,
+	}
+}
+
+// Get retrieves a user's preferences, returning the defaults if none were
+// saved
+func (r *PreferencesRepository) Get(userID uuid.UUID) (*models.UserPreferences, error) {
+	prefs := DefaultPreferences(userID)
+	query := `
+		SELECT user_id,
+			COALESCE(theme, $2) AS theme,
+			COALESCE(font_size, $3) AS font_size,
+			COALESCE(auto_categorize, $4) AS auto_categorize,
+			COALESCE(show_images, $5) AS show_images,
+			COALESCE(notifications_enabled, $6) AS notifications_enabled
+		FROM user_preferences WHERE user_id = $1
+	`
+
+	err := r.db.Get(prefs, query, userID,
+		prefs.Theme, prefs.FontSize, prefs.AutoCategorize, prefs.ShowImages, prefs.NotificationsEnabled)
+	if err == sql.ErrNoRows {
+		return DefaultPreferences(userID), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get preferences: %w", err)
+	}
+
+	return prefs, nil
+}
+
+// Save stores a user's preferences
+func (r *PreferencesRepository) Save(prefs *models.UserPreferences) error {
+	query := `
+		INSERT INTO user_preferences (user_id, theme, font_size, auto_categorize, show_images, notifications_enabled)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id) DO UPDATE SET
+			theme = EXCLUDED.theme,
+			font_size = EXCLUDED.font_size,
+			auto_categorize = EXCLUDED.auto_categorize,
+			show_images = EXCLUDED.show_images,
+			notifications_enabled = EXCLUDED.notifications_enabled
+	`
+
+	_, err := r.db.Exec(query, prefs.UserID, prefs.Theme, prefs.FontSize,
+		prefs.AutoCategorize, prefs.ShowImages, prefs.NotificationsEnabled)
+	if err != nil {
+		return fmt.Errorf("failed to save preferences: %w", err)
+	}
+
+	return nil
+}
+
+// ListImageSenders returns the senders whose images the user always shows
+func (r *PreferencesRepository) ListImageSenders(userID uuid.UUID) ([]models.ImageSender, error) {
+	senders := []models.ImageSender{}
+	query := `SELECT * FROM image_allowed_senders WHERE user_id = $1 ORDER BY sender`
+
+	if err := r.db.Select(&senders, query, userID); err != nil {
+		return nil, fmt.Errorf("failed to list image senders: %w", err)
+	}
+
+	return senders, nil
+}
+
+// AddImageSender always shows images from sender, an address or @domain
+func (r *PreferencesRepository) AddImageSender(userID uuid.UUID, sender string) (*models.ImageSender, error) {
+	row := &models.ImageSender{}
+	query := `
+		INSERT INTO image_allowed_senders (user_id, sender) VALUES ($1, $2)
+		ON CONFLICT (user_id, sender) DO UPDATE SET sender = EXCLUDED.sender
+		RETURNING *
+	`
+
+	if err := r.db.Get(row, query, userID, strings.ToLower(sender)); err != nil {
+		return nil, fmt.Errorf("failed to add image sender: %w", err)
+	}
+
+	return row, nil
+}
+
+// RemoveImageSender stops always showing images from sender
+func (r *PreferencesRepository) RemoveImageSender(userID uuid.UUID, sender string) error {
+	query := `DELETE FROM image_allowed_senders WHERE user_id = $1 AND sender = $2`
+
+	result, err := r.db.Exec(query, userID, strings.ToLower(sender))
+	if err != nil {
+		return fmt.Errorf("failed to remove image sender: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("image sender not found")
+	}
+
+	return nil
+}
+
+// ImagesAllowedFrom reports whether the user always shows images from the
+// given address, by address or by domain
+func (r *PreferencesRepository) ImagesAllowedFrom(userID uuid.UUID, address string) (bool, error) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	domain := ""
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		domain = address[at:]
+	}
+
+	var allowed bool
+	query := `SELECT EXISTS (SELECT 1 FROM image_allowed_senders WHERE user_id = $1 AND sender IN ($2, $3))`
+
+	if err := r.db.Get(&allowed, query, userID, address, domain); err != nil {
+		return false, fmt.Errorf("failed to check image sender: %w", err)
+	}
+
+	return allowed, nil
+}
@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// SyncStateRepository handles per-folder sync state database operations
+type SyncStateRepository struct {
+	db *sqlx.DB
+}
+
+// NewSyncStateRepository creates a new sync state repository
+func NewSyncStateRepository(db *sqlx.DB) *SyncStateRepository {
+	return &SyncStateRepository{db: db}
+}
+
+// Get retrieves the sync state of a folder, returning a zero state if the
+// folder has never been synced
+func (r *SyncStateRepository) Get(accountID uuid.UUID, folder string) (*models.SyncState, error) {
+	state := &models.SyncState{}
+	query := `SELECT * FROM sync_state WHERE account_id = $1 AND folder = $2`
+
+	err := r.db.Get(state, query, accountID, folder)
+	if err == sql.ErrNoRows {
+		return &models.SyncState{AccountID: accountID, Folder: folder}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sync state: %w", err)
+	}
+
+	return state, nil
+}
+
+// Save stores the sync state of a folder. Within the same UIDVALIDITY the
+// stored last_uid never moves backwards, so concurrent syncs of one folder
+// cannot undo each other's progress.
+func (r *SyncStateRepository) Save(state *models.SyncState) error {
+	query := `
+		INSERT INTO sync_state (account_id, folder, uid_validity, last_uid, cursor)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (account_id, folder) DO UPDATE SET
+			last_uid = CASE
+				WHEN sync_state.uid_validity = EXCLUDED.uid_validity
+				THEN GREATEST(sync_state.last_uid, EXCLUDED.last_uid)
+				ELSE EXCLUDED.last_uid
+			END,
+			uid_validity = EXCLUDED.uid_validity,
+			cursor = EXCLUDED.cursor
+	`
+
+	_, err := r.db.Exec(query, state.AccountID, state.Folder, state.UIDValidity, state.LastUID, state.Cursor)
+	if err != nil {
+		return fmt.Errorf("failed to save sync state: %w", err)
+	}
+
+	return nil
+}
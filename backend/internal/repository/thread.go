@@ -0,0 +1,209 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/threading"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// ThreadRepository handles Message-ID threading database operations
+type ThreadRepository struct {
+	db *sqlx.DB
+}
+
+// NewThreadRepository creates a new thread repository
+func NewThreadRepository(db *sqlx.DB) *ThreadRepository {
+	return &ThreadRepository{db: db}
+}
+
+// Assign places an email in a thread and returns the thread key. The
+// thread is the one already holding the message or any of its references;
+// when these belong to different threads, the threads are merged into the
+// one of the oldest reference. Messages without references fall back to
+// the thread of a nearby message with the same subject if either of them
+// is a reply.
+func (r *ThreadRepository) Assign(accountID, emailID uuid.UUID, msg *threading.Message) (string, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Threads of one account are assigned one message at a time so
+	// concurrent syncs cannot split a thread
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('thread_messages:' || $1::text))`, accountID); err != nil {
+		return "", fmt.Errorf("failed to lock threads: %w", err)
+	}
+
+	messageID := msg.MessageID
+	if messageID == "" {
+		messageID = emailID.String() + "@dadmail.invalid"
+	}
+	ids := append(append([]string{}, msg.References...), messageID)
+
+	known := []struct {
+		MessageID string `db:"message_id"`
+		ThreadID  string `db:"thread_id"`
+	}{}
+	err = tx.Select(&known, `
+		SELECT message_id, thread_id FROM thread_messages
+		WHERE account_id = $1 AND message_id = ANY($2)
+	`, accountID, pq.StringArray(ids))
+	if err != nil {
+		return "", fmt.Errorf("failed to look up thread messages: %w", err)
+	}
+
+	threadOf := make(map[string]string, len(known))
+	for _, k := range known {
+		threadOf[k.MessageID] = k.ThreadID
+	}
+
+	var threadID string
+	var merged []string
+	for _, id := range ids {
+		switch t := threadOf[id]; {
+		case t == "":
+		case threadID == "":
+			threadID = t
+		case t != threadID && !contains(merged, t):
+			merged = append(merged, t)
+		}
+	}
+
+	if threadID == "" && len(msg.References) == 0 && msg.SubjectKey != "" {
+		err = tx.Get(&threadID, `
+			SELECT thread_id FROM thread_messages
+			WHERE account_id = $1 AND subject_key = $2 AND ($3 OR is_reply)
+				AND received_at BETWEEN $4::timestamp - make_interval(secs => $5) AND $4::timestamp + make_interval(secs => $5)
+			ORDER BY abs(extract(epoch FROM received_at - $4::timestamp))
+			LIMIT 1
+		`, accountID, msg.SubjectKey, msg.IsReply, msg.ReceivedAt.UTC().Format(timestampLayout), threading.SubjectWindow.Seconds())
+		if err != nil && err != sql.ErrNoRows {
+			return "", fmt.Errorf("failed to look up thread by subject: %w", err)
+		}
+	}
+	if threadID == "" {
+		threadID = threading.Key(ids[0])
+	}
+
+	if len(msg.References) > 0 {
+		_, err = tx.Exec(`
+			INSERT INTO thread_messages (account_id, message_id, thread_id)
+			SELECT $1, unnest($2::text[]), $3
+			ON CONFLICT (account_id, message_id) DO NOTHING
+		`, accountID, pq.StringArray(msg.References), threadID)
+		if err != nil {
+			return "", fmt.Errorf("failed to save thread references: %w", err)
+		}
+	}
+
+	var subjectKey *string
+	if msg.SubjectKey != "" {
+		subjectKey = &msg.SubjectKey
+	}
+	_, err = tx.Exec(`
+		INSERT INTO thread_messages (account_id, message_id, thread_id, subject_key, is_reply, received_at)
+		VALUES ($1, $2, $3, $4, $5, $6::timestamp)
+		ON CONFLICT (account_id, message_id) DO UPDATE SET
+			thread_id = EXCLUDED.thread_id,
+			subject_key = EXCLUDED.subject_key,
+			is_reply = EXCLUDED.is_reply,
+			received_at = EXCLUDED.received_at
+	`, accountID, messageID, threadID, subjectKey, msg.IsReply, msg.ReceivedAt.UTC().Format(timestampLayout))
+	if err != nil {
+		return "", fmt.Errorf("failed to save thread message: %w", err)
+	}
+
+	if len(merged) > 0 {
+		if err := mergeThreads(tx, accountID, threadID, merged); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE emails SET thread_id = $2 WHERE id = $1`, emailID, threadID); err != nil {
+		return "", fmt.Errorf("failed to set email thread: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit thread assignment: %w", err)
+	}
+
+	return threadID, nil
+}
+
+// mergeThreads moves the messages, emails and conversation of the merged
+// threads into threadID. Of several conversation rows the one of threadID,
+// or else the most recently active one, is kept.
+func mergeThreads(tx *sqlx.Tx, accountID uuid.UUID, threadID string, merged []string) error {
+	from := pq.StringArray(merged)
+
+	if _, err := tx.Exec(`
+		UPDATE thread_messages SET thread_id = $2 WHERE account_id = $1 AND thread_id = ANY($3)
+	`, accountID, threadID, from); err != nil {
+		return fmt.Errorf("failed to merge thread messages: %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE emails SET thread_id = $2 WHERE account_id = $1 AND thread_id = ANY($3)
+	`, accountID, threadID, from); err != nil {
+		return fmt.Errorf("failed to merge thread emails: %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		DELETE FROM conversations
+		WHERE account_id = $1 AND thread_id = ANY($3) AND (
+			EXISTS (SELECT 1 FROM conversations WHERE account_id = $1 AND thread_id = $2)
+			OR id <> (
+				SELECT id FROM conversations WHERE account_id = $1 AND thread_id = ANY($3)
+				ORDER BY last_message_at DESC NULLS LAST LIMIT 1
+			)
+		)
+	`, accountID, threadID, from); err != nil {
+		return fmt.Errorf("failed to merge conversations: %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE conversations SET thread_id = $2 WHERE account_id = $1 AND thread_id = ANY($3)
+	`, accountID, threadID, from); err != nil {
+		return fmt.Errorf("failed to merge conversations: %w", err)
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ListConversations retrieves the conversations of all the user's accounts,
+// most recently active first
+func (r *ThreadRepository) ListConversations(userID uuid.UUID) ([]models.Conversation, error) {
+	conversations := []models.Conversation{}
+	query := `
+		SELECT c.id, c.account_id, c.thread_id, c.participants, c.subject,
+			COALESCE(c.message_count, 0) AS message_count, c.last_message_at, c.topics,
+			COALESCE(c.importance_score, 0) AS importance_score,
+			COALESCE(c.has_action_items, false) AS has_action_items,
+			c.action_items, c.created_at, c.updated_at
+		FROM conversations c
+		JOIN email_accounts a ON a.id = c.account_id
+		WHERE a.user_id = $1
+		ORDER BY c.last_message_at DESC NULLS LAST, c.id
+	`
+
+	if err := r.db.Select(&conversations, query, userID); err != nil {
+		return nil, fmt.Errorf("failed to list conversations: %w", err)
+	}
+
+	return conversations, nil
+}
@@ -0,0 +1,94 @@
+package repository_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+	"github.com/jay/dadmail/internal/threading"
+	"github.com/jmoiron/sqlx"
+)
+
+// threadOf returns the stored thread of an email
+func threadOf(t *testing.T, db *sqlx.DB, emailID uuid.UUID) string {
+	t.Helper()
+	var threadID string
+	if err := db.Get(&threadID, `SELECT COALESCE(thread_id, '') FROM emails WHERE id = $1`, emailID); err != nil {
+		t.Fatalf("select thread: %v", err)
+	}
+	return threadID
+}
+
+func TestAssignMergesThreadsWhenTheParentArrivesLate(t *testing.T) {
+	db := testdb.Open(t)
+	account := newTestAccount(t, db)
+	emails := repository.NewEmailRepository(db)
+	threads := repository.NewThreadRepository(db)
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	assign := func(uid int, msg *threading.Message) (uuid.UUID, string) {
+		t.Helper()
+		email := &models.Email{
+			AccountID:   account.ID,
+			ExternalID:  "INBOX:1:" + string(rune('0'+uid)),
+			FromAddress: "kid@example.com",
+			ReceivedAt:  msg.ReceivedAt,
+		}
+		if err := emails.Upsert(email); err != nil {
+			t.Fatalf("Upsert: %v", err)
+		}
+		threadID, err := threads.Assign(account.ID, email.ID, msg)
+		if err != nil {
+			t.Fatalf("Assign: %v", err)
+		}
+		return email.ID, threadID
+	}
+
+	// Two replies arrive before the messages they answer. Each only knows
+	// its own parent, so they start separate threads.
+	first, firstThread := assign(1, threading.NewMessage("<c@example.com>", "<a@example.com>", nil, "Re: Lunch", at))
+	second, secondThread := assign(2, threading.NewMessage("<d@example.com>", "<b@example.com>", nil, "Re: Lunch", at.Add(time.Hour)))
+	if firstThread == secondThread {
+		t.Fatalf("unrelated replies share thread %s", firstThread)
+	}
+	for _, threadID := range []string{firstThread, secondThread} {
+		if _, err := db.Exec(`INSERT INTO conversations (account_id, thread_id, last_message_at) VALUES ($1, $2, $3)`,
+			account.ID, threadID, at); err != nil {
+			t.Fatalf("insert conversation: %v", err)
+		}
+	}
+
+	// b answers a, which joins both threads into the one of the oldest
+	// reference
+	parent, parentThread := assign(3, threading.NewMessage("<b@example.com>", "<a@example.com>", nil, "Re: Lunch", at.Add(-time.Hour)))
+	if parentThread != firstThread {
+		t.Errorf("late parent joined thread %s, want %s", parentThread, firstThread)
+	}
+	for _, id := range []uuid.UUID{first, second, parent} {
+		if got := threadOf(t, db, id); got != firstThread {
+			t.Errorf("email %s is in thread %s, want %s", id, got, firstThread)
+		}
+	}
+
+	var conversations []string
+	if err := db.Select(&conversations, `SELECT thread_id FROM conversations WHERE account_id = $1`, account.ID); err != nil {
+		t.Fatalf("select conversations: %v", err)
+	}
+	if len(conversations) != 1 || conversations[0] != firstThread {
+		t.Errorf("conversations after the merge = %v, want only %s", conversations, firstThread)
+	}
+
+	var stale int
+	if err := db.Get(&stale, `SELECT COUNT(*) FROM thread_messages WHERE account_id = $1 AND thread_id = $2`, account.ID, secondThread); err != nil || stale != 0 {
+		t.Errorf("%d thread messages left in the merged thread, %v", stale, err)
+	}
+
+	// A reply without references finds the thread by subject
+	_, bySubject := assign(4, threading.NewMessage("<e@example.com>", "", nil, "RE: lunch", at.Add(2*time.Hour)))
+	if bySubject != firstThread {
+		t.Errorf("reply by subject joined thread %s, want %s", bySubject, firstThread)
+	}
+}
@@ -0,0 +1,287 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// writebackColumns maps write-back fields to their emails columns
+var writebackColumns = map[string]string{
+	models.WritebackRead:     "is_read",
+	models.WritebackStarred:  "is_starred",
+	models.WritebackArchived: "is_archived",
+}
+
+// pendingWriteback is true inside an UPDATE of emails while a change to the
+// given field is waiting to be written back. Sync keeps the local value of
+// such fields so it does not undo the user's change.
+func pendingWriteback(field string) string {
+	return `EXISTS (
+		SELECT 1 FROM email_writebacks w
+		WHERE w.email_id = emails.id AND w.field = '` + field + `' AND w.status IN ('pending', 'applying')
+	)`
+}
+
+// EmailChanges is a state change requested by the user. Nil fields are
+// left unchanged.
+type EmailChanges struct {
+	IsRead     *bool
+	IsStarred  *bool
+	IsArchived *bool
+}
+
+// WritebackRepository handles provider write-back queue operations
+type WritebackRepository struct {
+	db *sqlx.DB
+}
+
+// NewWritebackRepository creates a new write-back repository
+func NewWritebackRepository(db *sqlx.DB) *WritebackRepository {
+	return &WritebackRepository{db: db}
+}
+
+// Update applies changes to the given emails of the user and queues them
+// for write-back. Emails that are not the user's, or are deleted, are
+// skipped. It returns the IDs of the emails that were found.
+func (r *WritebackRepository) Update(userID uuid.UUID, ids []uuid.UUID, changes *EmailChanges) ([]uuid.UUID, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	owned, err := lockOwnedEmails(tx, userID, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for field, value := range map[string]*bool{
+		models.WritebackRead:     changes.IsRead,
+		models.WritebackStarred:  changes.IsStarred,
+		models.WritebackArchived: changes.IsArchived,
+	} {
+		if value == nil || len(owned) == 0 {
+			continue
+		}
+
+		column := writebackColumns[field]
+		query := `
+			WITH changed AS (
+				UPDATE emails SET ` + column + ` = $2
+				WHERE id = ANY($1::uuid[]) AND ` + column + ` IS DISTINCT FROM $2
+				RETURNING id, account_id
+			)
+			INSERT INTO email_writebacks (email_id, account_id, field, value)
+			SELECT id, account_id, $3, $2 FROM changed
+			ON CONFLICT (email_id, field) WHERE status = 'pending' DO UPDATE SET
+				value = EXCLUDED.value, attempts = 0, next_attempt_at = NOW(), last_error = NULL
+		`
+		if _, err := tx.Exec(query, uuidArray(owned), *value, field); err != nil {
+			return nil, fmt.Errorf("failed to update emails: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit email update: %w", err)
+	}
+
+	return owned, nil
+}
+
+// Delete hides the given emails of the user and queues their deletion on
+// the provider. Pending changes to other fields of those emails are
+// dropped. It returns the IDs of the emails that were found.
+func (r *WritebackRepository) Delete(userID uuid.UUID, ids []uuid.UUID) ([]uuid.UUID, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	owned, err := lockOwnedEmails(tx, userID, ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(owned) == 0 {
+		return owned, nil
+	}
+
+	_, err = tx.Exec(`DELETE FROM email_writebacks WHERE email_id = ANY($1::uuid[]) AND status = 'pending'`, uuidArray(owned))
+	if err != nil {
+		return nil, fmt.Errorf("failed to drop pending changes: %w", err)
+	}
+
+	query := `
+		WITH deleted AS (
+			UPDATE emails SET deleted_at = NOW()
+			WHERE id = ANY($1::uuid[])
+			RETURNING id, account_id
+		)
+		INSERT INTO email_writebacks (email_id, account_id, field, value)
+		SELECT id, account_id, $2, true FROM deleted
+	`
+	if _, err := tx.Exec(query, uuidArray(owned), models.WritebackDeleted); err != nil {
+		return nil, fmt.Errorf("failed to delete emails: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit email deletion: %w", err)
+	}
+
+	return owned, nil
+}
+
+// lockOwnedEmails returns which of ids are undeleted emails of the user and
+// locks them for the rest of the transaction
+func lockOwnedEmails(tx *sqlx.Tx, userID uuid.UUID, ids []uuid.UUID) ([]uuid.UUID, error) {
+	owned := []uuid.UUID{}
+	query := `
+		SELECT e.id FROM emails e
+		JOIN email_accounts a ON a.id = e.account_id
+		WHERE e.id = ANY($2::uuid[]) AND a.user_id = $1 AND e.deleted_at IS NULL
+		ORDER BY e.id
+		FOR UPDATE OF e
+	`
+
+	if err := tx.Select(&owned, query, userID, uuidArray(ids)); err != nil {
+		return nil, fmt.Errorf("failed to lock emails: %w", err)
+	}
+
+	return owned, nil
+}
+
+// ClaimDue leases up to limit due changes to the caller, oldest first.
+// Changes whose previous lease expired are claimed again, unless the user
+// changed the field since; the stale change is then dropped. A pending
+// change waits while an earlier change to the same field is being applied,
+// so the provider sees a field's changes in order.
+func (r *WritebackRepository) ClaimDue(limit int, lease time.Duration) ([]models.EmailWriteback, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM email_writebacks w
+		WHERE w.status = 'applying' AND w.locked_until < NOW() AND EXISTS (
+			SELECT 1 FROM email_writebacks newer
+			WHERE newer.email_id = w.email_id AND newer.field = w.field AND newer.status = 'pending'
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to drop superseded write-backs: %w", err)
+	}
+
+	changes := []models.EmailWriteback{}
+	query := `
+		UPDATE email_writebacks SET status = 'applying', locked_until = $1, attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM email_writebacks w
+			WHERE (w.status = 'pending' AND w.next_attempt_at <= NOW() AND NOT EXISTS (
+					SELECT 1 FROM email_writebacks earlier
+					WHERE earlier.email_id = w.email_id AND earlier.field = w.field AND earlier.status = 'applying'
+				))
+			   OR (w.status = 'applying' AND w.locked_until < NOW())
+			ORDER BY created_at ASC
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *
+	`
+
+	if err := tx.Select(&changes, query, time.Now().Add(lease), limit); err != nil {
+		return nil, fmt.Errorf("failed to claim email write-backs: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit email write-back claim: %w", err)
+	}
+
+	return changes, nil
+}
+
+// Complete removes an applied change
+func (r *WritebackRepository) Complete(change *models.EmailWriteback) error {
+	if _, err := r.db.Exec(`DELETE FROM email_writebacks WHERE id = $1`, change.ID); err != nil {
+		return fmt.Errorf("failed to complete email write-back: %w", err)
+	}
+	return nil
+}
+
+// MarkRetry records a failed attempt and schedules the next one. If the
+// user changed the field again meanwhile, the newer change supersedes this
+// one and it is dropped.
+func (r *WritebackRepository) MarkRetry(change *models.EmailWriteback, attemptErr string, nextAttemptAt time.Time) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		DELETE FROM email_writebacks
+		WHERE id = $1 AND EXISTS (
+			SELECT 1 FROM email_writebacks newer
+			WHERE newer.email_id = $2 AND newer.field = $3 AND newer.status = 'pending'
+		)
+	`, change.ID, change.EmailID, change.Field)
+	if err != nil {
+		return fmt.Errorf("failed to drop superseded write-back: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		_, err = tx.Exec(`
+			UPDATE email_writebacks SET status = 'pending', locked_until = NULL, last_error = $2, next_attempt_at = $3
+			WHERE id = $1
+		`, change.ID, attemptErr, nextAttemptAt)
+		if err != nil {
+			return fmt.Errorf("failed to schedule email write-back retry: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit email write-back retry: %w", err)
+	}
+
+	return nil
+}
+
+// MarkFailed gives up on a change. The email keeps its local state until
+// the next sync reports the provider's.
+func (r *WritebackRepository) MarkFailed(change *models.EmailWriteback, attemptErr string) error {
+	query := `
+		UPDATE email_writebacks SET status = 'failed', locked_until = NULL, last_error = $2
+		WHERE id = $1
+	`
+
+	if _, err := r.db.Exec(query, change.ID, attemptErr); err != nil {
+		return fmt.Errorf("failed to mark email write-back failed: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteFailed removes changes that were given up on longer than olderThan
+// ago and returns how many there were
+func (r *WritebackRepository) DeleteFailed(olderThan time.Duration) (int64, error) {
+	query := `DELETE FROM email_writebacks WHERE status = 'failed' AND updated_at < NOW() - make_interval(secs => $1)`
+
+	result, err := r.db.Exec(query, olderThan.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete failed email write-backs: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func uuidArray(ids []uuid.UUID) pq.StringArray {
+	array := make(pq.StringArray, len(ids))
+	for i, id := range ids {
+		array[i] = id.String()
+	}
+	return array
+}
@@ -0,0 +1,101 @@
+package repository_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+)
+
+func TestWritebackClaimsFieldChangesInOrder(t *testing.T) {
+	db := testdb.Open(t)
+	account := newTestAccount(t, db)
+	email := &models.Email{AccountID: account.ID, ExternalID: "INBOX:1:1", FromAddress: "kid@example.com", ReceivedAt: time.Now()}
+	if err := repository.NewEmailRepository(db).Upsert(email); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	repo := repository.NewWritebackRepository(db)
+	ids := []uuid.UUID{email.ID}
+	yes, no := true, false
+
+	claim := func(lease time.Duration) []models.EmailWriteback {
+		t.Helper()
+		changes, err := repo.ClaimDue(10, lease)
+		if err != nil {
+			t.Fatalf("ClaimDue: %v", err)
+		}
+		return changes
+	}
+	update := func(changes *repository.EmailChanges) {
+		t.Helper()
+		if _, err := repo.Update(account.UserID, ids, changes); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+	}
+
+	t.Run("expired claim superseded", func(t *testing.T) {
+		// Read, and the worker applying it stalls past its lease
+		update(&repository.EmailChanges{IsRead: &yes})
+		if stale := claim(-time.Second); len(stale) != 1 {
+			t.Fatalf("claimed %d changes, want 1", len(stale))
+		}
+		// Unread again before the stale change was retried
+		update(&repository.EmailChanges{IsRead: &no})
+
+		changes := claim(time.Minute)
+		if len(changes) != 1 || changes[0].Value {
+			t.Fatalf("claimed %+v, want only the unread change", changes)
+		}
+		var left int
+		if err := db.Get(&left, `SELECT COUNT(*) FROM email_writebacks WHERE field = $1`, models.WritebackRead); err != nil || left != 1 {
+			t.Errorf("%d read write-backs left, %v; want the stale one dropped", left, err)
+		}
+		if err := repo.Complete(&changes[0]); err != nil {
+			t.Fatalf("Complete: %v", err)
+		}
+	})
+
+	t.Run("pending waits for applying", func(t *testing.T) {
+		update(&repository.EmailChanges{IsStarred: &yes})
+		applying := claim(time.Minute)
+		if len(applying) != 1 {
+			t.Fatalf("claimed %d changes, want 1", len(applying))
+		}
+		update(&repository.EmailChanges{IsStarred: &no})
+
+		if changes := claim(time.Minute); len(changes) != 0 {
+			t.Fatalf("claimed %+v while the earlier star change was being applied", changes)
+		}
+		if err := repo.Complete(&applying[0]); err != nil {
+			t.Fatalf("Complete: %v", err)
+		}
+		changes := claim(time.Minute)
+		if len(changes) != 1 || changes[0].Field != models.WritebackStarred || changes[0].Value {
+			t.Fatalf("claimed %+v, want the unstar change", changes)
+		}
+
+		if err := repo.MarkFailed(&changes[0], "mailbox is read-only"); err != nil {
+			t.Fatalf("MarkFailed: %v", err)
+		}
+	})
+
+	t.Run("failed changes pruned", func(t *testing.T) {
+		if n, err := repo.DeleteFailed(time.Hour); err != nil || n != 0 {
+			t.Errorf("DeleteFailed of a recent failure = %d, %v; want 0", n, err)
+		}
+		for _, stmt := range []string{
+			`ALTER TABLE email_writebacks DISABLE TRIGGER update_email_writebacks_updated_at`,
+			`UPDATE email_writebacks SET updated_at = NOW() - interval '2 hours'`,
+		} {
+			if _, err := db.Exec(stmt); err != nil {
+				t.Fatalf("age failures: %v", err)
+			}
+		}
+		if n, err := repo.DeleteFailed(time.Hour); err != nil || n != 1 {
+			t.Errorf("DeleteFailed = %d, %v; want 1", n, err)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+// Package sanitize makes untrusted email HTML safe to render.
+package sanitize
+
+import (
+	"sync"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+var (
+	policyOnce sync.Once
+	policy     *bluemonday.Policy
+)
+
+// HTML removes scripts, forms, event handlers and anything else that could
+// run code or submit data, keeping the formatting emails commonly use.
+// Inline images referenced as cid: URLs are kept.
+func HTML(html string) string {
+	policyOnce.Do(func() {
+		policy = newPolicy()
+	})
+	return policy.Sanitize(html)
+}
+
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+
+	p.AllowURLSchemes("http", "https", "mailto", "cid")
+	p.RequireNoFollowOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+
+	// Layout attributes of table based email templates
+	p.AllowAttrs("align", "valign", "width", "height", "bgcolor").
+		OnElements("table", "thead", "tbody", "tfoot", "tr", "td", "th", "div", "p", "img", "center")
+	p.AllowAttrs("border", "cellpadding", "cellspacing").OnElements("table")
+	p.AllowElements("center", "font")
+	p.AllowAttrs("color", "face", "size").OnElements("font")
+
+	// Inline styles, limited to properties that cannot load content
+	p.AllowStyles(
+		"color", "background-color", "font", "font-family", "font-size", "font-style", "font-weight",
+		"line-height", "text-align", "text-decoration", "text-transform", "vertical-align", "white-space",
+		"margin", "margin-top", "margin-right", "margin-bottom", "margin-left",
+		"padding", "padding-top", "padding-right", "padding-bottom", "padding-left",
+		"border", "border-top", "border-right", "border-bottom", "border-left",
+		"border-color", "border-style", "border-width", "border-collapse", "border-radius",
+		"width", "max-width", "min-width", "height", "max-height", "min-height", "display",
+	).Globally()
+
+	return p
+}
@@ -0,0 +1,163 @@
+package sanitize
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// BlockedImageSrc replaces the source of blocked remote images. It is an
+// inline grey placeholder so that showing it loads nothing.
+const BlockedImageSrc = "data:image/svg+xml,%3Csvg%20xmlns%3D%22http%3A%2F%2Fwww.w3.org%2F2000%2Fsvg%22%20width%3D%2224%22%20height%3D%2224%22%3E%3Crect%20width%3D%2224%22%20height%3D%2224%22%20fill%3D%22%23e0e0e0%22%2F%3E%3C%2Fsvg%3E"
+
+// ImageOptions controls how Images treats remote images
+type ImageOptions struct {
+	// AllowRemote shows remote images through Proxy instead of blocking them
+	AllowRemote bool
+	// Proxy returns the proxied URL of a remote image, or "" to block it
+	Proxy func(src string) string
+}
+
+// ImageReport counts what Images changed
+type ImageReport struct {
+	Blocked         int `json:"blocked"`          // remote images replaced by a placeholder
+	TrackersRemoved int `json:"trackers_removed"` // tracking pixels removed
+}
+
+// Images rewrites the images of HTML that HTML already sanitized. Remote
+// images are never loaded directly: they are either proxied or replaced by
+// a placeholder marked with data-blocked-image. Tracking pixels, tiny or
+// hidden remote images, are removed. Inline cid: images are kept.
+func Images(sanitized string, opts ImageOptions) (string, ImageReport) {
+	var report ImageReport
+	var out strings.Builder
+
+	z := html.NewTokenizer(strings.NewReader(sanitized))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			out.Write(z.Raw())
+			continue
+		}
+		token := z.Token()
+		if token.Data != "img" {
+			out.Write(z.Raw())
+			continue
+		}
+
+		src := strings.TrimSpace(attr(token, "src"))
+		if !isRemote(src) {
+			out.WriteString(token.String())
+			continue
+		}
+
+		if isTrackingPixel(token) {
+			report.TrackersRemoved++
+			continue
+		}
+
+		proxied := ""
+		if opts.AllowRemote && opts.Proxy != nil {
+			if strings.HasPrefix(src, "//") {
+				src = "https:" + src
+			}
+			proxied = opts.Proxy(src)
+		}
+		if proxied != "" {
+			token.Attr = withAttr(token.Attr, "src", proxied)
+		} else {
+			report.Blocked++
+			token.Attr = withAttr(token.Attr, "src", BlockedImageSrc)
+			token.Attr = append(token.Attr, html.Attribute{Key: "data-blocked-image", Val: "true"})
+		}
+		token.Attr = withoutAttr(token.Attr, "srcset")
+		out.WriteString(token.String())
+	}
+
+	return out.String(), report
+}
+
+func isRemote(src string) bool {
+	u, err := url.Parse(src)
+	if err != nil {
+		// Unparseable sources are blocked rather than passed through
+		return src != ""
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "cid", "data":
+		return false
+	case "":
+		// Protocol relative URLs load from the network too
+		return strings.HasPrefix(src, "//")
+	}
+	return true
+}
+
+// isTrackingPixel reports whether an image is too small or hidden to be
+// meant for the reader
+func isTrackingPixel(token html.Token) bool {
+	if tiny(attr(token, "width")) || tiny(attr(token, "height")) {
+		return true
+	}
+
+	for _, decl := range strings.Split(attr(token, "style"), ";") {
+		name, value, ok := strings.Cut(decl, ":")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.ToLower(strings.TrimSpace(value))
+		switch {
+		case name == "display" && value == "none",
+			name == "visibility" && value == "hidden",
+			(name == "width" || name == "height" || name == "max-width" || name == "max-height") && tiny(value):
+			return true
+		}
+	}
+	return false
+}
+
+// tiny reports whether a dimension is at most one pixel
+func tiny(value string) bool {
+	value = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "px")
+	if value == "" {
+		return false
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	return err == nil && n <= 1
+}
+
+func attr(token html.Token, key string) string {
+	for _, a := range token.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func withAttr(attrs []html.Attribute, key, val string) []html.Attribute {
+	for i := range attrs {
+		if attrs[i].Key == key {
+			attrs[i].Val = val
+			return attrs
+		}
+	}
+	return append(attrs, html.Attribute{Key: key, Val: val})
+}
+
+func withoutAttr(attrs []html.Attribute, key string) []html.Attribute {
+	kept := attrs[:0]
+	for _, a := range attrs {
+		if a.Key != key {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,115 @@
+package sanitize
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// proxy stands in for the image proxy, which only signs http and https URLs
+func proxy(src string) string {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return ""
+	}
+	return "/api/v1/images/proxy?url=" + url.QueryEscape(src)
+}
+
+func TestImages(t *testing.T) {
+	const (
+		blockedSrc  = `src="` + BlockedImageSrc + `"`
+		blockedMark = `data-blocked-image="true"`
+	)
+
+	tests := []struct {
+		name        string
+		in          string
+		allow       bool
+		want        []string // substrings of the output
+		notWant     []string
+		blocked     int
+		trackersOut int
+	}{
+		{
+			name:    "blocked by default",
+			in:      `<p>Hi</p><img src="https://cdn.example.com/kids.jpg" alt="Kids">`,
+			want:    []string{`<p>Hi</p>`, blockedSrc, blockedMark, `alt="Kids"`},
+			notWant: []string{"cdn.example.com"},
+			blocked: 1,
+		},
+		{
+			name:    "srcset dropped when blocked",
+			in:      `<img src="https://cdn.example.com/a.jpg" srcset="https://cdn.example.com/a2.jpg 2x">`,
+			want:    []string{blockedSrc, blockedMark},
+			notWant: []string{"srcset", "cdn.example.com"},
+			blocked: 1,
+		},
+		{
+			name:    "protocol relative is remote",
+			in:      `<img src="//cdn.example.com/a.jpg">`,
+			want:    []string{blockedSrc, blockedMark},
+			blocked: 1,
+		},
+		{
+			name:    "allowed images go through the proxy",
+			in:      `<img src="https://cdn.example.com/kids.jpg" srcset="https://cdn.example.com/kids2.jpg 2x">`,
+			allow:   true,
+			want:    []string{`src="/api/v1/images/proxy?url=https%3A%2F%2Fcdn.example.com%2Fkids.jpg"`},
+			notWant: []string{"srcset", "data-blocked-image"},
+		},
+		{
+			name:  "protocol relative is proxied over https",
+			in:    `<img src="//cdn.example.com/a.jpg">`,
+			allow: true,
+			want:  []string{`src="/api/v1/images/proxy?url=https%3A%2F%2Fcdn.example.com%2Fa.jpg"`},
+		},
+		{
+			name:    "blocked when the proxy refuses",
+			in:      `<img src="ftp://files.example.com/a.jpg">`,
+			allow:   true,
+			want:    []string{blockedSrc, blockedMark},
+			notWant: []string{"ftp:"},
+			blocked: 1,
+		},
+		{
+			name:        "tracking pixels are removed",
+			in:          `<img src="https://t.example.com/o.gif" width="1" height="1"><img src="https://t.example.com/p.gif" style="display: none">`,
+			allow:       true,
+			notWant:     []string{"<img", "t.example.com"},
+			trackersOut: 2,
+		},
+		{
+			name:    "inline images are kept",
+			in:      `<img src="cid:photo@example.com"><img src="data:image/png;base64,iVBORw0KGgo=">`,
+			want:    []string{`src="cid:photo@example.com"`, `src="data:image/png;base64,iVBORw0KGgo="`},
+			notWant: []string{"data-blocked-image"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, report := Images(tt.in, ImageOptions{AllowRemote: tt.allow, Proxy: proxy})
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("output lacks %s:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(got, notWant) {
+					t.Errorf("output contains %s:\n%s", notWant, got)
+				}
+			}
+			if report.Blocked != tt.blocked || report.TrackersRemoved != tt.trackersOut {
+				t.Errorf("report = %+v, want %d blocked and %d trackers removed", report, tt.blocked, tt.trackersOut)
+			}
+		})
+	}
+}
+
+func TestImagesAfterHTML(t *testing.T) {
+	// Images runs on the output of HTML, which must keep remote sources for
+	// Images to block or proxy them
+	got, report := Images(HTML(`<div><img src="https://cdn.example.com/kids.jpg"></div>`), ImageOptions{Proxy: proxy})
+	if report.Blocked != 1 || strings.Contains(got, "cdn.example.com") {
+		t.Errorf("Images(HTML(...)) = %s, %+v", got, report)
+	}
+}
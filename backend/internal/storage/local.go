@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalURLPrefix is the API path under which temporary URLs of the local
+// store are served
+const LocalURLPrefix = "/api/v1/blobs/"
+
+// ErrInvalidSignature is returned for temporary URLs that were tampered
+// with or have expired
+var ErrInvalidSignature = errors.New("invalid or expired blob URL")
+
+var _ BlobStore = (*LocalStore)(nil)
+
+// LocalStore keeps objects as files below a directory. Temporary URLs
+// point at the API, which checks their HMAC signature and serves the file.
+type LocalStore struct {
+	root      string
+	publicURL string
+	secret    []byte
+}
+
+// NewLocalStore creates a store rooted at dir. publicURL is the base URL
+// of the API used in temporary URLs; empty yields relative URLs.
+func NewLocalStore(dir, publicURL string, secret []byte) (*LocalStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("local storage path is required")
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("local storage URL secret is required")
+	}
+
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve storage path: %w", err)
+	}
+
+	return &LocalStore{
+		root:      root,
+		publicURL: strings.TrimRight(publicURL, "/"),
+		secret:    secret,
+	}, nil
+}
+
+// Init creates the storage directory if it does not exist
+func (s *LocalStore) Init(ctx context.Context) error {
+	if err := os.MkdirAll(s.root, 0o700); err != nil {
+		return fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return nil
+}
+
+// Put stores data under key, replacing any existing object
+func (s *LocalStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	return s.PutStream(ctx, key, bytes.NewReader(data), int64(len(data)), contentType)
+}
+
+// PutStream stores size bytes read from r under key, replacing any existing
+// object. The file is written in full before it becomes visible under its
+// name.
+func (s *LocalStore) PutStream(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return fmt.Errorf("failed to put object: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to put object: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, io.LimitReader(r, size))
+	if err == nil && written != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to put object: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to put object: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return fmt.Errorf("failed to put object: %w", err)
+	}
+
+	return nil
+}
+
+// Get reads the object stored under key
+func (s *LocalStore) Get(ctx context.Context, key string) ([]byte, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object: %w", err)
+	}
+
+	return data, nil
+}
+
+// Open streams the object stored under key and returns its size
+func (s *LocalStore) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open object: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	return f, info.Size(), nil
+}
+
+// Exists reports whether an object is stored under key
+func (s *LocalStore) Exists(ctx context.Context, key string) (bool, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	return true, nil
+}
+
+// Delete removes the object stored under key. Deleting a missing object is
+// not an error.
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+
+	return nil
+}
+
+// URL returns a signed URL under LocalURLPrefix that the API serves until
+// ttl has passed
+func (s *LocalStore) URL(ctx context.Context, key string, ttl time.Duration, opts URLOptions) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	query := url.Values{"expires": {expires}}
+	if opts.ContentType != "" {
+		query.Set("content_type", opts.ContentType)
+	}
+	if opts.ContentDisposition != "" {
+		query.Set("content_disposition", opts.ContentDisposition)
+	}
+	query.Set("signature", s.sign(key, query))
+
+	return s.publicURL + LocalURLPrefix + escapeKey(key) + "?" + query.Encode(), nil
+}
+
+// VerifyURL checks the signature and expiry of a temporary URL for key and
+// returns the response headers it was issued with
+func (s *LocalStore) VerifyURL(key string, query url.Values) (URLOptions, error) {
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get("signature"))
+	if err != nil {
+		return URLOptions{}, ErrInvalidSignature
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(s.sign(key, query))
+	if !hmac.Equal(signature, expected) {
+		return URLOptions{}, ErrInvalidSignature
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return URLOptions{}, ErrInvalidSignature
+	}
+
+	return URLOptions{
+		ContentType:        query.Get("content_type"),
+		ContentDisposition: query.Get("content_disposition"),
+	}, nil
+}
+
+// sign computes the signature of a temporary URL over the key and every
+// parameter that affects the response
+func (s *LocalStore) sign(key string, query url.Values) string {
+	mac := hmac.New(sha256.New, s.secret)
+	for _, part := range []string{key, query.Get("expires"), query.Get("content_type"), query.Get("content_disposition")} {
+		mac.Write([]byte(strconv.Itoa(len(part))))
+		mac.Write([]byte{':'})
+		mac.Write([]byte(part))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// path maps a key onto a file below the root, rejecting keys that would
+// escape it
+func (s *LocalStore) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if key == "" || clean != "/"+key || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return "", fmt.Errorf("invalid object key %q", key)
+		}
+	}
+
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// escapeKey escapes each segment of a key for use in a URL path
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *LocalStore {
+	t.Helper()
+	s, err := NewLocalStore(t.TempDir(), "https://dadmail.example", []byte("secret"))
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	return s
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	parent := t.TempDir()
+	s, err := NewLocalStore(filepath.Join(parent, "blobs"), "", []byte("secret"))
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	ctx := context.Background()
+	if err := s.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	keys := []string{
+		"",
+		"../outside",
+		"a/../../outside",
+		"a/../b",
+		"/absolute",
+		"a//b",
+		"a/",
+		"./a",
+		"a/.hidden",
+		`a\..\..\outside`,
+	}
+	for _, key := range keys {
+		t.Run(key, func(t *testing.T) {
+			if err := s.Put(ctx, key, []byte("x"), "text/plain"); err == nil {
+				t.Errorf("Put accepted key %q", key)
+			}
+			if _, err := s.Get(ctx, key); err == nil || errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(%q) error = %v, want invalid key", key, err)
+			}
+			if _, err := s.Exists(ctx, key); err == nil {
+				t.Errorf("Exists accepted key %q", key)
+			}
+			if err := s.Delete(ctx, key); err == nil {
+				t.Errorf("Delete accepted key %q", key)
+			}
+			if _, err := s.URL(ctx, key, time.Minute, URLOptions{}); err == nil {
+				t.Errorf("URL accepted key %q", key)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(parent, "outside")); !os.IsNotExist(err) {
+		t.Errorf("a file was written outside the store: %v", err)
+	}
+}
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	key := "attachments/2026/photo 1.png"
+
+	if err := s.Put(ctx, key, []byte("png"), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	data, err := s.Get(ctx, key)
+	if err != nil || string(data) != "png" {
+		t.Fatalf("Get = %q, %v", data, err)
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete error = %v, want ErrNotFound", err)
+	}
+}
+
+// signedURL issues a URL for key and splits it into the key it serves and
+// its query
+func signedURL(t *testing.T, s *LocalStore, key string, ttl time.Duration, opts URLOptions) (string, url.Values) {
+	t.Helper()
+	raw, err := s.URL(context.Background(), key, ttl, opts)
+	if err != nil {
+		t.Fatalf("URL: %v", err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("URL returned %q: %v", raw, err)
+	}
+	if !strings.HasPrefix(u.Path, LocalURLPrefix) {
+		t.Fatalf("URL path %q is not under %s", u.Path, LocalURLPrefix)
+	}
+	return strings.TrimPrefix(u.Path, LocalURLPrefix), u.Query()
+}
+
+func TestLocalStoreVerifyURL(t *testing.T) {
+	s := newTestStore(t)
+	opts := URLOptions{ContentType: "application/pdf", ContentDisposition: `attachment; filename="letter.pdf"`}
+
+	key, query := signedURL(t, s, "attachments/letter 1.pdf", time.Minute, opts)
+	if key != "attachments/letter 1.pdf" {
+		t.Fatalf("URL serves key %q", key)
+	}
+	got, err := s.VerifyURL(key, query)
+	if err != nil {
+		t.Fatalf("VerifyURL: %v", err)
+	}
+	if got != opts {
+		t.Errorf("VerifyURL = %+v, want %+v", got, opts)
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		tamper func(q url.Values)
+	}{
+		{"other key", "attachments/other.pdf", func(q url.Values) {}},
+		{"later expiry", key, func(q url.Values) {
+			q.Set("expires", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		}},
+		{"content type", key, func(q url.Values) { q.Set("content_type", "text/html") }},
+		{"content disposition dropped", key, func(q url.Values) { q.Del("content_disposition") }},
+		{"signature", key, func(q url.Values) { q.Set("signature", strings.Repeat("A", 43)) }},
+		{"malformed signature", key, func(q url.Values) { q.Set("signature", "not base64!") }},
+		{"no signature", key, func(q url.Values) { q.Del("signature") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{}
+			for k, v := range query {
+				q[k] = append([]string(nil), v...)
+			}
+			tt.tamper(q)
+			if _, err := s.VerifyURL(tt.key, q); !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("VerifyURL error = %v, want ErrInvalidSignature", err)
+			}
+		})
+	}
+
+	t.Run("other secret", func(t *testing.T) {
+		other, err := NewLocalStore(t.TempDir(), "", []byte("other secret"))
+		if err != nil {
+			t.Fatalf("NewLocalStore: %v", err)
+		}
+		if _, err := other.VerifyURL(key, query); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("VerifyURL error = %v, want ErrInvalidSignature", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		key, query := signedURL(t, s, "attachments/letter.pdf", -time.Minute, URLOptions{})
+		if _, err := s.VerifyURL(key, query); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("VerifyURL error = %v, want ErrInvalidSignature", err)
+		}
+	})
+}
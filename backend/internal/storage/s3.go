@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/jay/dadmail/internal/config"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ErrNotFound is returned when an object does not exist
+var ErrNotFound = errors.New("object not found")
+
+var _ BlobStore = (*S3Store)(nil)
+
+// S3Store reads and writes objects in one bucket of an S3-compatible store
+// such as MinIO
+type S3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3Store creates a store for the configured bucket. No connection is
+// made until the first request.
+func NewS3Store(cfg *config.StorageConfig) (*S3Store, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	return &S3Store{client: client, bucket: cfg.Bucket}, nil
+}
+
+// Init creates the bucket if it does not exist
+func (s *S3Store) Init(ctx context.Context) error {
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return fmt.Errorf("failed to check bucket: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	if err := s.client.MakeBucket(ctx, s.bucket, minio.MakeBucketOptions{}); err != nil {
+		return fmt.Errorf("failed to create bucket: %w", err)
+	}
+
+	return nil
+}
+
+// Put stores data under key, replacing any existing object
+func (s *S3Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	return s.PutStream(ctx, key, bytes.NewReader(data), int64(len(data)), contentType)
+}
+
+// PutStream stores size bytes read from r under key, replacing any existing
+// object. Large objects are uploaded in parts.
+func (s *S3Store) PutStream(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put object: %w", err)
+	}
+
+	return nil
+}
+
+// Get reads the object stored under key
+func (s *S3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	defer obj.Close()
+
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read object: %w", err)
+	}
+
+	return data, nil
+}
+
+// Open streams the object stored under key and returns its size. The
+// caller must close the reader.
+func (s *S3Store) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get object: %w", err)
+	}
+
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, 0, ErrNotFound
+		}
+		return nil, 0, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	return obj, info.Size, nil
+}
+
+// Exists reports whether an object is stored under key
+func (s *S3Store) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	return true, nil
+}
+
+// Delete removes the object stored under key. Deleting a missing object is
+// not an error.
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+
+	return nil
+}
+
+// URL returns a presigned GET URL for the object stored under key
+func (s *S3Store) URL(ctx context.Context, key string, ttl time.Duration, opts URLOptions) (string, error) {
+	params := url.Values{}
+	if opts.ContentType != "" {
+		params.Set("response-content-type", opts.ContentType)
+	}
+	if opts.ContentDisposition != "" {
+		params.Set("response-content-disposition", opts.ContentDisposition)
+	}
+
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, key, ttl, params)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign object URL: %w", err)
+	}
+
+	return u.String(), nil
+}
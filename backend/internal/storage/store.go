@@ -0,0 +1,61 @@
+// Package storage stores objects such as cached message bodies and
+// attachments, either in S3-compatible object storage or on local disk.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jay/dadmail/internal/config"
+)
+
+// Storage backends selectable with STORAGE_BACKEND
+const (
+	BackendS3    = "s3"
+	BackendLocal = "local"
+)
+
+// BlobStore stores objects by key. Implementations behave identically, so
+// features built on it work the same against MinIO and on a laptop.
+type BlobStore interface {
+	// Init prepares the store, creating the bucket or directory if needed
+	Init(ctx context.Context) error
+	// Put stores data under key, replacing any existing object
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// PutStream stores size bytes read from r under key, replacing any
+	// existing object, for objects too large to hold in memory
+	PutStream(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get reads the object stored under key, or returns ErrNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Open streams the object stored under key and returns its size, or
+	// returns ErrNotFound. The caller must close the reader.
+	Open(ctx context.Context, key string) (io.ReadCloser, int64, error)
+	// Exists reports whether an object is stored under key
+	Exists(ctx context.Context, key string) (bool, error)
+	// Delete removes the object stored under key. Deleting a missing object
+	// is not an error.
+	Delete(ctx context.Context, key string) error
+	// URL returns a temporary URL that downloads the object without further
+	// authentication until ttl has passed
+	URL(ctx context.Context, key string, ttl time.Duration, opts URLOptions) (string, error)
+}
+
+// URLOptions sets the response headers of a temporary URL
+type URLOptions struct {
+	ContentType        string
+	ContentDisposition string
+}
+
+// New creates the blob store selected by the configuration
+func New(cfg *config.StorageConfig) (BlobStore, error) {
+	switch cfg.Backend {
+	case BackendS3:
+		return NewS3Store(cfg)
+	case BackendLocal:
+		return NewLocalStore(cfg.LocalPath, cfg.PublicURL, []byte(cfg.URLSecret))
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
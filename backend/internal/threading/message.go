@@ -0,0 +1,88 @@
+// Package threading groups messages into conversations by Message-ID,
+// In-Reply-To and References, in the manner of Jamie Zawinski's algorithm,
+// for providers that have no thread IDs of their own.
+package threading
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SubjectWindow bounds how far apart in time two messages without
+// references may be and still be grouped by subject
+const SubjectWindow = 30 * 24 * time.Hour
+
+// replyPrefix matches one reply or forward marker at the start of a
+// subject, including localized ones and counters such as "Re[2]:"
+var replyPrefix = regexp.MustCompile(`(?i)^\s*(re|fwd?|aw|wg|sv|vs|antw|rif|r|tr|enc)(\[\d+\]|\(\d+\))?\s*:\s*`)
+
+// listTag matches a mailing list tag such as "[users]" before the subject
+var listTag = regexp.MustCompile(`^\s*\[[^\]]*\]\s*`)
+
+// Message is the threading information of one message
+type Message struct {
+	MessageID  string
+	References []string // ancestors, oldest first
+	SubjectKey string
+	IsReply    bool
+	ReceivedAt time.Time
+}
+
+// NewMessage builds the threading information of a message from its
+// headers. References take precedence; In-Reply-To names the parent when
+// it is not already the last reference.
+func NewMessage(messageID, inReplyTo string, references []string, subject string, receivedAt time.Time) *Message {
+	m := &Message{
+		MessageID:  strings.TrimSpace(messageID),
+		ReceivedAt: receivedAt,
+	}
+	m.SubjectKey, m.IsReply = SubjectKey(subject)
+
+	seen := map[string]bool{m.MessageID: true}
+	add := func(id string) {
+		id = strings.TrimSpace(id)
+		if id != "" && !seen[id] {
+			seen[id] = true
+			m.References = append(m.References, id)
+		}
+	}
+	for _, id := range references {
+		add(id)
+	}
+	if len(m.References) == 0 || m.References[len(m.References)-1] != inReplyTo {
+		add(inReplyTo)
+	}
+
+	return m
+}
+
+// SubjectKey normalizes a subject for grouping: reply and forward markers
+// and list tags are removed, whitespace is collapsed and case folded.
+// isReply reports whether any marker was removed.
+func SubjectKey(subject string) (key string, isReply bool) {
+	s := subject
+	for {
+		if loc := replyPrefix.FindStringIndex(s); loc != nil {
+			s = s[loc[1]:]
+			isReply = true
+			continue
+		}
+		if loc := listTag.FindStringIndex(s); loc != nil && loc[1] < len(s) {
+			s = s[loc[1]:]
+			continue
+		}
+		break
+	}
+
+	return strings.ToLower(strings.Join(strings.Fields(s), " ")), isReply
+}
+
+// Key derives a thread key from the Message-ID of the thread's first
+// known message. Keys fit emails.thread_id whatever the ID's length.
+func Key(messageID string) string {
+	sum := sha256.Sum256([]byte(messageID))
+	return hex.EncodeToString(sum[:16])
+}
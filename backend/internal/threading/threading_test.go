@@ -0,0 +1,109 @@
+package threading
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubjectKey(t *testing.T) {
+	tests := []struct {
+		subject string
+		key     string
+		isReply bool
+	}{
+		{"Lunch on Sunday", "lunch on sunday", false},
+		{"Re: Lunch on Sunday", "lunch on sunday", true},
+		{"RE: re: Fwd: Lunch on Sunday", "lunch on sunday", true},
+		{"Re[2]: Lunch on Sunday", "lunch on sunday", true},
+		{"Re(3): Lunch on Sunday", "lunch on sunday", true},
+		{"AW: WG: Lunch on Sunday", "lunch on sunday", true},
+		{"[family] Re: Lunch  on\tSunday", "lunch on sunday", true},
+		{"Re: [family] Lunch on Sunday", "lunch on sunday", true},
+		{"[family]", "[family]", false},
+		{"Recipe: apple pie", "recipe: apple pie", false},
+		{"  ", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.subject, func(t *testing.T) {
+			key, isReply := SubjectKey(tt.subject)
+			if key != tt.key || isReply != tt.isReply {
+				t.Errorf("SubjectKey(%q) = %q, %v, want %q, %v", tt.subject, key, isReply, tt.key, tt.isReply)
+			}
+		})
+	}
+}
+
+func TestNewMessageReferences(t *testing.T) {
+	tests := []struct {
+		name       string
+		messageID  string
+		inReplyTo  string
+		references []string
+		want       []string
+	}{
+		{
+			name:      "no references",
+			messageID: "<c@example.com>",
+		},
+		{
+			name:      "in-reply-to only",
+			messageID: "<c@example.com>",
+			inReplyTo: "<b@example.com>",
+			want:      []string{"<b@example.com>"},
+		},
+		{
+			name:       "references keep their order",
+			messageID:  "<c@example.com>",
+			inReplyTo:  "<b@example.com>",
+			references: []string{"<a@example.com>", "<b@example.com>"},
+			want:       []string{"<a@example.com>", "<b@example.com>"},
+		},
+		{
+			name:       "in-reply-to missing from references becomes the parent",
+			messageID:  "<d@example.com>",
+			inReplyTo:  "<c@example.com>",
+			references: []string{"<a@example.com>", "<b@example.com>"},
+			want:       []string{"<a@example.com>", "<b@example.com>", "<c@example.com>"},
+		},
+		{
+			name:       "in-reply-to earlier in references is not repeated",
+			messageID:  "<c@example.com>",
+			inReplyTo:  "<a@example.com>",
+			references: []string{"<a@example.com>", "<b@example.com>"},
+			want:       []string{"<a@example.com>", "<b@example.com>"},
+		},
+		{
+			name:       "duplicates, blanks and the message itself are dropped",
+			messageID:  " <c@example.com> ",
+			references: []string{"<a@example.com>", " ", "<a@example.com>", "<c@example.com>", " <b@example.com>"},
+			want:       []string{"<a@example.com>", "<b@example.com>"},
+		},
+	}
+
+	receivedAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMessage(tt.messageID, tt.inReplyTo, tt.references, "Re: Lunch", receivedAt)
+			if !reflect.DeepEqual(m.References, tt.want) {
+				t.Errorf("References = %q, want %q", m.References, tt.want)
+			}
+			if m.MessageID != strings.TrimSpace(tt.messageID) {
+				t.Errorf("MessageID = %q", m.MessageID)
+			}
+			if m.SubjectKey != "lunch" || !m.IsReply || !m.ReceivedAt.Equal(receivedAt) {
+				t.Errorf("message = %+v", m)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	a, b := Key("<a@example.com>"), Key("<b@example.com>")
+	if len(a) != 32 || a == b || a != Key("<a@example.com>") {
+		t.Errorf("Key = %q and %q", a, b)
+	}
+}
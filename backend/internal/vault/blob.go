@@ -0,0 +1,70 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+)
+
+// SealBlob encrypts binary data such as a cached message body with the
+// active key. label names what the data belongs to (for example
+// "email_bodies:<email id>") and must be passed again to OpenBlob. The
+// result is the envelope header "v2:<key id>:" followed by the raw nonce and
+// ciphertext.
+func (v *Vault) SealBlob(label string, plaintext []byte) ([]byte, error) {
+	aead := v.keys[v.activeID]
+	header := []byte(currentVersion + ":" + v.activeID + ":")
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	out := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, blobAssociatedData(label, v.activeID)), nil
+}
+
+// OpenBlob decrypts data produced by SealBlob with the same label
+func (v *Vault) OpenBlob(label string, sealed []byte) ([]byte, error) {
+	version, rest, ok := bytes.Cut(sealed, []byte(":"))
+	if !ok || string(version) != currentVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	keyID, rest, ok := bytes.Cut(rest, []byte(":"))
+	if !ok {
+		return nil, fmt.Errorf("malformed blob envelope")
+	}
+
+	aead, ok := v.keys[string(keyID)]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %q is not in the keyring", keyID)
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, blobAssociatedData(label, string(keyID)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt blob: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// BlobNeedsReseal reports whether data produced by SealBlob was not sealed
+// with the active key
+func (v *Vault) BlobNeedsReseal(sealed []byte) bool {
+	version, rest, ok := bytes.Cut(sealed, []byte(":"))
+	if !ok || string(version) != currentVersion {
+		return true
+	}
+	keyID, _, ok := bytes.Cut(rest, []byte(":"))
+	return !ok || string(keyID) != v.activeID
+}
+
+func blobAssociatedData(label, keyID string) []byte {
+	return []byte("dadmail:" + label + ":" + currentVersion + ":" + keyID)
+}
@@ -0,0 +1,140 @@
+package vault
+
+import (
+	"context"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jmoiron/sqlx"
+)
+
+// rotateBatchSize is the number of accounts re-sealed between progress saves
+const rotateBatchSize = 100
+
+// BlobResealer keeps mail sealed with SealBlob, such as imported messages
+// or cached bodies, and brings it onto the active key during a rotation
+type BlobResealer interface {
+	// Reseal re-seals, or drops if it can be fetched again, the account's
+	// data that is not sealed with the active key, and returns how many
+	// blobs it changed
+	Reseal(ctx context.Context, accountID uuid.UUID) (int, error)
+}
+
+// Rotator re-seals stored credentials, and the mail the resealers keep,
+// with the vault's active key
+type Rotator struct {
+	vault        *Vault
+	accountRepo  *repository.EmailAccountRepository
+	rotationRepo *repository.KeyRotationRepository
+	resealers    []BlobResealer
+}
+
+// NewRotator creates a new credential rotator
+func NewRotator(db *sqlx.DB, v *Vault, resealers ...BlobResealer) *Rotator {
+	return &Rotator{
+		vault:        v,
+		accountRepo:  repository.NewEmailAccountRepository(db),
+		rotationRepo: repository.NewKeyRotationRepository(db),
+		resealers:    resealers,
+	}
+}
+
+// Run walks email_accounts in batches and re-seals every credential, and
+// every blob of the account's mail, not yet sealed with the active key.
+// Progress is saved after each batch so an interrupted run resumes where it
+// stopped. The rotation is only marked complete once every account was
+// re-sealed; otherwise the next run starts over, and retired keys must stay
+// in the keyring until then. Making an earlier key active again starts a
+// new rotation to it.
+func (r *Rotator) Run(ctx context.Context) error {
+	keyID := r.vault.ActiveKeyID()
+	rotation, err := r.rotationRepo.Start(keyID)
+	if err != nil {
+		return err
+	}
+	if rotation.CompletedAt != nil {
+		return nil
+	}
+
+	after := uuid.Nil
+	if rotation.LastAccountID != nil {
+		after = *rotation.LastAccountID
+		log.Printf("Resuming credential rotation to key %s after account %s", keyID, after)
+	}
+
+	resealed, blobs, failed := 0, 0, 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		accounts, err := r.accountRepo.ListAfter(after, rotateBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(accounts) == 0 {
+			break
+		}
+
+		for i := range accounts {
+			ok, err := r.reseal(accounts[i].ID, accounts[i].CredentialsEncrypted)
+			if err != nil {
+				log.Printf("Failed to re-encrypt credentials of account %s: %v", accounts[i].ID, err)
+				failed++
+			} else if ok {
+				resealed++
+			}
+
+			for _, resealer := range r.resealers {
+				n, err := resealer.Reseal(ctx, accounts[i].ID)
+				if err != nil {
+					log.Printf("Failed to re-encrypt stored mail of account %s: %v", accounts[i].ID, err)
+					failed++
+				}
+				blobs += n
+			}
+		}
+
+		// A cancelled batch is redone on the next run
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		after = accounts[len(accounts)-1].ID
+		if err := r.rotationRepo.SaveProgress(keyID, &after); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		log.Printf("Credential rotation to key %s re-encrypted %d accounts and %d stored messages, %d failed; retrying on next run",
+			keyID, resealed, blobs, failed)
+		return r.rotationRepo.SaveProgress(keyID, nil)
+	}
+
+	log.Printf("Credential rotation to key %s complete, re-encrypted %d accounts and %d stored messages", keyID, resealed, blobs)
+	return r.rotationRepo.Complete(keyID)
+}
+
+// reseal re-encrypts one account's credentials if needed and reports
+// whether it did. Accounts without credentials, such as the import
+// account, are skipped.
+func (r *Rotator) reseal(accountID uuid.UUID, envelope string) (bool, error) {
+	if envelope == "" || !r.vault.NeedsReseal(envelope) {
+		return false, nil
+	}
+
+	creds, err := r.vault.Open(accountID, envelope)
+	if err != nil {
+		return false, err
+	}
+
+	sealed, err := r.vault.Seal(accountID, creds)
+	if err != nil {
+		return false, err
+	}
+
+	// If the credentials changed meanwhile they were sealed with the
+	// active key by whoever changed them
+	return r.accountRepo.ReplaceCredentials(accountID, envelope, sealed)
+}
@@ -0,0 +1,95 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jay/dadmail/internal/repository/testdb"
+)
+
+// recordingResealer records the accounts it was asked to reseal and fails
+// for the ones in fail
+type recordingResealer struct {
+	accounts []uuid.UUID
+	fail     map[uuid.UUID]bool
+}
+
+func (r *recordingResealer) Reseal(ctx context.Context, accountID uuid.UUID) (int, error) {
+	r.accounts = append(r.accounts, accountID)
+	if r.fail[accountID] {
+		return 0, errors.New("object storage unavailable")
+	}
+	return 1, nil
+}
+
+func TestRotatorResealsStoredMail(t *testing.T) {
+	db := testdb.Open(t)
+	userID := testdb.CreateUser(t, db)
+	accountRepo := repository.NewEmailAccountRepository(db)
+	ctx := context.Background()
+
+	old := newTestVault(t)
+	account := &models.EmailAccount{ID: uuid.New(), UserID: userID, Provider: "imap", EmailAddress: "grandpa@example.com"}
+	var err error
+	account.CredentialsEncrypted, err = old.Seal(account.ID, &Credentials{IMAP: &IMAPCredentials{Host: "imap.example.com"}})
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if err := accountRepo.Create(account); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// The import account has no credentials, only mail
+	imported, err := accountRepo.EnsureLocal(userID, "import", "old@example.com", "Old mail")
+	if err != nil {
+		t.Fatalf("EnsureLocal: %v", err)
+	}
+
+	rotated, err := New(map[string]string{
+		"k1": "0123456789abcdef0123456789abcdef",
+		"k2": "fedcba9876543210fedcba9876543210",
+	}, "k2")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// A failed reseal leaves the rotation open
+	resealer := &recordingResealer{fail: map[uuid.UUID]bool{imported.ID: true}}
+	if err := NewRotator(db, rotated, resealer).Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(resealer.accounts) != 2 {
+		t.Errorf("resealed mail of %d accounts, want 2", len(resealer.accounts))
+	}
+	rotation, err := repository.NewKeyRotationRepository(db).Start("k2")
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if rotation.CompletedAt != nil {
+		t.Errorf("rotation completed although stored mail failed to reseal")
+	}
+
+	stored, err := accountRepo.GetByID(account.ID)
+	if err != nil {
+		t.Fatalf("GetByID: %v", err)
+	}
+	if rotated.NeedsReseal(stored.CredentialsEncrypted) {
+		t.Errorf("credentials were not resealed")
+	}
+
+	// The next run starts over and completes
+	resealer.fail = nil
+	resealer.accounts = nil
+	if err := NewRotator(db, rotated, resealer).Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(resealer.accounts) != 2 {
+		t.Errorf("retry resealed mail of %d accounts, want 2", len(resealer.accounts))
+	}
+	if rotation, err = repository.NewKeyRotationRepository(db).Start("k2"); err != nil || rotation.CompletedAt == nil {
+		t.Errorf("rotation not completed: %+v, %v", rotation, err)
+	}
+}
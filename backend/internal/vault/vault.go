@@ -0,0 +1,210 @@
+// Package vault seals and opens the credentials stored in
+// email_accounts.credentials_encrypted.
+//
+// Credentials are encrypted with AES-256-GCM under a key from the configured
+// keyring. Each ciphertext is stored as a versioned envelope naming its key
+//
+//	v2:<key id>:<base64(nonce | ciphertext)>
+//
+// and is authenticated together with the owning account's ID, so a sealed
+// value copied onto another email_accounts row fails to open. Version 1
+// envelopes (v1:<base64>) predate the keyring and were sealed with the
+// default key.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jay/dadmail/internal/config"
+)
+
+const (
+	// currentVersion is the envelope version written by Seal
+	currentVersion = "v2"
+	// legacyVersion envelopes carry no key ID
+	legacyVersion = "v1"
+)
+
+// ErrUnsupportedVersion is returned when an envelope was written by an
+// unknown (or pre-vault) format
+var ErrUnsupportedVersion = errors.New("unsupported credentials envelope version")
+
+// Credentials is the plaintext document sealed for an email account. Only
+// the sections the account's provider uses are set.
+type Credentials struct {
+	IMAP  *IMAPCredentials  `json:"imap,omitempty"`
+	SMTP  *SMTPCredentials  `json:"smtp,omitempty"`
+	OAuth *OAuthCredentials `json:"oauth,omitempty"`
+	JMAP  *JMAPCredentials  `json:"jmap,omitempty"`
+}
+
+// IMAPCredentials holds an IMAP login
+type IMAPCredentials struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Security string `json:"security"` // tls, starttls, none
+}
+
+// SMTPCredentials holds submission server settings. Username and password
+// may be empty to reuse the IMAP login.
+type SMTPCredentials struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Security string `json:"security"` // tls, starttls, none
+}
+
+// OAuthCredentials holds the long-lived token of an OAuth provider
+type OAuthCredentials struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// JMAPCredentials holds a JMAP login. Without a username the password is
+// sent as a bearer token, such as a Fastmail API token.
+type JMAPCredentials struct {
+	SessionURL string `json:"session_url"` // or just the server host name
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+}
+
+// Vault encrypts and decrypts account credentials
+type Vault struct {
+	keys     map[string]cipher.AEAD
+	activeID string
+}
+
+// New creates a vault from a keyring of 32 byte AES-256 keys. New
+// credentials are sealed with the key named activeID; the other keys are
+// only used to open existing envelopes.
+func New(keys map[string]string, activeID string) (*Vault, error) {
+	v := &Vault{keys: map[string]cipher.AEAD{}, activeID: activeID}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid encryption key ID %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %q must be 32 bytes, got %d", id, len(key))
+		}
+
+		block, err := aes.NewCipher([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCM: %w", err)
+		}
+		v.keys[id] = aead
+	}
+
+	if _, ok := v.keys[activeID]; !ok {
+		return nil, fmt.Errorf("active encryption key %q is not in the keyring", activeID)
+	}
+
+	return v, nil
+}
+
+// ActiveKeyID returns the ID of the key Seal uses
+func (v *Vault) ActiveKeyID() string {
+	return v.activeID
+}
+
+// NeedsReseal reports whether an envelope was not sealed with the active key
+// in the current format
+func (v *Vault) NeedsReseal(envelope string) bool {
+	version, keyID, _, err := parseEnvelope(envelope)
+	return err != nil || version != currentVersion || keyID != v.activeID
+}
+
+// Seal encrypts creds for the account with the given ID
+func (v *Vault) Seal(accountID uuid.UUID, creds *Credentials) (string, error) {
+	if creds == nil || (creds.IMAP == nil && creds.SMTP == nil && creds.OAuth == nil && creds.JMAP == nil) {
+		return "", fmt.Errorf("credentials are empty")
+	}
+
+	plaintext, err := json.Marshal(creds)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode credentials: %w", err)
+	}
+
+	aead := v.keys[v.activeID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, associatedData(currentVersion, v.activeID, accountID))
+	return currentVersion + ":" + v.activeID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts an envelope produced by Seal for the same account
+func (v *Vault) Open(accountID uuid.UUID, envelope string) (*Credentials, error) {
+	version, keyID, encoded, err := parseEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, ok := v.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %q is not in the keyring", keyID)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, associatedData(version, keyID, accountID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt credentials: %w", err)
+	}
+
+	creds := &Credentials{}
+	if err := json.Unmarshal(plaintext, creds); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+
+	return creds, nil
+}
+
+// parseEnvelope splits an envelope into its version, key ID and encoded
+// ciphertext
+func parseEnvelope(envelope string) (version, keyID, encoded string, err error) {
+	version, rest, _ := strings.Cut(envelope, ":")
+	switch version {
+	case currentVersion:
+		keyID, encoded, ok := strings.Cut(rest, ":")
+		if !ok || keyID == "" {
+			return "", "", "", fmt.Errorf("malformed credentials envelope")
+		}
+		return version, keyID, encoded, nil
+	case legacyVersion:
+		return version, config.DefaultEncryptionKeyID, rest, nil
+	default:
+		return "", "", "", ErrUnsupportedVersion
+	}
+}
+
+// associatedData binds a ciphertext to its envelope version, key and
+// account
+func associatedData(version, keyID string, accountID uuid.UUID) []byte {
+	if version == legacyVersion {
+		return []byte("dadmail:email_accounts:" + version + ":" + accountID.String())
+	}
+	return []byte("dadmail:email_accounts:" + version + ":" + keyID + ":" + accountID.String())
+}
@@ -0,0 +1,107 @@
+package vault
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func newTestVault(t *testing.T) *Vault {
+	t.Helper()
+	v, err := New(map[string]string{"k1": "0123456789abcdef0123456789abcdef"}, "k1")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return v
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		creds *Credentials
+	}{
+		{"imap and smtp", &Credentials{
+			IMAP: &IMAPCredentials{Host: "imap.example.com", Port: 993, Username: "u", Password: "p", Security: "tls"},
+			SMTP: &SMTPCredentials{Host: "smtp.example.com", Port: 587, Security: "starttls"},
+		}},
+		{"jmap only", &Credentials{
+			JMAP: &JMAPCredentials{SessionURL: "https://jmap.example.com/.well-known/jmap", Username: "u", Password: "p"},
+		}},
+		{"jmap bearer token", &Credentials{
+			JMAP: &JMAPCredentials{SessionURL: "https://jmap.example.com/.well-known/jmap", Password: "token"},
+		}},
+	}
+
+	v := newTestVault(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accountID := uuid.New()
+			envelope, err := v.Seal(accountID, tt.creds)
+			if err != nil {
+				t.Fatalf("Seal: %v", err)
+			}
+			opened, err := v.Open(accountID, envelope)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if !reflect.DeepEqual(opened, tt.creds) {
+				t.Errorf("Open = %+v, want %+v", opened, tt.creds)
+			}
+
+			// Envelopes are bound to their account
+			if _, err := v.Open(uuid.New(), envelope); err == nil {
+				t.Errorf("Open succeeded for another account")
+			}
+		})
+	}
+}
+
+func TestSealRejectsEmptyCredentials(t *testing.T) {
+	v := newTestVault(t)
+	for _, creds := range []*Credentials{nil, {}} {
+		if _, err := v.Seal(uuid.New(), creds); err == nil {
+			t.Errorf("Seal(%+v) succeeded", creds)
+		}
+	}
+}
+
+func TestBlobResealAfterRotation(t *testing.T) {
+	old := newTestVault(t)
+	sealed, err := old.SealBlob("email_bodies:1", []byte("raw message"))
+	if err != nil {
+		t.Fatalf("SealBlob: %v", err)
+	}
+	if old.BlobNeedsReseal(sealed) {
+		t.Errorf("blob sealed with the active key needs resealing")
+	}
+
+	rotated, err := New(map[string]string{
+		"k1": "0123456789abcdef0123456789abcdef",
+		"k2": "fedcba9876543210fedcba9876543210",
+	}, "k2")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !rotated.BlobNeedsReseal(sealed) {
+		t.Errorf("blob sealed with a retired key does not need resealing")
+	}
+	if !rotated.BlobNeedsReseal([]byte("not a blob")) {
+		t.Errorf("malformed blob does not need resealing")
+	}
+
+	raw, err := rotated.OpenBlob("email_bodies:1", sealed)
+	if err != nil || string(raw) != "raw message" {
+		t.Fatalf("OpenBlob = %q, %v", raw, err)
+	}
+	resealed, err := rotated.SealBlob("email_bodies:1", raw)
+	if err != nil {
+		t.Fatalf("SealBlob: %v", err)
+	}
+	if rotated.BlobNeedsReseal(resealed) {
+		t.Errorf("resealed blob still needs resealing")
+	}
+	if _, err := old.OpenBlob("email_bodies:1", resealed); err == nil {
+		t.Errorf("blob sealed with k2 opened without it")
+	}
+}
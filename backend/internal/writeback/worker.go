@@ -0,0 +1,213 @@
+// Package writeback applies read, star, archive and delete changes made in
+// DadMail to the mailbox at the provider.
+package writeback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jay/dadmail/internal/mailimport"
+	"github.com/jay/dadmail/internal/models"
+	"github.com/jay/dadmail/internal/provider"
+	"github.com/jay/dadmail/internal/repository"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// MaxAttempts is how many times a change is tried before it is marked
+	// failed. The next sync then restores the provider's state.
+	MaxAttempts = 8
+
+	pollInterval = 5 * time.Second
+	batchSize    = 50
+	// lease must outlast a single provider call so a change is never
+	// claimed by two workers at once
+	lease = 5 * time.Minute
+
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = time.Hour
+
+	// Changes given up on are kept this long for troubleshooting
+	failedRetention = 7 * 24 * time.Hour
+	pruneInterval   = time.Hour
+)
+
+// Worker applies queued state changes to providers, retrying transient
+// failures with exponential backoff
+type Worker struct {
+	writebackRepo *repository.WritebackRepository
+	emailRepo     *repository.EmailRepository
+	accountRepo   *repository.EmailAccountRepository
+	providers     *provider.Registry
+}
+
+// NewWorker creates a new write-back worker
+func NewWorker(db *sqlx.DB, providers *provider.Registry) *Worker {
+	return &Worker{
+		writebackRepo: repository.NewWritebackRepository(db),
+		emailRepo:     repository.NewEmailRepository(db),
+		accountRepo:   repository.NewEmailAccountRepository(db),
+		providers:     providers,
+	}
+}
+
+// Run applies due changes until ctx is cancelled
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			processed, err := w.ProcessDue(ctx)
+			if err != nil {
+				log.Printf("Write-back processing failed: %v", err)
+			}
+			// Keep draining while full batches come back
+			if err != nil || processed < batchSize || ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue claims and applies one batch of due changes and returns how
+// many were claimed
+func (w *Worker) ProcessDue(ctx context.Context) (int, error) {
+	// Provider calls stop when the lease runs out, before another worker
+	// can claim the batch again
+	ctx, cancel := context.WithTimeout(ctx, lease)
+	defer cancel()
+
+	changes, err := w.writebackRepo.ClaimDue(batchSize, lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range changes {
+		w.process(ctx, &changes[i])
+	}
+
+	return len(changes), nil
+}
+
+// RunPruner deletes old failed changes periodically until ctx is
+// cancelled
+func (w *Worker) RunPruner(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		pruned, err := w.writebackRepo.DeleteFailed(failedRetention)
+		if err != nil {
+			log.Printf("Write-back pruning failed: %v", err)
+		}
+		if pruned > 0 {
+			log.Printf("Deleted %d failed write-backs", pruned)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Worker) process(ctx context.Context, change *models.EmailWriteback) {
+	err := w.apply(ctx, change)
+	if err == nil {
+		if err := w.writebackRepo.Complete(change); err != nil {
+			log.Printf("Write-back %s was applied but could not be completed: %v", change.ID, err)
+		}
+		return
+	}
+
+	if provider.IsPermanent(err) || change.Attempts >= MaxAttempts {
+		log.Printf("Write-back %s failed permanently after %d attempts: %v", change.ID, change.Attempts, err)
+		if err := w.writebackRepo.MarkFailed(change, err.Error()); err != nil {
+			log.Printf("Failed to mark write-back %s failed: %v", change.ID, err)
+		}
+		return
+	}
+
+	next := time.Now().Add(retryDelay(change.Attempts))
+	if err := w.writebackRepo.MarkRetry(change, err.Error(), next); err != nil {
+		log.Printf("Failed to schedule retry for write-back %s: %v", change.ID, err)
+	}
+}
+
+// apply makes the change at the provider. A message that no longer exists
+// there needs no change; the next sync removes it.
+func (w *Worker) apply(ctx context.Context, change *models.EmailWriteback) error {
+	email, err := w.emailRepo.GetByID(change.EmailID)
+	if err != nil {
+		return err
+	}
+	account, err := w.accountRepo.GetByID(change.AccountID)
+	if err != nil {
+		return err
+	}
+
+	// Imported mail exists only in DadMail, where it has been changed
+	if account.Provider != mailimport.ProviderName {
+		p, err := w.providers.Get(account.Provider)
+		if err != nil {
+			return err
+		}
+		err = applyChange(ctx, p, account, email.ExternalID, change)
+		if err != nil && !errors.Is(err, provider.ErrMessageGone) {
+			return err
+		}
+	}
+
+	// Deleted mail is gone from the mailbox, so drop the local row now
+	// rather than waiting for the next sync
+	if change.Field == models.WritebackDeleted {
+		return w.emailRepo.DeleteByExternalIDs(account.ID, []string{email.ExternalID})
+	}
+	return nil
+}
+
+// applyChange maps a change onto the provider: read and starred are flags,
+// archived moves between the inbox and the archive, and deleted mail goes
+// to the trash
+func applyChange(ctx context.Context, p provider.MailProvider, account *models.EmailAccount, id string, change *models.EmailWriteback) error {
+	value := change.Value
+	switch change.Field {
+	case models.WritebackRead:
+		return p.SetFlags(ctx, account, id, provider.Flags{Read: &value})
+	case models.WritebackStarred:
+		return p.SetFlags(ctx, account, id, provider.Flags{Starred: &value})
+	case models.WritebackArchived:
+		if value {
+			return p.Move(ctx, account, id, provider.FolderArchive)
+		}
+		return p.Move(ctx, account, id, provider.FolderInbox)
+	case models.WritebackDeleted:
+		return p.Move(ctx, account, id, provider.FolderTrash)
+	default:
+		return fmt.Errorf("unknown write-back field %q: %w", change.Field, provider.ErrUnsupported)
+	}
+}
+
+// retryDelay returns the backoff before the attempt after the given one:
+// 30s, 1m, 2m, 4m ... capped at an hour
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
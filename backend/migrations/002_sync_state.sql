@@ -0,0 +1,16 @@
+-- Incremental sync state for IMAP accounts
+
+-- One row per (account, folder). uid_validity and last_uid let the sync
+-- engine fetch only new messages and detect when the server has reset
+-- its UID numbering.
+CREATE TABLE sync_state (
+    account_id UUID NOT NULL REFERENCES email_accounts(id) ON DELETE CASCADE,
+    folder VARCHAR(255) NOT NULL,
+    uid_validity BIGINT NOT NULL DEFAULT 0,
+    last_uid BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (account_id, folder)
+);
+
+CREATE TRIGGER update_sync_state_updated_at BEFORE UPDATE ON sync_state
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
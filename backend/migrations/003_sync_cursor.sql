@@ -0,0 +1,5 @@
+-- Provider-specific sync cursors
+
+-- Providers with server-side change tracking (Gmail historyId, delta links,
+-- state strings) store their opaque position here instead of UIDs.
+ALTER TABLE sync_state ADD COLUMN cursor TEXT;
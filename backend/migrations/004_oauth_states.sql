@@ -0,0 +1,14 @@
+-- Pending OAuth authorization requests
+
+-- Each row is a single-use state value issued by an OAuth start endpoint.
+-- The callback must come from the same user before expires_at.
+CREATE TABLE oauth_states (
+    state VARCHAR(255) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    code_verifier VARCHAR(255) NOT NULL, -- PKCE verifier
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_oauth_states_expires ON oauth_states(expires_at);
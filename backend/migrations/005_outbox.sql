@@ -0,0 +1,44 @@
+-- Durable outbox for outgoing mail
+
+-- Messages are rendered once at enqueue time so every retry submits the
+-- exact same bytes (and Message-ID).
+CREATE TABLE outbox (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    account_id UUID NOT NULL REFERENCES email_accounts(id) ON DELETE CASCADE,
+    idempotency_key VARCHAR(255) NOT NULL,
+    message_id VARCHAR(255) NOT NULL,
+    from_address VARCHAR(255) NOT NULL,
+    recipients TEXT[] NOT NULL, -- envelope recipients, including bcc
+    subject TEXT,
+    raw_message BYTEA NOT NULL,
+
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, sending, sent, failed
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP, -- lease held by a worker while sending
+    last_error TEXT,
+    sent_at TIMESTAMP,
+
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    UNIQUE(user_id, idempotency_key)
+);
+
+CREATE INDEX idx_outbox_user ON outbox(user_id, created_at DESC);
+CREATE INDEX idx_outbox_due ON outbox(next_attempt_at) WHERE status IN ('pending', 'sending');
+
+-- One row per delivery attempt
+CREATE TABLE outbox_attempts (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    outbox_id UUID NOT NULL REFERENCES outbox(id) ON DELETE CASCADE,
+    attempt INT NOT NULL,
+    error TEXT, -- null when the attempt succeeded
+    attempted_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_outbox_attempts_outbox ON outbox_attempts(outbox_id, attempt);
+
+CREATE TRIGGER update_outbox_updated_at BEFORE UPDATE ON outbox
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
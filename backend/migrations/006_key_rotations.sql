@@ -0,0 +1,16 @@
+-- Progress of credential re-encryption jobs
+
+-- One row per encryption key that has been made active, reset when the key
+-- is made active again. The job walks email_accounts in id order and records
+-- the last account it finished, so an interrupted rotation resumes where it
+-- stopped.
+CREATE TABLE key_rotations (
+    key_id VARCHAR(255) PRIMARY KEY,
+    last_account_id UUID,
+    started_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TRIGGER update_key_rotations_updated_at BEFORE UPDATE ON key_rotations
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
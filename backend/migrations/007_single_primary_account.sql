@@ -0,0 +1,11 @@
+-- At most one primary email account per user
+
+-- Keep the oldest primary account of any user that has several
+UPDATE email_accounts a SET is_primary = false
+WHERE is_primary AND EXISTS (
+    SELECT 1 FROM email_accounts b
+    WHERE b.user_id = a.user_id AND b.is_primary
+      AND (b.created_at, b.id) < (a.created_at, a.id)
+);
+
+CREATE UNIQUE INDEX idx_email_accounts_primary ON email_accounts(user_id) WHERE is_primary;
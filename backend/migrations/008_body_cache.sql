@@ -0,0 +1,17 @@
+-- Cache of message bodies fetched from providers
+
+-- Bodies are stored encrypted in object storage; this table tracks them for
+-- TTL and size based eviction. email_id is deliberately not a foreign key:
+-- the object must be deleted along with the row, which the eviction job
+-- does once the entry expires.
+CREATE TABLE body_cache (
+    email_id UUID PRIMARY KEY,
+    object_key VARCHAR(255) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    last_accessed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_body_cache_expires ON body_cache(expires_at);
+CREATE INDEX idx_body_cache_accessed ON body_cache(last_accessed_at);
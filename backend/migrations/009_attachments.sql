@@ -0,0 +1,28 @@
+-- Attachments of received emails
+
+-- Attachment content is stored once per distinct SHA-256 in object storage
+-- under attachments/sha256/<hash>. attachment_blobs tracks those objects so
+-- unreferenced ones can be garbage collected.
+CREATE TABLE attachment_blobs (
+    sha256 CHAR(64) PRIMARY KEY,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE attachments (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    email_id UUID NOT NULL REFERENCES emails(id) ON DELETE CASCADE,
+    part VARCHAR(64) NOT NULL, -- MIME part path, e.g. 2.1
+    filename TEXT,
+    content_type VARCHAR(255) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    content_id VARCHAR(255), -- for inline images referenced by cid: URL
+    is_inline BOOLEAN NOT NULL DEFAULT false,
+    sha256 CHAR(64) NOT NULL REFERENCES attachment_blobs(sha256),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    UNIQUE(email_id, part)
+);
+
+CREATE INDEX idx_attachments_email ON attachments(email_id);
+CREATE INDEX idx_attachments_sha256 ON attachments(sha256);
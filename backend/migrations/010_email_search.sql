@@ -0,0 +1,63 @@
+-- Full-text search over email metadata and body text
+
+-- The search document lives beside emails rather than in it so SELECT e.*
+-- stays unchanged. body_text is the plain text of the body, recorded when
+-- a message is opened; bodies that were never opened are searched by
+-- snippet only.
+CREATE TABLE email_search (
+    email_id UUID PRIMARY KEY REFERENCES emails(id) ON DELETE CASCADE,
+    body_text TEXT,
+    document TSVECTOR NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_email_search_document ON email_search USING GIN(document);
+
+-- Subjects and senders rank above snippets, which rank above body text.
+-- Names and addresses use the simple configuration so they are not stemmed.
+CREATE OR REPLACE FUNCTION email_search_document(
+    subject TEXT, from_name TEXT, from_address TEXT, snippet TEXT, body_text TEXT
+) RETURNS TSVECTOR AS $$
+    SELECT
+        setweight(to_tsvector('english', coalesce(subject, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(from_name, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(from_address, '') || ' ' ||
+            translate(coalesce(from_address, ''), '@.', '  ')), 'B') ||
+        setweight(to_tsvector('english', coalesce(snippet, '')), 'C') ||
+        setweight(to_tsvector('english', left(coalesce(body_text, ''), 100000)), 'D')
+$$ LANGUAGE sql IMMUTABLE;
+
+-- Rebuild the document when the indexed email columns change
+CREATE OR REPLACE FUNCTION email_search_sync_email()
+RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO email_search (email_id, document)
+    VALUES (NEW.id, email_search_document(NEW.subject, NEW.from_name, NEW.from_address, NEW.snippet, NULL))
+    ON CONFLICT (email_id) DO UPDATE SET
+        document = email_search_document(NEW.subject, NEW.from_name, NEW.from_address, NEW.snippet, email_search.body_text),
+        updated_at = NOW();
+    RETURN NULL;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER email_search_sync_email AFTER INSERT OR UPDATE OF subject, from_name, from_address, snippet ON emails
+    FOR EACH ROW EXECUTE FUNCTION email_search_sync_email();
+
+-- Rebuild the document when body text is recorded
+CREATE OR REPLACE FUNCTION email_search_sync_body()
+RETURNS TRIGGER AS $$
+BEGIN
+    SELECT email_search_document(e.subject, e.from_name, e.from_address, e.snippet, NEW.body_text)
+    INTO NEW.document
+    FROM emails e WHERE e.id = NEW.email_id;
+    NEW.updated_at = NOW();
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER email_search_sync_body BEFORE INSERT OR UPDATE OF body_text ON email_search
+    FOR EACH ROW EXECUTE FUNCTION email_search_sync_body();
+
+-- Index existing emails
+INSERT INTO email_search (email_id, document)
+SELECT id, email_search_document(subject, from_name, from_address, snippet, NULL) FROM emails;
@@ -0,0 +1,34 @@
+-- Write-back of local state changes to the mail provider
+
+ALTER TABLE emails ADD COLUMN is_archived BOOLEAN NOT NULL DEFAULT false;
+-- Set when the user deletes an email; the row is hidden and removed once
+-- the provider has applied the deletion
+ALTER TABLE emails ADD COLUMN deleted_at TIMESTAMP;
+
+-- Queue of changes to apply on the provider. There is at most one pending
+-- change per email and field: a newer change replaces the pending one.
+-- While a change is pending or applying, sync keeps the local value of the
+-- field instead of the provider's.
+CREATE TABLE email_writebacks (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    email_id UUID NOT NULL REFERENCES emails(id) ON DELETE CASCADE,
+    account_id UUID NOT NULL REFERENCES email_accounts(id) ON DELETE CASCADE,
+    field VARCHAR(20) NOT NULL, -- read, starred, archived, deleted
+    value BOOLEAN NOT NULL,
+
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, applying, failed
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP, -- lease held by a worker while applying
+    last_error TEXT,
+
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_email_writebacks_pending ON email_writebacks(email_id, field) WHERE status = 'pending';
+CREATE INDEX idx_email_writebacks_email ON email_writebacks(email_id) WHERE status IN ('pending', 'applying');
+CREATE INDEX idx_email_writebacks_due ON email_writebacks(next_attempt_at) WHERE status IN ('pending', 'applying');
+
+CREATE TRIGGER update_email_writebacks_updated_at BEFORE UPDATE ON email_writebacks
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
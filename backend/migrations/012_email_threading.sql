@@ -0,0 +1,26 @@
+-- Message-ID based threading for providers without native thread IDs
+
+-- Maps every Message-ID seen in an account, whether of a synced message or
+-- only referenced by one, to the thread key stored in emails.thread_id.
+-- Referenced-only rows let a parent that arrives after its replies join
+-- their thread, and a message that links two threads merges them.
+CREATE TABLE thread_messages (
+    account_id UUID NOT NULL REFERENCES email_accounts(id) ON DELETE CASCADE,
+    message_id TEXT NOT NULL,
+    thread_id VARCHAR(255) NOT NULL,
+
+    -- Set once the message itself was seen, for subject based grouping of
+    -- messages without references
+    subject_key TEXT,
+    is_reply BOOLEAN NOT NULL DEFAULT false,
+    received_at TIMESTAMP,
+
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (account_id, message_id)
+);
+
+CREATE INDEX idx_thread_messages_thread ON thread_messages(account_id, thread_id);
+CREATE INDEX idx_thread_messages_subject ON thread_messages(account_id, subject_key, received_at DESC)
+    WHERE subject_key IS NOT NULL;
+CREATE INDEX idx_emails_unthreaded ON emails(account_id) WHERE thread_id IS NULL;
@@ -0,0 +1,9 @@
+-- Senders whose remote images are shown even when show_images is off
+
+CREATE TABLE image_allowed_senders (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    sender VARCHAR(255) NOT NULL, -- lower-case address, or @domain
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (user_id, sender)
+);
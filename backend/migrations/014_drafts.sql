@@ -0,0 +1,56 @@
+-- Drafts saved on the server so unsent messages follow the user across
+-- devices
+
+CREATE TABLE drafts (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    account_id UUID REFERENCES email_accounts(id) ON DELETE SET NULL, -- null sends from the primary account
+    to_addresses TEXT[] NOT NULL DEFAULT '{}',
+    cc_addresses TEXT[] NOT NULL DEFAULT '{}',
+    bcc_addresses TEXT[] NOT NULL DEFAULT '{}',
+    subject TEXT NOT NULL DEFAULT '',
+    text_body TEXT NOT NULL DEFAULT '',
+    html_body TEXT NOT NULL DEFAULT '',
+    -- Incremented by every change; a save must name the version it edited
+    version INT NOT NULL DEFAULT 1,
+    -- Set when the user deletes or sends the draft while a copy still has
+    -- to be removed from the provider; the row is hidden until then
+    deleted_at TIMESTAMP,
+
+    -- Copy in the provider's Drafts folder. The copy is brought up to date
+    -- whenever synced_version is behind version.
+    sync_to_provider BOOLEAN NOT NULL DEFAULT false,
+    provider_account_id UUID REFERENCES email_accounts(id) ON DELETE SET NULL,
+    provider_draft_id TEXT, -- Gmail draft ID, or Message-ID of the IMAP copy
+    synced_version INT NOT NULL DEFAULT 0,
+    sync_attempts INT NOT NULL DEFAULT 0,
+    sync_next_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sync_locked_until TIMESTAMP, -- lease held by a worker while syncing
+    sync_error TEXT,
+
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_drafts_user ON drafts(user_id, updated_at DESC) WHERE deleted_at IS NULL;
+CREATE INDEX idx_drafts_sync_due ON drafts(sync_next_at)
+    WHERE synced_version < version AND (sync_to_provider OR provider_draft_id IS NOT NULL);
+
+-- Files attached to a draft. Content lives in the attachment blob store, so
+-- attaching a received attachment does not copy it.
+CREATE TABLE draft_attachments (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    draft_id UUID NOT NULL REFERENCES drafts(id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    sha256 CHAR(64) NOT NULL REFERENCES attachment_blobs(sha256),
+    source_attachment_id UUID REFERENCES attachments(id) ON DELETE SET NULL, -- attached from a received email
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_draft_attachments_draft ON draft_attachments(draft_id);
+CREATE INDEX idx_draft_attachments_sha256 ON draft_attachments(sha256);
+
+CREATE TRIGGER update_drafts_updated_at BEFORE UPDATE ON drafts
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
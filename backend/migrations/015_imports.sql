@@ -0,0 +1,48 @@
+-- Import of historical mail from mbox files and .eml collections
+
+-- Archives uploaded in chunks and imported by the worker
+CREATE TABLE imports (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    filename VARCHAR(255) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'uploading', -- uploading, pending, importing, done, failed
+    chunk_count INT NOT NULL DEFAULT 0,
+
+    -- Progress, saved while the worker reads the archive
+    bytes_total BIGINT NOT NULL DEFAULT 0,
+    bytes_processed BIGINT NOT NULL DEFAULT 0,
+    imported_count INT NOT NULL DEFAULT 0,
+    duplicate_count INT NOT NULL DEFAULT 0,
+    failed_count INT NOT NULL DEFAULT 0,
+
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP, -- lease held by a worker while importing
+    last_error TEXT,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_imports_user ON imports(user_id, created_at DESC);
+CREATE INDEX idx_imports_due ON imports(next_attempt_at) WHERE status IN ('pending', 'importing');
+CREATE INDEX idx_imports_uploading ON imports(updated_at) WHERE status = 'uploading';
+
+CREATE TRIGGER update_imports_updated_at BEFORE UPDATE ON imports
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Source of imported messages, which no provider can serve. Messages are
+-- stored encrypted in object storage with the credential keyring and are
+-- re-encrypted along with credentials when the active key changes.
+-- When the email is deleted the row stays behind with a null email_id
+-- until the collector has deleted the object.
+CREATE TABLE imported_messages (
+    object_key VARCHAR(255) PRIMARY KEY,
+    email_id UUID UNIQUE REFERENCES emails(id) ON DELETE SET NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_imported_messages_orphaned ON imported_messages(created_at) WHERE email_id IS NULL;
@@ -0,0 +1,38 @@
+-- Exports of a user's mailbox as a downloadable zip archive
+
+CREATE TABLE exports (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- whose mail is exported
+    requested_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- the user or a full-access caregiver
+    format VARCHAR(10) NOT NULL DEFAULT 'mbox', -- mbox, eml
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, exporting, done, failed, expired
+
+    -- Progress, saved while the worker writes the archive
+    email_total INT NOT NULL DEFAULT 0,
+    email_count INT NOT NULL DEFAULT 0,
+    failed_count INT NOT NULL DEFAULT 0,
+
+    -- Finished archive in object storage, deleted at expires_at
+    object_key VARCHAR(255),
+    size_bytes BIGINT,
+    expires_at TIMESTAMP,
+
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP, -- lease held by a worker while exporting
+    last_error TEXT,
+    completed_at TIMESTAMP,
+
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- One export of a mailbox runs at a time
+CREATE UNIQUE INDEX idx_exports_active ON exports(user_id) WHERE status IN ('pending', 'exporting');
+CREATE INDEX idx_exports_user ON exports(user_id, created_at DESC);
+CREATE INDEX idx_exports_requested_by ON exports(requested_by, created_at DESC);
+CREATE INDEX idx_exports_due ON exports(next_attempt_at) WHERE status IN ('pending', 'exporting');
+CREATE INDEX idx_exports_expires ON exports(expires_at) WHERE status = 'done';
+
+CREATE TRIGGER update_exports_updated_at BEFORE UPDATE ON exports
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
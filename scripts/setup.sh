@@ -75,7 +75,9 @@ sleep 10
 
 echo ""
 echo "5. Running database migrations..."
-docker-compose exec -T postgres psql -U dadmail -d dadmail -f /docker-entrypoint-initdb.d/001_initial.sql || true
+for migration in ../backend/migrations/*.sql; do
+    docker-compose exec -T postgres psql -U dadmail -d dadmail -f "/docker-entrypoint-initdb.d/$(basename "$migration")" || true
+done
 
 echo ""
 echo "========================================="